@@ -30,6 +30,12 @@ func (h *AuthHandler) FirebaseAuthClient() *auth.Client {
 	return h.firebaseAuth
 }
 
+// FirebaseApp returns the Firebase App instance.
+// Needed to create the other Firebase clients in main.go
+func (h *AuthHandler) FirebaseApp() *firebase.App {
+	return h.app
+}
+
 // NewAuthHandler creates a new AuthHandler.
 // Modified to accept UserRepository
 func NewAuthHandler(ctx context.Context, credentialsPath string, userRepo repository.UserRepository) (*AuthHandler, error) {
@@ -1,6 +1,7 @@
 package compatibility
 
 import (
+	"errors"
 	"kimiyomi/services"
 	"net/http"
 
@@ -58,6 +59,10 @@ func (h *CompatibilityAPI) GetDailyCompatibility(c *gin.Context) {
 	}
 
 	result, err := h.service.GetDailyCompatibility(c.Request.Context(), userID.(string))
+	if errors.Is(err, services.ErrDailyCompatibilityNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
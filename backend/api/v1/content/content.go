@@ -41,11 +41,12 @@ func (h *ContentAPI) CreateContent(c *gin.Context) {
 	c.JSON(http.StatusCreated, content)
 }
 
-// GetContent handles retrieving a content item
+// GetContent handles retrieving a content item.
+// Content the user cannot access is returned as a teaser with "locked": true and no media_url.
 func (h *ContentAPI) GetContent(c *gin.Context) {
 	contentID := c.Param("id")
 	// Pass context to service method
-	content, err := h.contentService.GetContent(c.Request.Context(), contentID)
+	content, err := h.contentService.GetContent(c.Request.Context(), services.PrincipalFromContext(c), contentID)
 	if err != nil {
 		// Consider differentiating between Not Found and other errors
 		c.JSON(http.StatusNotFound, gin.H{"error": "Content not found or error retrieving content"})
@@ -96,7 +97,7 @@ func (h *ContentAPI) ListContents(c *gin.Context) {
 	}
 
 	// Pass context and filter to service method
-	contents, err := h.contentService.ListContents(c.Request.Context(), filter)
+	contents, err := h.contentService.ListContents(c.Request.Context(), services.PrincipalFromContext(c), filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -120,7 +121,7 @@ func (h *ContentAPI) ListContentsByType(c *gin.Context) {
 	}
 
 	// Pass context and filter to service method
-	contents, err := h.contentService.ListContents(c.Request.Context(), filter)
+	contents, err := h.contentService.ListContents(c.Request.Context(), services.PrincipalFromContext(c), filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
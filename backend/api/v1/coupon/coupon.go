@@ -0,0 +1,204 @@
+package coupon
+
+import (
+	"errors"
+	"kimiyomi/models"
+	"kimiyomi/services"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CouponAPI handles promo code requests
+type CouponAPI struct {
+	couponService  services.CouponService
+	priceResolver  services.PlanPriceResolver
+	paymentService services.PaymentService
+}
+
+// NewCouponAPI creates a new CouponAPI instance
+func NewCouponAPI(couponService services.CouponService, priceResolver services.PlanPriceResolver, paymentService services.PaymentService) *CouponAPI {
+	return &CouponAPI{
+		couponService:  couponService,
+		priceResolver:  priceResolver,
+		paymentService: paymentService,
+	}
+}
+
+// ValidateCoupon handles checking a promo code before checkout.
+// The target is a plan (plan_id and billing_cycle), a content item (content_id) or an amount.
+func (h *CouponAPI) ValidateCoupon(c *gin.Context) {
+	var req struct {
+		Code         string  `json:"code" binding:"required"`
+		PlanID       string  `json:"plan_id"`
+		BillingCycle string  `json:"billing_cycle" binding:"omitempty,oneof=monthly yearly"`
+		ContentID    string  `json:"content_id"`
+		Amount       float64 `json:"amount" binding:"omitempty,gt=0"`
+		Currency     string  `json:"currency" binding:"omitempty,len=3"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	var target services.CouponTarget
+	switch {
+	case req.PlanID != "":
+		if req.BillingCycle == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "billing_cycle is required with plan_id"})
+			return
+		}
+		price, err := h.priceResolver.ResolvePrice(ctx, req.PlanID, req.BillingCycle)
+		if err != nil {
+			h.handleError(c, err)
+			return
+		}
+		target = services.CouponTarget{PlanID: req.PlanID, Amount: price.Amount}
+	case req.ContentID != "":
+		price, err := h.paymentService.ContentPrice(ctx, req.ContentID)
+		if err != nil {
+			h.handleError(c, err)
+			return
+		}
+		target = services.CouponTarget{Amount: price}
+	default:
+		if req.Amount == 0 || req.Currency == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "plan_id, content_id or amount and currency is required"})
+			return
+		}
+		amount, err := models.NewMoneyFromMajor(req.Amount, req.Currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		target = services.CouponTarget{Amount: amount}
+	}
+
+	quote, err := h.couponService.Quote(ctx, principal.UID, req.Code, target)
+	if err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"code":               quote.Coupon.Code,
+		"description":        quote.Coupon.Description,
+		"discount_type":      quote.Coupon.DiscountType,
+		"percent_off":        quote.Coupon.PercentOff,
+		"duration":           quote.Coupon.Duration,
+		"duration_in_months": quote.Coupon.DurationInMonths,
+		"valid_until":        quote.Coupon.ValidUntil,
+		"amount":             target.Amount.Major(),
+		"discount":           quote.Discount.Major(),
+		"total":              quote.Total.Major(),
+		"currency":           quote.Total.Currency,
+	})
+}
+
+// AdminListCoupons handles listing every coupon with its usage
+func (h *CouponAPI) AdminListCoupons(c *gin.Context) {
+	coupons, err := h.couponService.ListCoupons(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, coupons)
+}
+
+// AdminCreateCoupon handles registering a promo code for a campaign
+func (h *CouponAPI) AdminCreateCoupon(c *gin.Context) {
+	var req struct {
+		Code                  string     `json:"code" binding:"required"`
+		Description           string     `json:"description"`
+		DiscountType          string     `json:"discount_type" binding:"required,oneof=percent fixed"`
+		PercentOff            int        `json:"percent_off"`
+		AmountOff             float64    `json:"amount_off"` // fixedのみ、主単位
+		Currency              string     `json:"currency"`
+		Duration              string     `json:"duration"`
+		DurationInMonths      int        `json:"duration_in_months"`
+		MaxRedemptions        int        `json:"max_redemptions"`
+		MaxRedemptionsPerUser int        `json:"max_redemptions_per_user"`
+		ValidFrom             *time.Time `json:"valid_from"`
+		ValidUntil            *time.Time `json:"valid_until"`
+		PlanIDs               []string   `json:"plan_ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	coupon := &models.Coupon{
+		Code:                  req.Code,
+		Description:           req.Description,
+		DiscountType:          req.DiscountType,
+		PercentOff:            req.PercentOff,
+		Duration:              req.Duration,
+		DurationInMonths:      req.DurationInMonths,
+		MaxRedemptions:        req.MaxRedemptions,
+		MaxRedemptionsPerUser: req.MaxRedemptionsPerUser,
+		ValidFrom:             req.ValidFrom,
+		ValidUntil:            req.ValidUntil,
+		PlanIDs:               req.PlanIDs,
+		Active:                true,
+	}
+	if coupon.Duration == "" {
+		coupon.Duration = models.CouponDurationOnce
+	}
+	if req.DiscountType == models.CouponDiscountFixed {
+		amountOff, err := models.NewMoneyFromMajor(req.AmountOff, req.Currency)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		coupon.AmountOff = amountOff
+	}
+
+	if err := h.couponService.CreateCoupon(c.Request.Context(), coupon); err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, coupon)
+}
+
+// AdminDeactivateCoupon handles ending a campaign; existing discounts keep running
+func (h *CouponAPI) AdminDeactivateCoupon(c *gin.Context) {
+	coupon, err := h.couponService.DeactivateCoupon(c.Request.Context(), c.Param("code"))
+	if err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, coupon)
+}
+
+// AdminListRedemptions handles the redemption report of a coupon
+func (h *CouponAPI) AdminListRedemptions(c *gin.Context) {
+	redemptions, err := h.couponService.ListRedemptions(c.Request.Context(), c.Param("code"))
+	if err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, redemptions)
+}
+
+func (h *CouponAPI) handleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrCouponNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrCouponCodeTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case services.IsCouponError(err), errors.Is(err, services.ErrUnknownPlan), errors.Is(err, services.ErrContentNotForSale),
+		errors.Is(err, models.ErrInvalidCouponCode), errors.Is(err, models.ErrInvalidCouponDiscount),
+		errors.Is(err, models.ErrInvalidCouponDuration), errors.Is(err, models.ErrInvalidCouponLimits),
+		errors.Is(err, models.ErrInvalidCouponWindow), errors.Is(err, models.ErrInvalidCurrency):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
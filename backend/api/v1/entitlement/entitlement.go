@@ -0,0 +1,64 @@
+package entitlement
+
+import (
+	"kimiyomi/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EntitlementsContextKey is where Require stores the entitlements for later handlers
+const EntitlementsContextKey = "entitlements"
+
+// EntitlementAPI handles entitlement requests
+type EntitlementAPI struct {
+	entitlementService services.EntitlementService
+}
+
+// NewEntitlementAPI creates a new EntitlementAPI instance
+func NewEntitlementAPI(entitlementService services.EntitlementService) *EntitlementAPI {
+	return &EntitlementAPI{entitlementService: entitlementService}
+}
+
+// GetMyEntitlements handles retrieving what the signed-in user can access
+func (h *EntitlementAPI) GetMyEntitlements(c *gin.Context) {
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	entitlements, err := h.entitlementService.Get(c.Request.Context(), principal.UID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, entitlements)
+}
+
+// Require rejects users without the feature, e.g. services.FeaturePremium.
+// It must run after the auth middleware.
+func (h *EntitlementAPI) Require(feature string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := services.PrincipalFromContext(c)
+		if principal == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		entitlements, err := h.entitlementService.Get(c.Request.Context(), principal.UID)
+		if err != nil {
+			log.Printf("ユーザー %s の権利情報の取得に失敗: %v", principal.UID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check entitlements"})
+			return
+		}
+		if !entitlements.HasFeature(feature) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "This feature requires " + feature, "feature": feature})
+			return
+		}
+
+		c.Set(EntitlementsContextKey, entitlements)
+		c.Next()
+	}
+}
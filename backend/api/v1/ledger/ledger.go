@@ -0,0 +1,80 @@
+package ledger
+
+import (
+	"fmt"
+	"kimiyomi/services"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LedgerAPI handles finance reports on the billing ledger
+type LedgerAPI struct {
+	ledgerService services.LedgerService
+}
+
+// NewLedgerAPI creates a new LedgerAPI instance
+func NewLedgerAPI(ledgerService services.LedgerService) *LedgerAPI {
+	return &LedgerAPI{ledgerService: ledgerService}
+}
+
+// periodQuery is the inclusive range of JST months, e.g. ?from=2026-04&to=2027-03
+type periodQuery struct {
+	From string `form:"from"`
+	To   string `form:"to"`
+}
+
+// AdminMonthlySummary handles revenue totals per month, source and currency
+func (h *LedgerAPI) AdminMonthlySummary(c *gin.Context) {
+	from, to, ok := h.period(c)
+	if !ok {
+		return
+	}
+
+	summaries, err := h.ledgerService.MonthlySummary(c.Request.Context(), from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, summaries)
+}
+
+// AdminExportCSV handles downloading the ledger entries of the period as CSV
+func (h *LedgerAPI) AdminExportCSV(c *gin.Context) {
+	from, to, ok := h.period(c)
+	if !ok {
+		return
+	}
+
+	filename := fmt.Sprintf("ledger_%s_%s.csv", from.Format("200601"), to.AddDate(0, -1, 0).Format("200601"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Status(http.StatusOK)
+	if err := h.ledgerService.ExportCSV(c.Request.Context(), from, to, c.Writer); err != nil {
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Type")
+			c.Writer.Header().Del("Content-Disposition")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// 書き出し途中の失敗はステータスを変えられないため、ログに残して打ち切る
+		log.Printf("Error exporting ledger CSV: %v", err)
+		c.Abort()
+	}
+}
+
+func (h *LedgerAPI) period(c *gin.Context) (time.Time, time.Time, bool) {
+	var query periodQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return time.Time{}, time.Time{}, false
+	}
+	from, to, err := services.LedgerPeriod(query.From, query.To, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
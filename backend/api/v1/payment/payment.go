@@ -1,31 +1,47 @@
 package payment
 
 import (
+	"errors"
+	"io"
+	"kimiyomi/models"
 	"kimiyomi/services"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go"
 )
 
 // PaymentAPI handles payment-related HTTP requests.
 // Renamed from PaymentHandler
 type PaymentAPI struct {
 	paymentService services.PaymentService // Use interface type
+	webhookService services.StripeWebhookService
+	policy         services.PaymentPolicy
 }
 
 // NewPaymentAPI creates a new payment handler instance.
 // Renamed from NewPaymentHandler
-func NewPaymentAPI(paymentService services.PaymentService) *PaymentAPI {
+func NewPaymentAPI(paymentService services.PaymentService, webhookService services.StripeWebhookService, policy services.PaymentPolicy) *PaymentAPI {
 	return &PaymentAPI{
 		paymentService: paymentService,
+		webhookService: webhookService,
+		policy:         policy,
 	}
 }
 
+// maxWebhookBodyBytes limits the size of webhook payloads read into memory
+const maxWebhookBodyBytes = 65536
+
 // CreatePayment handles payment creation (creating payment intent)
 func (h *PaymentAPI) CreatePayment(c *gin.Context) {
 	var req struct {
-		Amount   float64 `json:"amount" binding:"required,gt=0"`
-		Currency string  `json:"currency" binding:"required,len=3"`
+		// ContentID buys a content item at its catalog price; amount and currency are then ignored
+		ContentID string  `json:"content_id"`
+		Amount    float64 `json:"amount" binding:"omitempty,gt=0"`
+		Currency  string  `json:"currency" binding:"omitempty,len=3"`
+		// CouponCode is a promo code applied to the amount
+		CouponCode string `json:"coupon_code"`
 		// Add other potential fields like PaymentMethodID
 	}
 
@@ -34,14 +50,40 @@ func (h *PaymentAPI) CreatePayment(c *gin.Context) {
 		return
 	}
 
-	userID, exists := c.Get("uid") // From auth middleware (string)
-	if !exists {
+	principal := services.PrincipalFromContext(c) // From auth middleware
+	if principal == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	// Call the service method to create payment intent
-	payment, pi, err := h.paymentService.CreatePaymentIntent(c.Request.Context(), userID.(string), req.Amount, req.Currency)
+	var (
+		payment *models.Payment
+		pi      *stripe.PaymentIntent
+		err     error
+	)
+	if req.ContentID != "" {
+		payment, pi, err = h.paymentService.PurchaseContent(c.Request.Context(), principal, req.ContentID, req.CouponCode)
+		if errors.Is(err, services.ErrContentNotForSale) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		if req.Amount == 0 || req.Currency == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "amount and currency are required without content_id"})
+			return
+		}
+		amount, moneyErr := models.NewMoneyFromMajor(req.Amount, req.Currency)
+		if moneyErr != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": moneyErr.Error()})
+			return
+		}
+		// Call the service method to create payment intent
+		payment, pi, err = h.paymentService.CreatePaymentIntent(c.Request.Context(), principal, amount, req.CouponCode)
+	}
+	if services.IsCouponError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		// Handle potential Stripe errors vs DB errors
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment intent: " + err.Error()})
@@ -53,6 +95,9 @@ func (h *PaymentAPI) CreatePayment(c *gin.Context) {
 		"payment_id":    payment.ID,
 		"client_secret": pi.ClientSecret, // Important for client-side confirmation
 		"status":        payment.Status,
+		"amount":        payment.Amount.Major(),
+		"discount":      payment.Discount.Major(),
+		"currency":      payment.Amount.Currency,
 	})
 }
 
@@ -66,28 +111,61 @@ func (h *PaymentAPI) GetPayment(c *gin.Context) {
 		return
 	}
 
-	// TODO: Check if the requesting user owns this payment
-	// userID, _ := c.Get("uid")
-	// if payment.UserID != userID.(string) { ... }
+	if err := h.policy.AuthorizeView(c.Request.Context(), services.PrincipalFromContext(c), payment); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
 
 	c.JSON(http.StatusOK, payment)
 }
 
-// ProcessRefund handles payment refund
+// ProcessRefund handles payment refund.
+// The body is optional; without an amount the remaining balance is refunded.
 func (h *PaymentAPI) ProcessRefund(c *gin.Context) {
 	paymentID := c.Param("id")
 
-	// TODO: Validate user permissions to refund this payment
+	var req struct {
+		Amount float64 `json:"amount" binding:"omitempty,gt=0"`
+		Reason string  `json:"reason" binding:"omitempty,oneof=duplicate fraudulent requested_by_customer"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	payment, err := h.paymentService.GetPaymentByID(c.Request.Context(), paymentID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found or error retrieving payment"})
+		return
+	}
+	if err := h.policy.AuthorizeRefund(c.Request.Context(), services.PrincipalFromContext(c), payment); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
 
 	// Pass context to service method
-	err := h.paymentService.ProcessRefund(c.Request.Context(), paymentID)
+	refund, err := h.paymentService.ProcessRefund(c.Request.Context(), paymentID, req.Amount, req.Reason)
 	if err != nil {
-		// Handle specific errors (e.g., already refunded, not succeeded)
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		var stripeErr *stripe.Error
+		switch {
+		case errors.Is(err, models.ErrRefundExceedsPayment), errors.Is(err, models.ErrPaymentNotRefundable):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, models.ErrInvalidMoneyPrecision), errors.Is(err, models.ErrInvalidRefundAmount), errors.Is(err, models.ErrInvalidRefundReason):
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrRefundOutcomeUnknown), errors.As(err, &stripeErr):
+			log.Printf("Stripe refund failed for payment %s: %v", paymentID, err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		default:
+			log.Printf("Error processing refund for payment %s: %v", paymentID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process refund"})
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Refund processed successfully"})
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Refund processed successfully",
+		"refund":  refund,
+	})
 }
 
 // GetUserPayments handles retrieving all payments for the authenticated user
@@ -108,6 +186,34 @@ func (h *PaymentAPI) GetUserPayments(c *gin.Context) {
 	c.JSON(http.StatusOK, payments)
 }
 
+// HandleStripeWebhook receives Stripe events (unauthenticated; verified by Stripe-Signature)
+func (h *PaymentAPI) HandleStripeWebhook(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBodyBytes))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	err = h.webhookService.HandleEvent(c.Request.Context(), payload, c.GetHeader("Stripe-Signature"))
+	if errors.Is(err, services.ErrInvalidWebhookSignature) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+		return
+	}
+	if errors.Is(err, models.ErrWebhookEventInProgress) {
+		// 別の配信が処理中のため、Stripeに後で再送させる
+		c.JSON(http.StatusConflict, gin.H{"error": "Event is being processed"})
+		return
+	}
+	if err != nil {
+		// Return 5xx so that Stripe retries the delivery
+		log.Printf("Error handling Stripe webhook: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process event"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
 /*
 // Remove RegisterRoutes
 func (h *PaymentHandler) RegisterRoutes(router *gin.RouterGroup) {
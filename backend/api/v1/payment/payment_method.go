@@ -0,0 +1,133 @@
+package payment
+
+import (
+	"errors"
+	"fmt"
+	"kimiyomi/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// paymentTypeCard is the index of PaymentType.card in the Flutter PaymentMethod model
+const paymentTypeCard = 0
+
+// SavedPaymentMethod is the JSON shape expected by the Flutter PaymentMethod model
+type SavedPaymentMethod struct {
+	ID         string  `json:"id"`
+	Type       int     `json:"type"`
+	Last4      *string `json:"last4"`
+	Brand      *string `json:"brand"`
+	ExpiryDate *string `json:"expiryDate"`
+	IsDefault  bool    `json:"isDefault"`
+}
+
+// PaymentMethodAPI handles saved payment method requests
+type PaymentMethodAPI struct {
+	customerService services.CustomerService
+}
+
+// NewPaymentMethodAPI creates a new payment method handler instance
+func NewPaymentMethodAPI(customerService services.CustomerService) *PaymentMethodAPI {
+	return &PaymentMethodAPI{customerService: customerService}
+}
+
+// ListPaymentMethods handles listing the user's saved cards
+func (h *PaymentMethodAPI) ListPaymentMethods(c *gin.Context) {
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	methods, err := h.customerService.ListPaymentMethods(c.Request.Context(), principal)
+	if err != nil {
+		h.handleError(c, err)
+		return
+	}
+
+	response := make([]SavedPaymentMethod, 0, len(methods))
+	for _, m := range methods {
+		response = append(response, toSavedPaymentMethod(m))
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// CreateSetupIntent handles starting to save a new card
+func (h *PaymentMethodAPI) CreateSetupIntent(c *gin.Context) {
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	si, err := h.customerService.CreateSetupIntent(c.Request.Context(), principal)
+	if err != nil {
+		h.handleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"setup_intent_id": si.ID,
+		"client_secret":   si.ClientSecret, // Confirmed on the client to attach the card
+	})
+}
+
+// DetachPaymentMethod handles removing a saved card
+func (h *PaymentMethodAPI) DetachPaymentMethod(c *gin.Context) {
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := h.customerService.DetachPaymentMethod(c.Request.Context(), principal, c.Param("id")); err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Payment method removed"})
+}
+
+// SetDefaultPaymentMethod handles choosing the card used for later payments
+func (h *PaymentMethodAPI) SetDefaultPaymentMethod(c *gin.Context) {
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	if err := h.customerService.SetDefaultPaymentMethod(c.Request.Context(), principal, c.Param("id")); err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Default payment method updated"})
+}
+
+func (h *PaymentMethodAPI) handleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrPaymentMethodNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrBillingEmailRequired):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrEmailNotVerified):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func toSavedPaymentMethod(m services.SavedPaymentMethod) SavedPaymentMethod {
+	saved := SavedPaymentMethod{ID: m.ID, Type: paymentTypeCard, IsDefault: m.IsDefault}
+	if m.Last4 != "" {
+		saved.Last4 = &m.Last4
+	}
+	if m.Brand != "" {
+		saved.Brand = &m.Brand
+	}
+	if m.ExpYear != 0 && m.ExpMonth != 0 {
+		// DateTime.parse on the client requires a full ISO 8601 date
+		expiry := fmt.Sprintf("%04d-%02d-01T00:00:00Z", m.ExpYear, m.ExpMonth)
+		saved.ExpiryDate = &expiry
+	}
+	return saved
+}
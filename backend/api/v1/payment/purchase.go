@@ -0,0 +1,121 @@
+package payment
+
+import (
+	"errors"
+	"io"
+	"kimiyomi/models"
+	"kimiyomi/services"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// verificationSources maps the in_app_purchase plugin's verification source to a purchase platform
+var verificationSources = map[string]string{
+	"app_store":   models.PurchasePlatformIOS,
+	"google_play": models.PurchasePlatformAndroid,
+}
+
+// PurchaseAPI handles in-app purchase requests from the mobile app
+type PurchaseAPI struct {
+	purchaseService     services.PurchaseService
+	notificationService services.StoreNotificationService
+}
+
+// NewPurchaseAPI creates a new in-app purchase handler instance
+func NewPurchaseAPI(purchaseService services.PurchaseService, notificationService services.StoreNotificationService) *PurchaseAPI {
+	return &PurchaseAPI{purchaseService: purchaseService, notificationService: notificationService}
+}
+
+// ConfirmPurchase handles verifying a store transaction and recording it for the caller.
+// The body is what the Flutter app sends from PurchaseDetails; its userId is ignored in favor of the signed-in user.
+func (h *PurchaseAPI) ConfirmPurchase(c *gin.Context) {
+	var req struct {
+		TransactionID    string `json:"transactionId"`
+		ProductID        string `json:"productId"`
+		VerificationData struct {
+			Source                 string `json:"source" binding:"required"`
+			ServerVerificationData string `json:"serverVerificationData"`
+		} `json:"verificationData" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	platform, ok := verificationSources[req.VerificationData.Source]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": services.ErrUnsupportedPlatform.Error()})
+		return
+	}
+
+	purchase, err := h.purchaseService.ConfirmPurchase(c.Request.Context(), principal, &services.StoreReceipt{
+		Platform:      platform,
+		ProductID:     req.ProductID,
+		TransactionID: req.TransactionID,
+		Data:          req.VerificationData.ServerVerificationData,
+	})
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, purchase)
+	case errors.Is(err, services.ErrUnsupportedPlatform), errors.Is(err, services.ErrInvalidReceipt):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPurchasePending):
+		c.JSON(http.StatusAccepted, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrPurchaseOwnedByAnotherUser):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrStoreUnavailable):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm purchase: " + err.Error()})
+	}
+}
+
+// HandleAppStoreNotification receives App Store Server Notifications V2 (unauthenticated; verified by the JWS chain)
+func (h *PurchaseAPI) HandleAppStoreNotification(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBodyBytes))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	h.respondToNotification(c, "App Store", h.notificationService.HandleAppStoreNotification(c.Request.Context(), payload))
+}
+
+// HandleGooglePlayNotification receives real-time developer notifications pushed by Pub/Sub
+// (unauthenticated; verified by the push subscription's OIDC token)
+func (h *PurchaseAPI) HandleGooglePlayNotification(c *gin.Context) {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookBodyBytes))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to read request body"})
+		return
+	}
+
+	err = h.notificationService.HandleGooglePlayNotification(c.Request.Context(), payload, c.GetHeader("Authorization"))
+	h.respondToNotification(c, "Google Play", err)
+}
+
+func (h *PurchaseAPI) respondToNotification(c *gin.Context, store string, err error) {
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"received": true})
+	case errors.Is(err, services.ErrUnsupportedPlatform):
+		c.JSON(http.StatusNotFound, gin.H{"error": store + " notifications are not configured"})
+	case errors.Is(err, services.ErrInvalidWebhookSignature):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid signature"})
+	case errors.Is(err, models.ErrWebhookEventInProgress):
+		// 別の配信が処理中のため、ストアに後で再送させる
+		c.JSON(http.StatusConflict, gin.H{"error": "Notification is being processed"})
+	default:
+		// Return 5xx so that the store retries the delivery
+		log.Printf("Error handling %s notification: %v", store, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process notification"})
+	}
+}
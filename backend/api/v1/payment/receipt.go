@@ -0,0 +1,51 @@
+package payment
+
+import (
+	"errors"
+	"kimiyomi/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReceiptAPI handles downloading receipts of payments
+type ReceiptAPI struct {
+	paymentService services.PaymentService
+	receiptService services.ReceiptService
+	policy         services.PaymentPolicy
+}
+
+// NewReceiptAPI creates a new ReceiptAPI instance
+func NewReceiptAPI(paymentService services.PaymentService, receiptService services.ReceiptService, policy services.PaymentPolicy) *ReceiptAPI {
+	return &ReceiptAPI{
+		paymentService: paymentService,
+		receiptService: receiptService,
+		policy:         policy,
+	}
+}
+
+// GetReceipt handles downloading the receipt PDF of a payment, issuing it on the first request
+func (h *ReceiptAPI) GetReceipt(c *gin.Context) {
+	payment, err := h.paymentService.GetPaymentByID(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found or error retrieving payment"})
+		return
+	}
+	if err := h.policy.AuthorizeView(c.Request.Context(), services.PrincipalFromContext(c), payment); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+
+	receipt, err := h.receiptService.GetOrIssueReceipt(c.Request.Context(), payment)
+	if errors.Is(err, services.ErrReceiptUnavailable) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="receipt_`+receipt.Number+`.pdf"`)
+	c.Data(http.StatusOK, "application/pdf", receipt.PDF)
+}
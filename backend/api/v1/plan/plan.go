@@ -0,0 +1,156 @@
+package plan
+
+import (
+	"errors"
+	"kimiyomi/models"
+	"kimiyomi/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Indexes of the PlanInterval enum in the Flutter Plan model
+const (
+	planIntervalMonth = 0
+	planIntervalYear  = 1
+)
+
+// PlanOffer is one purchasable price of a plan, in the JSON shape of the Flutter Plan model
+type PlanOffer struct {
+	ID            string   `json:"id"` // e.g. "premium_monthly"
+	PlanID        string   `json:"plan_id"`
+	BillingCycle  string   `json:"billing_cycle"` // Sent back as is when subscribing
+	Name          string   `json:"name"`
+	Description   string   `json:"description"`
+	Price         float64  `json:"price"`
+	Currency      string   `json:"currency"`
+	Interval      int      `json:"interval"`
+	IntervalCount int      `json:"interval_count"`
+	TrialDays     int      `json:"trial_days"`
+	Features      []string `json:"features"`
+}
+
+// PlanAPI handles plan catalog requests
+type PlanAPI struct {
+	planService services.PlanService
+}
+
+// NewPlanAPI creates a new PlanAPI instance
+func NewPlanAPI(planService services.PlanService) *PlanAPI {
+	return &PlanAPI{planService: planService}
+}
+
+// ListPlans handles the public catalog; each plan is listed once per billing cycle it is sold for
+func (h *PlanAPI) ListPlans(c *gin.Context) {
+	plans, err := h.planService.ListPlans(c.Request.Context(), false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	offers := []PlanOffer{}
+	for _, plan := range plans {
+		for _, cycle := range []string{models.BillingCycleMonthly, models.BillingCycleYearly} {
+			if price, _, ok := plan.Price(cycle); ok {
+				offers = append(offers, toPlanOffer(plan, cycle, price))
+			}
+		}
+	}
+	c.JSON(http.StatusOK, offers)
+}
+
+// AdminListPlans handles listing every plan, including retired ones
+func (h *PlanAPI) AdminListPlans(c *gin.Context) {
+	plans, err := h.planService.ListPlans(c.Request.Context(), true)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, plans)
+}
+
+// AdminGetPlan handles retrieving a single plan
+func (h *PlanAPI) AdminGetPlan(c *gin.Context) {
+	plan, err := h.planService.GetPlan(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// AdminCreatePlan handles adding a plan to the catalog
+func (h *PlanAPI) AdminCreatePlan(c *gin.Context) {
+	var plan models.Plan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.planService.CreatePlan(c.Request.Context(), &plan); err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, plan)
+}
+
+// AdminUpdatePlan handles replacing a plan
+func (h *PlanAPI) AdminUpdatePlan(c *gin.Context) {
+	var plan models.Plan
+	if err := c.ShouldBindJSON(&plan); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	plan.ID = c.Param("id") // Ensure ID from path is used
+
+	if err := h.planService.UpdatePlan(c.Request.Context(), &plan); err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, plan)
+}
+
+// AdminRetirePlan handles retiring a plan; it is kept for existing subscriptions
+func (h *PlanAPI) AdminRetirePlan(c *gin.Context) {
+	if err := h.planService.RetirePlan(c.Request.Context(), c.Param("id")); err != nil {
+		h.handleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Plan retired successfully"})
+}
+
+func (h *PlanAPI) handleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrPlanNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrInvalidPlanID), errors.Is(err, models.ErrInvalidPlanName),
+		errors.Is(err, models.ErrPlanWithoutPrice), errors.Is(err, models.ErrInvalidAmount),
+		errors.Is(err, models.ErrInvalidCurrency), errors.Is(err, models.ErrInvalidTrialDays):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func toPlanOffer(plan *models.Plan, cycle string, price models.Money) PlanOffer {
+	offer := PlanOffer{
+		ID:            plan.ID + "_" + cycle,
+		PlanID:        plan.ID,
+		BillingCycle:  cycle,
+		Name:          plan.Name,
+		Description:   plan.Description,
+		Price:         price.Major(),
+		Currency:      price.Currency,
+		Interval:      planIntervalMonth,
+		IntervalCount: 1,
+		TrialDays:     plan.TrialDays,
+		Features:      plan.Entitlements,
+	}
+	if cycle == models.BillingCycleYearly {
+		offer.Interval = planIntervalYear
+	}
+	if offer.Features == nil {
+		offer.Features = []string{}
+	}
+	return offer
+}
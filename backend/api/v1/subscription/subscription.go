@@ -1,6 +1,8 @@
 package subscription
 
 import (
+	"errors"
+	"io"
 	"kimiyomi/models"
 	"kimiyomi/services"
 	"net/http"
@@ -33,13 +35,15 @@ type SubscriptionResponse struct {
 // Renamed from SubscriptionHandler
 type SubscriptionAPI struct {
 	subscriptionService services.SubscriptionService
+	policy              services.SubscriptionPolicy
 }
 
 // NewSubscriptionAPI creates a new subscription handler instance.
 // Renamed from NewSubscriptionHandler
-func NewSubscriptionAPI(subscriptionService services.SubscriptionService) *SubscriptionAPI {
+func NewSubscriptionAPI(subscriptionService services.SubscriptionService, policy services.SubscriptionPolicy) *SubscriptionAPI {
 	return &SubscriptionAPI{
 		subscriptionService: subscriptionService,
+		policy:              policy,
 	}
 }
 
@@ -48,6 +52,7 @@ func (h *SubscriptionAPI) CreateSubscription(c *gin.Context) {
 	var req struct {
 		PlanID       string `json:"plan_id" binding:"required"`
 		BillingCycle string `json:"billing_cycle" binding:"required,oneof=monthly yearly"`
+		CouponCode   string `json:"coupon_code"`
 		// Add PaymentMethodID or other necessary fields from client
 	}
 
@@ -56,41 +61,43 @@ func (h *SubscriptionAPI) CreateSubscription(c *gin.Context) {
 		return
 	}
 
-	userID, exists := c.Get("uid") // From auth middleware (string)
-	if !exists {
+	principal := services.PrincipalFromContext(c) // From auth middleware
+	if principal == nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	// Create models.Subscription object
+	// Create models.Subscription object; status and billing period are filled in from Stripe
 	subscription := &models.Subscription{
-		UserID:       userID.(string),
 		PlanID:       req.PlanID,
 		BillingCycle: req.BillingCycle,
-		Status:       models.SubscriptionStatusActive, // Initial status
-		AutoRenew:    true,                            // Default auto-renew
-		// Set StartDate, EndDate based on PlanID and BillingCycle logic
-		// Link Stripe Subscription ID after successful payment/setup
+		CouponCode:   req.CouponCode,
 	}
 
 	// Pass context and the subscription object
-	if err := h.subscriptionService.CreateSubscription(c.Request.Context(), subscription); err != nil {
+	pi, err := h.subscriptionService.CreateSubscription(c.Request.Context(), principal, subscription)
+	if errors.Is(err, services.ErrUnknownPlan) || services.IsCouponError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		// Consider more specific error handling (e.g., duplicate subscription)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create subscription: " + err.Error()})
 		return
 	}
 
-	// Return the created subscription (or relevant parts)
-	c.JSON(http.StatusCreated, subscription)
+	response := gin.H{"subscription": subscription}
+	if pi != nil {
+		// The first payment needs confirmation on the client (e.g. 3-D Secure)
+		response["client_secret"] = pi.ClientSecret
+	}
+	c.JSON(http.StatusCreated, response)
 }
 
 // GetSubscription handles retrieving a subscription
 func (h *SubscriptionAPI) GetSubscription(c *gin.Context) {
 	subscriptionID := c.Param("id")
 
-	// TODO: Validate that the requesting user owns this subscription or has permission
-	// userID, _ := c.Get("uid")
-
 	// Pass context
 	subscription, err := h.subscriptionService.GetSubscription(c.Request.Context(), subscriptionID)
 	if err != nil {
@@ -98,59 +105,212 @@ func (h *SubscriptionAPI) GetSubscription(c *gin.Context) {
 		return
 	}
 
+	if err := h.policy.AuthorizeView(c.Request.Context(), services.PrincipalFromContext(c), subscription); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+
 	c.JSON(http.StatusOK, subscription)
 }
 
-// CancelSubscription handles subscription cancellation
+// GetUserSubscriptions handles listing the caller's subscriptions.
+// Query parameters status, plan_id and billing_cycle narrow the list.
+func (h *SubscriptionAPI) GetUserSubscriptions(c *gin.Context) {
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var filter models.SubscriptionFilter
+	if err := c.ShouldBindQuery(&filter); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filter parameters: " + err.Error()})
+		return
+	}
+
+	subscriptions, err := h.subscriptionService.ListUserSubscriptions(c.Request.Context(), principal.UID, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, subscriptions)
+}
+
+// GetMySubscription handles retrieving the caller's effective subscription
+func (h *SubscriptionAPI) GetMySubscription(c *gin.Context) {
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	h.respondCurrentSubscription(c, principal.UID)
+}
+
+// GetUserSubscription handles retrieving a user's effective subscription, as called by the Flutter app.
+// Users can only read their own; staff can read anyone's.
+func (h *SubscriptionAPI) GetUserSubscription(c *gin.Context) {
+	userID := c.Param("id")
+	if err := h.policy.AuthorizeViewUser(c.Request.Context(), services.PrincipalFromContext(c), userID); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+	h.respondCurrentSubscription(c, userID)
+}
+
+func (h *SubscriptionAPI) respondCurrentSubscription(c *gin.Context, userID string) {
+	current, err := h.subscriptionService.GetCurrentSubscription(c.Request.Context(), userID)
+	if errors.Is(err, services.ErrNoActiveSubscription) {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, current)
+}
+
+// CancelSubscription handles cancellation by the subscriber.
+// Renewal stops and access continues until the end of the paid period.
 func (h *SubscriptionAPI) CancelSubscription(c *gin.Context) {
-	subscriptionID := c.Param("id")
+	subscription, ok := h.ownedSubscription(c)
+	if !ok {
+		return
+	}
+
+	err := h.subscriptionService.CancelSubscription(c.Request.Context(), subscription.ID)
+	if errors.Is(err, services.ErrSubscriptionNotCancelable) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel subscription: " + err.Error()})
+		return
+	}
 
-	// TODO: Validate that the requesting user owns this subscription or has permission
-	// userID, _ := c.Get("uid")
+	c.JSON(http.StatusOK, gin.H{"message": "Subscription will be cancelled at the end of the current period"})
+}
 
-	// Pass context
-	err := h.subscriptionService.CancelSubscription(c.Request.Context(), subscriptionID)
+// RenewSubscription handles reactivating a cancelled subscription before its period ends
+func (h *SubscriptionAPI) RenewSubscription(c *gin.Context) {
+	subscription, ok := h.ownedSubscription(c)
+	if !ok {
+		return
+	}
+
+	subscription, err := h.subscriptionService.ReactivateSubscription(c.Request.Context(), subscription.ID)
+	if errors.Is(err, services.ErrSubscriptionNotReactivatable) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		// Handle specific errors (e.g., already cancelled)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reactivate subscription: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// AdminCancelSubscription handles ending a subscription immediately, optionally with a refund
+func (h *SubscriptionAPI) AdminCancelSubscription(c *gin.Context) {
+	var req struct {
+		Refund string `json:"refund"` // none (default), prorated or full
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if req.Refund == "" {
+		req.Refund = services.CancelRefundNone
+	}
+
+	subscription, refunded, err := h.subscriptionService.TerminateSubscription(c.Request.Context(), c.Param("id"), req.Refund)
+	switch {
+	case errors.Is(err, services.ErrInvalidRefundMode):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrSubscriptionNotCancelable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel subscription: " + err.Error()})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Subscription cancelled successfully"})
+	c.JSON(http.StatusOK, gin.H{
+		"subscription":          subscription,
+		"refunded_amount":       refunded.Major(),
+		"refunded_amount_minor": refunded.Minor,
+		"currency":              refunded.Currency,
+	})
 }
 
-/*
-// GetUserSubscriptions - Service method not available in interface
-func (h *SubscriptionAPI) GetUserSubscriptions(c *gin.Context) {
-	userID, exists := c.Get("uid")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+// ChangePlan handles upgrades and downgrades between plans and billing cycles.
+// Upgrades apply immediately; downgrades are returned as a pending change until the period ends.
+func (h *SubscriptionAPI) ChangePlan(c *gin.Context) {
+	var req struct {
+		PlanID       string `json:"plan_id"`
+		BillingCycle string `json:"billing_cycle" binding:"omitempty,oneof=monthly yearly"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	subscription, ok := h.ownedSubscription(c)
+	if !ok {
+		return
+	}
+
+	// Omitted fields keep their current value, so the client can change only the billing cycle
+	if req.PlanID == "" {
+		req.PlanID = subscription.PlanID
+	}
+	if req.BillingCycle == "" {
+		req.BillingCycle = subscription.BillingCycle
+	}
+
+	subscription, pi, err := h.subscriptionService.ChangePlan(c.Request.Context(), subscription.ID, req.PlanID, req.BillingCycle)
+	switch {
+	case errors.Is(err, services.ErrUnknownPlan), errors.Is(err, services.ErrPlanUnchanged):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, services.ErrSubscriptionNotChangeable):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change plan: " + err.Error()})
 		return
 	}
 
-	// subscriptions, err := h.subscriptionService.GetUserSubscriptions(c.Request.Context(), userID.(string))
-	// if err != nil {
-	// 	c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-	// 	return
-	// }
-	// c.JSON(http.StatusOK, subscriptions)
-	c.JSON(http.StatusNotImplemented, gin.H{"message": "GetUserSubscriptions endpoint not fully implemented"})
+	response := gin.H{"subscription": subscription}
+	if pi != nil {
+		// The prorated invoice needs confirmation on the client; the new plan applies once it is paid
+		response["client_secret"] = pi.ClientSecret
+	}
+	c.JSON(http.StatusOK, response)
 }
 
-// RenewSubscription - Service method not available in interface
-func (h *SubscriptionAPI) RenewSubscription(c *gin.Context) {
-	subscriptionID := c.Param("id")
-	// TODO: Validate ownership
+// ownedSubscription loads the subscription in the path and checks that it belongs to the caller.
+// It writes the error response and returns false otherwise.
+func (h *SubscriptionAPI) ownedSubscription(c *gin.Context) (*models.Subscription, bool) {
+	principal := services.PrincipalFromContext(c)
+	if principal == nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
 
-	// err := h.subscriptionService.RenewSubscription(c.Request.Context(), subscriptionID)
-	// if err != nil {
-	// 	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-	// 	return
-	// }
-	// c.JSON(http.StatusOK, gin.H{"message": "Subscription renewed successfully"})
-	c.JSON(http.StatusNotImplemented, gin.H{"message": "RenewSubscription endpoint not fully implemented"})
+	subscription, err := h.subscriptionService.GetSubscription(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found or error retrieving subscription"})
+		return nil, false
+	}
+	if err := h.policy.AuthorizeManage(c.Request.Context(), principal, subscription); err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return nil, false
+	}
+	return subscription, true
 }
-*/
 
 /*
 // Remove RegisterRoutes
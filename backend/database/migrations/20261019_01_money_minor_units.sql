@@ -0,0 +1,34 @@
+-- 金額を最小通貨単位の整数（JPYは円、USDはセント）に移行する
+
+-- 通貨ごとの小数桁数（models.CurrencyExponent と同じ定義）
+CREATE FUNCTION pg_temp.currency_exponent(code TEXT) RETURNS INT AS $$
+    SELECT CASE
+        WHEN upper(code) IN ('BIF', 'CLP', 'DJF', 'GNF', 'ISK', 'JPY', 'KMF', 'KRW', 'MGA',
+                             'PYG', 'RWF', 'UGX', 'VND', 'VUV', 'XAF', 'XOF', 'XPF') THEN 0
+        WHEN upper(code) IN ('BHD', 'JOD', 'KWD', 'OMR', 'TND') THEN 3
+        ELSE 2
+    END
+$$ LANGUAGE SQL IMMUTABLE;
+
+-- 決済
+ALTER TABLE payments
+    ADD COLUMN amount_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN amount_currency VARCHAR(3) NOT NULL DEFAULT 'JPY';
+UPDATE payments SET
+    amount_currency = upper(currency),
+    amount_minor = round(amount * power(10, pg_temp.currency_exponent(currency)));
+ALTER TABLE payments DROP COLUMN amount, DROP COLUMN currency;
+
+-- サブスクリプション（これまで通貨を持たなかったためJPYとみなす）
+ALTER TABLE subscriptions
+    ADD COLUMN amount_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN amount_currency VARCHAR(3) NOT NULL DEFAULT 'JPY';
+UPDATE subscriptions SET amount_minor = round(amount);
+ALTER TABLE subscriptions DROP COLUMN amount;
+
+-- コンテンツ価格（同上）
+ALTER TABLE contents
+    ADD COLUMN price_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN price_currency VARCHAR(3) NOT NULL DEFAULT 'JPY';
+UPDATE contents SET price_minor = round(price);
+ALTER TABLE contents DROP COLUMN price;
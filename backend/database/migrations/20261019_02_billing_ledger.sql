@@ -0,0 +1,37 @@
+-- Stripe・App Store・Google Playの入出金をまとめる追記専用の台帳
+
+CREATE TABLE ledger_entries (
+    id BIGSERIAL PRIMARY KEY,
+    source VARCHAR(32) NOT NULL,
+    type VARCHAR(32) NOT NULL,
+    source_ref VARCHAR(255) NOT NULL,
+    amount_minor BIGINT NOT NULL,
+    amount_currency VARCHAR(3) NOT NULL,
+    user_id VARCHAR(255),
+    reference_type VARCHAR(32),
+    reference_id VARCHAR(255),
+    estimated BOOLEAN NOT NULL DEFAULT FALSE,
+    description TEXT,
+    occurred_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_ledger_source_ref ON ledger_entries (source, type, source_ref);
+CREATE INDEX idx_ledger_entries_occurred_at ON ledger_entries (occurred_at);
+CREATE INDEX idx_ledger_entries_user_id ON ledger_entries (user_id);
+CREATE INDEX idx_ledger_reference ON ledger_entries (reference_type, reference_id);
+
+-- 訂正は逆符号の記録で行い、既存の記録は変更・削除させない
+CREATE FUNCTION ledger_entries_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'ledger_entries is append-only';
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER ledger_entries_append_only
+    BEFORE UPDATE OR DELETE ON ledger_entries
+    FOR EACH ROW EXECUTE FUNCTION ledger_entries_append_only();
+
+-- ストアが報告した支払額
+ALTER TABLE purchases
+    ADD COLUMN price_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN price_currency VARCHAR(3) NOT NULL DEFAULT '';
@@ -0,0 +1,30 @@
+-- Stripeの支払いに対して発行する領収書
+
+CREATE TABLE receipts (
+    id VARCHAR(255) PRIMARY KEY,
+    number VARCHAR(32) NOT NULL,
+    payment_id VARCHAR(255) NOT NULL,
+    user_id VARCHAR(255),
+    recipient_name VARCHAR(255),
+    description TEXT,
+    amount_minor BIGINT NOT NULL,
+    amount_currency VARCHAR(3) NOT NULL,
+    tax_rate INTEGER NOT NULL,
+    tax_minor BIGINT NOT NULL,
+    tax_currency VARCHAR(3) NOT NULL,
+    seller_name VARCHAR(255),
+    seller_address TEXT,
+    seller_contact VARCHAR(255),
+    issued_at TIMESTAMPTZ NOT NULL,
+    pdf BYTEA NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX idx_receipts_number ON receipts (number);
+CREATE UNIQUE INDEX idx_receipts_payment_id ON receipts (payment_id);
+CREATE INDEX idx_receipts_user_id ON receipts (user_id);
+
+-- 領収書番号の年ごとの連番
+CREATE TABLE receipt_sequences (
+    year INTEGER PRIMARY KEY,
+    last_number BIGINT NOT NULL
+);
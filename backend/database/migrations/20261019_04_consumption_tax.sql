@@ -0,0 +1,21 @@
+-- 消費税額の保持とインボイス（適格請求書）対応
+
+-- 支払い・サブスクリプションの金額に含まれる消費税額と税率
+ALTER TABLE payments
+    ADD COLUMN tax_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN tax_currency VARCHAR(3) NOT NULL DEFAULT '',
+    ADD COLUMN tax_rate INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE subscriptions
+    ADD COLUMN tax_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN tax_currency VARCHAR(3) NOT NULL DEFAULT '',
+    ADD COLUMN tax_rate INTEGER NOT NULL DEFAULT 0;
+
+-- これまでの価格は標準税率10%の税込価格として扱う（円未満切り捨て）
+UPDATE payments
+    SET tax_rate = 10, tax_minor = FLOOR(amount_minor * 10 / 110.0), tax_currency = amount_currency;
+UPDATE subscriptions
+    SET tax_rate = 10, tax_minor = FLOOR(amount_minor * 10 / 110.0), tax_currency = amount_currency;
+
+-- 領収書に記載する適格請求書発行事業者登録番号
+ALTER TABLE receipts
+    ADD COLUMN registration_number VARCHAR(14) NOT NULL DEFAULT '';
@@ -0,0 +1,24 @@
+-- スケジューラーの実行履歴。予定時刻ごとに1行だけ作成し、同じ回を複数のレプリカが実行しないようにする
+
+CREATE TABLE IF NOT EXISTS job_runs (
+    id SERIAL PRIMARY KEY,
+    job_name VARCHAR(255) NOT NULL,
+    instance VARCHAR(255),
+    status VARCHAR(32) NOT NULL,
+    error TEXT,
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- 既存の履歴は開始時刻を分に切り捨てて予定時刻とする
+ALTER TABLE job_runs ADD COLUMN IF NOT EXISTS scheduled_at TIMESTAMPTZ;
+UPDATE job_runs SET scheduled_at = date_trunc('minute', COALESCE(started_at, created_at)) WHERE scheduled_at IS NULL;
+-- 切り捨てで重複した古い履歴は最初の1件だけ残す
+DELETE FROM job_runs a USING job_runs b
+    WHERE a.job_name = b.job_name AND a.scheduled_at = b.scheduled_at AND a.id > b.id;
+ALTER TABLE job_runs ALTER COLUMN scheduled_at SET NOT NULL;
+
+DROP INDEX IF EXISTS idx_job_runs_job_name;
+CREATE UNIQUE INDEX idx_job_runs_schedule ON job_runs (job_name, scheduled_at);
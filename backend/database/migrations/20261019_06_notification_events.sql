@@ -0,0 +1,23 @@
+-- ユーザーへの通知のアウトボックス。通知配信ジョブがFCMで配信する
+
+CREATE TABLE IF NOT EXISTS notification_events (
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    type VARCHAR(64) NOT NULL,
+    resource_type VARCHAR(64),
+    resource_id VARCHAR(255),
+    deadline_at TIMESTAMPTZ,
+    dedupe_key VARCHAR(255) NOT NULL,
+    status VARCHAR(32) NOT NULL DEFAULT 'pending',
+    sent_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_notification_events_dedupe_key ON notification_events (dedupe_key);
+CREATE INDEX IF NOT EXISTS idx_notification_events_user_id ON notification_events (user_id);
+CREATE INDEX IF NOT EXISTS idx_notification_events_status ON notification_events (status);
+
+-- 配信失敗時の再試行
+ALTER TABLE notification_events
+    ADD COLUMN IF NOT EXISTS attempts INTEGER NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS last_error TEXT;
@@ -0,0 +1,8 @@
+-- クーポンによるサブスクリプション請求額の減額分（税込）
+-- 既存の契約は次回のStripe同期で割引後の金額に更新される
+
+ALTER TABLE subscriptions
+    ADD COLUMN discount_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN discount_currency VARCHAR(3) NOT NULL DEFAULT 'JPY';
+
+UPDATE subscriptions SET discount_currency = amount_currency;
@@ -0,0 +1,13 @@
+-- 無料トライアルの利用履歴。1ユーザー1回までをuser_idの一意制約で保証する
+
+CREATE TABLE IF NOT EXISTS trial_redemptions (
+    id SERIAL PRIMARY KEY,
+    user_id VARCHAR(255) NOT NULL,
+    plan_id VARCHAR(255),
+    subscription_id VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_trial_redemptions_user_id ON trial_redemptions (user_id);
+
+-- トライアル中のサブスクリプションの終了日時
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS trial_end TIMESTAMPTZ;
@@ -0,0 +1,52 @@
+-- プロモーションコード。利用上限はredeemed_countとcoupon_redemptionsで管理する
+
+CREATE TABLE IF NOT EXISTS coupons (
+    id VARCHAR(255) PRIMARY KEY,
+    code VARCHAR(32) NOT NULL,
+    description TEXT,
+    discount_type VARCHAR(16) NOT NULL,
+    percent_off INTEGER NOT NULL DEFAULT 0,
+    amount_off_minor BIGINT NOT NULL DEFAULT 0,
+    amount_off_currency VARCHAR(3),
+    duration VARCHAR(16),
+    duration_in_months INTEGER NOT NULL DEFAULT 0,
+    max_redemptions INTEGER NOT NULL DEFAULT 0,
+    max_redemptions_per_user INTEGER NOT NULL DEFAULT 0,
+    redeemed_count INTEGER NOT NULL DEFAULT 0,
+    valid_from TIMESTAMPTZ,
+    valid_until TIMESTAMPTZ,
+    plan_ids TEXT,
+    stripe_coupon_id VARCHAR(255),
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+-- コードは大文字に正規化して保存する
+CREATE UNIQUE INDEX IF NOT EXISTS idx_coupons_code ON coupons (code);
+CREATE INDEX IF NOT EXISTS idx_coupons_active ON coupons (active);
+
+-- クーポンの利用履歴。決済が成立しなかった利用はreleasedにして行は残す
+CREATE TABLE IF NOT EXISTS coupon_redemptions (
+    id VARCHAR(255) PRIMARY KEY,
+    coupon_id VARCHAR(255) NOT NULL REFERENCES coupons (id),
+    user_id VARCHAR(255) NOT NULL,
+    payment_id VARCHAR(255),
+    subscription_id VARCHAR(255),
+    discount_minor BIGINT NOT NULL DEFAULT 0,
+    discount_currency VARCHAR(3),
+    status VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_coupon_id ON coupon_redemptions (coupon_id);
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_user_id ON coupon_redemptions (user_id);
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_payment_id ON coupon_redemptions (payment_id);
+CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_subscription_id ON coupon_redemptions (subscription_id);
+
+-- 決済・サブスクリプションに適用したコードと割引額（Amountは割引後の金額）
+ALTER TABLE payments
+    ADD COLUMN IF NOT EXISTS coupon_code VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS discount_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS discount_currency VARCHAR(3);
+UPDATE payments SET discount_currency = amount_currency WHERE discount_currency IS NULL;
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS coupon_code VARCHAR(32);
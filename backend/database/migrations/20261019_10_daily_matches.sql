@@ -0,0 +1,33 @@
+-- 夜間バッチで事前計算する日替わり相性候補と、バッチの再開に使う進捗
+
+CREATE TABLE IF NOT EXISTS daily_matches (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id),
+    match_date DATE NOT NULL,
+    rank INTEGER NOT NULL,
+    candidate_id INTEGER NOT NULL REFERENCES users(id),
+    score DECIMAL(5,2) NOT NULL,
+    created_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ,
+    deleted_at TIMESTAMPTZ
+);
+-- ユーザー・日付ごとに順位は1件だけ
+CREATE UNIQUE INDEX IF NOT EXISTS idx_daily_match_rank ON daily_matches (user_id, match_date, rank);
+CREATE INDEX IF NOT EXISTS idx_daily_matches_match_date ON daily_matches (match_date);
+CREATE INDEX IF NOT EXISTS idx_daily_matches_deleted_at ON daily_matches (deleted_at);
+
+CREATE TABLE IF NOT EXISTS job_progresses (
+    id SERIAL PRIMARY KEY,
+    job_name VARCHAR(255) NOT NULL,
+    run_key VARCHAR(255) NOT NULL,
+    status VARCHAR(32) NOT NULL,
+    cursor INTEGER NOT NULL DEFAULT 0,
+    processed INTEGER NOT NULL DEFAULT 0,
+    total INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_job_progress_run ON job_progresses (job_name, run_key);
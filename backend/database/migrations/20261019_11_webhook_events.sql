@@ -0,0 +1,14 @@
+-- Webhook（Stripe・App Store・Google Play）の重複処理防止。
+-- 処理中のイベントはlocked_untilまで他の配信に処理させず、過ぎたものは再処理できる
+
+CREATE TABLE IF NOT EXISTS webhook_events (
+    id SERIAL PRIMARY KEY,
+    source VARCHAR(32) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    type VARCHAR(255),
+    status VARCHAR(32) NOT NULL DEFAULT 'processed',
+    locked_until TIMESTAMPTZ,
+    processed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_webhook_event ON webhook_events (source, event_id);
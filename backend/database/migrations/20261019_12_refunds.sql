@@ -0,0 +1,25 @@
+-- 返金ごとの記録（部分返金に対応）と、決済ごとの返金済み累計額
+
+CREATE TABLE IF NOT EXISTS refunds (
+    id VARCHAR(255) PRIMARY KEY,
+    payment_id VARCHAR(255) NOT NULL,
+    stripe_refund_id VARCHAR(255),
+    amount_minor BIGINT NOT NULL,
+    amount_currency VARCHAR(3) NOT NULL,
+    reason VARCHAR(64),
+    status VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_refunds_payment_id ON refunds (payment_id);
+-- 確定前の返金はNULLのため、一意制約は複数のNULLを許す
+CREATE UNIQUE INDEX IF NOT EXISTS idx_refunds_stripe_refund_id ON refunds (stripe_refund_id);
+-- 照合ジョブが保留中の返金を古い順に取り出す
+CREATE INDEX IF NOT EXISTS idx_refunds_pending ON refunds (updated_at) WHERE status = 'pending';
+
+ALTER TABLE payments
+    ADD COLUMN IF NOT EXISTS refunded_minor BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS refunded_currency VARCHAR(3);
+UPDATE payments SET refunded_currency = amount_currency WHERE refunded_currency IS NULL;
+-- これまで全額返金のみだったため、返金済みの決済は全額を返金済みとする
+UPDATE payments SET refunded_minor = amount_minor WHERE status = 'refunded';
@@ -0,0 +1,12 @@
+-- Firebaseユーザーとの紐付けとStripe Customer、決済に使った顧客・支払い方法
+
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS firebase_uid VARCHAR(128),
+    ADD COLUMN IF NOT EXISTS stripe_customer_id VARCHAR(255) NOT NULL DEFAULT '';
+-- 未連携のユーザーはNULLのため、一意制約は複数のNULLを許す
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_firebase_uid ON users (firebase_uid);
+CREATE INDEX IF NOT EXISTS idx_users_stripe_customer_id ON users (stripe_customer_id);
+
+ALTER TABLE payments
+    ADD COLUMN IF NOT EXISTS stripe_customer_id VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS stripe_payment_method_id VARCHAR(255) NOT NULL DEFAULT '';
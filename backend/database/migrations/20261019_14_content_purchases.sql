@@ -0,0 +1,4 @@
+-- 単品購入したコンテンツ（権利情報の判定に使う）
+
+ALTER TABLE payments ADD COLUMN IF NOT EXISTS content_id VARCHAR(255) NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_payments_content_id ON payments (content_id);
@@ -0,0 +1,15 @@
+-- 保護されたリソースへのアクセス判定（拒否）の監査ログ
+
+CREATE TABLE IF NOT EXISTS audit_logs (
+    id SERIAL PRIMARY KEY,
+    actor_uid VARCHAR(255),
+    action VARCHAR(255),
+    resource_type VARCHAR(255),
+    resource_id VARCHAR(255),
+    decision VARCHAR(32),
+    reason TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_actor_uid ON audit_logs (actor_uid);
+CREATE INDEX IF NOT EXISTS idx_audit_resource ON audit_logs (resource_type, resource_id);
+CREATE INDEX IF NOT EXISTS idx_audit_logs_created_at ON audit_logs (created_at);
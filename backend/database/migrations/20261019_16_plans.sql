@@ -0,0 +1,27 @@
+-- プランカタログ（これまで環境変数STRIPE_PLAN_PRICESで定義していたプラン）
+
+CREATE TABLE IF NOT EXISTS plans (
+    id VARCHAR(255) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    monthly_price_minor BIGINT NOT NULL DEFAULT 0,
+    monthly_price_currency VARCHAR(3),
+    yearly_price_minor BIGINT NOT NULL DEFAULT 0,
+    yearly_price_currency VARCHAR(3),
+    stripe_monthly_price_id VARCHAR(255),
+    stripe_yearly_price_id VARCHAR(255),
+    entitlements TEXT,
+    store_product_ids TEXT,
+    trial_days INT NOT NULL DEFAULT 0,
+    active BOOLEAN NOT NULL DEFAULT FALSE,
+    sort_order INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_plans_active ON plans (active);
+
+-- 既存のプランIDを引き継ぐ。StripeのPrice IDは環境ごとに異なるため、
+-- 管理APIから設定するまでは決済を開始できない（ErrUnknownPlan）
+INSERT INTO plans (id, name, monthly_price_minor, monthly_price_currency, entitlements, store_product_ids, active, sort_order)
+VALUES ('premium', 'プレミアムプラン', 1000, 'JPY', '["premium"]', '["premium_monthly","premium_yearly"]', TRUE, 1)
+ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,2 @@
+-- Webhookで受け取ったStripeのサブスクリプションIDから契約を引く
+CREATE INDEX IF NOT EXISTS idx_subscriptions_stripe_sub_id ON subscriptions (stripe_sub_id);
@@ -0,0 +1,5 @@
+-- 期間終了時に適用するプラン変更（ダウングレード）の予約
+ALTER TABLE subscriptions
+    ADD COLUMN IF NOT EXISTS pending_plan_id VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS pending_billing_cycle VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS pending_change_at TIMESTAMPTZ;
@@ -0,0 +1,9 @@
+-- 更新失敗時の猶予期間と再請求の状態
+ALTER TABLE subscriptions
+    ADD COLUMN IF NOT EXISTS past_due_since TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS grace_until TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS renewal_attempts INT NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS next_retry_at TIMESTAMPTZ;
+
+-- 期限切れ・更新失敗の巡回ジョブが対象の契約を終了日で取り出す
+CREATE INDEX IF NOT EXISTS idx_subscriptions_status_end_date ON subscriptions (status, end_date);
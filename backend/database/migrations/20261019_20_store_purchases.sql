@@ -0,0 +1,9 @@
+-- ストアで検証した購入の元の購入ID・環境・取り消し日時
+ALTER TABLE purchases
+    ADD COLUMN IF NOT EXISTS original_purchase_id VARCHAR(255),
+    ADD COLUMN IF NOT EXISTS environment VARCHAR(32),
+    ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ;
+
+-- 既存の購入は更新をまたいだ記録がないため、自身を元の購入とする
+UPDATE purchases SET original_purchase_id = purchase_id WHERE original_purchase_id IS NULL;
+CREATE INDEX IF NOT EXISTS idx_purchases_original_purchase_id ON purchases (original_purchase_id);
@@ -0,0 +1,2 @@
+-- ストアが報告した自動更新の設定（不明な場合はNULL）
+ALTER TABLE purchases ADD COLUMN IF NOT EXISTS auto_renew BOOLEAN;
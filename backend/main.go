@@ -7,22 +7,30 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	authAPI "kimiyomi/api/v1/auth"
 	compAPI "kimiyomi/api/v1/compatibility"
 	contentAPI "kimiyomi/api/v1/content"
+	couponAPI "kimiyomi/api/v1/coupon"
 	diagAPI "kimiyomi/api/v1/diagnosis"
+	entitlementAPI "kimiyomi/api/v1/entitlement"
+	ledgerAPI "kimiyomi/api/v1/ledger"
 	paymentAPI "kimiyomi/api/v1/payment"
+	planAPI "kimiyomi/api/v1/plan"
 	subAPI "kimiyomi/api/v1/subscription"
 
+	"kimiyomi/models"
 	"kimiyomi/repository"
 	"kimiyomi/services"
 
 	"firebase.google.com/go/v4/auth"
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/stripe/stripe-go"
+	"google.golang.org/api/option"
 	"gorm.io/driver/postgres" // Example DB driver
 	"gorm.io/gorm"
-	// Add other necessary imports like redis client
 )
 
 // --- Dependency Setup ---
@@ -56,6 +64,18 @@ return nil, fmt.Errorf("failed to connect database: %w", err)
 }
 app.DB = db
 
+// Redis (権利情報などのキャッシュ)
+redisHost := os.Getenv("REDIS_HOST")
+if redisHost == "" {
+redisHost = "localhost"
+log.Println("WARNING: REDIS_HOST not set, using localhost.")
+}
+redisPort := os.Getenv("REDIS_PORT")
+if redisPort == "" {
+redisPort = "6379"
+}
+app.RedisClient = redis.NewClient(&redis.Options{Addr: redisHost + ":" + redisPort})
+
 // 2. Initialize Repositories
 userRepo := repository.NewUserRepository(db) // Assuming NewUserRepository exists
 compRepo := repository.NewCompatibilityRepository(db) // Assuming NewCompatibilityRepository exists
@@ -63,18 +83,132 @@ contentRepo := repository.NewContentRepository(db)
 diagRepo := repository.NewDiagnosisRepository(db) // Assuming NewDiagnosisRepository exists
 paymentRepo := repository.NewPaymentRepository(db)
 subRepo := repository.NewSubscriptionRepository(db) // Assuming NewSubscriptionRepository exists
+jobRepo := repository.NewJobRepository(db)
+webhookEventRepo := repository.NewWebhookEventRepository(db)
+refundRepo := repository.NewRefundRepository(db)
+auditLogRepo := repository.NewAuditLogRepository(db)
+planRepo := repository.NewPlanRepository(db)
+purchaseRepo := repository.NewPurchaseRepository(db)
+notificationRepo := repository.NewNotificationRepository(db)
+trialRepo := repository.NewTrialRepository(db)
+couponRepo := repository.NewCouponRepository(db)
+ledgerRepo := repository.NewLedgerRepository(db)
+receiptRepo := repository.NewReceiptRepository(db)
 // Initialize other repositories (Question, Answer etc.) if needed
 
 // 3. Initialize Services
+stripe.Key = os.Getenv("STRIPE_SECRET_KEY")
+if stripe.Key == "" {
+log.Println("WARNING: STRIPE_SECRET_KEY not set.")
+}
+stripeWebhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+if stripeWebhookSecret == "" {
+log.Println("WARNING: STRIPE_WEBHOOK_SECRET not set.")
+}
+
+app.CacheService = services.NewCacheService(app.RedisClient)
 app.AuthService = services.NewAuthService(userRepo)
 app.CompatibilityService = services.NewCompatibilityService(compRepo, userRepo)
-app.ContentService = services.NewContentService(contentRepo)
 app.DiagnosisService = services.NewDiagnosisService(diagRepo /*, questionRepo, userRepo */) // Pass required repos
-app.PaymentService = services.NewPaymentService(paymentRepo, userRepo)
-app.SubscriptionService = services.NewSubscriptionService(subRepo)
+app.CustomerService = services.NewCustomerService(userRepo)
+app.EntitlementService = services.NewEntitlementService(subRepo, purchaseRepo, paymentRepo, planRepo, app.CacheService)
+app.ContentService = services.NewContentService(contentRepo, app.EntitlementService)
+app.CouponService = services.NewCouponService(couponRepo)
+app.LedgerService = services.NewLedgerService(ledgerRepo, paymentRepo, subRepo, &services.LedgerConfig{
+// 小規模事業者プログラム・継続課金の手数料率
+StoreCommissionRates: map[string]float64{models.LedgerSourceAppStore: 0.15, models.LedgerSourceGooglePlay: 0.15},
+})
+// 消費税（カタログ価格は税込）。軽減税率の商品はRatePercentにTaxRateReducedを指定する
+taxRules := models.TaxRules{
+models.TaxProductContent:      {RatePercent: models.TaxRateStandard, Inclusive: true},
+models.TaxProductSubscription: {RatePercent: models.TaxRateStandard, Inclusive: true, StripeTaxRateID: os.Getenv("STRIPE_TAX_RATE_ID")},
+models.TaxProductOther:        {RatePercent: models.TaxRateStandard, Inclusive: true},
+}
+if err := taxRules.Validate(); err != nil {
+return nil, fmt.Errorf("invalid tax rules: %w", err)
+}
+app.PaymentService = services.NewPaymentService(paymentRepo, refundRepo, userRepo, contentRepo, app.CustomerService, app.CouponService, app.EntitlementService, taxRules)
+app.PlanService = services.NewPlanService(planRepo)
+app.ReceiptService = services.NewReceiptService(receiptRepo, userRepo, contentRepo, &services.ReceiptConfig{
+SellerName:         os.Getenv("RECEIPT_SELLER_NAME"),
+SellerAddress:      os.Getenv("RECEIPT_SELLER_ADDRESS"),
+SellerContact:      os.Getenv("RECEIPT_SELLER_CONTACT"),
+RegistrationNumber: os.Getenv("INVOICE_REGISTRATION_NUMBER"),
+})
+if os.Getenv("RECEIPT_SELLER_NAME") == "" {
+log.Println("WARNING: RECEIPT_SELLER_NAME not set. Receipts will not show the seller.")
+}
+if os.Getenv("INVOICE_REGISTRATION_NUMBER") == "" {
+log.Println("WARNING: INVOICE_REGISTRATION_NUMBER not set. Receipts will not qualify as invoices.")
+}
+purchaseVerifiers := map[string]services.PurchaseVerifier{}
+var appStoreConfig *services.AppStoreConfig
+var googlePlayNotificationConfig *services.GooglePlayNotificationConfig
+if os.Getenv("APPLE_PRIVATE_KEY_PATH") != "" {
+appStoreConfig, err = services.LoadAppStoreConfig(os.Getenv("APPLE_ISSUER_ID"), os.Getenv("APPLE_KEY_ID"), os.Getenv("APPLE_BUNDLE_ID"), os.Getenv("APPLE_PRIVATE_KEY_PATH"), os.Getenv("APPLE_ROOT_CA_PATH"))
+if err != nil {
+return nil, fmt.Errorf("failed to load App Store config: %w", err)
+}
+purchaseVerifiers[models.PurchasePlatformIOS] = services.NewAppStoreVerifier(appStoreConfig)
+} else {
+log.Println("WARNING: APPLE_PRIVATE_KEY_PATH not set. iOS purchases cannot be verified.")
+}
+if os.Getenv("GOOGLE_PLAY_CREDENTIALS_PATH") != "" {
+googlePlayVerifier, err := services.NewGooglePlayVerifier(ctx, &services.GooglePlayConfig{
+PackageName:   os.Getenv("GOOGLE_PLAY_PACKAGE_NAME"),
+ClientOptions: []option.ClientOption{option.WithCredentialsFile(os.Getenv("GOOGLE_PLAY_CREDENTIALS_PATH"))},
+})
+if err != nil {
+return nil, fmt.Errorf("failed to initialize Google Play verifier: %w", err)
+}
+purchaseVerifiers[models.PurchasePlatformAndroid] = googlePlayVerifier
+if os.Getenv("GOOGLE_PLAY_RTDN_AUDIENCE") != "" {
+googlePlayNotificationConfig = &services.GooglePlayNotificationConfig{
+PackageName:         os.Getenv("GOOGLE_PLAY_PACKAGE_NAME"),
+Audience:            os.Getenv("GOOGLE_PLAY_RTDN_AUDIENCE"),
+ServiceAccountEmail: os.Getenv("GOOGLE_PLAY_RTDN_SERVICE_ACCOUNT"),
+}
+} else {
+log.Println("WARNING: GOOGLE_PLAY_RTDN_AUDIENCE not set. Google Play notifications will be rejected.")
+}
+} else {
+log.Println("WARNING: GOOGLE_PLAY_CREDENTIALS_PATH not set. Android purchases cannot be verified.")
+}
+app.PurchaseService = services.NewPurchaseService(purchaseRepo, purchaseVerifiers, app.EntitlementService, app.LedgerService)
+app.StoreNotificationService = services.NewStoreNotificationService(webhookEventRepo, app.PurchaseService, appStoreConfig, googlePlayNotificationConfig)
+app.SubscriptionService = services.NewSubscriptionService(subRepo, app.CustomerService, app.PlanService, app.EntitlementService, purchaseRepo, trialRepo, notificationRepo, app.CouponService, &services.DunningConfig{
+GracePeriod:    7 * 24 * time.Hour,
+RetryIntervals: []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, 5 * 24 * time.Hour},
+ReminderBefore: 3 * 24 * time.Hour,
+}, taxRules)
+app.StripeWebhookService = services.NewStripeWebhookService(stripeWebhookSecret, webhookEventRepo, app.PaymentService, app.SubscriptionService, app.LedgerService)
+app.PaymentPolicy = services.NewPaymentPolicy(auditLogRepo)
+app.SubscriptionPolicy = services.NewSubscriptionPolicy(auditLogRepo)
+app.CompatibilityMatrixJob, err = services.NewCompatibilityMatrixJob(compRepo, userRepo, jobRepo, &services.CompatibilityMatrixConfig{
+ChunkSize:         200,
+CandidatesPerUser: 10,
+})
+if err != nil {
+return nil, fmt.Errorf("failed to initialize compatibility matrix job: %w", err)
+}
 // Initialize other services
 
-// 4. Initialize API Handlers
+// 5. Register scheduled jobs
+app.Scheduler = services.NewScheduler(jobRepo)
+scheduledJobs := []services.ScheduledJob{
+{Name: services.CompatibilityMatrixJobName, Schedule: "0 3 * * *", Timeout: 2 * time.Hour, Run: app.CompatibilityMatrixJob.Run},
+{Name: "compatibility-cache-cleanup", Schedule: "30 4 * * *", Timeout: 10 * time.Minute, Run: app.CompatibilityService.PurgeExpired},
+{Name: "payment-reconcile", Schedule: "*/15 * * * *", Timeout: 10 * time.Minute, Run: app.PaymentService.ReconcilePendingPayments},
+{Name: "refund-reconcile", Schedule: "*/15 * * * *", Timeout: 10 * time.Minute, Run: app.PaymentService.ReconcilePendingRefunds},
+{Name: "subscription-sweep", Schedule: "5 * * * *", Timeout: 30 * time.Minute, Run: app.SubscriptionService.SweepSubscriptions},
+}
+for _, job := range scheduledJobs {
+if err := app.Scheduler.Register(job); err != nil {
+return nil, fmt.Errorf("failed to register scheduled job: %w", err)
+}
+}
+
+// 6. Initialize API Handlers
 credentialsPath := os.Getenv("FIREBASE_CREDENTIALS_PATH")
 if credentialsPath == "" {
 credentialsPath = "path/to/your/serviceAccountKey.json" // Fallback
@@ -85,13 +219,28 @@ app.AuthAPI, err = authAPI.NewAuthHandler(ctx, credentialsPath, userRepo)
 if err != nil {
 return nil, fmt.Errorf("failed to initialize auth handler: %w", err)
 }
+messagingClient, err := app.AuthAPI.FirebaseApp().Messaging(ctx)
+if err != nil {
+return nil, fmt.Errorf("failed to initialize messaging client: %w", err)
+}
+app.NotificationDeliveryJob = services.NewNotificationDeliveryJob(notificationRepo, services.NewFCMNotificationSender(messagingClient))
+if err := app.Scheduler.Register(services.ScheduledJob{Name: services.NotificationDeliveryJobName, Schedule: "* * * * *", Timeout: 5 * time.Minute, Run: app.NotificationDeliveryJob.Run}); err != nil {
+return nil, fmt.Errorf("failed to register scheduled job: %w", err)
+}
 
 // Initialize other API handlers (assuming they exist and accept services)
 app.CompAPI = compAPI.NewCompatibilityAPI(app.CompatibilityService)
 app.ContentAPI = contentAPI.NewContentAPI(app.ContentService)
+app.CouponAPI = couponAPI.NewCouponAPI(app.CouponService, app.PlanService, app.PaymentService)
+app.LedgerAPI = ledgerAPI.NewLedgerAPI(app.LedgerService)
 app.DiagAPI = diagAPI.NewDiagnosisAPI(app.DiagnosisService)
-app.PaymentAPI = paymentAPI.NewPaymentAPI(app.PaymentService)
-app.SubscriptionAPI = subAPI.NewSubscriptionAPI(app.SubscriptionService)
+app.EntitlementAPI = entitlementAPI.NewEntitlementAPI(app.EntitlementService)
+app.PaymentAPI = paymentAPI.NewPaymentAPI(app.PaymentService, app.StripeWebhookService, app.PaymentPolicy)
+app.PaymentMethodAPI = paymentAPI.NewPaymentMethodAPI(app.CustomerService)
+app.ReceiptAPI = paymentAPI.NewReceiptAPI(app.PaymentService, app.ReceiptService, app.PaymentPolicy)
+app.PurchaseAPI = paymentAPI.NewPurchaseAPI(app.PurchaseService, app.StoreNotificationService)
+app.PlanAPI = planAPI.NewPlanAPI(app.PlanService)
+app.SubscriptionAPI = subAPI.NewSubscriptionAPI(app.SubscriptionService, app.SubscriptionPolicy)
 
 return app, nil
 }
@@ -107,6 +256,10 @@ if err != nil {
 log.Fatalf("Failed to initialize application: %v", err)
 }
 
+// Start scheduled jobs
+app.Scheduler.Start()
+defer app.Scheduler.Stop(ctx)
+
 // Gin framework initialization
 router := gin.Default()
 
@@ -124,11 +277,24 @@ authGroup := api.Group("/auth")
 app.AuthAPI.RegisterRoutes(authGroup)
 }
 
+// Webhooks are authenticated by their signatures, not Firebase tokens
+api.POST("/payments/webhook", app.PaymentAPI.HandleStripeWebhook)
+api.POST("/payments/app-store/notifications", app.PurchaseAPI.HandleAppStoreNotification)
+api.POST("/payments/google-play/notifications", app.PurchaseAPI.HandleGooglePlayNotification)
+
+// Plan catalog is public so that it can be shown before sign-in
+api.GET("/plans", app.PlanAPI.ListPlans)
+
 // --- Protected Routes ---
 protected := api.Group("/")
 // Use middleware from the initialized AuthAPI
 protected.Use(FirebaseAuthMiddleware(app.AuthAPI.FirebaseAuthClient())) // Use getter method
 {
+protected.GET("/me/entitlements", app.EntitlementAPI.GetMyEntitlements)
+protected.GET("/me/subscription", app.SubscriptionAPI.GetMySubscription)
+protected.GET("/users/:id/subscription", app.SubscriptionAPI.GetUserSubscription)
+protected.POST("/coupons/validate", app.CouponAPI.ValidateCoupon)
+
 diagnosisGroup := protected.Group("/diagnosis")
 {
 // Use methods from initialized DiagAPI
@@ -148,11 +314,21 @@ paymentGroup := protected.Group("/payments")
 {
 // Use methods from initialized PaymentAPI
 paymentGroup.POST("", app.PaymentAPI.CreatePayment) // Restore
+paymentGroup.POST("/confirm", app.PurchaseAPI.ConfirmPurchase)
 paymentGroup.GET("/:id", app.PaymentAPI.GetPayment) // Restore
+paymentGroup.GET("/:id/receipt", app.ReceiptAPI.GetReceipt)
 paymentGroup.POST("/:id/refund", app.PaymentAPI.ProcessRefund) // Restore
 paymentGroup.GET("", app.PaymentAPI.GetUserPayments) // Restore
 }
 
+paymentMethodGroup := protected.Group("/payment-methods")
+{
+paymentMethodGroup.GET("", app.PaymentMethodAPI.ListPaymentMethods)
+paymentMethodGroup.POST("/setup-intent", app.PaymentMethodAPI.CreateSetupIntent)
+paymentMethodGroup.DELETE("/:id", app.PaymentMethodAPI.DetachPaymentMethod)
+paymentMethodGroup.POST("/:id/default", app.PaymentMethodAPI.SetDefaultPaymentMethod)
+}
+
 contentGroup := protected.Group("/contents")
 {
 // Use methods from initialized ContentAPI
@@ -169,9 +345,43 @@ subscriptionGroup := protected.Group("/subscriptions")
 // Use methods from initialized SubscriptionAPI
 subscriptionGroup.POST("", app.SubscriptionAPI.CreateSubscription) // Restore
 subscriptionGroup.GET("/:id", app.SubscriptionAPI.GetSubscription) // Restore
+subscriptionGroup.PATCH("/:id", app.SubscriptionAPI.ChangePlan)
 subscriptionGroup.POST("/:id/cancel", app.SubscriptionAPI.CancelSubscription) // Restore
-// subscriptionGroup.POST("/:id/renew", app.SubscriptionAPI.RenewSubscription) // Keep commented - Service method missing
-// subscriptionGroup.GET("", app.SubscriptionAPI.GetUserSubscriptions) // Keep commented - Service method missing
+subscriptionGroup.POST("/:id/renew", app.SubscriptionAPI.RenewSubscription)
+subscriptionGroup.GET("", app.SubscriptionAPI.GetUserSubscriptions)
+}
+
+// --- Admin Routes ---
+adminGroup := protected.Group("/admin")
+adminGroup.Use(RequireRole(services.RoleAdmin))
+{
+adminPlanGroup := adminGroup.Group("/plans")
+{
+adminPlanGroup.GET("", app.PlanAPI.AdminListPlans)
+adminPlanGroup.GET("/:id", app.PlanAPI.AdminGetPlan)
+adminPlanGroup.POST("", app.PlanAPI.AdminCreatePlan)
+adminPlanGroup.PUT("/:id", app.PlanAPI.AdminUpdatePlan)
+adminPlanGroup.DELETE("/:id", app.PlanAPI.AdminRetirePlan)
+}
+
+adminSubscriptionGroup := adminGroup.Group("/subscriptions")
+{
+adminSubscriptionGroup.POST("/:id/cancel", app.SubscriptionAPI.AdminCancelSubscription)
+}
+
+adminCouponGroup := adminGroup.Group("/coupons")
+{
+adminCouponGroup.GET("", app.CouponAPI.AdminListCoupons)
+adminCouponGroup.POST("", app.CouponAPI.AdminCreateCoupon)
+adminCouponGroup.POST("/:code/deactivate", app.CouponAPI.AdminDeactivateCoupon)
+adminCouponGroup.GET("/:code/redemptions", app.CouponAPI.AdminListRedemptions)
+}
+
+adminLedgerGroup := adminGroup.Group("/ledger")
+{
+adminLedgerGroup.GET("/summary", app.LedgerAPI.AdminMonthlySummary)
+adminLedgerGroup.GET("/export", app.LedgerAPI.AdminExportCSV)
+}
 }
 }
 }
@@ -206,6 +416,18 @@ func FirebaseAuthMiddleware(authClient *auth.Client) gin.HandlerFunc {
 
 		// Set UID in context for use by handlers
 		c.Set("uid", token.UID)
+		c.Set(services.PrincipalContextKey, services.PrincipalFromClaims(token.UID, token.Claims))
+		c.Next()
+	}
+}
+
+// RequireRole rejects principals that have none of the given roles
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if p := services.PrincipalFromContext(c); p == nil || !p.HasRole(roles...) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
 		c.Next()
 	}
 }
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditDecision represents the outcome recorded in an audit log
+const (
+	AuditDecisionDenied = "denied"
+)
+
+// AuditLog records access decisions on protected resources
+type AuditLog struct {
+	ID           uint      `json:"id" gorm:"primaryKey"`
+	ActorUID     string    `json:"actor_uid" gorm:"index"` // Firebase UID of the requester
+	Action       string    `json:"action"`                 // e.g. "payment.refund"
+	ResourceType string    `json:"resource_type" gorm:"index:idx_audit_resource"`
+	ResourceID   string    `json:"resource_id" gorm:"index:idx_audit_resource"`
+	Decision     string    `json:"decision"`
+	Reason       string    `json:"reason"`
+	CreatedAt    time.Time `json:"created_at" gorm:"index"`
+}
@@ -17,6 +17,16 @@ type Compatibility struct {
 	ExpiresAt   time.Time            // 相性診断の有効期限
 }
 
+// DailyMatch 日替わり相性の事前計算結果（夜間バッチで生成）
+type DailyMatch struct {
+	gorm.Model
+	UserID      uint      `gorm:"not null;uniqueIndex:idx_daily_match_rank"`
+	MatchDate   time.Time `gorm:"type:date;not null;uniqueIndex:idx_daily_match_rank"`
+	Rank        int       `gorm:"not null;uniqueIndex:idx_daily_match_rank"` // 1が最も相性の良い候補
+	CandidateID uint      `gorm:"not null"`
+	Score       float64   `gorm:"type:decimal(5,2);not null"`
+}
+
 // CompatibilityDetails 相性の詳細スコア
 type CompatibilityDetails struct {
 	ValueScore     float64 `gorm:"type:decimal(5,2)"` // 価値観の一致度
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 )
@@ -11,10 +12,11 @@ type Content struct {
 	Title       string    `json:"title"`
 	Description string    `json:"description"`
 	Type        string    `json:"type"`
-	Price       float64   `json:"price"`
+	Price       Money     `json:"price" gorm:"embedded;embeddedPrefix:price_"`
 	Status      string    `json:"status"`
-	MediaURL    string    `json:"media_url"`
+	MediaURL    string    `json:"media_url,omitempty"` // ロック中は返さない
 	AccessLevel string    `json:"access_level"`
+	Locked      bool      `json:"locked" gorm:"-"` // 閲覧権限がなく、ティーザーとして返す場合にtrue
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
 }
@@ -40,6 +42,17 @@ const (
 	AccessLevelSubscribers = "subscribers"
 )
 
+// IsListed reports whether users other than admins can see the content; drafts and archived items are hidden
+func (c *Content) IsListed() bool {
+	return c.Status != ContentStatusDraft && c.Status != ContentStatusArchived
+}
+
+// Lock turns the content into a teaser for a user without access, hiding its media
+func (c *Content) Lock() {
+	c.MediaURL = ""
+	c.Locked = true
+}
+
 // Validate performs validation on Content fields
 func (c *Content) Validate() error {
 	if c.Title == "" {
@@ -48,7 +61,7 @@ func (c *Content) Validate() error {
 	if c.MediaURL == "" {
 		return ErrInvalidURL
 	}
-	if c.Price < 0 {
+	if c.Price.Minor < 0 {
 		return ErrInvalidPrice
 	}
 	return nil
@@ -66,3 +79,42 @@ type ContentFilter struct {
 	Type   string `form:"type"`
 	Status string `form:"status"`
 }
+
+// MarshalJSON keeps the price as a decimal number with a top-level currency for existing clients
+func (c Content) MarshalJSON() ([]byte, error) {
+	type alias Content
+	return json.Marshal(struct {
+		alias
+		Price      float64 `json:"price"`
+		PriceMinor int64   `json:"price_minor"`
+		Currency   string  `json:"currency"`
+	}{
+		alias:      alias(c),
+		Price:      c.Price.Major(),
+		PriceMinor: c.Price.Minor,
+		Currency:   c.Price.Currency,
+	})
+}
+
+// UnmarshalJSON accepts a decimal price; the currency defaults to DefaultCurrency when omitted
+func (c *Content) UnmarshalJSON(data []byte) error {
+	type alias Content
+	aux := struct {
+		*alias
+		Price    float64 `json:"price"`
+		Currency string  `json:"currency"`
+	}{alias: (*alias)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Currency == "" {
+		aux.Currency = DefaultCurrency
+	}
+
+	price, err := NewMoneyFromMajor(aux.Price, aux.Currency)
+	if err != nil {
+		return err
+	}
+	c.Price = price
+	return nil
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// CouponDiscountType represents how a coupon reduces the price
+const (
+	CouponDiscountPercent = "percent" // 割引率
+	CouponDiscountFixed   = "fixed"   // 定額割引
+)
+
+// CouponDuration represents how many subscription invoices a coupon discounts
+const (
+	CouponDurationOnce      = "once"
+	CouponDurationRepeating = "repeating"
+	CouponDurationForever   = "forever"
+)
+
+// CouponRedemptionStatus represents the status of a coupon redemption
+const (
+	CouponRedemptionStatusRedeemed = "redeemed"
+	CouponRedemptionStatusReleased = "released" // 決済が成立せず利用枠を戻した
+)
+
+// Coupon represents a promo code for campaigns
+type Coupon struct {
+	ID                    string     `json:"id" gorm:"primaryKey"`
+	Code                  string     `json:"code" gorm:"not null;uniqueIndex"` // 大文字で保存
+	Description           string     `json:"description"`
+	DiscountType          string     `json:"discount_type" gorm:"not null"`
+	PercentOff            int        `json:"percent_off"`                                           // 1〜100（percentのみ）
+	AmountOff             Money      `json:"amount_off" gorm:"embedded;embeddedPrefix:amount_off_"` // fixedのみ
+	Duration              string     `json:"duration"`                                              // サブスクリプションで割引する期間
+	DurationInMonths      int        `json:"duration_in_months"`                                    // repeatingのみ
+	MaxRedemptions        int        `json:"max_redemptions"`                                       // 0は無制限
+	MaxRedemptionsPerUser int        `json:"max_redemptions_per_user"`                              // 0は無制限
+	RedeemedCount         int        `json:"redeemed_count"`
+	ValidFrom             *time.Time `json:"valid_from"`
+	ValidUntil            *time.Time `json:"valid_until"`
+	PlanIDs               []string   `json:"plan_ids" gorm:"serializer:json"` // 空の場合は全プランと単品購入に適用
+	StripeCouponID        string     `json:"-"`
+	Active                bool       `json:"active" gorm:"index"`
+	CreatedAt             time.Time  `json:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at"`
+}
+
+// CouponRedemption records one use of a coupon, for limits and campaign reporting
+type CouponRedemption struct {
+	ID             string    `json:"id" gorm:"primaryKey"`
+	CouponID       string    `json:"coupon_id" gorm:"not null;index"`
+	UserID         string    `json:"user_id" gorm:"not null;index"`
+	PaymentID      string    `json:"payment_id,omitempty" gorm:"index"`
+	SubscriptionID string    `json:"subscription_id,omitempty" gorm:"index"`
+	Discount       Money     `json:"discount" gorm:"embedded;embeddedPrefix:discount_"` // 単品購入・初回請求での割引額
+	Status         string    `json:"status" gorm:"not null"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Common errors for Coupon model
+var (
+	ErrInvalidCouponCode     = errors.New("coupon code must be 3 to 32 letters, digits, '-' or '_'")
+	ErrInvalidCouponDiscount = errors.New("coupon needs a percent_off between 1 and 100 or a positive amount_off")
+	ErrInvalidCouponDuration = errors.New("invalid coupon duration")
+	ErrInvalidCouponLimits   = errors.New("coupon limits cannot be negative")
+	ErrInvalidCouponWindow   = errors.New("valid_until must be after valid_from")
+	ErrCouponExhausted       = errors.New("coupon has reached its redemption limit")
+	ErrCouponAlreadyUsed     = errors.New("coupon has already been used by this user")
+)
+
+// NormalizeCouponCode makes codes case-insensitive
+func NormalizeCouponCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate performs validation checks on the coupon
+func (c *Coupon) Validate() error {
+	if len(c.Code) < 3 || len(c.Code) > 32 {
+		return ErrInvalidCouponCode
+	}
+	for _, r := range c.Code {
+		if !(r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return ErrInvalidCouponCode
+		}
+	}
+
+	switch c.DiscountType {
+	case CouponDiscountPercent:
+		if c.PercentOff < 1 || c.PercentOff > 100 {
+			return ErrInvalidCouponDiscount
+		}
+	case CouponDiscountFixed:
+		if c.AmountOff.Minor <= 0 {
+			return ErrInvalidCouponDiscount
+		}
+		if !isCurrencyCode(c.AmountOff.Currency) {
+			return ErrInvalidCurrency
+		}
+	default:
+		return ErrInvalidCouponDiscount
+	}
+
+	switch c.Duration {
+	case CouponDurationOnce, CouponDurationForever:
+	case CouponDurationRepeating:
+		if c.DurationInMonths <= 0 {
+			return ErrInvalidCouponDuration
+		}
+	default:
+		return ErrInvalidCouponDuration
+	}
+
+	if c.MaxRedemptions < 0 || c.MaxRedemptionsPerUser < 0 {
+		return ErrInvalidCouponLimits
+	}
+	if c.ValidFrom != nil && c.ValidUntil != nil && !c.ValidUntil.After(*c.ValidFrom) {
+		return ErrInvalidCouponWindow
+	}
+	return nil
+}
+
+// IsValidAt reports whether the coupon can be redeemed at the given time, ignoring usage limits
+func (c *Coupon) IsValidAt(now time.Time) bool {
+	if !c.Active {
+		return false
+	}
+	if c.ValidFrom != nil && now.Before(*c.ValidFrom) {
+		return false
+	}
+	return c.ValidUntil == nil || now.Before(*c.ValidUntil)
+}
+
+// AppliesToPlan reports whether the coupon can be used for the plan; "" is a one-off purchase
+func (c *Coupon) AppliesToPlan(planID string) bool {
+	if len(c.PlanIDs) == 0 {
+		return true
+	}
+	for _, id := range c.PlanIDs {
+		if id == planID {
+			return true
+		}
+	}
+	return false
+}
+
+// Discount returns how much the coupon takes off the amount, never more than the amount itself.
+// ok is false when a fixed discount is in another currency.
+func (c *Coupon) Discount(amount Money) (discount Money, ok bool) {
+	switch c.DiscountType {
+	case CouponDiscountPercent:
+		return Money{Minor: amount.Minor * int64(c.PercentOff) / 100, Currency: amount.Currency}, true
+	case CouponDiscountFixed:
+		if c.AmountOff.Currency != amount.Currency {
+			return Money{}, false
+		}
+		off := c.AmountOff.Minor
+		if off > amount.Minor {
+			off = amount.Minor
+		}
+		return Money{Minor: off, Currency: amount.Currency}, true
+	}
+	return Money{}, false
+}
+
+// MarshalJSON renders the fixed discount in the same decimal format as Payment
+func (c Coupon) MarshalJSON() ([]byte, error) {
+	type alias Coupon
+	return json.Marshal(struct {
+		alias
+		AmountOff      float64 `json:"amount_off"`
+		AmountOffMinor int64   `json:"amount_off_minor"`
+		Currency       string  `json:"currency,omitempty"`
+	}{
+		alias:          alias(c),
+		AmountOff:      c.AmountOff.Major(),
+		AmountOffMinor: c.AmountOff.Minor,
+		Currency:       c.AmountOff.Currency,
+	})
+}
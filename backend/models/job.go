@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+)
+
+// JobStatus represents the status of a batch job
+const (
+	JobStatusRunning   = "running"
+	JobStatusSucceeded = "succeeded"
+	JobStatusFailed    = "failed"
+)
+
+// JobProgress バッチジョブの進捗（クラッシュ後の再開に使用）
+type JobProgress struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	JobName    string     `json:"job_name" gorm:"not null;uniqueIndex:idx_job_progress_run"`
+	RunKey     string     `json:"run_key" gorm:"not null;uniqueIndex:idx_job_progress_run"` // 実行単位（対象日など）
+	Status     string     `json:"status" gorm:"not null"`
+	Cursor     uint       `json:"cursor"` // 処理済みの最後のユーザーID
+	Processed  int        `json:"processed"`
+	Total      int        `json:"total"`
+	LastError  string     `json:"last_error" gorm:"type:text"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// JobRun スケジューラーによるジョブ実行履歴。
+// 予定時刻ごとに1行だけ作成でき、同じ回を複数のレプリカが実行しないようにする。
+type JobRun struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	JobName     string     `json:"job_name" gorm:"not null;uniqueIndex:idx_job_runs_schedule"`
+	ScheduledAt time.Time  `json:"scheduled_at" gorm:"not null;uniqueIndex:idx_job_runs_schedule"` // cronの予定時刻
+	Instance    string     `json:"instance"`                                                       // 実行したレプリカ
+	Status      string     `json:"status" gorm:"not null"`
+	Error       string     `json:"error" gorm:"type:text"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
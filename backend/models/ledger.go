@@ -0,0 +1,93 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// LedgerSource represents the billing system a ledger entry was reported by
+const (
+	LedgerSourceStripe     = "stripe"
+	LedgerSourceAppStore   = "app_store"
+	LedgerSourceGooglePlay = "google_play"
+)
+
+// LedgerEntryType represents the kind of money movement
+const (
+	LedgerEntryCharge          = "charge"
+	LedgerEntryRefund          = "refund"
+	LedgerEntryDispute         = "dispute"
+	LedgerEntryDisputeReversal = "dispute_reversal" // チャージバックで勝訴し戻った金額
+	LedgerEntryFee             = "fee"
+	LedgerEntryFeeReversal     = "fee_reversal"
+)
+
+// LedgerReference represents the local record a ledger entry belongs to
+const (
+	LedgerReferencePayment      = "payment"
+	LedgerReferenceSubscription = "subscription"
+	LedgerReferencePurchase     = "purchase"
+)
+
+// LedgerEntry is an append-only record of money moving through one of the billing systems.
+// Entries are never updated; corrections are recorded as new entries of the opposite sign.
+type LedgerEntry struct {
+	ID            uint      `json:"id" gorm:"primaryKey"`
+	Source        string    `json:"source" gorm:"not null;uniqueIndex:idx_ledger_source_ref"`
+	Type          string    `json:"type" gorm:"not null;uniqueIndex:idx_ledger_source_ref"`
+	SourceRef     string    `json:"source_ref" gorm:"not null;uniqueIndex:idx_ledger_source_ref"` // Stripeのch_/re_/dp_ IDやストアの取引ID
+	Amount        Money     `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`                // 入金はプラス、返金・手数料はマイナス
+	UserID        string    `json:"user_id,omitempty" gorm:"index"`
+	ReferenceType string    `json:"reference_type,omitempty" gorm:"index:idx_ledger_reference"`
+	ReferenceID   string    `json:"reference_id,omitempty" gorm:"index:idx_ledger_reference"`
+	Estimated     bool      `json:"estimated"` // ストアの手数料など、実額ではなく料率から算出した金額
+	Description   string    `json:"description,omitempty"`
+	OccurredAt    time.Time `json:"occurred_at" gorm:"index"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Common errors for LedgerEntry model
+var (
+	ErrInvalidLedgerEntry = errors.New("ledger entry must have a source, type and source reference")
+	ErrInvalidLedgerSign  = errors.New("ledger entry amount has the wrong sign for its type")
+)
+
+// IsLedgerCredit reports whether entries of the type add to revenue
+func IsLedgerCredit(entryType string) bool {
+	switch entryType {
+	case LedgerEntryCharge, LedgerEntryDisputeReversal, LedgerEntryFeeReversal:
+		return true
+	}
+	return false
+}
+
+// Validate performs validation checks on the ledger entry
+func (e *LedgerEntry) Validate() error {
+	if e.Source == "" || e.Type == "" || e.SourceRef == "" {
+		return ErrInvalidLedgerEntry
+	}
+	if !isCurrencyCode(e.Amount.Currency) {
+		return ErrInvalidCurrency
+	}
+	if IsLedgerCredit(e.Type) != (e.Amount.Minor >= 0) {
+		return ErrInvalidLedgerSign
+	}
+	return nil
+}
+
+// MarshalJSON renders the amount in the same decimal format as Payment
+func (e LedgerEntry) MarshalJSON() ([]byte, error) {
+	type alias LedgerEntry
+	return json.Marshal(struct {
+		alias
+		Amount      float64 `json:"amount"`
+		AmountMinor int64   `json:"amount_minor"`
+		Currency    string  `json:"currency"`
+	}{
+		alias:       alias(e),
+		Amount:      e.Amount.Major(),
+		AmountMinor: e.Amount.Minor,
+		Currency:    e.Amount.Currency,
+	})
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// DefaultCurrency is used for amounts stored before a currency was recorded
+const DefaultCurrency = "JPY"
+
+// Money represents an amount in the minor unit of its ISO 4217 currency
+type Money struct {
+	Minor    int64  `json:"minor" gorm:"column:minor"`
+	Currency string `json:"currency" gorm:"column:currency;size:3"`
+}
+
+// Common errors for Money
+var (
+	ErrInvalidCurrency       = errors.New("currency must be a 3-letter ISO 4217 code")
+	ErrInvalidMoneyPrecision = errors.New("amount has more decimal places than the currency allows")
+)
+
+// currencyExponents lists currencies whose minor unit is not 1/100 of the major unit.
+// ゼロ小数通貨（JPYなど）は最小単位がそのまま主単位になる。
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"MGA": 0, "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "JOD": 3, "KWD": 3, "OMR": 3, "TND": 3,
+}
+
+// CurrencyExponent returns the number of decimal places of the currency's minor unit
+func CurrencyExponent(currency string) int {
+	if exp, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return exp
+	}
+	return 2
+}
+
+// NewMoney creates Money from an amount in minor units
+func NewMoney(minor int64, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	if !isCurrencyCode(currency) {
+		return Money{}, ErrInvalidCurrency
+	}
+	return Money{Minor: minor, Currency: currency}, nil
+}
+
+// NewMoneyFromMajor converts a decimal amount such as 12.34 into Money.
+// Amounts finer than the currency's minor unit are rejected instead of rounded.
+func NewMoneyFromMajor(amount float64, currency string) (Money, error) {
+	currency = strings.ToUpper(currency)
+	if !isCurrencyCode(currency) {
+		return Money{}, ErrInvalidCurrency
+	}
+	scaled := amount * math.Pow10(CurrencyExponent(currency))
+	minor := math.Round(scaled)
+	if math.Abs(scaled-minor) > 1e-6 {
+		return Money{}, ErrInvalidMoneyPrecision
+	}
+	return Money{Minor: int64(minor), Currency: currency}, nil
+}
+
+// Major returns the amount in major units, for display and backward-compatible JSON
+func (m Money) Major() float64 {
+	return float64(m.Minor) / math.Pow10(CurrencyExponent(m.Currency))
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Minor == 0
+}
+
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCurrencyExponent(t *testing.T) {
+	tests := []struct {
+		currency string
+		want     int
+	}{
+		{"JPY", 0},
+		{"jpy", 0},
+		{"KRW", 0},
+		{"USD", 2},
+		{"EUR", 2},
+		{"KWD", 3},
+		{"BHD", 3},
+		{"XYZ", 2}, // 未知の通貨は2桁とみなす
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, CurrencyExponent(tt.currency), tt.currency)
+	}
+}
+
+func TestNewMoneyFromMajor(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		currency string
+		want     Money
+		wantErr  error
+	}{
+		{"円はそのまま", 1200, "JPY", Money{Minor: 1200, Currency: "JPY"}, nil},
+		{"通貨コードは大文字にする", 500, "jpy", Money{Minor: 500, Currency: "JPY"}, nil},
+		{"円の小数は拒否", 1200.5, "JPY", Money{}, ErrInvalidMoneyPrecision},
+		{"ドルはセント", 12.34, "USD", Money{Minor: 1234, Currency: "USD"}, nil},
+		{"浮動小数の誤差は丸める", 0.29, "USD", Money{Minor: 29, Currency: "USD"}, nil},
+		{"浮動小数の誤差は丸める（加算）", 0.1 + 0.2, "USD", Money{Minor: 30, Currency: "USD"}, nil},
+		{"セント未満は拒否", 12.345, "USD", Money{}, ErrInvalidMoneyPrecision},
+		{"3桁通貨", 1.234, "KWD", Money{Minor: 1234, Currency: "KWD"}, nil},
+		{"3桁通貨の4桁目は拒否", 1.2345, "KWD", Money{}, ErrInvalidMoneyPrecision},
+		{"負の金額", -3.5, "USD", Money{Minor: -350, Currency: "USD"}, nil},
+		{"不正な通貨コード", 100, "JP", Money{}, ErrInvalidCurrency},
+		{"英字以外の通貨コード", 100, "J1Y", Money{}, ErrInvalidCurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMoneyFromMajor(tt.amount, tt.currency)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMoneyMajor(t *testing.T) {
+	assert.Equal(t, 1200.0, Money{Minor: 1200, Currency: "JPY"}.Major())
+	assert.Equal(t, 12.34, Money{Minor: 1234, Currency: "USD"}.Major())
+	assert.Equal(t, 1.234, Money{Minor: 1234, Currency: "KWD"}.Major())
+}
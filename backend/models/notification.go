@@ -0,0 +1,39 @@
+package models
+
+import (
+	"time"
+)
+
+// NotificationType represents the kind of user notification
+const (
+	NotificationTypeSubscriptionPaymentFailed = "subscription.payment_failed" // 更新時の支払いに失敗
+	NotificationTypeSubscriptionGraceEnding   = "subscription.grace_ending"   // 猶予期間の終了が近い
+	NotificationTypeSubscriptionExpiring      = "subscription.expiring"       // 解約済みの契約の期間終了が近い
+	NotificationTypeSubscriptionExpired       = "subscription.expired"        // 利用期間が終了した
+	NotificationTypeSubscriptionTrialEnding   = "subscription.trial_ending"   // 無料トライアルの終了が近い
+)
+
+// NotificationStatus represents the delivery status of a notification
+const (
+	NotificationStatusPending = "pending"
+	NotificationStatusSent    = "sent"
+	NotificationStatusFailed  = "failed" // 再試行を打ち切った
+)
+
+// NotificationEvent is an outbox entry for a notification to the user.
+// Events are written right after the state change that caused them is saved, and delivered by the notification delivery job.
+type NotificationEvent struct {
+	ID            uint       `json:"id" gorm:"primaryKey"`
+	UserID        string     `json:"user_id" gorm:"not null;index"`
+	Type          string     `json:"type" gorm:"not null"`
+	ResourceType  string     `json:"resource_type"`
+	ResourceID    string     `json:"resource_id"`
+	DeadlineAt    *time.Time `json:"deadline_at"`                   // 利用できなくなる日時など
+	DedupeKey     string     `json:"-" gorm:"not null;uniqueIndex"` // 同じ通知を二重に作らないためのキー
+	Status        string     `json:"status" gorm:"not null;index;default:pending"`
+	Attempts      int        `json:"attempts"`        // 失敗した配信の回数
+	NextAttemptAt *time.Time `json:"next_attempt_at"` // 次に配信を試みる日時
+	LastError     string     `json:"last_error" gorm:"type:text"`
+	SentAt        *time.Time `json:"sent_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
@@ -1,16 +1,20 @@
 package models
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 )
 
 // PaymentStatus represents the status of a payment
 const (
-	PaymentStatusPending   = "pending"
-	PaymentStatusSucceeded = "succeeded"
-	PaymentStatusFailed    = "failed"
-	PaymentStatusRefunded  = "refunded"
+	PaymentStatusPending           = "pending"
+	PaymentStatusSucceeded         = "succeeded"
+	PaymentStatusFailed            = "failed"
+	PaymentStatusPartiallyRefunded = "partially_refunded"
+	PaymentStatusRefunded          = "refunded"
+	PaymentStatusDisputed          = "disputed"
+	PaymentStatusCanceled          = "canceled"
 )
 
 // PaymentMethod represents the method used for payment
@@ -22,15 +26,22 @@ const (
 
 // Payment represents a payment transaction
 type Payment struct {
-	ID            string    `json:"id" gorm:"primaryKey"`
-	UserID        string    `json:"user_id" gorm:"index"`
-	Amount        float64   `json:"amount"`
-	Currency      string    `json:"currency"`
-	Status        string    `json:"status"`
-	PaymentMethod string    `json:"payment_method"`
-	StripeID      string    `json:"stripe_id" gorm:"index"` // Store Stripe PaymentIntent ID
-	CreatedAt     time.Time `json:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at"`
+	ID                    string    `json:"id" gorm:"primaryKey"`
+	UserID                string    `json:"user_id" gorm:"index"`
+	Amount                Money     `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	RefundedAmount        Money     `json:"refunded_amount" gorm:"embedded;embeddedPrefix:refunded_"` // 返金済みの累計額
+	Status                string    `json:"status"`
+	PaymentMethod         string    `json:"payment_method"`
+	StripeID              string    `json:"stripe_id" gorm:"index"`            // Store Stripe PaymentIntent ID
+	StripeCustomerID      string    `json:"-"`                                 // Stripe Customer the intent was created for
+	StripePaymentMethodID string    `json:"-"`                                 // Saved payment method preselected on the intent
+	ContentID             string    `json:"content_id,omitempty" gorm:"index"` // 単品購入したコンテンツ
+	CouponCode            string    `json:"coupon_code,omitempty"`
+	Discount              Money     `json:"-" gorm:"embedded;embeddedPrefix:discount_"` // Amountは割引後の金額
+	Tax                   Money     `json:"-" gorm:"embedded;embeddedPrefix:tax_"`      // Amountに含まれる消費税額
+	TaxRate               int       `json:"tax_rate"`                                   // 消費税率(%)
+	CreatedAt             time.Time `json:"created_at"`
+	UpdatedAt             time.Time `json:"updated_at"`
 }
 
 // Validate performs validation checks on the Payment struct
@@ -38,12 +49,115 @@ func (p *Payment) Validate() error {
 	if p.UserID == "" {
 		return errors.New("user ID cannot be empty")
 	}
-	if p.Amount <= 0 {
+	if p.Amount.Minor <= 0 {
 		return errors.New("amount must be positive")
 	}
-	if p.Currency == "" {
+	if p.Amount.Currency == "" {
 		return errors.New("currency cannot be empty")
 	}
 	// Add more validation as needed (e.g., check status, payment method)
 	return nil
 }
+
+// CanTransitionTo reports whether the payment may move to the given status.
+// Webhooks can arrive out of order, so a late event must not undo a later state.
+func (p *Payment) CanTransitionTo(status string) bool {
+	switch status {
+	case PaymentStatusSucceeded:
+		return p.Status == PaymentStatusPending || p.Status == PaymentStatusFailed
+	case PaymentStatusFailed, PaymentStatusCanceled:
+		return p.Status == PaymentStatusPending
+	case PaymentStatusPartiallyRefunded, PaymentStatusRefunded, PaymentStatusDisputed:
+		return p.IsCaptured()
+	}
+	return false
+}
+
+// SetPrice sets the amount to charge for the price and the consumption tax contained in it
+func (p *Payment) SetPrice(price Money, tax TaxRule) {
+	p.Amount, p.Tax = tax.Apply(price)
+	p.TaxRate = tax.RatePercent
+}
+
+// IsCaptured reports whether the funds of the payment have been captured
+func (p *Payment) IsCaptured() bool {
+	switch p.Status {
+	case PaymentStatusSucceeded, PaymentStatusPartiallyRefunded, PaymentStatusRefunded, PaymentStatusDisputed:
+		return true
+	}
+	return false
+}
+
+// SetRefundedAmount records the cumulative refunded amount in minor units and derives the refund status from it
+func (p *Payment) SetRefundedAmount(totalMinor int64) {
+	p.RefundedAmount = Money{Minor: totalMinor, Currency: p.Amount.Currency}
+	switch {
+	case totalMinor <= 0:
+		return
+	case totalMinor >= p.Amount.Minor:
+		p.Status = PaymentStatusRefunded
+	case p.Status != PaymentStatusDisputed:
+		p.Status = PaymentStatusPartiallyRefunded
+	}
+}
+
+// RemainingRefundable returns the captured amount that has not been refunded yet
+func (p *Payment) RemainingRefundable() Money {
+	return Money{Minor: p.Amount.Minor - p.RefundedAmount.Minor, Currency: p.Amount.Currency}
+}
+
+// ExceedsRefundable reports whether refunding amountMinor on top of alreadyRefundedMinor exceeds the captured amount
+func (p *Payment) ExceedsRefundable(alreadyRefundedMinor, amountMinor int64) bool {
+	return alreadyRefundedMinor+amountMinor > p.Amount.Minor
+}
+
+// MarshalJSON keeps amounts as decimal numbers with a top-level currency for existing clients
+func (p Payment) MarshalJSON() ([]byte, error) {
+	type alias Payment
+	return json.Marshal(struct {
+		alias
+		Amount         float64 `json:"amount"`
+		AmountMinor    int64   `json:"amount_minor"`
+		RefundedAmount float64 `json:"refunded_amount"`
+		Discount       float64 `json:"discount,omitempty"`
+		Tax            float64 `json:"tax"`
+		Currency       string  `json:"currency"`
+	}{
+		alias:          alias(p),
+		Amount:         p.Amount.Major(),
+		AmountMinor:    p.Amount.Minor,
+		RefundedAmount: p.RefundedAmount.Major(),
+		Discount:       p.Discount.Major(),
+		Tax:            p.Tax.Major(),
+		Currency:       p.Amount.Currency,
+	})
+}
+
+// UnmarshalJSON accepts the decimal amount format produced by MarshalJSON;
+// the currency defaults to DefaultCurrency when omitted
+func (p *Payment) UnmarshalJSON(data []byte) error {
+	type alias Payment
+	aux := struct {
+		*alias
+		Amount         float64 `json:"amount"`
+		RefundedAmount float64 `json:"refunded_amount"`
+		Currency       string  `json:"currency"`
+	}{alias: (*alias)(p)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Currency == "" {
+		aux.Currency = DefaultCurrency
+	}
+
+	amount, err := NewMoneyFromMajor(aux.Amount, aux.Currency)
+	if err != nil {
+		return err
+	}
+	refunded, err := NewMoneyFromMajor(aux.RefundedAmount, aux.Currency)
+	if err != nil {
+		return err
+	}
+	p.Amount, p.RefundedAmount = amount, refunded
+	return nil
+}
@@ -0,0 +1,36 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaymentUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantAmount   Money
+		wantRefunded Money
+		wantErr      error
+	}{
+		{"通貨の省略はデフォルト通貨", `{"amount": 1200}`, Money{Minor: 1200, Currency: DefaultCurrency}, Money{Minor: 0, Currency: DefaultCurrency}, nil},
+		{"ドルはセント", `{"amount": 12.34, "refunded_amount": 2.5, "currency": "USD"}`, Money{Minor: 1234, Currency: "USD"}, Money{Minor: 250, Currency: "USD"}, nil},
+		{"円の小数は拒否", `{"amount": 1200.5}`, Money{}, Money{}, ErrInvalidMoneyPrecision},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var payment Payment
+			err := json.Unmarshal([]byte(tt.body), &payment)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantAmount, payment.Amount)
+			assert.Equal(t, tt.wantRefunded, payment.RefundedAmount)
+		})
+	}
+}
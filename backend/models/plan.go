@@ -0,0 +1,70 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// Plan represents a subscription plan in the catalog
+type Plan struct {
+	ID                   string    `json:"id" gorm:"primaryKey"` // e.g. "premium"
+	Name                 string    `json:"name" gorm:"not null"` // 表示名
+	Description          string    `json:"description"`
+	MonthlyPrice         Money     `json:"monthly_price" gorm:"embedded;embeddedPrefix:monthly_price_"`
+	YearlyPrice          Money     `json:"yearly_price" gorm:"embedded;embeddedPrefix:yearly_price_"`
+	StripeMonthlyPriceID string    `json:"stripe_monthly_price_id"`
+	StripeYearlyPriceID  string    `json:"stripe_yearly_price_id"`
+	Entitlements         []string  `json:"entitlements" gorm:"serializer:json"`      // プランで利用できる機能
+	StoreProductIDs      []string  `json:"store_product_ids" gorm:"serializer:json"` // App Store / Google Playの対応商品ID
+	TrialDays            int       `json:"trial_days"`
+	Active               bool      `json:"active" gorm:"index"` // falseは新規契約不可（既存契約は継続）
+	SortOrder            int       `json:"sort_order"`
+	CreatedAt            time.Time `json:"created_at"`
+	UpdatedAt            time.Time `json:"updated_at"`
+}
+
+// Common errors for Plan model
+var (
+	ErrInvalidPlanName  = errors.New("plan name cannot be empty")
+	ErrPlanWithoutPrice = errors.New("plan must have a monthly or yearly price")
+	ErrInvalidTrialDays = errors.New("trial days cannot be negative")
+)
+
+// Validate performs validation checks on the plan
+func (p *Plan) Validate() error {
+	if p.ID == "" {
+		return ErrInvalidPlanID
+	}
+	if p.Name == "" {
+		return ErrInvalidPlanName
+	}
+	if p.MonthlyPrice.Minor <= 0 && p.YearlyPrice.Minor <= 0 {
+		return ErrPlanWithoutPrice
+	}
+	for _, price := range []Money{p.MonthlyPrice, p.YearlyPrice} {
+		if price.Minor < 0 {
+			return ErrInvalidAmount
+		}
+		if price.Minor > 0 && !isCurrencyCode(price.Currency) {
+			return ErrInvalidCurrency
+		}
+	}
+	if p.TrialDays < 0 {
+		return ErrInvalidTrialDays
+	}
+	return nil
+}
+
+// Price returns the price and Stripe price ID for a billing cycle.
+// ok is false when the plan is not sold for that cycle.
+func (p *Plan) Price(billingCycle string) (price Money, stripePriceID string, ok bool) {
+	switch billingCycle {
+	case BillingCycleMonthly:
+		price, stripePriceID = p.MonthlyPrice, p.StripeMonthlyPriceID
+	case BillingCycleYearly:
+		price, stripePriceID = p.YearlyPrice, p.StripeYearlyPriceID
+	default:
+		return Money{}, "", false
+	}
+	return price, stripePriceID, price.Minor > 0
+}
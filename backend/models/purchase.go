@@ -1,25 +1,42 @@
 package models
 
 import (
-	"errors"
 	"time"
 
 	"github.com/go-playground/validator/v10"
-	"gorm.io/gorm"
+)
+
+// PurchasePlatform represents the store a purchase was made in
+const (
+	PurchasePlatformIOS     = "ios"
+	PurchasePlatformAndroid = "android"
 )
 
 // Purchase represents a purchase transaction (Apple In-App Purchase or Google Play Billing)
 type Purchase struct {
-	ID          uint      `json:"id" gorm:"primaryKey"`               // 自動採番されるID
-	UserID      string    `json:"user_id" gorm:"index"`               // ユーザーID (Firebase AuthenticationのUID)
-	ProductID   string    `json:"product_id" gorm:"index"`            // 商品ID (App Store Connect/Google Play Consoleで設定)
-	PurchaseID  string    `json:"purchase_id" gorm:"unique;not null"` // 購入ID (レシートから取得、重複を防ぐためにunique)
-	Platform    string    `json:"platform"`                           // "ios" or "android"
-	Receipt     string    `json:"receipt"`                            // レシートデータ (検証のために保存)
-	PurchasedAt time.Time `json:"purchased_at"`                       // 購入日時
-	ExpiresAt   time.Time `json:"expires_at" gorm:"index"`            // 有効期限 (サブスクリプションの場合)
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID                 uint       `json:"id" gorm:"primaryKey"`                        // 自動採番されるID
+	UserID             string     `json:"user_id" gorm:"index"`                        // ユーザーID (Firebase AuthenticationのUID)
+	ProductID          string     `json:"product_id" gorm:"index"`                     // 商品ID (App Store Connect/Google Play Consoleで設定)
+	PurchaseID         string     `json:"purchase_id" gorm:"unique;not null"`          // 購入ID (レシートから取得、重複を防ぐためにunique)
+	OriginalPurchaseID string     `json:"original_purchase_id" gorm:"index"`           // 更新をまたいで変わらない元の購入ID
+	Platform           string     `json:"platform"`                                    // "ios" or "android"
+	Environment        string     `json:"environment,omitempty"`                       // ストアの環境 (Production/Sandbox)
+	Receipt            string     `json:"-"`                                           // レシートデータ (検証のために保存)
+	PurchasedAt        time.Time  `json:"purchased_at"`                                // 購入日時
+	ExpiresAt          time.Time  `json:"expires_at" gorm:"index"`                     // 有効期限 (サブスクリプションの場合)
+	RevokedAt          *time.Time `json:"revoked_at,omitempty"`                        // 返金・ファミリー共有の解除などで取り消された日時
+	AutoRenew          *bool      `json:"auto_renew,omitempty"`                        // 自動更新の設定 (不明な場合はnil)
+	Price              Money      `json:"price" gorm:"embedded;embeddedPrefix:price_"` // ストアが報告した支払額 (不明な場合はゼロ)
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
+// IsActiveAt reports whether the purchase grants access at the given time; a zero ExpiresAt never expires
+func (p *Purchase) IsActiveAt(now time.Time) bool {
+	if p.RevokedAt != nil {
+		return false
+	}
+	return p.ExpiresAt.IsZero() || p.ExpiresAt.After(now)
 }
 
 // Validate performs validation on Purchase fields
@@ -27,31 +44,3 @@ func (p *Purchase) Validate() error {
 	validate := validator.New()
 	return validate.Struct(p)
 }
-
-// BeforeCreate is a GORM hook that runs before creating a new purchase
-func (p *Purchase) BeforeCreate(tx *gorm.DB) error {
-	p.CreatedAt = time.Now()
-	p.UpdatedAt = time.Now()
-	if err := p.Validate(); err != nil {
-		return err
-	}
-	// 重複チェックをここで行うことも可能 (purchase_id がuniqueの場合)
-	var existingPurchase Purchase
-	if err := tx.Where("purchase_id = ?", p.PurchaseID).First(&existingPurchase).Error; err == nil {
-		// 既に同じ purchase_id が存在する場合は、エラーを返す (または更新処理を行う)
-		// return errors.New("duplicated purchase_id")
-
-		// 更新
-		p.ID = existingPurchase.ID
-		return tx.Model(&Purchase{}).Where("purchase_id = ?", p.PurchaseID).Updates(p).Error
-	} else if !errors.Is(err, gorm.ErrRecordNotFound) { // レコードが存在しない以外のエラー
-		return err
-	}
-	return nil
-}
-
-// BeforeUpdate is a GORM hook that runs before updating a purchase
-func (p *Purchase) BeforeUpdate() error {
-	p.UpdatedAt = time.Now()
-	return p.Validate() // 更新時にもバリデーション
-}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// ReceiptNumberPrefix is the prefix of receipt numbers, e.g. KY-2026-000123
+const ReceiptNumberPrefix = "KY"
+
+// Receipt is a 領収書 issued for a Stripe payment.
+// The seller and the amounts are copied at issue time so that re-downloads stay identical to the first issue.
+type Receipt struct {
+	ID                 string    `json:"id" gorm:"primaryKey"`
+	Number             string    `json:"number" gorm:"uniqueIndex;not null"`
+	PaymentID          string    `json:"payment_id" gorm:"uniqueIndex;not null"` // 1件の支払いに発行する領収書は1通
+	UserID             string    `json:"user_id" gorm:"index"`
+	RecipientName      string    `json:"recipient_name"`                                // 宛名、不明な場合は空
+	Description        string    `json:"description"`                                   // 但し書き
+	Amount             Money     `json:"amount" gorm:"embedded;embeddedPrefix:amount_"` // 税込の受領額
+	TaxRate            int       `json:"tax_rate"`                                      // 消費税率(%)
+	TaxAmount          Money     `json:"tax_amount" gorm:"embedded;embeddedPrefix:tax_"`
+	SellerName         string    `json:"seller_name"`
+	SellerAddress      string    `json:"seller_address"`
+	SellerContact      string    `json:"seller_contact"`
+	RegistrationNumber string    `json:"registration_number"` // 適格請求書発行事業者登録番号
+	IssuedAt           time.Time `json:"issued_at"`
+	PDF                []byte    `json:"-"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+// ReceiptSequence holds the last receipt number used in a year; numbers restart from 1 every year
+type ReceiptSequence struct {
+	Year       int   `gorm:"primaryKey;autoIncrement:false"`
+	LastNumber int64 `gorm:"not null"`
+}
+
+// ReceiptNumber formats the n-th receipt number of the year
+func ReceiptNumber(year int, n int64) string {
+	return fmt.Sprintf("%s-%d-%06d", ReceiptNumberPrefix, year, n)
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// RefundStatus represents the status of a refund
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusSucceeded = "succeeded"
+	RefundStatusFailed    = "failed"
+	RefundStatusCanceled  = "canceled"
+)
+
+// RefundReason represents the reason codes accepted by Stripe
+const (
+	RefundReasonDuplicate           = "duplicate"
+	RefundReasonFraudulent          = "fraudulent"
+	RefundReasonRequestedByCustomer = "requested_by_customer"
+)
+
+// Refund represents a single Stripe refund against a payment
+type Refund struct {
+	ID             string    `json:"id" gorm:"primaryKey"`
+	PaymentID      string    `json:"payment_id" gorm:"index"`
+	StripeRefundID *string   `json:"stripe_refund_id" gorm:"uniqueIndex"` // 返金確定前はNULL
+	Amount         Money     `json:"amount" gorm:"embedded;embeddedPrefix:amount_"`
+	Reason         string    `json:"reason"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Common errors for Refund model
+var (
+	ErrInvalidRefundAmount  = errors.New("refund amount must be positive")
+	ErrInvalidRefundReason  = errors.New("invalid refund reason")
+	ErrRefundExceedsPayment = errors.New("refund amount exceeds the refundable balance")
+	ErrPaymentNotRefundable = errors.New("payment cannot be refunded as it has not succeeded")
+)
+
+// Validate performs validation checks on the refund
+func (r *Refund) Validate() error {
+	if r.Amount.Minor <= 0 {
+		return ErrInvalidRefundAmount
+	}
+	switch r.Reason {
+	case "", RefundReasonDuplicate, RefundReasonFraudulent, RefundReasonRequestedByCustomer:
+		return nil
+	}
+	return ErrInvalidRefundReason
+}
+
+// MarshalJSON renders the amount in the same decimal format as Payment
+func (r Refund) MarshalJSON() ([]byte, error) {
+	type alias Refund
+	return json.Marshal(struct {
+		alias
+		Amount      float64 `json:"amount"`
+		AmountMinor int64   `json:"amount_minor"`
+		Currency    string  `json:"currency"`
+	}{
+		alias:       alias(r),
+		Amount:      r.Amount.Major(),
+		AmountMinor: r.Amount.Minor,
+		Currency:    r.Amount.Currency,
+	})
+}
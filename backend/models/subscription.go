@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"errors"
 	"time"
 
@@ -9,28 +10,110 @@ import (
 
 // Subscription represents a user's subscription
 type Subscription struct {
-	ID           string    `json:"id" gorm:"primaryKey"`
-	UserID       string    `json:"user_id" gorm:"index"`
-	PlanID       string    `json:"plan_id"`
-	Status       string    `json:"status"`
-	StartDate    time.Time `json:"start_date"`
-	EndDate      time.Time `json:"end_date"`
-	BillingCycle string    `json:"billing_cycle"`
-	Amount       float64   `json:"amount"`
-	AutoRenew    bool      `json:"auto_renew"`
-	StripeSubID  string    `json:"stripe_subscription_id"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID           string     `json:"id" gorm:"primaryKey"`
+	UserID       string     `json:"user_id" gorm:"index"`
+	PlanID       string     `json:"plan_id"`
+	Status       string     `json:"status"`
+	StartDate    time.Time  `json:"start_date"`
+	EndDate      time.Time  `json:"end_date"`
+	BillingCycle string     `json:"billing_cycle"`
+	Amount       Money      `json:"amount" gorm:"embedded;embeddedPrefix:amount_"` // 1回あたりの税込請求額
+	Tax          Money      `json:"-" gorm:"embedded;embeddedPrefix:tax_"`         // Amountに含まれる消費税額
+	TaxRate      int        `json:"tax_rate"`                                      // 消費税率(%)
+	Discount     Money      `json:"-" gorm:"embedded;embeddedPrefix:discount_"`    // クーポンによる1回あたりの請求額の減額分（税込）
+	AutoRenew    bool       `json:"auto_renew"`
+	StripeSubID  string     `json:"stripe_subscription_id" gorm:"index"`
+	TrialEnd     *time.Time `json:"trial_end,omitempty"`   // 無料トライアルの終了日時
+	CouponCode   string     `json:"coupon_code,omitempty"` // 申込時に適用したプロモーションコード
+	// 期間終了時に適用する予定のプラン変更（ダウングレード）
+	PendingPlanID       string     `json:"pending_plan_id,omitempty"`
+	PendingBillingCycle string     `json:"pending_billing_cycle,omitempty"`
+	PendingChangeAt     *time.Time `json:"pending_change_at,omitempty"`
+	// 更新時の支払い失敗（past_due）の管理
+	PastDueSince    *time.Time `json:"past_due_since,omitempty"`
+	GraceUntil      *time.Time `json:"grace_until,omitempty"` // この日時を過ぎると期限切れにする
+	RenewalAttempts int        `json:"-"`                     // 再請求の回数
+	NextRetryAt     *time.Time `json:"-"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
 }
 
 // SubscriptionStatus represents the status of a subscription
 const (
-	SubscriptionStatusActive   = "active"
-	SubscriptionStatusInactive = "inactive"
-	SubscriptionStatusCanceled = "canceled"
-	SubscriptionStatusExpired  = "expired"
+	SubscriptionStatusActive     = "active"
+	SubscriptionStatusTrialing   = "trialing" // 無料トライアル中
+	SubscriptionStatusInactive   = "inactive"
+	SubscriptionStatusIncomplete = "incomplete" // 初回支払いが未完了（3Dセキュア認証待ちなど）
+	SubscriptionStatusPastDue    = "past_due"   // 更新時の支払いに失敗（猶予期間中は利用可能）
+	SubscriptionStatusCanceled   = "canceled"
+	SubscriptionStatusExpired    = "expired"
 )
 
+// SetPrice sets the amount billed per period for the plan price less the discount, and the consumption tax contained in it.
+// Like Stripe, the tax is computed on the discounted price; Discount keeps how much less than the list price is billed.
+func (s *Subscription) SetPrice(price Money, discount Money, tax TaxRule) {
+	net := price
+	if discount.Currency == price.Currency && discount.Minor > 0 {
+		if discount.Minor > price.Minor {
+			discount.Minor = price.Minor
+		}
+		net.Minor -= discount.Minor
+	}
+	list, _ := tax.Apply(price)
+	s.Amount, s.Tax = tax.Apply(net)
+	s.Discount = Money{Minor: list.Minor - s.Amount.Minor, Currency: s.Amount.Currency}
+	s.TaxRate = tax.RatePercent
+}
+
+// ListAmount returns what a period would cost without the discount, tax included
+func (s *Subscription) ListAmount() Money {
+	return Money{Minor: s.Amount.Minor + s.Discount.Minor, Currency: s.Amount.Currency}
+}
+
+// IsCurrent reports whether the subscription is running normally, including during a trial
+func (s *Subscription) IsCurrent() bool {
+	return s.Status == SubscriptionStatusActive || s.Status == SubscriptionStatusTrialing
+}
+
+// GrantsAccess reports whether the subscriber can use the plan at the given time.
+// Past-due subscriptions keep access until the grace period ends.
+func (s *Subscription) GrantsAccess(now time.Time) bool {
+	switch s.Status {
+	case SubscriptionStatusActive, SubscriptionStatusTrialing:
+		return true
+	case SubscriptionStatusPastDue:
+		return s.GraceUntil != nil && now.Before(*s.GraceUntil)
+	}
+	return false
+}
+
+// ClearDunning forgets the failed renewal state
+func (s *Subscription) ClearDunning() {
+	s.PastDueSince = nil
+	s.GraceUntil = nil
+	s.RenewalAttempts = 0
+	s.NextRetryAt = nil
+}
+
+// HasPendingChange reports whether a plan change is scheduled for the end of the period
+func (s *Subscription) HasPendingChange() bool {
+	return s.PendingPlanID != ""
+}
+
+// ClearPendingChange forgets a scheduled plan change
+func (s *Subscription) ClearPendingChange() {
+	s.PendingPlanID = ""
+	s.PendingBillingCycle = ""
+	s.PendingChangeAt = nil
+}
+
+// SubscriptionFilter defines criteria for listing a user's subscriptions
+type SubscriptionFilter struct {
+	Status       string `form:"status"`
+	PlanID       string `form:"plan_id"`
+	BillingCycle string `form:"billing_cycle" binding:"omitempty,oneof=monthly yearly"`
+}
+
 // BillingCycle represents the billing cycle options
 const (
 	BillingCycleMonthly = "monthly"
@@ -53,7 +136,7 @@ func (s *Subscription) Validate() error {
 	if s.PlanID == "" {
 		return ErrInvalidPlanID
 	}
-	if s.Amount < 0 {
+	if s.Amount.Minor < 0 {
 		return ErrInvalidAmount
 	}
 	return nil
@@ -66,3 +149,46 @@ func (s *Subscription) BeforeCreate(tx *gorm.DB) error {
 	}
 	return nil
 }
+
+// MarshalJSON keeps the amount as a decimal number with a top-level currency for existing clients
+func (s Subscription) MarshalJSON() ([]byte, error) {
+	type alias Subscription
+	return json.Marshal(struct {
+		alias
+		Amount      float64 `json:"amount"`
+		AmountMinor int64   `json:"amount_minor"`
+		Tax         float64 `json:"tax"`
+		Discount    float64 `json:"discount"`
+		Currency    string  `json:"currency"`
+	}{
+		alias:       alias(s),
+		Amount:      s.Amount.Major(),
+		AmountMinor: s.Amount.Minor,
+		Tax:         s.Tax.Major(),
+		Discount:    s.Discount.Major(),
+		Currency:    s.Amount.Currency,
+	})
+}
+
+// UnmarshalJSON accepts a decimal amount; the currency defaults to DefaultCurrency when omitted
+func (s *Subscription) UnmarshalJSON(data []byte) error {
+	type alias Subscription
+	aux := struct {
+		*alias
+		Amount   float64 `json:"amount"`
+		Currency string  `json:"currency"`
+	}{alias: (*alias)(s)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Currency == "" {
+		aux.Currency = DefaultCurrency
+	}
+
+	amount, err := NewMoneyFromMajor(aux.Amount, aux.Currency)
+	if err != nil {
+		return err
+	}
+	s.Amount = amount
+	return nil
+}
@@ -0,0 +1,82 @@
+package models
+
+import "errors"
+
+// Product types that have their own consumption tax rule
+const (
+	TaxProductContent      = "content"      // コンテンツの単品購入
+	TaxProductSubscription = "subscription" // Stripeのサブスクリプション
+	TaxProductOther        = "other"        // 金額を指定した支払い
+)
+
+// Consumption tax rates in percent
+const (
+	TaxRateStandard = 10
+	TaxRateReduced  = 8 // 軽減税率
+)
+
+// ErrInvalidTaxRate is returned for rates other than the standard and reduced consumption tax rates
+var ErrInvalidTaxRate = errors.New("tax rate must be the standard or reduced consumption tax rate, or 0")
+
+// TaxRule is the consumption tax applied to the prices of a product type
+type TaxRule struct {
+	RatePercent int
+	Inclusive   bool // 価格が税込かどうか
+	// StripeTaxRateID is attached to Stripe subscriptions so that Stripe bills and itemizes the same tax
+	StripeTaxRateID string
+}
+
+// DefaultTaxRule applies when no rule is configured: catalog prices include the standard rate
+var DefaultTaxRule = TaxRule{RatePercent: TaxRateStandard, Inclusive: true}
+
+// Validate performs validation checks on the tax rule
+func (r TaxRule) Validate() error {
+	switch r.RatePercent {
+	case 0, TaxRateReduced, TaxRateStandard:
+		return nil
+	}
+	return ErrInvalidTaxRate
+}
+
+// Apply returns the amount to charge for a price and the consumption tax contained in it.
+// インボイス制度に合わせ、端数処理は1回の請求につき税率ごとに1回（切り捨て）とする。
+func (r TaxRule) Apply(price Money) (total Money, tax Money) {
+	tax = Money{Currency: price.Currency}
+	if r.RatePercent <= 0 {
+		return price, tax
+	}
+	rate := int64(r.RatePercent)
+	if r.Inclusive {
+		tax.Minor = price.Minor * rate / (100 + rate)
+		return price, tax
+	}
+	tax.Minor = price.Minor * rate / 100
+	return Money{Minor: price.Minor + tax.Minor, Currency: price.Currency}, tax
+}
+
+// IncludedTax returns the consumption tax contained in a tax-inclusive amount, rounded down
+func IncludedTax(amount Money, ratePercent int) Money {
+	_, tax := TaxRule{RatePercent: ratePercent, Inclusive: true}.Apply(amount)
+	return tax
+}
+
+// TaxRules holds the tax rule of each product type, keyed by TaxProduct*
+type TaxRules map[string]TaxRule
+
+// Rule returns the rule of the product type, or DefaultTaxRule when none is configured
+func (r TaxRules) Rule(productType string) TaxRule {
+	if rule, ok := r[productType]; ok {
+		return rule
+	}
+	return DefaultTaxRule
+}
+
+// Validate performs validation checks on every rule
+func (r TaxRules) Validate() error {
+	for _, rule := range r {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// TrialRedemption records that a user has used their free trial.
+// Rows are kept after the subscription is canceled, so each user gets at most one trial.
+type TrialRedemption struct {
+	ID             uint      `json:"id" gorm:"primaryKey"`
+	UserID         string    `json:"user_id" gorm:"not null;uniqueIndex"`
+	PlanID         string    `json:"plan_id"`
+	SubscriptionID string    `json:"subscription_id"`
+	CreatedAt      time.Time `json:"created_at"`
+}
@@ -9,13 +9,15 @@ import (
 // User ユーザーモデル
 type User struct {
 	gorm.Model
-	Email         string `gorm:"uniqueIndex;not null"`
-	Password      string `gorm:"not null"`
-	Name          string `gorm:"not null"`
-	DateOfBirth   time.Time
-	Gender        string
-	Big5Results   Big5Results `gorm:"embedded"`
-	LastDiagnosis time.Time
+	Email            string `gorm:"uniqueIndex;not null"`
+	Password         string `gorm:"not null"`
+	Name             string `gorm:"not null"`
+	DateOfBirth      time.Time
+	Gender           string
+	Big5Results      Big5Results `gorm:"embedded"`
+	LastDiagnosis    time.Time
+	FirebaseUID      *string `gorm:"uniqueIndex"` // Firebase AuthenticationのUID
+	StripeCustomerID string  `gorm:"index"`       // Stripe Customer ID（初回決済時に作成）
 }
 
 // Big5Results Big5診断結果
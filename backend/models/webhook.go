@@ -0,0 +1,35 @@
+package models
+
+import (
+	"errors"
+	"time"
+)
+
+// WebhookSource represents the origin of a webhook event
+const (
+	WebhookSourceStripe     = "stripe"
+	WebhookSourceAppStore   = "app_store"   // App Store Server Notifications (notificationUUID)
+	WebhookSourceGooglePlay = "google_play" // Google Playのリアルタイム デベロッパー通知 (Pub/SubのmessageId)
+)
+
+// WebhookEventStatus represents the processing state of a webhook event
+const (
+	WebhookEventStatusProcessing = "processing" // 処理中（locked_untilを過ぎると再処理できる）
+	WebhookEventStatusProcessed  = "processed"
+)
+
+// ErrWebhookEventInProgress is returned when another delivery of the event is still being processed
+var ErrWebhookEventInProgress = errors.New("webhook event is being processed")
+
+// WebhookEvent records webhook events so that redeliveries are ignored once processed.
+// A processing event whose lease has expired was abandoned, for example by a crash, and may be claimed again.
+type WebhookEvent struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	Source      string     `json:"source" gorm:"not null;uniqueIndex:idx_webhook_event"`
+	EventID     string     `json:"event_id" gorm:"not null;uniqueIndex:idx_webhook_event"`
+	Type        string     `json:"type"`
+	Status      string     `json:"status" gorm:"not null"`
+	LockedUntil *time.Time `json:"locked_until"`
+	ProcessedAt *time.Time `json:"processed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
@@ -0,0 +1,27 @@
+package repository
+
+import (
+	"context"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+)
+
+// AuditLogRepository defines operations for the append-only audit log
+type AuditLogRepository interface {
+	Create(ctx context.Context, entry *models.AuditLog) error
+}
+
+type auditLogRepository struct {
+	db *gorm.DB
+}
+
+// NewAuditLogRepository creates a new instance of AuditLogRepository
+func NewAuditLogRepository(db *gorm.DB) AuditLogRepository {
+	return &auditLogRepository{db: db}
+}
+
+func (r *auditLogRepository) Create(ctx context.Context, entry *models.AuditLog) error {
+	return r.db.WithContext(ctx).Create(entry).Error
+}
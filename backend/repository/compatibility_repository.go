@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"kimiyomi/models"
 
@@ -13,6 +14,9 @@ type CompatibilityRepository interface {
 	CreateCompatibilityResult(ctx context.Context, result *models.Compatibility) error
 	GetCompatibilityResultByID(ctx context.Context, id string) (*models.Compatibility, error)
 	GetCompatibilityResultsByUserID(ctx context.Context, userID string) ([]models.Compatibility, error)
+	ReplaceDailyMatches(ctx context.Context, userIDs []uint, date time.Time, matches []models.DailyMatch) error
+	GetDailyMatches(ctx context.Context, userID uint, date time.Time) ([]models.DailyMatch, error)
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
 	// Add other necessary methods like CalculateCompatibility, GetAdvice etc.
 }
 
@@ -49,4 +53,46 @@ func (r *compatibilityRepository) GetCompatibilityResultsByUserID(ctx context.Co
 	return results, nil
 }
 
+// ReplaceDailyMatches replaces the precomputed matches of the given users for a date.
+// Re-running the same chunk is therefore idempotent.
+func (r *compatibilityRepository) ReplaceDailyMatches(ctx context.Context, userIDs []uint, date time.Time, matches []models.DailyMatch) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id IN ? AND match_date = ?", userIDs, date).Delete(&models.DailyMatch{}).Error; err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return nil
+		}
+		return tx.Create(&matches).Error
+	})
+}
+
+func (r *compatibilityRepository) GetDailyMatches(ctx context.Context, userID uint, date time.Time) ([]models.DailyMatch, error) {
+	var matches []models.DailyMatch
+	if err := r.db.WithContext(ctx).Where("user_id = ? AND match_date = ?", userID, date).Order("rank ASC").Find(&matches).Error; err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// DeleteExpired removes expired compatibility results and past daily matches
+func (r *compatibilityRepository) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	var deleted int64
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Where("expires_at < ?", now).Delete(&models.Compatibility{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted += result.RowsAffected
+
+		result = tx.Unscoped().Where("match_date < ?", now.AddDate(0, 0, -1)).Delete(&models.DailyMatch{})
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted += result.RowsAffected
+		return nil
+	})
+	return deleted, err
+}
+
 // TODO: Implement other methods like FindValidCompatibility if needed by the service
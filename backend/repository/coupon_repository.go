@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CouponRepository defines the interface for coupon data operations
+type CouponRepository interface {
+	GetByCode(ctx context.Context, code string) (*models.Coupon, error)
+	List(ctx context.Context) ([]*models.Coupon, error)
+	Create(ctx context.Context, coupon *models.Coupon) error
+	Update(ctx context.Context, coupon *models.Coupon) error
+	CountUserRedemptions(ctx context.Context, couponID string, userID string) (int64, error)
+	Redeem(ctx context.Context, redemption *models.CouponRedemption) error
+	Release(ctx context.Context, redemptionID string) error
+	ListRedemptionsByPaymentID(ctx context.Context, paymentID string) ([]*models.CouponRedemption, error)
+	ListRedemptionsByCouponID(ctx context.Context, couponID string) ([]*models.CouponRedemption, error)
+}
+
+type couponRepository struct {
+	db *gorm.DB
+}
+
+// NewCouponRepository creates a new instance of CouponRepository
+func NewCouponRepository(db *gorm.DB) CouponRepository {
+	return &couponRepository{db: db}
+}
+
+func (r *couponRepository) GetByCode(ctx context.Context, code string) (*models.Coupon, error) {
+	var coupon models.Coupon
+	if err := r.db.WithContext(ctx).First(&coupon, "code = ?", code).Error; err != nil {
+		return nil, err
+	}
+	return &coupon, nil
+}
+
+func (r *couponRepository) List(ctx context.Context) ([]*models.Coupon, error) {
+	var coupons []*models.Coupon
+	if err := r.db.WithContext(ctx).Order("created_at DESC").Find(&coupons).Error; err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+func (r *couponRepository) Create(ctx context.Context, coupon *models.Coupon) error {
+	return r.db.WithContext(ctx).Create(coupon).Error
+}
+
+func (r *couponRepository) Update(ctx context.Context, coupon *models.Coupon) error {
+	return r.db.WithContext(ctx).Save(coupon).Error
+}
+
+// CountUserRedemptions counts the user's redemptions that still hold a slot
+func (r *couponRepository) CountUserRedemptions(ctx context.Context, couponID string, userID string) (int64, error) {
+	var count int64
+	err := r.db.WithContext(ctx).Model(&models.CouponRedemption{}).
+		Where("coupon_id = ? AND user_id = ? AND status = ?", couponID, userID, models.CouponRedemptionStatusRedeemed).
+		Count(&count).Error
+	return count, err
+}
+
+// Redeem records a redemption within the coupon's limits.
+// The coupon row is locked so that concurrent redemptions cannot exceed the limits together.
+func (r *couponRepository) Redeem(ctx context.Context, redemption *models.CouponRedemption) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var coupon models.Coupon
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&coupon, "id = ?", redemption.CouponID).Error; err != nil {
+			return err
+		}
+		if coupon.MaxRedemptions > 0 && coupon.RedeemedCount >= coupon.MaxRedemptions {
+			return models.ErrCouponExhausted
+		}
+		if coupon.MaxRedemptionsPerUser > 0 {
+			var used int64
+			if err := tx.Model(&models.CouponRedemption{}).
+				Where("coupon_id = ? AND user_id = ? AND status = ?", coupon.ID, redemption.UserID, models.CouponRedemptionStatusRedeemed).
+				Count(&used).Error; err != nil {
+				return err
+			}
+			if used >= int64(coupon.MaxRedemptionsPerUser) {
+				return models.ErrCouponAlreadyUsed
+			}
+		}
+
+		redemption.Status = models.CouponRedemptionStatusRedeemed
+		if err := tx.Create(redemption).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Coupon{}).Where("id = ?", coupon.ID).
+			Update("redeemed_count", gorm.Expr("redeemed_count + 1")).Error
+	})
+}
+
+// Release gives the slot of a redemption back; the row is kept for reporting
+func (r *couponRepository) Release(ctx context.Context, redemptionID string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.CouponRedemption{}).
+			Where("id = ? AND status = ?", redemptionID, models.CouponRedemptionStatusRedeemed).
+			Update("status", models.CouponRedemptionStatusReleased)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error // 解放済み
+		}
+
+		var redemption models.CouponRedemption
+		if err := tx.First(&redemption, "id = ?", redemptionID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.Coupon{}).Where("id = ?", redemption.CouponID).
+			Update("redeemed_count", gorm.Expr("redeemed_count - 1")).Error
+	})
+}
+
+func (r *couponRepository) ListRedemptionsByPaymentID(ctx context.Context, paymentID string) ([]*models.CouponRedemption, error) {
+	var redemptions []*models.CouponRedemption
+	if err := r.db.WithContext(ctx).Where("payment_id = ?", paymentID).Find(&redemptions).Error; err != nil {
+		return nil, err
+	}
+	return redemptions, nil
+}
+
+func (r *couponRepository) ListRedemptionsByCouponID(ctx context.Context, couponID string) ([]*models.CouponRedemption, error) {
+	var redemptions []*models.CouponRedemption
+	if err := r.db.WithContext(ctx).Where("coupon_id = ?", couponID).Order("created_at DESC").Find(&redemptions).Error; err != nil {
+		return nil, err
+	}
+	return redemptions, nil
+}
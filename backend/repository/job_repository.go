@@ -0,0 +1,86 @@
+package repository
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// JobRepository defines operations for batch job bookkeeping
+type JobRepository interface {
+	GetOrCreateProgress(ctx context.Context, jobName string, runKey string) (*models.JobProgress, error)
+	UpdateProgress(ctx context.Context, progress *models.JobProgress) error
+	CreateRun(ctx context.Context, run *models.JobRun) (bool, error)
+	UpdateRun(ctx context.Context, run *models.JobRun) error
+	WithLock(ctx context.Context, name string, fn func(ctx context.Context) error) (bool, error)
+}
+
+type jobRepository struct {
+	db *gorm.DB
+}
+
+// NewJobRepository creates a new instance of JobRepository
+func NewJobRepository(db *gorm.DB) JobRepository {
+	return &jobRepository{db: db}
+}
+
+// GetOrCreateProgress returns the progress row for the given run, creating it on the first run
+func (r *jobRepository) GetOrCreateProgress(ctx context.Context, jobName string, runKey string) (*models.JobProgress, error) {
+	progress := models.JobProgress{JobName: jobName, RunKey: runKey}
+	err := r.db.WithContext(ctx).
+		Where(&models.JobProgress{JobName: jobName, RunKey: runKey}).
+		Attrs(models.JobProgress{Status: models.JobStatusRunning, StartedAt: time.Now()}).
+		FirstOrCreate(&progress).Error
+	if err != nil {
+		return nil, err
+	}
+	return &progress, nil
+}
+
+func (r *jobRepository) UpdateProgress(ctx context.Context, progress *models.JobProgress) error {
+	return r.db.WithContext(ctx).Save(progress).Error
+}
+
+// CreateRun records the run of a scheduled time.
+// It returns false when the run of that time already exists, i.e. another replica has taken it.
+func (r *jobRepository) CreateRun(ctx context.Context, run *models.JobRun) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "job_name"}, {Name: "scheduled_at"}}, DoNothing: true}).
+		Create(run)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (r *jobRepository) UpdateRun(ctx context.Context, run *models.JobRun) error {
+	return r.db.WithContext(ctx).Save(run).Error
+}
+
+// WithLock runs fn while holding a PostgreSQL advisory lock for name.
+// It returns false without running fn when another replica holds the lock.
+// The lock only prevents overlapping runs; use CreateRun to run each scheduled time once.
+func (r *jobRepository) WithLock(ctx context.Context, name string, fn func(ctx context.Context) error) (bool, error) {
+	acquired := false
+	err := r.db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		if err := conn.Raw("SELECT pg_try_advisory_lock(hashtext(?))", name).Scan(&acquired).Error; err != nil {
+			return err
+		}
+		if !acquired {
+			return nil
+		}
+		// セッションロックは接続に残るため、タイムアウト後でも必ず解放する
+		defer func() {
+			if err := conn.WithContext(context.Background()).Exec("SELECT pg_advisory_unlock(hashtext(?))", name).Error; err != nil {
+				log.Printf("アドバイザリーロックの解放に失敗 (%s): %v", name, err)
+			}
+		}()
+		return fn(ctx)
+	})
+	return acquired, err
+}
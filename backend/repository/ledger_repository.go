@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LedgerRepository defines operations for the append-only billing ledger; entries cannot be updated or deleted
+type LedgerRepository interface {
+	Append(ctx context.Context, entry *models.LedgerEntry) (bool, error)
+	GetBySourceRef(ctx context.Context, source, entryType, sourceRef string) (*models.LedgerEntry, error)
+	ListBetween(ctx context.Context, from, to time.Time) ([]*models.LedgerEntry, error)
+}
+
+type ledgerRepository struct {
+	db *gorm.DB
+}
+
+// NewLedgerRepository creates a new instance of LedgerRepository
+func NewLedgerRepository(db *gorm.DB) LedgerRepository {
+	return &ledgerRepository{db: db}
+}
+
+// Append records the entry and reports whether it is new; an entry with the same source reference is kept as is
+func (r *ledgerRepository) Append(ctx context.Context, entry *models.LedgerEntry) (bool, error) {
+	result := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(entry)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+func (r *ledgerRepository) GetBySourceRef(ctx context.Context, source, entryType, sourceRef string) (*models.LedgerEntry, error) {
+	var entry models.LedgerEntry
+	if err := r.db.WithContext(ctx).First(&entry, "source = ? AND type = ? AND source_ref = ?", source, entryType, sourceRef).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// ListBetween returns the entries that occurred in [from, to) in chronological order
+func (r *ledgerRepository) ListBetween(ctx context.Context, from, to time.Time) ([]*models.LedgerEntry, error) {
+	var entries []*models.LedgerEntry
+	if err := r.db.WithContext(ctx).
+		Where("occurred_at >= ? AND occurred_at < ?", from, to).
+		Order("occurred_at, id").
+		Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
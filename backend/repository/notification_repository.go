@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// NotificationRepository defines operations for the notification outbox
+type NotificationRepository interface {
+	Enqueue(ctx context.Context, event *models.NotificationEvent) (bool, error)
+	ListPending(ctx context.Context, now time.Time, limit int) ([]*models.NotificationEvent, error)
+	MarkSent(ctx context.Context, id uint) error
+	MarkFailed(ctx context.Context, event *models.NotificationEvent) error
+}
+
+type notificationRepository struct {
+	db *gorm.DB
+}
+
+// NewNotificationRepository creates a new instance of NotificationRepository
+func NewNotificationRepository(db *gorm.DB) NotificationRepository {
+	return &notificationRepository{db: db}
+}
+
+// Enqueue stores the event unless one with the same dedupe key exists, and reports whether it was stored
+func (r *notificationRepository) Enqueue(ctx context.Context, event *models.NotificationEvent) (bool, error) {
+	if event.Status == "" {
+		event.Status = models.NotificationStatusPending
+	}
+	result := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(event)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ListPending returns undelivered events that are due at now, oldest first
+func (r *notificationRepository) ListPending(ctx context.Context, now time.Time, limit int) ([]*models.NotificationEvent, error) {
+	var events []*models.NotificationEvent
+	if err := r.db.WithContext(ctx).
+		Where("status = ?", models.NotificationStatusPending).
+		Where("next_attempt_at IS NULL OR next_attempt_at <= ?", now).
+		Order("id ASC").
+		Limit(limit).
+		Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (r *notificationRepository) MarkSent(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Model(&models.NotificationEvent{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"status": models.NotificationStatusSent, "sent_at": time.Now()}).Error
+}
+
+// MarkFailed records a failed delivery with the event's status, attempts, next attempt and error
+func (r *notificationRepository) MarkFailed(ctx context.Context, event *models.NotificationEvent) error {
+	return r.db.WithContext(ctx).Model(&models.NotificationEvent{}).Where("id = ?", event.ID).
+		Updates(map[string]interface{}{
+			"status":          event.Status,
+			"attempts":        event.Attempts,
+			"next_attempt_at": event.NextAttemptAt,
+			"last_error":      event.LastError,
+		}).Error
+}
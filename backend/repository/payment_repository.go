@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"kimiyomi/models"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -10,9 +11,13 @@ import (
 // PaymentRepository defines the interface for payment data operations
 type PaymentRepository interface {
 	GetPaymentByID(ctx context.Context, paymentID string) (*models.Payment, error)
+	GetPaymentByStripeID(ctx context.Context, stripeID string) (*models.Payment, error)
 	ListPaymentsByUserID(ctx context.Context, userID string) ([]*models.Payment, error)
 	CreatePayment(ctx context.Context, payment *models.Payment) error
 	UpdatePayment(ctx context.Context, payment *models.Payment) error
+	ListStalePendingPayments(ctx context.Context, orphanedBefore time.Time, abandonedBefore time.Time, limit int) ([]*models.Payment, error)
+	TouchPayment(ctx context.Context, paymentID string) error
+	ListContentPurchases(ctx context.Context, userID string) ([]*models.Payment, error)
 }
 
 type paymentRepository struct {
@@ -32,6 +37,14 @@ func (r *paymentRepository) GetPaymentByID(ctx context.Context, paymentID string
 	return &payment, nil
 }
 
+func (r *paymentRepository) GetPaymentByStripeID(ctx context.Context, stripeID string) (*models.Payment, error) {
+	var payment models.Payment
+	if err := r.db.WithContext(ctx).First(&payment, "stripe_id = ?", stripeID).Error; err != nil {
+		return nil, err
+	}
+	return &payment, nil
+}
+
 func (r *paymentRepository) ListPaymentsByUserID(ctx context.Context, userID string) ([]*models.Payment, error) {
 	var payments []*models.Payment
 	if err := r.db.WithContext(ctx).Where("user_id = ?", userID).Find(&payments).Error; err != nil {
@@ -47,3 +60,35 @@ func (r *paymentRepository) CreatePayment(ctx context.Context, payment *models.P
 func (r *paymentRepository) UpdatePayment(ctx context.Context, payment *models.Payment) error {
 	return r.db.WithContext(ctx).Save(payment).Error
 }
+
+// ListStalePendingPayments returns pending payments that need reconciling: those without a PaymentIntent ID
+// not updated since orphanedBefore, and those with one not updated since abandonedBefore
+func (r *paymentRepository) ListStalePendingPayments(ctx context.Context, orphanedBefore time.Time, abandonedBefore time.Time, limit int) ([]*models.Payment, error) {
+	var payments []*models.Payment
+	if err := r.db.WithContext(ctx).
+		Where("status = ?", models.PaymentStatusPending).
+		Where("(stripe_id = '' AND updated_at < ?) OR updated_at < ?", orphanedBefore, abandonedBefore).
+		Order("updated_at ASC").
+		Limit(limit).
+		Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
+
+// TouchPayment sets the updated time of the payment to now, postponing its next reconciliation
+func (r *paymentRepository) TouchPayment(ctx context.Context, paymentID string) error {
+	return r.db.WithContext(ctx).Model(&models.Payment{}).Where("id = ?", paymentID).Update("updated_at", time.Now()).Error
+}
+
+// ListContentPurchases returns the user's captured one-off content payments that were not fully refunded or disputed
+func (r *paymentRepository) ListContentPurchases(ctx context.Context, userID string) ([]*models.Payment, error) {
+	var payments []*models.Payment
+	if err := r.db.WithContext(ctx).
+		Where("user_id = ? AND content_id <> '' AND status IN ?", userID,
+			[]string{models.PaymentStatusSucceeded, models.PaymentStatusPartiallyRefunded}).
+		Find(&payments).Error; err != nil {
+		return nil, err
+	}
+	return payments, nil
+}
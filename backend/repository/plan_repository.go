@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+)
+
+// PlanRepository defines the interface for plan catalog operations
+type PlanRepository interface {
+	GetByID(ctx context.Context, id string) (*models.Plan, error)
+	GetByStripePriceID(ctx context.Context, stripePriceID string) (*models.Plan, error)
+	List(ctx context.Context, activeOnly bool) ([]*models.Plan, error)
+	Create(ctx context.Context, plan *models.Plan) error
+	Update(ctx context.Context, plan *models.Plan) error
+}
+
+type planRepository struct {
+	db *gorm.DB
+}
+
+// NewPlanRepository creates a new instance of PlanRepository
+func NewPlanRepository(db *gorm.DB) PlanRepository {
+	return &planRepository{db: db}
+}
+
+func (r *planRepository) GetByID(ctx context.Context, id string) (*models.Plan, error) {
+	var plan models.Plan
+	if err := r.db.WithContext(ctx).First(&plan, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// GetByStripePriceID finds the plan, including retired ones, that sells the Stripe price
+func (r *planRepository) GetByStripePriceID(ctx context.Context, stripePriceID string) (*models.Plan, error) {
+	var plan models.Plan
+	if err := r.db.WithContext(ctx).
+		Where("stripe_monthly_price_id = ? OR stripe_yearly_price_id = ?", stripePriceID, stripePriceID).
+		First(&plan).Error; err != nil {
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// List returns plans in display order
+func (r *planRepository) List(ctx context.Context, activeOnly bool) ([]*models.Plan, error) {
+	var plans []*models.Plan
+	query := r.db.WithContext(ctx).Order("sort_order ASC, id ASC")
+	if activeOnly {
+		query = query.Where("active = ?", true)
+	}
+	if err := query.Find(&plans).Error; err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+func (r *planRepository) Create(ctx context.Context, plan *models.Plan) error {
+	return r.db.WithContext(ctx).Create(plan).Error
+}
+
+func (r *planRepository) Update(ctx context.Context, plan *models.Plan) error {
+	return r.db.WithContext(ctx).Save(plan).Error
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"context"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// PurchaseRepository defines the interface for in-app purchase data operations
+type PurchaseRepository interface {
+	GetByPurchaseID(ctx context.Context, purchaseID string) (*models.Purchase, error)
+	ListByUserID(ctx context.Context, userID string) ([]*models.Purchase, error)
+	ListByOriginalPurchaseID(ctx context.Context, originalPurchaseID string) ([]*models.Purchase, error)
+	UpsertByPurchaseID(ctx context.Context, purchase *models.Purchase) error
+}
+
+type purchaseRepository struct {
+	db *gorm.DB
+}
+
+// NewPurchaseRepository creates a new instance of PurchaseRepository
+func NewPurchaseRepository(db *gorm.DB) PurchaseRepository {
+	return &purchaseRepository{db: db}
+}
+
+func (r *purchaseRepository) GetByPurchaseID(ctx context.Context, purchaseID string) (*models.Purchase, error) {
+	var purchase models.Purchase
+	if err := r.db.WithContext(ctx).First(&purchase, "purchase_id = ?", purchaseID).Error; err != nil {
+		return nil, err
+	}
+	return &purchase, nil
+}
+
+func (r *purchaseRepository) ListByUserID(ctx context.Context, userID string) ([]*models.Purchase, error) {
+	var purchases []*models.Purchase
+	if err := r.db.WithContext(ctx).Where("user_id = ?", userID).Order("purchased_at DESC").Find(&purchases).Error; err != nil {
+		return nil, err
+	}
+	return purchases, nil
+}
+
+func (r *purchaseRepository) ListByOriginalPurchaseID(ctx context.Context, originalPurchaseID string) ([]*models.Purchase, error) {
+	var purchases []*models.Purchase
+	if err := r.db.WithContext(ctx).Where("original_purchase_id = ?", originalPurchaseID).Order("purchased_at DESC").Find(&purchases).Error; err != nil {
+		return nil, err
+	}
+	return purchases, nil
+}
+
+// UpsertByPurchaseID inserts the purchase or refreshes the store state of the record with the same
+// purchase ID in a single statement, so that concurrent confirmations of one transaction cannot collide.
+// The owner, creation time, a previously stored receipt and the first revocation are kept; purchase is filled with the stored row.
+func (r *purchaseRepository) UpsertByPurchaseID(ctx context.Context, purchase *models.Purchase) error {
+	return r.db.WithContext(ctx).Clauses(
+		clause.OnConflict{
+			Columns: []clause.Column{{Name: "purchase_id"}},
+			DoUpdates: append(
+				clause.AssignmentColumns([]string{"product_id", "original_purchase_id", "platform", "environment", "purchased_at", "expires_at", "auto_renew", "price_minor", "price_currency", "updated_at"}),
+				// 更新通知などレシートを伴わない反映では、保存済みのレシートを残す
+				clause.Assignment{Column: clause.Column{Name: "receipt"}, Value: gorm.Expr("COALESCE(NULLIF(excluded.receipt, ''), purchases.receipt)")},
+				// 取り消しは覆らないため、遅れて届いた有効な状態の反映で消さない
+				clause.Assignment{Column: clause.Column{Name: "revoked_at"}, Value: gorm.Expr("COALESCE(purchases.revoked_at, excluded.revoked_at)")},
+			),
+		},
+		clause.Returning{},
+	).Create(purchase).Error
+}
@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB connects to the PostgreSQL database in DATABASE_URL and migrates the models
+// into a schema of its own, which is dropped when the test ends
+func openTestDB(t *testing.T, tables ...interface{}) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+
+	admin, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	require.NoError(t, admin.Exec("CREATE SCHEMA "+schema).Error)
+	t.Cleanup(func() {
+		admin.Exec("DROP SCHEMA " + schema + " CASCADE")
+		if sqlDB, err := admin.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+
+	// 接続ごとにsearch_pathを設定し、テーブル名を本番と同じにする
+	switch {
+	case !strings.Contains(dsn, "://"):
+		dsn += " search_path=" + schema
+	case strings.Contains(dsn, "?"):
+		dsn += "&search_path=" + schema
+	default:
+		dsn += "?search_path=" + schema
+	}
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	require.NoError(t, db.AutoMigrate(tables...))
+	return db
+}
+
+func TestUpsertByPurchaseIDKeepsFirstOwnerUnderConcurrency(t *testing.T) {
+	db := openTestDB(t, &models.Purchase{})
+	repo := NewPurchaseRepository(db)
+	ctx := context.Background()
+
+	const writers = 8
+	start := make(chan struct{})
+	results := make([]*models.Purchase, writers)
+	errs := make([]error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			purchase := &models.Purchase{
+				UserID:      fmt.Sprintf("user-%d", i),
+				ProductID:   "premium_monthly",
+				PurchaseID:  "1000000123456789",
+				Platform:    "ios",
+				Receipt:     fmt.Sprintf("receipt-%d", i),
+				PurchasedAt: time.Now(),
+			}
+			<-start
+			errs[i] = repo.UpsertByPurchaseID(ctx, purchase)
+			results[i] = purchase
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	var stored []models.Purchase
+	require.NoError(t, db.Find(&stored, "purchase_id = ?", "1000000123456789").Error)
+	require.Len(t, stored, 1)
+	owner := stored[0].UserID
+	for i := 0; i < writers; i++ {
+		require.NoError(t, errs[i])
+		// 後から書いた側にも保存済みの行（最初の所有者）が返る
+		assert.Equal(t, owner, results[i].UserID, i)
+		assert.Equal(t, stored[0].ID, results[i].ID, i)
+	}
+
+	// 最初の所有者は後の確認で変わらず、レシートのない反映では保存済みのレシートを残す
+	later := &models.Purchase{UserID: "someone-else", ProductID: "premium_yearly", PurchaseID: "1000000123456789", Platform: "ios", PurchasedAt: time.Now()}
+	require.NoError(t, repo.UpsertByPurchaseID(ctx, later))
+	assert.Equal(t, owner, later.UserID)
+	assert.Equal(t, "premium_yearly", later.ProductID)
+	assert.Equal(t, stored[0].Receipt, later.Receipt)
+
+	// 一度取り消された購入は、取り消しのない後の反映でも取り消されたまま
+	revokedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Microsecond)
+	revoke := &models.Purchase{ProductID: "premium_yearly", PurchaseID: "1000000123456789", Platform: "ios", PurchasedAt: time.Now(), RevokedAt: &revokedAt}
+	require.NoError(t, repo.UpsertByPurchaseID(ctx, revoke))
+	renewed := &models.Purchase{ProductID: "premium_yearly", PurchaseID: "1000000123456789", Platform: "ios", PurchasedAt: time.Now()}
+	require.NoError(t, repo.UpsertByPurchaseID(ctx, renewed))
+	require.NotNil(t, renewed.RevokedAt)
+	assert.True(t, revokedAt.Equal(*renewed.RevokedAt))
+}
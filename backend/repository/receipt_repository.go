@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ReceiptRepository defines operations for issued receipts
+type ReceiptRepository interface {
+	GetByPaymentID(ctx context.Context, paymentID string) (*models.Receipt, error)
+	Issue(ctx context.Context, year int, receipt *models.Receipt, render func(*models.Receipt) error) (bool, error)
+}
+
+type receiptRepository struct {
+	db *gorm.DB
+}
+
+// NewReceiptRepository creates a new instance of ReceiptRepository
+func NewReceiptRepository(db *gorm.DB) ReceiptRepository {
+	return &receiptRepository{db: db}
+}
+
+// errReceiptExists rolls back an issue that lost the race for the payment
+var errReceiptExists = errors.New("receipt already issued for the payment")
+
+func (r *receiptRepository) GetByPaymentID(ctx context.Context, paymentID string) (*models.Receipt, error) {
+	var receipt models.Receipt
+	if err := r.db.WithContext(ctx).First(&receipt, "payment_id = ?", paymentID).Error; err != nil {
+		return nil, err
+	}
+	return &receipt, nil
+}
+
+// Issue takes the next receipt number of the year, renders the receipt and stores it, and reports whether it is new.
+// The sequence row stays locked until commit, so numbers have no gaps even when a concurrent issue for the same payment is rolled back.
+func (r *receiptRepository) Issue(ctx context.Context, year int, receipt *models.Receipt, render func(*models.Receipt) error) (bool, error) {
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		sequence := models.ReceiptSequence{Year: year, LastNumber: 1}
+		if err := tx.Clauses(
+			clause.OnConflict{
+				Columns:   []clause.Column{{Name: "year"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{"last_number": gorm.Expr("receipt_sequences.last_number + 1")}),
+			},
+			clause.Returning{},
+		).Create(&sequence).Error; err != nil {
+			return err
+		}
+
+		receipt.Number = models.ReceiptNumber(year, sequence.LastNumber)
+		if err := render(receipt); err != nil {
+			return err
+		}
+		result := tx.Clauses(clause.OnConflict{Columns: []clause.Column{{Name: "payment_id"}}, DoNothing: true}).Create(receipt)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errReceiptExists
+		}
+		return nil
+	})
+	if errors.Is(err, errReceiptExists) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// RefundRepository defines the interface for refund data operations
+type RefundRepository interface {
+	CreateRefund(ctx context.Context, refund *models.Refund) error
+	UpdateRefund(ctx context.Context, refund *models.Refund) error
+	SyncStripeRefund(ctx context.Context, refund *models.Refund) error
+	ListRefundsByPaymentID(ctx context.Context, paymentID string) ([]*models.Refund, error)
+	ListStalePendingRefunds(ctx context.Context, before time.Time, limit int) ([]*models.Refund, error)
+	TouchRefund(ctx context.Context, refundID string) error
+}
+
+type refundRepository struct {
+	db *gorm.DB
+}
+
+// NewRefundRepository creates a new instance of RefundRepository
+func NewRefundRepository(db *gorm.DB) RefundRepository {
+	return &refundRepository{db: db}
+}
+
+// CreateRefund reserves a refund against its payment.
+// The payment row is locked so that concurrent refunds cannot exceed the captured amount together.
+func (r *refundRepository) CreateRefund(ctx context.Context, refund *models.Refund) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var payment models.Payment
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, "id = ?", refund.PaymentID).Error; err != nil {
+			return err
+		}
+		if !payment.IsCaptured() {
+			return models.ErrPaymentNotRefundable
+		}
+
+		var reserved int64
+		if err := tx.Model(&models.Refund{}).
+			Where("payment_id = ? AND status IN ?", refund.PaymentID, []string{models.RefundStatusPending, models.RefundStatusSucceeded}).
+			Select("COALESCE(SUM(amount_minor), 0)").
+			Scan(&reserved).Error; err != nil {
+			return err
+		}
+		if payment.ExceedsRefundable(reserved, refund.Amount.Minor) {
+			return models.ErrRefundExceedsPayment
+		}
+
+		return tx.Create(refund).Error
+	})
+}
+
+// UpdateRefund saves the refund and recalculates the refunded total of its payment
+func (r *refundRepository) UpdateRefund(ctx context.Context, refund *models.Refund) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(refund).Error; err != nil {
+			return err
+		}
+		return syncRefundedAmount(tx, refund.PaymentID)
+	})
+}
+
+// SyncStripeRefund stores a refund reported by Stripe.
+// Refunds created through this API are matched by ID, refunds made elsewhere by their Stripe refund ID.
+// The webhook can arrive before ProcessRefund attaches the Stripe ID, so both are checked.
+func (r *refundRepository) SyncStripeRefund(ctx context.Context, refund *models.Refund) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var existing models.Refund
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ? OR stripe_refund_id = ?", refund.ID, refund.StripeRefundID).
+			First(&existing).Error
+
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if err := tx.Create(refund).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			existing.StripeRefundID = refund.StripeRefundID
+			existing.Amount = refund.Amount
+			existing.Status = refund.Status
+			if refund.Reason != "" {
+				existing.Reason = refund.Reason
+			}
+			if err := tx.Save(&existing).Error; err != nil {
+				return err
+			}
+			*refund = existing
+		}
+
+		return syncRefundedAmount(tx, refund.PaymentID)
+	})
+}
+
+func (r *refundRepository) ListRefundsByPaymentID(ctx context.Context, paymentID string) ([]*models.Refund, error) {
+	var refunds []*models.Refund
+	if err := r.db.WithContext(ctx).Where("payment_id = ?", paymentID).Order("created_at ASC").Find(&refunds).Error; err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// ListStalePendingRefunds returns pending refunds not updated since before, oldest first
+func (r *refundRepository) ListStalePendingRefunds(ctx context.Context, before time.Time, limit int) ([]*models.Refund, error) {
+	var refunds []*models.Refund
+	if err := r.db.WithContext(ctx).
+		Where("status = ? AND updated_at < ?", models.RefundStatusPending, before).
+		Order("updated_at ASC").
+		Limit(limit).
+		Find(&refunds).Error; err != nil {
+		return nil, err
+	}
+	return refunds, nil
+}
+
+// TouchRefund sets the updated time of the refund to now, postponing its next reconciliation
+func (r *refundRepository) TouchRefund(ctx context.Context, refundID string) error {
+	return r.db.WithContext(ctx).Model(&models.Refund{}).Where("id = ?", refundID).Update("updated_at", time.Now()).Error
+}
+
+// syncRefundedAmount recalculates the refunded total and status of a payment from its succeeded refunds
+func syncRefundedAmount(tx *gorm.DB, paymentID string) error {
+	var payment models.Payment
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&payment, "id = ?", paymentID).Error; err != nil {
+		return err
+	}
+
+	var refunded int64
+	if err := tx.Model(&models.Refund{}).
+		Where("payment_id = ? AND status = ?", paymentID, models.RefundStatusSucceeded).
+		Select("COALESCE(SUM(amount_minor), 0)").
+		Scan(&refunded).Error; err != nil {
+		return err
+	}
+
+	payment.SetRefundedAmount(refunded)
+	return tx.Save(&payment).Error
+}
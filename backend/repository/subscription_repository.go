@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"kimiyomi/models"
+	"time"
 
 	"gorm.io/gorm"
 )
@@ -11,8 +12,13 @@ import (
 type SubscriptionRepository interface {
 	GetByID(ctx context.Context, subscriptionID string) (*models.Subscription, error)
 	GetByUserID(ctx context.Context, userID string) ([]*models.Subscription, error)
+	ListByUserID(ctx context.Context, userID string, filter models.SubscriptionFilter) ([]*models.Subscription, error)
+	GetByStripeSubID(ctx context.Context, stripeSubID string) (*models.Subscription, error)
 	Create(ctx context.Context, subscription *models.Subscription) error
 	Update(ctx context.Context, subscription *models.Subscription) error
+	ListExpiring(ctx context.Context, endBefore time.Time, afterID string, limit int) ([]*models.Subscription, error)
+	ListOverdueRenewals(ctx context.Context, endBefore time.Time, limit int) ([]*models.Subscription, error)
+	ListDuePastDue(ctx context.Context, now time.Time, remindBefore time.Time, afterID string, limit int) ([]*models.Subscription, error)
 }
 
 type subscriptionRepository struct {
@@ -40,6 +46,34 @@ func (r *subscriptionRepository) GetByUserID(ctx context.Context, userID string)
 	return subscriptions, nil
 }
 
+// ListByUserID returns the user's subscriptions matching the filter, newest first
+func (r *subscriptionRepository) ListByUserID(ctx context.Context, userID string, filter models.SubscriptionFilter) ([]*models.Subscription, error) {
+	query := r.db.WithContext(ctx).Where("user_id = ?", userID)
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.PlanID != "" {
+		query = query.Where("plan_id = ?", filter.PlanID)
+	}
+	if filter.BillingCycle != "" {
+		query = query.Where("billing_cycle = ?", filter.BillingCycle)
+	}
+
+	var subscriptions []*models.Subscription
+	if err := query.Order("created_at DESC").Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+func (r *subscriptionRepository) GetByStripeSubID(ctx context.Context, stripeSubID string) (*models.Subscription, error) {
+	var subscription models.Subscription
+	if err := r.db.WithContext(ctx).First(&subscription, "stripe_sub_id = ?", stripeSubID).Error; err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
 func (r *subscriptionRepository) Create(ctx context.Context, subscription *models.Subscription) error {
 	return r.db.WithContext(ctx).Create(subscription).Error
 }
@@ -47,3 +81,50 @@ func (r *subscriptionRepository) Create(ctx context.Context, subscription *model
 func (r *subscriptionRepository) Update(ctx context.Context, subscription *models.Subscription) error {
 	return r.db.WithContext(ctx).Save(subscription).Error
 }
+
+// currentSubscriptionStatuses are the statuses for which models.Subscription.IsCurrent is true
+var currentSubscriptionStatuses = []string{models.SubscriptionStatusActive, models.SubscriptionStatusTrialing}
+
+// ListExpiring returns current subscriptions that will not renew and end before the given time.
+// Subscriptions without a Stripe subscription never renew. Results are ordered by ID after afterID
+// like ListDuePastDue, so subscriptions still waiting for their end date do not hide the rest.
+func (r *subscriptionRepository) ListExpiring(ctx context.Context, endBefore time.Time, afterID string, limit int) ([]*models.Subscription, error) {
+	var subscriptions []*models.Subscription
+	if err := r.db.WithContext(ctx).
+		Where("status IN ? AND end_date < ? AND (auto_renew = ? OR stripe_sub_id = '') AND id > ?", currentSubscriptionStatuses, endBefore, false, afterID).
+		Order("id ASC").
+		Limit(limit).
+		Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// ListOverdueRenewals returns renewing Stripe subscriptions whose period ended before the given time
+func (r *subscriptionRepository) ListOverdueRenewals(ctx context.Context, endBefore time.Time, limit int) ([]*models.Subscription, error) {
+	var subscriptions []*models.Subscription
+	if err := r.db.WithContext(ctx).
+		Where("status IN ? AND auto_renew = ? AND stripe_sub_id <> '' AND end_date < ?", currentSubscriptionStatuses, true, endBefore).
+		Order("end_date ASC").
+		Limit(limit).
+		Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// ListDuePastDue returns past-due subscriptions that need work at now: dunning not started yet,
+// a retry due, or a grace period ending before remindBefore. Results are ordered by ID after afterID,
+// so callers page through every due subscription instead of seeing the same first rows again.
+func (r *subscriptionRepository) ListDuePastDue(ctx context.Context, now time.Time, remindBefore time.Time, afterID string, limit int) ([]*models.Subscription, error) {
+	var subscriptions []*models.Subscription
+	if err := r.db.WithContext(ctx).
+		Where("status = ? AND id > ?", models.SubscriptionStatusPastDue, afterID).
+		Where("grace_until IS NULL OR grace_until <= ? OR next_retry_at <= ?", remindBefore, now).
+		Order("id ASC").
+		Limit(limit).
+		Find(&subscriptions).Error; err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"context"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// TrialRepository defines operations for free trial redemptions
+type TrialRepository interface {
+	Redeem(ctx context.Context, redemption *models.TrialRedemption) (bool, error)
+	Release(ctx context.Context, userID string, subscriptionID string) error
+}
+
+type trialRepository struct {
+	db *gorm.DB
+}
+
+// NewTrialRepository creates a new instance of TrialRepository
+func NewTrialRepository(db *gorm.DB) TrialRepository {
+	return &trialRepository{db: db}
+}
+
+// Redeem records the user's trial and reports whether the user had not used it yet
+func (r *trialRepository) Redeem(ctx context.Context, redemption *models.TrialRedemption) (bool, error) {
+	result := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(redemption)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Release gives the trial back when the subscription that redeemed it could not be started
+func (r *trialRepository) Release(ctx context.Context, userID string, subscriptionID string) error {
+	return r.db.WithContext(ctx).
+		Where("user_id = ? AND subscription_id = ?", userID, subscriptionID).
+		Delete(&models.TrialRedemption{}).Error
+}
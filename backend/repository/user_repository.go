@@ -2,6 +2,7 @@ package repository
 
 import (
 	"context"
+	"time"
 
 	"kimiyomi/models"
 
@@ -13,8 +14,11 @@ type UserRepository interface {
 	Create(ctx context.Context, user *models.User) error
 	GetByID(ctx context.Context, id string) (*models.User, error)
 	GetByEmail(ctx context.Context, email string) (*models.User, error) // Added for auth
+	GetByFirebaseUID(ctx context.Context, uid string) (*models.User, error)
+	SetStripeCustomerID(ctx context.Context, userID uint, previousID string, customerID string) error
 	Update(ctx context.Context, user *models.User) error
 	Delete(ctx context.Context, id string) error
+	ListActiveUsers(ctx context.Context, afterID uint, limit int) ([]models.User, error)
 }
 
 // --- Implementation ---
@@ -49,6 +53,22 @@ func (r *userRepository) GetByEmail(ctx context.Context, email string) (*models.
 	return &user, nil
 }
 
+func (r *userRepository) GetByFirebaseUID(ctx context.Context, uid string) (*models.User, error) {
+	var user models.User
+	if err := r.db.WithContext(ctx).Where("firebase_uid = ?", uid).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SetStripeCustomerID replaces the customer ID only if it still equals previousID,
+// so that concurrent requests keep the first customer that was stored
+func (r *userRepository) SetStripeCustomerID(ctx context.Context, userID uint, previousID string, customerID string) error {
+	return r.db.WithContext(ctx).Model(&models.User{}).
+		Where("id = ? AND stripe_customer_id = ?", userID, previousID).
+		Update("stripe_customer_id", customerID).Error
+}
+
 func (r *userRepository) Update(ctx context.Context, user *models.User) error {
 	return r.db.WithContext(ctx).Save(user).Error
 }
@@ -57,3 +77,17 @@ func (r *userRepository) Delete(ctx context.Context, id string) error {
 	// Assuming User ID is uint
 	return r.db.WithContext(ctx).Delete(&models.User{}, "id = ?", id).Error
 }
+
+// ListActiveUsers returns users who have completed the diagnosis, ordered by ID.
+// afterID is used as a keyset cursor for chunked processing.
+func (r *userRepository) ListActiveUsers(ctx context.Context, afterID uint, limit int) ([]models.User, error) {
+	var users []models.User
+	if err := r.db.WithContext(ctx).
+		Where("id > ? AND last_diagnosis > ?", afterID, time.Time{}).
+		Order("id ASC").
+		Limit(limit).
+		Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
@@ -0,0 +1,85 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"kimiyomi/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// webhookEventLease is how long a claim is held before another delivery may take the event over
+const webhookEventLease = 5 * time.Minute
+
+// WebhookEventRepository defines operations for webhook event deduplication
+type WebhookEventRepository interface {
+	Claim(ctx context.Context, source string, eventID string, eventType string) (bool, error)
+	Complete(ctx context.Context, source string, eventID string) error
+	Release(ctx context.Context, source string, eventID string) error
+}
+
+type webhookEventRepository struct {
+	db *gorm.DB
+}
+
+// NewWebhookEventRepository creates a new instance of WebhookEventRepository
+func NewWebhookEventRepository(db *gorm.DB) WebhookEventRepository {
+	return &webhookEventRepository{db: db}
+}
+
+// Claim starts processing the event under a lease and reports whether the caller should process it.
+// It returns false for processed events and models.ErrWebhookEventInProgress while another claim is live;
+// a claim whose lease has expired (the process died mid-way) is taken over.
+func (r *webhookEventRepository) Claim(ctx context.Context, source string, eventID string, eventType string) (bool, error) {
+	now := time.Now()
+	lockedUntil := now.Add(webhookEventLease)
+	event := &models.WebhookEvent{
+		Source:      source,
+		EventID:     eventID,
+		Type:        eventType,
+		Status:      models.WebhookEventStatusProcessing,
+		LockedUntil: &lockedUntil,
+	}
+	result := r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "source"}, {Name: "event_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"locked_until"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "webhook_events.status = ? AND webhook_events.locked_until < ?", Vars: []interface{}{models.WebhookEventStatusProcessing, now}},
+		}},
+	}).Create(event)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 1 {
+		return true, nil
+	}
+
+	var existing models.WebhookEvent
+	if err := r.db.WithContext(ctx).Where("source = ? AND event_id = ?", source, eventID).First(&existing).Error; err != nil {
+		return false, err
+	}
+	if existing.Status == models.WebhookEventStatusProcessed {
+		return false, nil
+	}
+	return false, models.ErrWebhookEventInProgress
+}
+
+// Complete marks a claimed event as processed so that redeliveries are skipped
+func (r *webhookEventRepository) Complete(ctx context.Context, source string, eventID string) error {
+	return r.db.WithContext(ctx).Model(&models.WebhookEvent{}).
+		Where("source = ? AND event_id = ?", source, eventID).
+		Updates(map[string]interface{}{
+			"status":       models.WebhookEventStatusProcessed,
+			"locked_until": nil,
+			"processed_at": time.Now(),
+		}).Error
+}
+
+// Release forgets a claimed event so that a redelivery is processed again
+func (r *webhookEventRepository) Release(ctx context.Context, source string, eventID string) error {
+	return r.db.WithContext(ctx).
+		Where("source = ? AND event_id = ? AND status = ?", source, eventID, models.WebhookEventStatusProcessing).
+		Delete(&models.WebhookEvent{}).Error
+}
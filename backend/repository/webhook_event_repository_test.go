@@ -0,0 +1,40 @@
+package repository
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookEventClaimTakesOverAbandonedEvents(t *testing.T) {
+	db := openTestDB(t, &models.WebhookEvent{})
+	repo := NewWebhookEventRepository(db)
+	ctx := context.Background()
+
+	claimed, err := repo.Claim(ctx, models.WebhookSourceStripe, "evt_1", "charge.succeeded")
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// 処理中の再送は後で再送させる
+	_, err = repo.Claim(ctx, models.WebhookSourceStripe, "evt_1", "charge.succeeded")
+	assert.ErrorIs(t, err, models.ErrWebhookEventInProgress)
+
+	// 処理中に落ちてリースが切れたイベントは再処理できる
+	require.NoError(t, db.Model(&models.WebhookEvent{}).Where("event_id = ?", "evt_1").
+		Update("locked_until", time.Now().Add(-time.Minute)).Error)
+	claimed, err = repo.Claim(ctx, models.WebhookSourceStripe, "evt_1", "charge.succeeded")
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// 処理済みのイベントは二度と処理しない
+	require.NoError(t, repo.Complete(ctx, models.WebhookSourceStripe, "evt_1"))
+	require.NoError(t, repo.Release(ctx, models.WebhookSourceStripe, "evt_1"))
+	claimed, err = repo.Claim(ctx, models.WebhookSourceStripe, "evt_1", "charge.succeeded")
+	require.NoError(t, err)
+	assert.False(t, claimed)
+}
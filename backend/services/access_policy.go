@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+)
+
+// PrincipalContextKey is the gin context key under which the auth middleware stores the Principal
+const PrincipalContextKey = "principal"
+
+// Roles granted through Firebase custom claims
+const (
+	RoleAdmin   = "admin"
+	RoleSupport = "support"
+)
+
+// ErrForbidden is returned when the principal is not allowed to perform an action
+var ErrForbidden = errors.New("forbidden")
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UID           string
+	Email         string
+	EmailVerified bool
+	Roles         []string
+}
+
+// PrincipalFromClaims builds a Principal from Firebase ID token claims.
+// Roles may be given as "admin": true, "role": "support" or "roles": ["admin", "support"].
+func PrincipalFromClaims(uid string, claims map[string]interface{}) *Principal {
+	p := &Principal{UID: uid}
+	if email, ok := claims["email"].(string); ok {
+		p.Email = email
+	}
+	if verified, ok := claims["email_verified"].(bool); ok {
+		p.EmailVerified = verified
+	}
+	if admin, ok := claims["admin"].(bool); ok && admin {
+		p.Roles = append(p.Roles, RoleAdmin)
+	}
+	if role, ok := claims["role"].(string); ok && role != "" {
+		p.Roles = append(p.Roles, role)
+	}
+	if roles, ok := claims["roles"].([]interface{}); ok {
+		for _, r := range roles {
+			if role, ok := r.(string); ok && role != "" {
+				p.Roles = append(p.Roles, role)
+			}
+		}
+	}
+	return p
+}
+
+// PrincipalFromContext returns the caller stored by the auth middleware, or nil.
+// It accepts *gin.Context without tying this package to gin.
+func PrincipalFromContext(c interface {
+	Get(key string) (interface{}, bool)
+}) *Principal {
+	principal, _ := c.Get(PrincipalContextKey)
+	p, _ := principal.(*Principal)
+	return p
+}
+
+// HasRole reports whether the principal has any of the given roles
+func (p *Principal) HasRole(roles ...string) bool {
+	if p == nil {
+		return false
+	}
+	for _, have := range p.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// auditor records denied access decisions
+type auditor struct {
+	auditRepo repository.AuditLogRepository
+}
+
+// deny writes an audit log entry and returns ErrForbidden
+func (a auditor) deny(ctx context.Context, principal *Principal, action string, resourceType string, resourceID string, reason string) error {
+	entry := &models.AuditLog{
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Decision:     models.AuditDecisionDenied,
+		Reason:       reason,
+	}
+	if principal != nil {
+		entry.ActorUID = principal.UID
+	}
+	if err := a.auditRepo.Create(ctx, entry); err != nil {
+		log.Printf("監査ログの記録に失敗 (%s %s/%s): %v", action, resourceType, resourceID, err)
+	}
+	return ErrForbidden
+}
+
+// PaymentPolicy decides who may read and refund payments
+type PaymentPolicy interface {
+	AuthorizeView(ctx context.Context, principal *Principal, payment *models.Payment) error
+	AuthorizeRefund(ctx context.Context, principal *Principal, payment *models.Payment) error
+}
+
+type paymentPolicy struct {
+	auditor
+}
+
+// NewPaymentPolicy creates a new instance of PaymentPolicy
+func NewPaymentPolicy(auditRepo repository.AuditLogRepository) PaymentPolicy {
+	return &paymentPolicy{auditor{auditRepo: auditRepo}}
+}
+
+// AuthorizeView allows owners and staff to read a payment
+func (p *paymentPolicy) AuthorizeView(ctx context.Context, principal *Principal, payment *models.Payment) error {
+	if principal != nil && principal.UID == payment.UserID {
+		return nil
+	}
+	if principal.HasRole(RoleAdmin, RoleSupport) {
+		return nil
+	}
+	return p.deny(ctx, principal, "payment.view", "payment", payment.ID, "not the owner")
+}
+
+// AuthorizeRefund allows only staff to refund, including the owner's own payments
+func (p *paymentPolicy) AuthorizeRefund(ctx context.Context, principal *Principal, payment *models.Payment) error {
+	if principal.HasRole(RoleAdmin, RoleSupport) {
+		return nil
+	}
+	return p.deny(ctx, principal, "payment.refund", "payment", payment.ID, "admin or support role required")
+}
+
+// SubscriptionPolicy decides who may read and manage subscriptions
+type SubscriptionPolicy interface {
+	AuthorizeView(ctx context.Context, principal *Principal, subscription *models.Subscription) error
+	AuthorizeViewUser(ctx context.Context, principal *Principal, userID string) error
+	AuthorizeManage(ctx context.Context, principal *Principal, subscription *models.Subscription) error
+}
+
+type subscriptionPolicy struct {
+	auditor
+}
+
+// NewSubscriptionPolicy creates a new instance of SubscriptionPolicy
+func NewSubscriptionPolicy(auditRepo repository.AuditLogRepository) SubscriptionPolicy {
+	return &subscriptionPolicy{auditor{auditRepo: auditRepo}}
+}
+
+// AuthorizeView allows owners and staff to read a subscription
+func (p *subscriptionPolicy) AuthorizeView(ctx context.Context, principal *Principal, subscription *models.Subscription) error {
+	if principal != nil && principal.UID == subscription.UserID {
+		return nil
+	}
+	if principal.HasRole(RoleAdmin, RoleSupport) {
+		return nil
+	}
+	return p.deny(ctx, principal, "subscription.view", "subscription", subscription.ID, "not the owner")
+}
+
+// AuthorizeViewUser allows users to read their own subscription status and staff to read anyone's
+func (p *subscriptionPolicy) AuthorizeViewUser(ctx context.Context, principal *Principal, userID string) error {
+	if principal != nil && principal.UID == userID {
+		return nil
+	}
+	if principal.HasRole(RoleAdmin, RoleSupport) {
+		return nil
+	}
+	return p.deny(ctx, principal, "subscription.view", "user", userID, "not the user")
+}
+
+// AuthorizeManage allows only the owner to cancel, reactivate or change a subscription.
+// Staff use the admin endpoints instead.
+func (p *subscriptionPolicy) AuthorizeManage(ctx context.Context, principal *Principal, subscription *models.Subscription) error {
+	if principal != nil && principal.UID == subscription.UserID {
+		return nil
+	}
+	return p.deny(ctx, principal, "subscription.manage", "subscription", subscription.ID, "not the owner")
+}
@@ -0,0 +1,323 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"kimiyomi/models"
+)
+
+// App Store Server API endpoints
+const (
+	AppStoreProductionURL = "https://api.storekit.itunes.apple.com"
+	AppStoreSandboxURL    = "https://api.storekit-sandbox.itunes.apple.com"
+)
+
+const (
+	// appStoreTokenLifetime must not exceed the 60 minutes accepted by Apple
+	appStoreTokenLifetime = 5 * time.Minute
+	// appStoreTransactionNotFound is the errorCode for a transaction unknown to the environment
+	appStoreTransactionNotFound = 4040010
+)
+
+// Marker extensions Apple puts on the certificates that sign App Store data
+var (
+	appleLeafCertOID         = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	appleIntermediateCertOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+)
+
+// AppStoreConfig holds the App Store Connect API key and the trust anchor for signed data
+type AppStoreConfig struct {
+	IssuerID   string
+	KeyID      string
+	PrivateKey *ecdsa.PrivateKey // App Store Connectで発行した.p8キー
+	BundleID   string
+	RootCAs    *x509.CertPool // Apple Root CA - G3
+	// BaseURLs are tried in order; a transaction missing from one environment is looked up in the next
+	BaseURLs   []string
+	HTTPClient *http.Client
+}
+
+// LoadAppStoreConfig reads the API key (.p8) and Apple's root certificate (PEM or DER) from files
+func LoadAppStoreConfig(issuerID, keyID, bundleID, privateKeyPath, rootCAPath string) (*AppStoreConfig, error) {
+	keyPEM, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("app store private key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("app store private key is not an ECDSA key")
+	}
+
+	rootData, err := os.ReadFile(rootCAPath)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootData) {
+		root, err := x509.ParseCertificate(rootData) // Appleが配布する.cerはDER形式
+		if err != nil {
+			return nil, err
+		}
+		roots.AddCert(root)
+	}
+
+	return &AppStoreConfig{
+		IssuerID:   issuerID,
+		KeyID:      keyID,
+		PrivateKey: ecKey,
+		BundleID:   bundleID,
+		RootCAs:    roots,
+		BaseURLs:   []string{AppStoreProductionURL, AppStoreSandboxURL},
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// appStoreTransaction is the decoded payload of a signed transaction (JWSTransactionDecodedPayload)
+type appStoreTransaction struct {
+	TransactionID         string `json:"transactionId"`
+	OriginalTransactionID string `json:"originalTransactionId"`
+	BundleID              string `json:"bundleId"`
+	ProductID             string `json:"productId"`
+	PurchaseDate          int64  `json:"purchaseDate"` // ミリ秒
+	ExpiresDate           int64  `json:"expiresDate"`
+	RevocationDate        int64  `json:"revocationDate"`
+	Environment           string `json:"environment"`
+	Price                 int64  `json:"price"` // 通貨単位の1000分の1
+	Currency              string `json:"currency"`
+}
+
+func (t *appStoreTransaction) verifiedPurchase() *VerifiedPurchase {
+	verified := &VerifiedPurchase{
+		ProductID:          t.ProductID,
+		PurchaseID:         t.TransactionID,
+		OriginalPurchaseID: t.OriginalTransactionID,
+		Environment:        t.Environment,
+		PurchasedAt:        time.UnixMilli(t.PurchaseDate),
+	}
+	if t.ExpiresDate > 0 {
+		verified.ExpiresAt = time.UnixMilli(t.ExpiresDate)
+	}
+	if t.RevocationDate > 0 {
+		revokedAt := time.UnixMilli(t.RevocationDate)
+		verified.RevokedAt = &revokedAt
+	}
+	if price, err := models.NewMoney(t.Price*int64(math.Pow10(models.CurrencyExponent(t.Currency)))/1000, t.Currency); err == nil {
+		verified.Price = price
+	}
+	return verified
+}
+
+type appStoreVerifier struct {
+	cfg *AppStoreConfig
+}
+
+// NewAppStoreVerifier creates a PurchaseVerifier backed by the App Store Server API
+func NewAppStoreVerifier(cfg *AppStoreConfig) PurchaseVerifier {
+	return &appStoreVerifier{cfg: cfg}
+}
+
+// Verify looks the transaction up with Apple instead of trusting the app's copy, so revocations and
+// the latest expiry are always reflected. The app may send the signed transaction or only its ID.
+func (v *appStoreVerifier) Verify(ctx context.Context, userID string, receipt *StoreReceipt) (*VerifiedPurchase, error) {
+	transactionID := receipt.TransactionID
+	if strings.Count(receipt.Data, ".") == 2 {
+		var signed appStoreTransaction
+		if err := verifyAppleJWS(receipt.Data, v.cfg.RootCAs, time.Now(), &signed); err != nil {
+			return nil, err
+		}
+		transactionID = signed.TransactionID
+	}
+	if transactionID == "" || strings.ContainsAny(transactionID, "/?#") {
+		return nil, ErrInvalidReceipt
+	}
+
+	signedTransaction, err := v.fetchTransaction(ctx, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	var transaction appStoreTransaction
+	if err := verifyAppleJWS(signedTransaction, v.cfg.RootCAs, time.Now(), &transaction); err != nil {
+		return nil, err
+	}
+	if transaction.BundleID != v.cfg.BundleID || transaction.TransactionID != transactionID {
+		return nil, ErrInvalidReceipt
+	}
+	if receipt.ProductID != "" && transaction.ProductID != receipt.ProductID {
+		return nil, ErrInvalidReceipt
+	}
+
+	return transaction.verifiedPurchase(), nil
+}
+
+// fetchTransaction calls Get Transaction Info and returns the signed transaction
+func (v *appStoreVerifier) fetchTransaction(ctx context.Context, transactionID string) (string, error) {
+	token, err := v.apiToken(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	for _, baseURL := range v.cfg.BaseURLs {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/inApps/v1/transactions/"+url.PathEscape(transactionID), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		resp, err := v.cfg.HTTPClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+		}
+		var body struct {
+			SignedTransactionInfo string `json:"signedTransactionInfo"`
+			ErrorCode             int    `json:"errorCode"`
+		}
+		decodeErr := json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusOK && decodeErr == nil:
+			return body.SignedTransactionInfo, nil
+		case resp.StatusCode == http.StatusNotFound && body.ErrorCode == appStoreTransactionNotFound:
+			continue // Sandboxの取引は本番環境では見つからない
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			return "", fmt.Errorf("%w: app store returned %d", ErrStoreUnavailable, resp.StatusCode)
+		case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusNotFound:
+			return "", ErrInvalidReceipt
+		default:
+			return "", fmt.Errorf("app store returned %d (error code %d)", resp.StatusCode, body.ErrorCode)
+		}
+	}
+	return "", ErrInvalidReceipt
+}
+
+// apiToken signs the ES256 bearer token for the App Store Server API
+func (v *appStoreVerifier) apiToken(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": v.cfg.KeyID, "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss": v.cfg.IssuerID,
+		"iat": now.Unix(),
+		"exp": now.Add(appStoreTokenLifetime).Unix(),
+		"aud": "appstoreconnect-v1",
+		"bid": v.cfg.BundleID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, v.cfg.PrivateKey, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWSの署名はDERではなく固定長のr||s
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyAppleJWS checks that data was signed by Apple and decodes its payload into v.
+// The x5c chain must lead to one of the roots and carry Apple's App Store marker extensions.
+func verifyAppleJWS(token string, roots *x509.CertPool, now time.Time, v interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidReceipt
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidReceipt
+	}
+	var header struct {
+		Alg string   `json:"alg"`
+		X5c []string `json:"x5c"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != "ES256" || len(header.X5c) < 2 {
+		return ErrInvalidReceipt
+	}
+
+	certs := make([]*x509.Certificate, len(header.X5c))
+	for i, encoded := range header.X5c {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return ErrInvalidReceipt
+		}
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return ErrInvalidReceipt
+		}
+	}
+	if !hasExtension(certs[0], appleLeafCertOID) || !hasExtension(certs[1], appleIntermediateCertOID) {
+		return ErrInvalidReceipt
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+	}
+
+	publicKey, ok := certs[0].PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return ErrInvalidReceipt
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(signature) != 64 {
+		return ErrInvalidReceipt
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(publicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return ErrInvalidReceipt
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidReceipt
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+	}
+	return nil
+}
+
+func hasExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testBundleID = "jp.kimiyomi.app"
+
+// testAppleChain is a throwaway root, intermediate and leaf shaped like the chain Apple signs App Store data with
+type testAppleChain struct {
+	roots   *x509.CertPool
+	leafKey *ecdsa.PrivateKey
+	x5c     []string
+}
+
+// newTestAppleChain issues the chain; markers controls whether the leaf and intermediate carry Apple's marker extensions
+func newTestAppleChain(t *testing.T, markers bool) *testAppleChain {
+	t.Helper()
+	notBefore, notAfter := time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour)
+	marker := func(oid asn1.ObjectIdentifier) []pkix.Extension {
+		if !markers {
+			return nil
+		}
+		return []pkix.Extension{{Id: oid, Value: []byte{0x05, 0x00}}} // ASN.1 NULL
+	}
+	issue := func(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		require.NoError(t, err)
+		cert, err := x509.ParseCertificate(der)
+		require.NoError(t, err)
+		return cert, key
+	}
+
+	root, rootKey := issue(&x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Test Root CA - G3"},
+		NotBefore: notBefore, NotAfter: notAfter, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign,
+	}, nil, nil)
+	intermediate, intermediateKey := issue(&x509.Certificate{
+		SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "Test Worldwide Developer Relations CA - G6"},
+		NotBefore: notBefore, NotAfter: notAfter, IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageCertSign, ExtraExtensions: marker(appleIntermediateCertOID),
+	}, root, rootKey)
+	leaf, leafKey := issue(&x509.Certificate{
+		SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "Test Prod ECC Mac App Store and iTunes Store Receipt Signing"},
+		NotBefore: notBefore, NotAfter: notAfter, KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtraExtensions: marker(appleLeafCertOID),
+	}, intermediate, intermediateKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	return &testAppleChain{
+		roots:   roots,
+		leafKey: leafKey,
+		x5c: []string{
+			base64.StdEncoding.EncodeToString(leaf.Raw),
+			base64.StdEncoding.EncodeToString(intermediate.Raw),
+			base64.StdEncoding.EncodeToString(root.Raw),
+		},
+	}
+}
+
+// sign encodes the payload as an ES256 JWS with the chain in the x5c header
+func (c *testAppleChain) sign(t *testing.T, payload interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]interface{}{"alg": "ES256", "x5c": c.x5c})
+	require.NoError(t, err)
+	body, err := json.Marshal(payload)
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, c.leafKey, digest[:])
+	require.NoError(t, err)
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyAppleJWSAcceptsChainToTrustedRoot(t *testing.T) {
+	chain := newTestAppleChain(t, true)
+	token := chain.sign(t, map[string]interface{}{"transactionId": "2000000123456789", "bundleId": testBundleID})
+
+	var transaction appStoreTransaction
+	require.NoError(t, verifyAppleJWS(token, chain.roots, time.Now(), &transaction))
+	assert.Equal(t, "2000000123456789", transaction.TransactionID)
+	assert.Equal(t, testBundleID, transaction.BundleID)
+}
+
+func TestVerifyAppleJWSRejectsForeignRoot(t *testing.T) {
+	trusted := newTestAppleChain(t, true)
+	foreign := newTestAppleChain(t, true)
+	token := foreign.sign(t, map[string]interface{}{"transactionId": "2000000123456789"})
+
+	var transaction appStoreTransaction
+	assert.ErrorIs(t, verifyAppleJWS(token, trusted.roots, time.Now(), &transaction), ErrInvalidReceipt)
+}
+
+func TestVerifyAppleJWSRejectsBadSignature(t *testing.T) {
+	chain := newTestAppleChain(t, true)
+	token := chain.sign(t, map[string]interface{}{"transactionId": "2000000123456789", "price": 480000})
+
+	// 署名はそのままで金額を書き換える
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"transactionId":"2000000123456789","price":1000}`))
+	var transaction appStoreTransaction
+	assert.ErrorIs(t, verifyAppleJWS(strings.Join(parts, "."), chain.roots, time.Now(), &transaction), ErrInvalidReceipt)
+}
+
+func TestVerifyAppleJWSRequiresAppleMarkers(t *testing.T) {
+	chain := newTestAppleChain(t, false)
+	token := chain.sign(t, map[string]interface{}{"transactionId": "2000000123456789"})
+
+	var transaction appStoreTransaction
+	assert.ErrorIs(t, verifyAppleJWS(token, chain.roots, time.Now(), &transaction), ErrInvalidReceipt)
+}
+
+func TestVerifyAppleJWSRejectsExpiredChain(t *testing.T) {
+	chain := newTestAppleChain(t, true)
+	token := chain.sign(t, map[string]interface{}{"transactionId": "2000000123456789"})
+
+	var transaction appStoreTransaction
+	assert.ErrorIs(t, verifyAppleJWS(token, chain.roots, time.Now().Add(48*time.Hour), &transaction), ErrInvalidReceipt)
+}
@@ -121,6 +121,40 @@ func (s *CacheService) GetStats(ctx context.Context) (map[string]interface{}, er
 	}, nil
 }
 
+// GetJSON 任意の値をキャッシュから取得する。キャッシュがなければfalseを返す
+func (s *CacheService) GetJSON(ctx context.Context, key string, dest interface{}) (bool, error) {
+	val, err := s.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("キャッシュの取得に失敗: %w", err)
+	}
+
+	if err := json.Unmarshal(val, dest); err != nil {
+		return false, fmt.Errorf("キャッシュのデシリアライズに失敗: %w", err)
+	}
+	return true, nil
+}
+
+// SetJSON 任意の値をキャッシュに保存する
+func (s *CacheService) SetJSON(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("キャッシュのシリアライズに失敗: %w", err)
+	}
+
+	if err := s.client.Set(ctx, key, data, ttl).Err(); err != nil {
+		return fmt.Errorf("キャッシュの保存に失敗: %w", err)
+	}
+	return nil
+}
+
+// Delete キャッシュを削除する
+func (s *CacheService) Delete(ctx context.Context, keys ...string) error {
+	return s.client.Del(ctx, keys...).Err()
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+)
+
+// CompatibilityMatrixJobName is the job name recorded in the job progress table
+const CompatibilityMatrixJobName = "compatibility-matrix"
+
+// jst 日替わりの区切りに使うタイムゾーン
+var jst = time.FixedZone("Asia/Tokyo", 9*60*60)
+
+// CompatibilityMatrixJob 日替わり相性候補を事前計算する夜間バッチ。
+// 全ユーザーを互いに採点するため計算量はユーザー数の2乗に比例し、対象ユーザーは全員メモリに載せる。
+// 数万人規模を超える場合は候補の絞り込み（地域・年齢などでの分割）が必要になる。
+type CompatibilityMatrixJob struct {
+	compRepo repository.CompatibilityRepository
+	userRepo repository.UserRepository
+	jobRepo  repository.JobRepository
+	config   *CompatibilityMatrixConfig
+}
+
+// CompatibilityMatrixConfig 夜間バッチの設定
+type CompatibilityMatrixConfig struct {
+	ChunkSize         int // 1チャンクで処理するユーザー数
+	CandidatesPerUser int // ユーザーごとに保存する候補数
+}
+
+// Validate checks that the chunk size and the number of candidates are positive
+func (c *CompatibilityMatrixConfig) Validate() error {
+	if c.ChunkSize <= 0 {
+		return fmt.Errorf("チャンクサイズは1以上にしてください: %d", c.ChunkSize)
+	}
+	if c.CandidatesPerUser <= 0 {
+		return fmt.Errorf("ユーザーごとの候補数は1以上にしてください: %d", c.CandidatesPerUser)
+	}
+	return nil
+}
+
+// NewCompatibilityMatrixJob creates a new instance of CompatibilityMatrixJob
+func NewCompatibilityMatrixJob(compRepo repository.CompatibilityRepository, userRepo repository.UserRepository, jobRepo repository.JobRepository, config *CompatibilityMatrixConfig) (*CompatibilityMatrixJob, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &CompatibilityMatrixJob{
+		compRepo: compRepo,
+		userRepo: userRepo,
+		jobRepo:  jobRepo,
+		config:   config,
+	}, nil
+}
+
+// Run computes the day's candidates for every active user.
+// Progress is committed per chunk, so a crashed run resumes after the last finished chunk.
+func (j *CompatibilityMatrixJob) Run(ctx context.Context) error {
+	date := matchDate(time.Now())
+	progress, err := j.jobRepo.GetOrCreateProgress(ctx, CompatibilityMatrixJobName, date.Format("2006-01-02"))
+	if err != nil {
+		return fmt.Errorf("ジョブ進捗の取得に失敗: %w", err)
+	}
+	if progress.Status == models.JobStatusSucceeded {
+		return nil
+	}
+
+	if err := j.run(ctx, date, progress); err != nil {
+		progress.Status = models.JobStatusFailed
+		progress.LastError = err.Error()
+		if updateErr := j.jobRepo.UpdateProgress(ctx, progress); updateErr != nil {
+			log.Printf("ジョブ進捗の保存に失敗: %v", updateErr)
+		}
+		return err
+	}
+
+	now := time.Now()
+	progress.Status = models.JobStatusSucceeded
+	progress.LastError = ""
+	progress.FinishedAt = &now
+	return j.jobRepo.UpdateProgress(ctx, progress)
+}
+
+func (j *CompatibilityMatrixJob) run(ctx context.Context, date time.Time, progress *models.JobProgress) error {
+	pool, err := j.loadActiveUsers(ctx)
+	if err != nil {
+		return fmt.Errorf("対象ユーザーの取得に失敗: %w", err)
+	}
+
+	progress.Status = models.JobStatusRunning
+	progress.Total = len(pool)
+	if err := j.jobRepo.UpdateProgress(ctx, progress); err != nil {
+		return err
+	}
+
+	// 前回のカーソル以降から再開する
+	start := sort.Search(len(pool), func(i int) bool { return pool[i].ID > progress.Cursor })
+
+	for start < len(pool) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		end := start + j.config.ChunkSize
+		if end > len(pool) {
+			end = len(pool)
+		}
+		chunk := pool[start:end]
+
+		userIDs := make([]uint, 0, len(chunk))
+		var matches []models.DailyMatch
+		for i := range chunk {
+			userIDs = append(userIDs, chunk[i].ID)
+			matches = append(matches, j.rankCandidates(&chunk[i], pool, date)...)
+		}
+
+		if err := j.compRepo.ReplaceDailyMatches(ctx, userIDs, date, matches); err != nil {
+			return fmt.Errorf("相性候補の保存に失敗: %w", err)
+		}
+
+		progress.Cursor = chunk[len(chunk)-1].ID
+		progress.Processed += len(chunk)
+		if err := j.jobRepo.UpdateProgress(ctx, progress); err != nil {
+			return err
+		}
+		start = end
+	}
+
+	return nil
+}
+
+// loadActiveUsers loads every diagnosed user ordered by ID
+func (j *CompatibilityMatrixJob) loadActiveUsers(ctx context.Context) ([]models.User, error) {
+	var users []models.User
+	var afterID uint
+	for {
+		page, err := j.userRepo.ListActiveUsers(ctx, afterID, j.config.ChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, page...)
+		if len(page) < j.config.ChunkSize {
+			return users, nil
+		}
+		afterID = page[len(page)-1].ID
+	}
+}
+
+// rankCandidates scores the user against the pool and keeps the best candidates
+func (j *CompatibilityMatrixJob) rankCandidates(user *models.User, pool []models.User, date time.Time) []models.DailyMatch {
+	var scored []models.DailyMatch
+	for i := range pool {
+		if pool[i].ID == user.ID {
+			continue
+		}
+		c := models.CalculateCompatibility(user, &pool[i])
+		scored = append(scored, models.DailyMatch{
+			UserID:      user.ID,
+			MatchDate:   date,
+			CandidateID: pool[i].ID,
+			Score:       c.Score,
+		})
+	}
+
+	sort.SliceStable(scored, func(a, b int) bool { return scored[a].Score > scored[b].Score })
+	if len(scored) > j.config.CandidatesPerUser {
+		scored = scored[:j.config.CandidatesPerUser]
+	}
+	for i := range scored {
+		scored[i].Rank = i + 1
+	}
+	return scored
+}
+
+// matchDate returns the JST calendar day the given time belongs to
+func matchDate(t time.Time) time.Time {
+	y, m, d := t.In(jst).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, jst)
+}
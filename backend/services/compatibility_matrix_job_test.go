@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// memoryActiveUserRepository pages the users by ID like ListActiveUsers
+type memoryActiveUserRepository struct {
+	repository.UserRepository
+	users []models.User
+}
+
+func (r *memoryActiveUserRepository) ListActiveUsers(ctx context.Context, afterID uint, limit int) ([]models.User, error) {
+	var page []models.User
+	for _, user := range r.users {
+		if user.ID > afterID && len(page) < limit {
+			page = append(page, user)
+		}
+	}
+	return page, nil
+}
+
+// memoryMatchRepository records the users of each saved chunk and can fail a given chunk
+type memoryMatchRepository struct {
+	repository.CompatibilityRepository
+	chunks  [][]uint
+	matches map[uint][]models.DailyMatch
+	failAt  int // この回数目の保存を失敗させる（0は失敗させない）
+	calls   int
+}
+
+func (r *memoryMatchRepository) ReplaceDailyMatches(ctx context.Context, userIDs []uint, date time.Time, matches []models.DailyMatch) error {
+	r.calls++
+	if r.calls == r.failAt {
+		return errors.New("connection reset")
+	}
+	r.chunks = append(r.chunks, userIDs)
+	for _, id := range userIDs {
+		delete(r.matches, id)
+	}
+	for _, match := range matches {
+		r.matches[match.UserID] = append(r.matches[match.UserID], match)
+	}
+	return nil
+}
+
+// memoryProgressRepository keeps one progress row per job and run key
+type memoryProgressRepository struct {
+	repository.JobRepository
+	progress map[string]models.JobProgress
+}
+
+func (r *memoryProgressRepository) GetOrCreateProgress(ctx context.Context, jobName string, runKey string) (*models.JobProgress, error) {
+	progress, ok := r.progress[jobName+"@"+runKey]
+	if !ok {
+		progress = models.JobProgress{JobName: jobName, RunKey: runKey}
+	}
+	return &progress, nil
+}
+
+func (r *memoryProgressRepository) UpdateProgress(ctx context.Context, progress *models.JobProgress) error {
+	r.progress[progress.JobName+"@"+progress.RunKey] = *progress
+	return nil
+}
+
+func newTestCompatibilityUsers(n int) []models.User {
+	users := make([]models.User, n)
+	for i := range users {
+		users[i] = models.User{
+			Model:       gorm.Model{ID: uint(i + 1)},
+			Big5Results: models.Big5Results{Openness: float64(i % 5), Extraversion: float64(i % 3)},
+		}
+	}
+	return users
+}
+
+func TestNewCompatibilityMatrixJobRejectsInvalidConfig(t *testing.T) {
+	for _, config := range []CompatibilityMatrixConfig{
+		{ChunkSize: 0, CandidatesPerUser: 10},
+		{ChunkSize: -1, CandidatesPerUser: 10},
+		{ChunkSize: 200, CandidatesPerUser: 0},
+	} {
+		config := config
+		job, err := NewCompatibilityMatrixJob(nil, nil, nil, &config)
+		assert.Error(t, err, "%+v", config)
+		assert.Nil(t, job)
+	}
+}
+
+func TestCompatibilityMatrixJobResumesAfterLastFinishedChunk(t *testing.T) {
+	users := &memoryActiveUserRepository{users: newTestCompatibilityUsers(7)}
+	matches := &memoryMatchRepository{matches: map[uint][]models.DailyMatch{}, failAt: 2}
+	jobs := &memoryProgressRepository{progress: map[string]models.JobProgress{}}
+	job, err := NewCompatibilityMatrixJob(matches, users, jobs, &CompatibilityMatrixConfig{ChunkSize: 3, CandidatesPerUser: 2})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	// 2チャンク目の保存で落ちると、1チャンク目までが進捗に残る
+	require.Error(t, job.Run(ctx))
+	progress, err := jobs.GetOrCreateProgress(ctx, CompatibilityMatrixJobName, matchDate(time.Now()).Format("2006-01-02"))
+	require.NoError(t, err)
+	assert.Equal(t, models.JobStatusFailed, progress.Status)
+	assert.Equal(t, uint(3), progress.Cursor)
+	assert.Equal(t, 3, progress.Processed)
+
+	// 再実行は4人目から始まり、処理済みのチャンクはやり直さない
+	require.NoError(t, job.Run(ctx))
+	assert.Equal(t, [][]uint{{1, 2, 3}, {4, 5, 6}, {7}}, matches.chunks)
+	progress, err = jobs.GetOrCreateProgress(ctx, CompatibilityMatrixJobName, matchDate(time.Now()).Format("2006-01-02"))
+	require.NoError(t, err)
+	assert.Equal(t, models.JobStatusSucceeded, progress.Status)
+	assert.Equal(t, uint(7), progress.Cursor)
+	assert.Equal(t, 7, progress.Processed)
+	assert.Equal(t, 7, progress.Total)
+	for _, user := range users.users {
+		assert.Len(t, matches.matches[user.ID], 2, user.ID)
+	}
+
+	// 完了済みの日はもう一度走らせても何もしない
+	require.NoError(t, job.Run(ctx))
+	assert.Len(t, matches.chunks, 3)
+}
@@ -5,13 +5,22 @@ import (
 	"errors"
 	"kimiyomi/models"
 	"kimiyomi/repository"
+	"log"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
 )
 
+// ErrDailyCompatibilityNotFound is returned when no candidate has been computed for the user today
+var ErrDailyCompatibilityNotFound = errors.New("daily compatibility is not available yet")
+
 // CompatibilityService defines the interface for compatibility logic
 type CompatibilityService interface {
 	CalculateCompatibility(ctx context.Context, user1ID string, user2ID string) (*models.Compatibility, error)
 	GetDailyCompatibility(ctx context.Context, userID string) (*models.Compatibility, error)
 	GetCompatibilityHistory(ctx context.Context, userID string, limit int) ([]models.Compatibility, error)
+	PurgeExpired(ctx context.Context) error
 }
 
 // compatibilityService implements CompatibilityService
@@ -67,16 +76,26 @@ func (s *compatibilityService) CalculateCompatibility(ctx context.Context, user1
 	return compatibility, nil
 }
 
-// GetDailyCompatibility gets a daily compatibility check with a random user
-func (s *compatibilityService) GetDailyCompatibility(ctx context.Context, userID string) (*models.Compatibility, error) {
-	// TODO: Get a random user ID (excluding userID) using userRepo
-	// randomUserID, err := s.userRepo.GetRandomUserID(ctx, userID)
-	// if err != nil {
-	// 	 return nil, err
-	// }
-	var randomUserID string = "some_random_user_id" // Placeholder
+// GetDailyCompatibility returns today's featured match from the nightly precomputed candidates.
+// firebaseUID identifies the caller; the candidates are keyed by the user's DB ID.
+func (s *compatibilityService) GetDailyCompatibility(ctx context.Context, firebaseUID string) (*models.Compatibility, error) {
+	user, err := s.userRepo.GetByFirebaseUID(ctx, firebaseUID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrDailyCompatibilityNotFound // 未登録のユーザーには候補がない
+	}
+	if err != nil {
+		return nil, err
+	}
 
-	return s.CalculateCompatibility(ctx, userID, randomUserID)
+	matches, err := s.compRepo.GetDailyMatches(ctx, user.ID, matchDate(time.Now()))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, ErrDailyCompatibilityNotFound
+	}
+
+	return s.CalculateCompatibility(ctx, strconv.FormatUint(uint64(user.ID), 10), strconv.FormatUint(uint64(matches[0].CandidateID), 10))
 }
 
 // generateCompatibilityDescription generates the description text for a compatibility result
@@ -118,3 +137,13 @@ func (s *compatibilityService) GetCompatibilityHistory(ctx context.Context, user
 	// return s.compRepo.GetCompatibilityHistoryByUserID(ctx, userID, limit)
 	return nil, errors.New("GetCompatibilityHistory not fully implemented") // Placeholder
 }
+
+// PurgeExpired deletes cached compatibility results that are past their expiry
+func (s *compatibilityService) PurgeExpired(ctx context.Context) error {
+	deleted, err := s.compRepo.DeleteExpired(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("期限切れの相性診断結果を%d件削除しました", deleted)
+	return nil
+}
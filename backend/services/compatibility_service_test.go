@@ -0,0 +1,47 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func (r *memoryMatchRepository) GetDailyMatches(ctx context.Context, userID uint, date time.Time) ([]models.DailyMatch, error) {
+	return r.matches[userID], nil
+}
+
+func (r *memoryMatchRepository) CreateCompatibilityResult(ctx context.Context, result *models.Compatibility) error {
+	return nil
+}
+
+func TestGetDailyCompatibilityResolvesFirebaseUID(t *testing.T) {
+	uid := "firebase-uid-1"
+	diagnosed := time.Now().Add(-24 * time.Hour)
+	users := &memoryUserRepository{users: []*models.User{
+		{Model: gorm.Model{ID: 1}, FirebaseUID: &uid, LastDiagnosis: diagnosed},
+		{Model: gorm.Model{ID: 2}, LastDiagnosis: diagnosed},
+	}}
+	matches := &memoryMatchRepository{matches: map[uint][]models.DailyMatch{
+		1: {{UserID: 1, Rank: 1, CandidateID: 2}},
+	}}
+	service := NewCompatibilityService(matches, users)
+
+	result, err := service.GetDailyCompatibility(context.Background(), uid)
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), result.User1ID)
+	assert.Equal(t, uint(2), result.User2ID)
+
+	// 候補のないユーザーと未登録のユーザーは404にする
+	other := "firebase-uid-2"
+	users.users[1].FirebaseUID = &other
+	_, err = service.GetDailyCompatibility(context.Background(), other)
+	assert.ErrorIs(t, err, ErrDailyCompatibilityNotFound)
+	_, err = service.GetDailyCompatibility(context.Background(), "unknown")
+	assert.ErrorIs(t, err, ErrDailyCompatibilityNotFound)
+}
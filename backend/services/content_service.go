@@ -5,36 +5,99 @@ import (
 
 	"kimiyomi/models"
 	"kimiyomi/repository"
+
+	"gorm.io/gorm"
 )
 
-// ContentService handles business logic for content-related operations
+// ContentService handles business logic for content-related operations.
+// Reads are made for a principal: admins see everything, other users only listed content,
+// with the media of content they cannot access hidden.
 type ContentService interface {
-	GetContent(ctx context.Context, id string) (*models.Content, error)
-	ListContents(ctx context.Context, filter models.ContentFilter) ([]models.Content, error)
+	GetContent(ctx context.Context, principal *Principal, id string) (*models.Content, error)
+	ListContents(ctx context.Context, principal *Principal, filter models.ContentFilter) ([]models.Content, error)
 	CreateContent(ctx context.Context, content *models.Content) error
 	UpdateContent(ctx context.Context, content *models.Content) error
 	DeleteContent(ctx context.Context, id string) error
 }
 
 type contentService struct {
-	repo repository.ContentRepository
+	repo         repository.ContentRepository
+	entitlements EntitlementService
 }
 
 // NewContentService creates a new instance of ContentService
-func NewContentService(repo repository.ContentRepository) ContentService {
+func NewContentService(repo repository.ContentRepository, entitlements EntitlementService) ContentService {
 	return &contentService{
-		repo: repo,
+		repo:         repo,
+		entitlements: entitlements,
 	}
 }
 
-// GetContent retrieves content by ID
-func (s *contentService) GetContent(ctx context.Context, id string) (*models.Content, error) {
-	return s.repo.GetByID(ctx, id)
+// GetContent retrieves content by ID; unlisted content is reported as not found to non-admins
+func (s *contentService) GetContent(ctx context.Context, principal *Principal, id string) (*models.Content, error) {
+	content, err := s.repo.GetByID(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if principal.HasRole(RoleAdmin) {
+		return content, nil
+	}
+	if !content.IsListed() {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	contents := []models.Content{*content}
+	if err := s.lockInaccessible(ctx, principal, contents); err != nil {
+		return nil, err
+	}
+	return &contents[0], nil
 }
 
 // ListContents retrieves contents based on filter
-func (s *contentService) ListContents(ctx context.Context, filter models.ContentFilter) ([]models.Content, error) {
-	return s.repo.FindAll(ctx, filter)
+func (s *contentService) ListContents(ctx context.Context, principal *Principal, filter models.ContentFilter) ([]models.Content, error) {
+	contents, err := s.repo.FindAll(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if principal.HasRole(RoleAdmin) {
+		return contents, nil
+	}
+
+	listed := make([]models.Content, 0, len(contents))
+	for _, content := range contents {
+		if content.IsListed() {
+			listed = append(listed, content)
+		}
+	}
+	if err := s.lockInaccessible(ctx, principal, listed); err != nil {
+		return nil, err
+	}
+	return listed, nil
+}
+
+// lockInaccessible turns the contents the principal cannot access into teasers.
+// Entitlements are only loaded when some content is not free.
+func (s *contentService) lockInaccessible(ctx context.Context, principal *Principal, contents []models.Content) error {
+	var entitlements *Entitlements
+	for i := range contents {
+		content := &contents[i]
+		if content.AccessLevel == "" || content.AccessLevel == models.AccessLevelFree {
+			continue
+		}
+		if entitlements == nil {
+			entitlements = &Entitlements{}
+			if principal != nil {
+				var err error
+				if entitlements, err = s.entitlements.Get(ctx, principal.UID); err != nil {
+					return err
+				}
+			}
+		}
+		if !entitlements.CanAccess(content) {
+			content.Lock()
+		}
+	}
+	return nil
 }
 
 // CreateContent creates new content
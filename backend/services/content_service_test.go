@@ -0,0 +1,133 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+type memoryContentRepository struct {
+	repository.ContentRepository
+	contents []models.Content
+}
+
+func (r memoryContentRepository) GetByID(ctx context.Context, id string) (*models.Content, error) {
+	for _, content := range r.contents {
+		if content.ID == id {
+			return &content, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r memoryContentRepository) FindAll(ctx context.Context, filter models.ContentFilter) ([]models.Content, error) {
+	return append([]models.Content(nil), r.contents...), nil
+}
+
+// staticEntitlementService returns fixed entitlements and counts the lookups
+type staticEntitlementService struct {
+	EntitlementService
+	entitlements map[string]*Entitlements
+	calls        int
+}
+
+func (s *staticEntitlementService) Get(ctx context.Context, userID string) (*Entitlements, error) {
+	s.calls++
+	if entitlements, ok := s.entitlements[userID]; ok {
+		return entitlements, nil
+	}
+	return &Entitlements{UserID: userID}, nil
+}
+
+func newTestContentService() (ContentService, *staticEntitlementService) {
+	entitlements := &staticEntitlementService{entitlements: map[string]*Entitlements{
+		"subscriber": {
+			Features: []string{FeaturePremium},
+			Grants:   []EntitlementGrant{{Source: EntitlementSourceSubscription, SourceID: "sub-1", PlanID: "premium", Features: []string{FeaturePremium}}},
+		},
+		"buyer": {
+			ContentIDs: []string{"premium-1"},
+			Grants:     []EntitlementGrant{{Source: EntitlementSourceContent, SourceID: "pay-1", ContentID: "premium-1"}},
+		},
+	}}
+	repo := memoryContentRepository{contents: []models.Content{
+		{ID: "free-1", Title: "無料記事", Status: models.ContentStatusPublished, AccessLevel: models.AccessLevelFree, MediaURL: "https://cdn.example.com/free-1"},
+		{ID: "premium-1", Title: "プレミアム記事", Status: models.ContentStatusPublished, AccessLevel: models.AccessLevelPremium, MediaURL: "https://cdn.example.com/premium-1"},
+		{ID: "subscribers-1", Title: "会員限定動画", Status: models.ContentStatusPublished, AccessLevel: models.AccessLevelSubscribers, MediaURL: "https://cdn.example.com/subscribers-1"},
+		{ID: "draft-1", Title: "下書き", Status: models.ContentStatusDraft, AccessLevel: models.AccessLevelFree, MediaURL: "https://cdn.example.com/draft-1"},
+		{ID: "archived-1", Title: "公開終了", Status: models.ContentStatusArchived, AccessLevel: models.AccessLevelFree, MediaURL: "https://cdn.example.com/archived-1"},
+	}}
+	return NewContentService(repo, entitlements), entitlements
+}
+
+// lockedIDs returns the IDs of the listed contents and whether each is locked
+func lockedIDs(t *testing.T, contents []models.Content) map[string]bool {
+	locked := make(map[string]bool, len(contents))
+	for _, content := range contents {
+		if content.Locked {
+			assert.Empty(t, content.MediaURL, content.ID)
+		} else {
+			assert.NotEmpty(t, content.MediaURL, content.ID)
+		}
+		locked[content.ID] = content.Locked
+	}
+	return locked
+}
+
+func TestListContentsLocksByAccessLevel(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestContentService()
+
+	cases := map[string]map[string]bool{
+		"free-user":  {"free-1": false, "premium-1": true, "subscribers-1": true},
+		"subscriber": {"free-1": false, "premium-1": false, "subscribers-1": false},
+		"buyer":      {"free-1": false, "premium-1": false, "subscribers-1": true},
+	}
+	for uid, want := range cases {
+		contents, err := service.ListContents(ctx, &Principal{UID: uid}, models.ContentFilter{})
+		require.NoError(t, err)
+		assert.Equal(t, want, lockedIDs(t, contents), uid)
+	}
+
+	contents, err := service.ListContents(ctx, &Principal{UID: "admin", Roles: []string{RoleAdmin}}, models.ContentFilter{})
+	require.NoError(t, err)
+	assert.Len(t, contents, 5)
+	for _, content := range contents {
+		assert.False(t, content.Locked)
+	}
+}
+
+func TestGetContentHidesUnlistedFromNonAdmins(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestContentService()
+
+	_, err := service.GetContent(ctx, &Principal{UID: "subscriber"}, "draft-1")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	_, err = service.GetContent(ctx, &Principal{UID: "subscriber"}, "archived-1")
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	content, err := service.GetContent(ctx, &Principal{UID: "admin", Roles: []string{RoleAdmin}}, "draft-1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://cdn.example.com/draft-1", content.MediaURL)
+
+	content, err = service.GetContent(ctx, &Principal{UID: "free-user"}, "subscribers-1")
+	require.NoError(t, err)
+	assert.True(t, content.Locked)
+	assert.Empty(t, content.MediaURL)
+	assert.Equal(t, "会員限定動画", content.Title)
+}
+
+func TestGetFreeContentSkipsEntitlements(t *testing.T) {
+	service, entitlements := newTestContentService()
+
+	content, err := service.GetContent(context.Background(), &Principal{UID: "free-user"}, "free-1")
+	require.NoError(t, err)
+	assert.False(t, content.Locked)
+	assert.Zero(t, entitlements.calls)
+}
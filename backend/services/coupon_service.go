@@ -0,0 +1,234 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/coupon"
+	"gorm.io/gorm"
+)
+
+// Common errors for CouponService
+var (
+	// ErrCouponNotFound is returned for unknown promo codes
+	ErrCouponNotFound = errors.New("coupon not found")
+	// ErrCouponExpired is returned when the coupon is disabled or outside its validity window
+	ErrCouponExpired = errors.New("coupon is not valid at this time")
+	// ErrCouponNotApplicable is returned when the coupon does not cover the plan, currency or purchase
+	ErrCouponNotApplicable = errors.New("coupon cannot be applied to this purchase")
+	// ErrCouponCodeTaken is returned when registering a code that already exists
+	ErrCouponCodeTaken = errors.New("coupon code already exists")
+)
+
+// IsCouponError reports whether err means the promo code cannot be used, as opposed to a system failure
+func IsCouponError(err error) bool {
+	return errors.Is(err, ErrCouponNotFound) || errors.Is(err, ErrCouponExpired) || errors.Is(err, ErrCouponNotApplicable) ||
+		errors.Is(err, models.ErrCouponExhausted) || errors.Is(err, models.ErrCouponAlreadyUsed)
+}
+
+// CouponTarget is what a coupon is applied to
+type CouponTarget struct {
+	PlanID string       // 空の場合は単品購入
+	Amount models.Money // 単品購入の金額、またはサブスクリプションの初回請求額
+}
+
+// CouponQuote is the price after applying a coupon
+type CouponQuote struct {
+	Coupon   *models.Coupon
+	Discount models.Money
+	Total    models.Money
+}
+
+// CouponService manages promo codes and their redemptions
+type CouponService interface {
+	Quote(ctx context.Context, userID string, code string, target CouponTarget) (*CouponQuote, error)
+	Redeem(ctx context.Context, userID string, code string, target CouponTarget, redemption *models.CouponRedemption) (*CouponQuote, error)
+	Release(ctx context.Context, redemptionID string) error
+	ReleaseForPayment(ctx context.Context, paymentID string) error
+	ListCoupons(ctx context.Context) ([]*models.Coupon, error)
+	CreateCoupon(ctx context.Context, coupon *models.Coupon) error
+	DeactivateCoupon(ctx context.Context, code string) (*models.Coupon, error)
+	ListRedemptions(ctx context.Context, code string) ([]*models.CouponRedemption, error)
+}
+
+type couponService struct {
+	repo repository.CouponRepository
+}
+
+// NewCouponService creates a new instance of CouponService
+func NewCouponService(repo repository.CouponRepository) CouponService {
+	return &couponService{repo: repo}
+}
+
+// Quote checks whether the user can use the code for the target and computes the discount.
+// Limits are only checked here; Redeem enforces them atomically.
+func (s *couponService) Quote(ctx context.Context, userID string, code string, target CouponTarget) (*CouponQuote, error) {
+	c, err := s.getByCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	if !c.IsValidAt(time.Now()) {
+		return nil, ErrCouponExpired
+	}
+	if !c.AppliesToPlan(target.PlanID) {
+		return nil, ErrCouponNotApplicable
+	}
+	if target.PlanID != "" && c.StripeCouponID == "" {
+		return nil, ErrCouponNotApplicable // Stripe側にクーポンがなければサブスクリプションに適用できない
+	}
+
+	discount, ok := c.Discount(target.Amount)
+	if !ok {
+		return nil, ErrCouponNotApplicable
+	}
+	total := models.Money{Minor: target.Amount.Minor - discount.Minor, Currency: target.Amount.Currency}
+	if target.PlanID == "" && total.Minor <= 0 {
+		return nil, ErrCouponNotApplicable // 0円のPaymentIntentは作成できない
+	}
+
+	if c.MaxRedemptions > 0 && c.RedeemedCount >= c.MaxRedemptions {
+		return nil, models.ErrCouponExhausted
+	}
+	if c.MaxRedemptionsPerUser > 0 {
+		used, err := s.repo.CountUserRedemptions(ctx, c.ID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if used >= int64(c.MaxRedemptionsPerUser) {
+			return nil, models.ErrCouponAlreadyUsed
+		}
+	}
+	return &CouponQuote{Coupon: c, Discount: discount, Total: total}, nil
+}
+
+// Redeem applies the code and records the redemption, which must carry the payment or subscription ID.
+// Callers release the redemption if the purchase does not go through.
+func (s *couponService) Redeem(ctx context.Context, userID string, code string, target CouponTarget, redemption *models.CouponRedemption) (*CouponQuote, error) {
+	quote, err := s.Quote(ctx, userID, code, target)
+	if err != nil {
+		return nil, err
+	}
+
+	redemption.ID = uuid.NewString()
+	redemption.CouponID = quote.Coupon.ID
+	redemption.UserID = userID
+	redemption.Discount = quote.Discount
+	if err := s.repo.Redeem(ctx, redemption); err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+// Release gives the redemption's slot back
+func (s *couponService) Release(ctx context.Context, redemptionID string) error {
+	return s.repo.Release(ctx, redemptionID)
+}
+
+// ReleaseForPayment gives back the coupon used for a payment that was canceled or failed for good
+func (s *couponService) ReleaseForPayment(ctx context.Context, paymentID string) error {
+	redemptions, err := s.repo.ListRedemptionsByPaymentID(ctx, paymentID)
+	if err != nil {
+		return err
+	}
+	for _, redemption := range redemptions {
+		if redemption.Status != models.CouponRedemptionStatusRedeemed {
+			continue
+		}
+		if err := s.repo.Release(ctx, redemption.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *couponService) ListCoupons(ctx context.Context) ([]*models.Coupon, error) {
+	return s.repo.List(ctx)
+}
+
+// CreateCoupon registers a promo code and the Stripe coupon used for subscriptions.
+// Usage limits are enforced locally only, because released redemptions cannot be given back in Stripe.
+func (s *couponService) CreateCoupon(ctx context.Context, c *models.Coupon) error {
+	c.ID = uuid.NewString()
+	c.Code = models.NormalizeCouponCode(c.Code)
+	c.RedeemedCount = 0
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if _, err := s.repo.GetByCode(ctx, c.Code); err == nil {
+		return ErrCouponCodeTaken
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	params := &stripe.CouponParams{
+		ID:       stripe.String(c.ID),
+		Name:     stripe.String(c.Code),
+		Duration: stripe.String(c.Duration),
+	}
+	if c.Duration == models.CouponDurationRepeating {
+		params.DurationInMonths = stripe.Int64(int64(c.DurationInMonths))
+	}
+	if c.DiscountType == models.CouponDiscountPercent {
+		params.PercentOff = stripe.Float64(float64(c.PercentOff))
+	} else {
+		params.AmountOff = stripe.Int64(c.AmountOff.Minor)
+		params.Currency = stripe.String(strings.ToLower(c.AmountOff.Currency))
+	}
+	if c.ValidUntil != nil {
+		params.RedeemBy = stripe.Int64(c.ValidUntil.Unix())
+	}
+	params.AddMetadata("coupon_id", c.ID)
+
+	stripeCoupon, err := coupon.New(params)
+	if err != nil {
+		return err
+	}
+	c.StripeCouponID = stripeCoupon.ID
+
+	if err := s.repo.Create(ctx, c); err != nil {
+		// 同じコードの登録などで失敗した場合はStripe側のクーポンも削除する
+		if _, delErr := coupon.Del(stripeCoupon.ID, nil); delErr != nil {
+			log.Printf("Stripeクーポン %s の削除に失敗: %v", stripeCoupon.ID, delErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// DeactivateCoupon stops new redemptions; past redemptions and running discounts are kept
+func (s *couponService) DeactivateCoupon(ctx context.Context, code string) (*models.Coupon, error) {
+	c, err := s.getByCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	c.Active = false
+	if err := s.repo.Update(ctx, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ListRedemptions returns the redemptions of a coupon for campaign reporting
+func (s *couponService) ListRedemptions(ctx context.Context, code string) ([]*models.CouponRedemption, error) {
+	c, err := s.getByCode(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.ListRedemptionsByCouponID(ctx, c.ID)
+}
+
+func (s *couponService) getByCode(ctx context.Context, code string) (*models.Coupon, error) {
+	c, err := s.repo.GetByCode(ctx, models.NormalizeCouponCode(code))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCouponNotFound
+	}
+	return c, err
+}
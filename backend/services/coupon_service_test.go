@@ -0,0 +1,203 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// memoryCouponRepository enforces the redemption limits like the row-locking Redeem of couponRepository
+type memoryCouponRepository struct {
+	repository.CouponRepository
+	mu          sync.Mutex
+	coupons     map[string]*models.Coupon // コードごと
+	redemptions []*models.CouponRedemption
+}
+
+func newMemoryCouponRepository(coupons ...*models.Coupon) *memoryCouponRepository {
+	repo := &memoryCouponRepository{coupons: map[string]*models.Coupon{}}
+	for _, coupon := range coupons {
+		repo.coupons[coupon.Code] = coupon
+	}
+	return repo
+}
+
+func (r *memoryCouponRepository) GetByCode(ctx context.Context, code string) (*models.Coupon, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if coupon, ok := r.coupons[code]; ok {
+		copied := *coupon
+		return &copied, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryCouponRepository) CountUserRedemptions(ctx context.Context, couponID string, userID string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.countUserRedemptions(couponID, userID), nil
+}
+
+func (r *memoryCouponRepository) countUserRedemptions(couponID string, userID string) int64 {
+	var count int64
+	for _, redemption := range r.redemptions {
+		if redemption.CouponID == couponID && redemption.UserID == userID && redemption.Status == models.CouponRedemptionStatusRedeemed {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *memoryCouponRepository) Redeem(ctx context.Context, redemption *models.CouponRedemption) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var coupon *models.Coupon
+	for _, c := range r.coupons {
+		if c.ID == redemption.CouponID {
+			coupon = c
+		}
+	}
+	if coupon == nil {
+		return gorm.ErrRecordNotFound
+	}
+	if coupon.MaxRedemptions > 0 && coupon.RedeemedCount >= coupon.MaxRedemptions {
+		return models.ErrCouponExhausted
+	}
+	if coupon.MaxRedemptionsPerUser > 0 && r.countUserRedemptions(coupon.ID, redemption.UserID) >= int64(coupon.MaxRedemptionsPerUser) {
+		return models.ErrCouponAlreadyUsed
+	}
+	redemption.Status = models.CouponRedemptionStatusRedeemed
+	copied := *redemption
+	r.redemptions = append(r.redemptions, &copied)
+	coupon.RedeemedCount++
+	return nil
+}
+
+func (r *memoryCouponRepository) ListRedemptionsByPaymentID(ctx context.Context, paymentID string) ([]*models.CouponRedemption, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var redemptions []*models.CouponRedemption
+	for _, redemption := range r.redemptions {
+		if redemption.PaymentID == paymentID {
+			copied := *redemption
+			redemptions = append(redemptions, &copied)
+		}
+	}
+	return redemptions, nil
+}
+
+func (r *memoryCouponRepository) Release(ctx context.Context, redemptionID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, redemption := range r.redemptions {
+		if redemption.ID != redemptionID || redemption.Status != models.CouponRedemptionStatusRedeemed {
+			continue
+		}
+		redemption.Status = models.CouponRedemptionStatusReleased
+		for _, coupon := range r.coupons {
+			if coupon.ID == redemption.CouponID {
+				coupon.RedeemedCount--
+			}
+		}
+	}
+	return nil
+}
+
+func oneOffTarget(minor int64) CouponTarget {
+	return CouponTarget{Amount: models.Money{Minor: minor, Currency: "JPY"}}
+}
+
+func TestRedeemEnforcesTotalLimitAndReleaseGivesSlotBack(t *testing.T) {
+	repo := newMemoryCouponRepository(&models.Coupon{
+		ID: "coupon-1", Code: "SPRING", DiscountType: models.CouponDiscountFixed, AmountOff: models.Money{Minor: 300, Currency: "JPY"},
+		MaxRedemptions: 2, Active: true,
+	})
+	service := NewCouponService(repo)
+	ctx := context.Background()
+
+	first, err := service.Redeem(ctx, "user-1", "spring", oneOffTarget(1200), &models.CouponRedemption{PaymentID: "pay-1"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(300), first.Discount.Minor)
+	assert.Equal(t, int64(900), first.Total.Minor)
+	_, err = service.Redeem(ctx, "user-2", "SPRING", oneOffTarget(1200), &models.CouponRedemption{PaymentID: "pay-2"})
+	require.NoError(t, err)
+
+	_, err = service.Quote(ctx, "user-3", "SPRING", oneOffTarget(1200))
+	assert.ErrorIs(t, err, models.ErrCouponExhausted)
+	_, err = service.Redeem(ctx, "user-3", "SPRING", oneOffTarget(1200), &models.CouponRedemption{PaymentID: "pay-3"})
+	assert.ErrorIs(t, err, models.ErrCouponExhausted)
+
+	// 決済が成立しなかった利用を解放すると、別のユーザーが使える
+	require.NoError(t, service.ReleaseForPayment(ctx, "pay-1"))
+	_, err = service.Redeem(ctx, "user-3", "SPRING", oneOffTarget(1200), &models.CouponRedemption{PaymentID: "pay-3"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, repo.coupons["SPRING"].RedeemedCount)
+}
+
+func TestRedeemEnforcesPerUserLimit(t *testing.T) {
+	repo := newMemoryCouponRepository(&models.Coupon{
+		ID: "coupon-1", Code: "WELCOME", DiscountType: models.CouponDiscountPercent, PercentOff: 10,
+		MaxRedemptionsPerUser: 1, Active: true,
+	})
+	service := NewCouponService(repo)
+	ctx := context.Background()
+
+	redemption := &models.CouponRedemption{PaymentID: "pay-1"}
+	_, err := service.Redeem(ctx, "user-1", "WELCOME", oneOffTarget(1000), redemption)
+	require.NoError(t, err)
+	_, err = service.Redeem(ctx, "user-1", "WELCOME", oneOffTarget(1000), &models.CouponRedemption{PaymentID: "pay-2"})
+	assert.ErrorIs(t, err, models.ErrCouponAlreadyUsed)
+	assert.True(t, IsCouponError(err))
+
+	// 他のユーザーには影響しない
+	_, err = service.Redeem(ctx, "user-2", "WELCOME", oneOffTarget(1000), &models.CouponRedemption{PaymentID: "pay-3"})
+	require.NoError(t, err)
+
+	require.NoError(t, service.Release(ctx, redemption.ID))
+	_, err = service.Redeem(ctx, "user-1", "WELCOME", oneOffTarget(1000), &models.CouponRedemption{PaymentID: "pay-4"})
+	require.NoError(t, err)
+}
+
+func TestQuoteRejectsUnusableCoupons(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	repo := newMemoryCouponRepository(
+		&models.Coupon{ID: "c-expired", Code: "EXPIRED", DiscountType: models.CouponDiscountPercent, PercentOff: 10, ValidUntil: &past, Active: true},
+		&models.Coupon{ID: "c-inactive", Code: "INACTIVE", DiscountType: models.CouponDiscountPercent, PercentOff: 10},
+		&models.Coupon{ID: "c-plan", Code: "PREMIUM", DiscountType: models.CouponDiscountPercent, PercentOff: 10, PlanIDs: []string{"premium"}, StripeCouponID: "co_premium", Active: true},
+		&models.Coupon{ID: "c-usd", Code: "DOLLAR", DiscountType: models.CouponDiscountFixed, AmountOff: models.Money{Minor: 500, Currency: "USD"}, Active: true},
+		&models.Coupon{ID: "c-free", Code: "FREE", DiscountType: models.CouponDiscountPercent, PercentOff: 100, Active: true},
+	)
+	service := NewCouponService(repo)
+
+	tests := []struct {
+		code   string
+		target CouponTarget
+		want   error
+	}{
+		{"UNKNOWN", oneOffTarget(1000), ErrCouponNotFound},
+		{"EXPIRED", oneOffTarget(1000), ErrCouponExpired},
+		{"INACTIVE", oneOffTarget(1000), ErrCouponExpired},
+		{"PREMIUM", oneOffTarget(1000), ErrCouponNotApplicable},
+		{"DOLLAR", oneOffTarget(1000), ErrCouponNotApplicable},
+		// 0円の単品購入は作れない
+		{"FREE", oneOffTarget(1000), ErrCouponNotApplicable},
+		// Stripeクーポンのないコードはサブスクリプションに使えない
+		{"FREE", CouponTarget{PlanID: "basic", Amount: models.Money{Minor: 500, Currency: "JPY"}}, ErrCouponNotApplicable},
+	}
+	for _, tt := range tests {
+		_, err := service.Quote(context.Background(), "user-1", tt.code, tt.target)
+		assert.ErrorIs(t, err, tt.want, tt.code)
+	}
+
+	quote, err := service.Quote(context.Background(), "user-1", "premium", CouponTarget{PlanID: "premium", Amount: models.Money{Minor: 1000, Currency: "JPY"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), quote.Discount.Minor)
+}
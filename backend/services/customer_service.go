@@ -0,0 +1,219 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/customer"
+	"github.com/stripe/stripe-go/paymentmethod"
+	"github.com/stripe/stripe-go/setupintent"
+	"gorm.io/gorm"
+)
+
+// Common errors for CustomerService
+var (
+	ErrBillingEmailRequired  = errors.New("an email address is required to set up billing")
+	ErrEmailNotVerified      = errors.New("verify your email address to use the existing account")
+	ErrPaymentMethodNotFound = errors.New("payment method not found")
+)
+
+// SavedPaymentMethod is a card saved on the user's Stripe customer
+type SavedPaymentMethod struct {
+	ID        string
+	Brand     string
+	Last4     string
+	ExpMonth  uint64
+	ExpYear   uint64
+	IsDefault bool
+}
+
+// CustomerService links users to Stripe customers and manages their saved payment methods
+type CustomerService interface {
+	EnsureCustomer(ctx context.Context, principal *Principal) (*stripe.Customer, error)
+	CreateSetupIntent(ctx context.Context, principal *Principal) (*stripe.SetupIntent, error)
+	ListPaymentMethods(ctx context.Context, principal *Principal) ([]SavedPaymentMethod, error)
+	DetachPaymentMethod(ctx context.Context, principal *Principal, paymentMethodID string) error
+	SetDefaultPaymentMethod(ctx context.Context, principal *Principal, paymentMethodID string) error
+}
+
+type customerService struct {
+	userRepo repository.UserRepository
+}
+
+// NewCustomerService creates a new instance of CustomerService
+func NewCustomerService(userRepo repository.UserRepository) CustomerService {
+	return &customerService{userRepo: userRepo}
+}
+
+// EnsureCustomer returns the user's Stripe customer, creating the user row and the customer on first use
+func (s *customerService) EnsureCustomer(ctx context.Context, principal *Principal) (*stripe.Customer, error) {
+	user, err := s.findOrProvisionUser(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	previousID := user.StripeCustomerID
+	if previousID != "" {
+		c, err := customer.Get(previousID, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !c.Deleted {
+			return c, nil
+		}
+	}
+
+	// 同時リクエストでも同じ顧客が返るよう冪等キーを付ける
+	params := &stripe.CustomerParams{Email: stripe.String(user.Email)}
+	idempotencyKey := "customer-" + principal.UID
+	if previousID != "" {
+		idempotencyKey += "-" + previousID
+	}
+	params.SetIdempotencyKey(idempotencyKey)
+	params.AddMetadata("firebase_uid", principal.UID)
+	params.AddMetadata("user_id", strconv.FormatUint(uint64(user.ID), 10))
+
+	c, err := customer.New(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.userRepo.SetStripeCustomerID(ctx, user.ID, previousID, c.ID); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// findOrProvisionUser looks the user up by Firebase UID, linking or creating the row if needed
+func (s *customerService) findOrProvisionUser(ctx context.Context, principal *Principal) (*models.User, error) {
+	user, err := s.userRepo.GetByFirebaseUID(ctx, principal.UID)
+	if err == nil {
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if principal.Email == "" {
+		return nil, ErrBillingEmailRequired
+	}
+
+	uid := principal.UID
+	user, err = s.userRepo.GetByEmail(ctx, principal.Email)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		// Firebaseで登録されたユーザーはパスワードを持たない
+		user = &models.User{Email: principal.Email, FirebaseUID: &uid}
+		if err := s.userRepo.Create(ctx, user); err != nil {
+			return nil, err
+		}
+		return user, nil
+	case err != nil:
+		return nil, err
+	case user.FirebaseUID != nil && *user.FirebaseUID != uid:
+		return nil, fmt.Errorf("email %s is linked to another account", principal.Email)
+	case !principal.EmailVerified:
+		// 未確認のメールアドレスで既存ユーザーを乗っ取られないよう、確認済みの場合だけ紐付ける
+		return nil, ErrEmailNotVerified
+	}
+
+	user.FirebaseUID = &uid
+	if err := s.userRepo.Update(ctx, user); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// CreateSetupIntent starts saving a new card; the client confirms it with the returned client secret
+func (s *customerService) CreateSetupIntent(ctx context.Context, principal *Principal) (*stripe.SetupIntent, error) {
+	c, err := s.EnsureCustomer(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+	return setupintent.New(&stripe.SetupIntentParams{
+		Customer:           stripe.String(c.ID),
+		PaymentMethodTypes: stripe.StringSlice([]string{"card"}),
+		Usage:              stripe.String("off_session"),
+	})
+}
+
+// ListPaymentMethods returns the cards saved on the user's customer
+func (s *customerService) ListPaymentMethods(ctx context.Context, principal *Principal) ([]SavedPaymentMethod, error) {
+	c, err := s.EnsureCustomer(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	var defaultID string
+	if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil {
+		defaultID = c.InvoiceSettings.DefaultPaymentMethod.ID
+	}
+
+	methods := []SavedPaymentMethod{}
+	iter := paymentmethod.List(&stripe.PaymentMethodListParams{
+		Customer: stripe.String(c.ID),
+		Type:     stripe.String("card"),
+	})
+	for iter.Next() {
+		pm := iter.PaymentMethod()
+		saved := SavedPaymentMethod{ID: pm.ID, IsDefault: pm.ID == defaultID}
+		if pm.Card != nil {
+			saved.Brand = string(pm.Card.Brand)
+			saved.Last4 = pm.Card.Last4
+			saved.ExpMonth = pm.Card.ExpMonth
+			saved.ExpYear = pm.Card.ExpYear
+		}
+		methods = append(methods, saved)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+// DetachPaymentMethod removes a saved card from the user's customer
+func (s *customerService) DetachPaymentMethod(ctx context.Context, principal *Principal, paymentMethodID string) error {
+	if _, err := s.ownedPaymentMethod(ctx, principal, paymentMethodID); err != nil {
+		return err
+	}
+	_, err := paymentmethod.Detach(paymentMethodID, nil)
+	return err
+}
+
+// SetDefaultPaymentMethod makes a saved card the one used for later payments
+func (s *customerService) SetDefaultPaymentMethod(ctx context.Context, principal *Principal, paymentMethodID string) error {
+	c, err := s.ownedPaymentMethod(ctx, principal, paymentMethodID)
+	if err != nil {
+		return err
+	}
+	_, err = customer.Update(c.ID, &stripe.CustomerParams{
+		InvoiceSettings: &stripe.CustomerInvoiceSettingsParams{
+			DefaultPaymentMethod: stripe.String(paymentMethodID),
+		},
+	})
+	return err
+}
+
+// ownedPaymentMethod checks that the payment method is attached to the user's customer
+func (s *customerService) ownedPaymentMethod(ctx context.Context, principal *Principal, paymentMethodID string) (*stripe.Customer, error) {
+	c, err := s.EnsureCustomer(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+	pm, err := paymentmethod.Get(paymentMethodID, nil)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == 404 {
+			return nil, ErrPaymentMethodNotFound
+		}
+		return nil, err
+	}
+	if pm.Customer == nil || pm.Customer.ID != c.ID {
+		return nil, ErrPaymentMethodNotFound
+	}
+	return c, nil
+}
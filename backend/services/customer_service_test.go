@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// memoryUserRepository finds users by Firebase UID or email
+type memoryUserRepository struct {
+	repository.UserRepository
+	users []*models.User
+}
+
+func (r *memoryUserRepository) GetByFirebaseUID(ctx context.Context, uid string) (*models.User, error) {
+	for _, user := range r.users {
+		if user.FirebaseUID != nil && *user.FirebaseUID == uid {
+			return user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryUserRepository) GetByID(ctx context.Context, id string) (*models.User, error) {
+	for _, user := range r.users {
+		if strconv.FormatUint(uint64(user.ID), 10) == id {
+			return user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryUserRepository) GetByEmail(ctx context.Context, email string) (*models.User, error) {
+	for _, user := range r.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryUserRepository) Create(ctx context.Context, user *models.User) error {
+	user.ID = uint(len(r.users) + 1)
+	r.users = append(r.users, user)
+	return nil
+}
+
+func (r *memoryUserRepository) Update(ctx context.Context, user *models.User) error {
+	return nil
+}
+
+func TestPrincipalFromClaimsReadsEmailVerified(t *testing.T) {
+	p := PrincipalFromClaims("uid-1", map[string]interface{}{"email": "taro@example.com", "email_verified": true})
+	assert.True(t, p.EmailVerified)
+
+	p = PrincipalFromClaims("uid-1", map[string]interface{}{"email": "taro@example.com"})
+	assert.False(t, p.EmailVerified)
+}
+
+func TestFindOrProvisionUserLinksOnlyVerifiedEmail(t *testing.T) {
+	ctx := context.Background()
+	repo := &memoryUserRepository{users: []*models.User{{Model: gorm.Model{ID: 1}, Email: "taro@example.com"}}}
+	service := NewCustomerService(repo).(*customerService)
+
+	_, err := service.findOrProvisionUser(ctx, &Principal{UID: "uid-1", Email: "taro@example.com"})
+	assert.ErrorIs(t, err, ErrEmailNotVerified)
+	assert.Nil(t, repo.users[0].FirebaseUID)
+
+	user, err := service.findOrProvisionUser(ctx, &Principal{UID: "uid-1", Email: "taro@example.com", EmailVerified: true})
+	require.NoError(t, err)
+	assert.Equal(t, uint(1), user.ID)
+	require.NotNil(t, user.FirebaseUID)
+	assert.Equal(t, "uid-1", *user.FirebaseUID)
+
+	// 既存ユーザーがいなければ未確認でも新規作成する
+	user, err = service.findOrProvisionUser(ctx, &Principal{UID: "uid-2", Email: "hanako@example.com"})
+	require.NoError(t, err)
+	assert.Equal(t, uint(2), user.ID)
+}
@@ -0,0 +1,288 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+)
+
+// FeaturePremium is granted by every paid plan and gates premium routes and content
+const FeaturePremium = models.AccessLevelPremium
+
+// Entitlement sources
+const (
+	EntitlementSourceSubscription = "subscription" // Stripeサブスクリプション
+	EntitlementSourceStore        = "store"        // App Store / Google Playの購入
+	EntitlementSourceContent      = "content"      // コンテンツの単品購入
+)
+
+const (
+	entitlementCacheKeyPrefix = "entitlements:"
+	// entitlementCacheTTL bounds how stale a cached set can be if an invalidation is missed
+	entitlementCacheTTL = 5 * time.Minute
+)
+
+// EntitlementGrant is one source of access, kept so that support can see why a user has it
+type EntitlementGrant struct {
+	Source    string     `json:"source"`
+	SourceID  string     `json:"source_id"`
+	PlanID    string     `json:"plan_id,omitempty"`
+	Features  []string   `json:"features,omitempty"`
+	ContentID string     `json:"content_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // nilは無期限
+}
+
+// Entitlements is everything a user can currently access
+type Entitlements struct {
+	UserID     string             `json:"user_id"`
+	Features   []string           `json:"features"`
+	ContentIDs []string           `json:"content_ids"`
+	Grants     []EntitlementGrant `json:"grants"`
+	ComputedAt time.Time          `json:"computed_at"`
+}
+
+// HasFeature reports whether the user has the feature, e.g. FeaturePremium
+func (e *Entitlements) HasFeature(feature string) bool {
+	return containsString(e.Features, feature)
+}
+
+// HasContent reports whether the user bought the content individually
+func (e *Entitlements) HasContent(contentID string) bool {
+	return containsString(e.ContentIDs, contentID)
+}
+
+// IsSubscriber reports whether the user has a current plan from Stripe or a store
+func (e *Entitlements) IsSubscriber() bool {
+	for _, grant := range e.Grants {
+		if grant.Source == EntitlementSourceSubscription || grant.Source == EntitlementSourceStore {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccess reports whether the user may open the content.
+// Content bought individually is always accessible; content without an access level is free.
+func (e *Entitlements) CanAccess(content *models.Content) bool {
+	if e.HasContent(content.ID) {
+		return true
+	}
+	switch content.AccessLevel {
+	case "", models.AccessLevelFree:
+		return true
+	case models.AccessLevelPremium:
+		return e.HasFeature(FeaturePremium)
+	case models.AccessLevelSubscribers:
+		return e.IsSubscriber()
+	}
+	return false
+}
+
+// EntitlementInvalidator drops cached entitlements after the underlying records change
+type EntitlementInvalidator interface {
+	Invalidate(ctx context.Context, userID string) error
+}
+
+// EntitlementService is the single authority on what a user can access.
+// It merges Stripe subscriptions, store purchases and one-off content purchases.
+type EntitlementService interface {
+	EntitlementInvalidator
+	Get(ctx context.Context, userID string) (*Entitlements, error)
+}
+
+type entitlementService struct {
+	subRepo      repository.SubscriptionRepository
+	purchaseRepo repository.PurchaseRepository
+	payRepo      repository.PaymentRepository
+	planRepo     repository.PlanRepository
+	cache        *CacheService // nilの場合はキャッシュしない
+}
+
+// NewEntitlementService creates a new instance of EntitlementService
+func NewEntitlementService(subRepo repository.SubscriptionRepository, purchaseRepo repository.PurchaseRepository, payRepo repository.PaymentRepository, planRepo repository.PlanRepository, cache *CacheService) EntitlementService {
+	return &entitlementService{
+		subRepo:      subRepo,
+		purchaseRepo: purchaseRepo,
+		payRepo:      payRepo,
+		planRepo:     planRepo,
+		cache:        cache,
+	}
+}
+
+// Get returns the user's entitlements, from the cache when possible
+func (s *entitlementService) Get(ctx context.Context, userID string) (*Entitlements, error) {
+	if s.cache != nil {
+		var cached Entitlements
+		found, err := s.cache.GetJSON(ctx, entitlementCacheKeyPrefix+userID, &cached)
+		if err != nil {
+			log.Printf("権利情報のキャッシュ取得に失敗 (%s): %v", userID, err)
+		} else if found {
+			return &cached, nil
+		}
+	}
+
+	entitlements, err := s.compute(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cache != nil {
+		if ttl := entitlements.cacheTTL(); ttl > 0 {
+			if err := s.cache.SetJSON(ctx, entitlementCacheKeyPrefix+userID, entitlements, ttl); err != nil {
+				log.Printf("権利情報のキャッシュ保存に失敗 (%s): %v", userID, err)
+			}
+		}
+	}
+	return entitlements, nil
+}
+
+// Invalidate drops the cached entitlements of the user
+func (s *entitlementService) Invalidate(ctx context.Context, userID string) error {
+	if s.cache == nil || userID == "" {
+		return nil
+	}
+	return s.cache.Delete(ctx, entitlementCacheKeyPrefix+userID)
+}
+
+// compute builds the entitlements from the database
+func (s *entitlementService) compute(ctx context.Context, userID string) (*Entitlements, error) {
+	now := time.Now()
+	entitlements := &Entitlements{
+		UserID:     userID,
+		Features:   []string{},
+		ContentIDs: []string{},
+		Grants:     []EntitlementGrant{},
+		ComputedAt: now,
+	}
+
+	// 販売終了したプランも既存の契約には有効
+	plans, err := s.planRepo.List(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	plansByID := make(map[string]*models.Plan, len(plans))
+	plansByProduct := make(map[string]*models.Plan)
+	for _, plan := range plans {
+		plansByID[plan.ID] = plan
+		for _, productID := range plan.StoreProductIDs {
+			plansByProduct[productID] = plan
+		}
+	}
+
+	subscriptions, err := s.subRepo.GetByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, subscription := range subscriptions {
+		if !subscription.GrantsAccess(now) {
+			continue
+		}
+		grant := EntitlementGrant{
+			Source:   EntitlementSourceSubscription,
+			SourceID: subscription.ID,
+			PlanID:   subscription.PlanID,
+			Features: planFeatures(plansByID[subscription.PlanID]),
+		}
+		if subscription.Status == models.SubscriptionStatusPastDue {
+			grant.ExpiresAt = subscription.GraceUntil
+		} else if subscription.EndDate.After(now) {
+			endDate := subscription.EndDate
+			grant.ExpiresAt = &endDate
+		}
+		entitlements.Grants = append(entitlements.Grants, grant)
+	}
+
+	purchases, err := s.purchaseRepo.ListByUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, purchase := range purchases {
+		if !purchase.IsActiveAt(now) {
+			continue
+		}
+		plan, ok := plansByProduct[purchase.ProductID]
+		if !ok {
+			log.Printf("ストア商品 %s に対応するプランがありません (購入 %s)", purchase.ProductID, purchase.PurchaseID)
+			continue
+		}
+		grant := EntitlementGrant{
+			Source:   EntitlementSourceStore,
+			SourceID: purchase.PurchaseID,
+			PlanID:   plan.ID,
+			Features: planFeatures(plan),
+		}
+		if !purchase.ExpiresAt.IsZero() {
+			expiresAt := purchase.ExpiresAt
+			grant.ExpiresAt = &expiresAt
+		}
+		entitlements.Grants = append(entitlements.Grants, grant)
+	}
+
+	payments, err := s.payRepo.ListContentPurchases(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		entitlements.Grants = append(entitlements.Grants, EntitlementGrant{
+			Source:    EntitlementSourceContent,
+			SourceID:  payment.ID,
+			ContentID: payment.ContentID,
+		})
+	}
+
+	for _, grant := range entitlements.Grants {
+		for _, feature := range grant.Features {
+			if !containsString(entitlements.Features, feature) {
+				entitlements.Features = append(entitlements.Features, feature)
+			}
+		}
+		if grant.ContentID != "" && !containsString(entitlements.ContentIDs, grant.ContentID) {
+			entitlements.ContentIDs = append(entitlements.ContentIDs, grant.ContentID)
+		}
+	}
+	sort.Strings(entitlements.Features)
+	sort.Strings(entitlements.ContentIDs)
+	return entitlements, nil
+}
+
+// cacheTTL keeps the cached set from outliving the earliest expiring grant
+func (e *Entitlements) cacheTTL() time.Duration {
+	ttl := entitlementCacheTTL
+	for _, grant := range e.Grants {
+		if grant.ExpiresAt == nil {
+			continue
+		}
+		if remaining := grant.ExpiresAt.Sub(e.ComputedAt); remaining < ttl {
+			ttl = remaining
+		}
+	}
+	return ttl
+}
+
+// planFeatures returns the features of a plan; every paid plan includes FeaturePremium.
+// A plan missing from the catalog still grants FeaturePremium so that paying users are never locked out.
+func planFeatures(plan *models.Plan) []string {
+	features := []string{FeaturePremium}
+	if plan == nil {
+		return features
+	}
+	for _, feature := range plan.Entitlements {
+		if !containsString(features, feature) {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+func containsString(values []string, target string) bool {
+	for _, v := range values {
+		if v == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"kimiyomi/models"
+
+	"google.golang.org/api/androidpublisher/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// Subscription states of the Google Play Developer API (subscriptionsv2)
+const (
+	googlePlaySubscriptionPending         = "SUBSCRIPTION_STATE_PENDING"
+	googlePlaySubscriptionPendingCanceled = "SUBSCRIPTION_STATE_PENDING_PURCHASE_CANCELED"
+	googlePlayAcknowledgementPending      = "ACKNOWLEDGEMENT_STATE_PENDING"
+)
+
+// Purchase states of one-time products
+const (
+	googlePlayProductPurchased = 0
+	googlePlayProductPending   = 2
+	googlePlayPurchaseTypeTest = 0
+)
+
+// GooglePlayConfig holds the app's package name and the client options for the Developer API
+type GooglePlayConfig struct {
+	PackageName string
+	// ClientOptions carry the service account credentials; tests point the endpoint at a local server
+	ClientOptions []option.ClientOption
+}
+
+// GooglePlayAccountID is the obfuscated account ID the app must pass to the billing flow for the user.
+// It is compared with the purchase so that a token cannot be redeemed by another account.
+func GooglePlayAccountID(uid string) string {
+	sum := sha256.Sum256([]byte(uid))
+	return hex.EncodeToString(sum[:])
+}
+
+type googlePlayVerifier struct {
+	packageName string
+	publisher   *androidpublisher.Service
+}
+
+// NewGooglePlayVerifier creates a PurchaseVerifier backed by the Google Play Developer API
+func NewGooglePlayVerifier(ctx context.Context, cfg *GooglePlayConfig) (PurchaseVerifier, error) {
+	publisher, err := androidpublisher.NewService(ctx, cfg.ClientOptions...)
+	if err != nil {
+		return nil, err
+	}
+	return &googlePlayVerifier{packageName: cfg.PackageName, publisher: publisher}, nil
+}
+
+// Verify looks the purchase token up as a subscription first and as a one-time product otherwise,
+// checks that it was bought by the user, and acknowledges it so that Google does not refund it.
+func (v *googlePlayVerifier) Verify(ctx context.Context, userID string, receipt *StoreReceipt) (*VerifiedPurchase, error) {
+	if receipt.Data == "" {
+		return nil, ErrInvalidReceipt
+	}
+
+	subscription, err := v.publisher.Purchases.Subscriptionsv2.Get(v.packageName, receipt.Data).Context(ctx).Do()
+	if err == nil {
+		return v.verifySubscription(ctx, userID, receipt, subscription)
+	}
+	if !isGooglePlayNotFound(err) || receipt.ProductID == "" {
+		return nil, googlePlayError(err)
+	}
+
+	product, err := v.publisher.Purchases.Products.Get(v.packageName, receipt.ProductID, receipt.Data).Context(ctx).Do()
+	if err != nil {
+		return nil, googlePlayError(err)
+	}
+	return v.verifyProduct(ctx, userID, receipt, product)
+}
+
+func (v *googlePlayVerifier) verifySubscription(ctx context.Context, userID string, receipt *StoreReceipt, subscription *androidpublisher.SubscriptionPurchaseV2) (*VerifiedPurchase, error) {
+	switch subscription.SubscriptionState {
+	case googlePlaySubscriptionPending:
+		return nil, ErrPurchasePending
+	case googlePlaySubscriptionPendingCanceled:
+		return nil, ErrInvalidReceipt
+	}
+	if len(subscription.LineItems) == 0 {
+		return nil, ErrInvalidReceipt
+	}
+	lineItem := subscription.LineItems[0]
+	if receipt.ProductID != "" && lineItem.ProductId != receipt.ProductID {
+		return nil, ErrInvalidReceipt
+	}
+	var accountID string
+	if subscription.ExternalAccountIdentifiers != nil {
+		accountID = subscription.ExternalAccountIdentifiers.ObfuscatedExternalAccountId
+	}
+	if err := checkGooglePlayAccount(userID, accountID); err != nil {
+		return nil, err
+	}
+
+	verified := &VerifiedPurchase{
+		ProductID:          lineItem.ProductId,
+		PurchaseID:         subscription.LatestOrderId,
+		OriginalPurchaseID: receipt.Data, // 購入トークンは更新をまたいで変わらない
+		Environment:        googlePlayEnvironment(subscription.TestPurchase != nil),
+	}
+	if verified.PurchaseID == "" {
+		verified.PurchaseID = receipt.Data
+	}
+	var err error
+	if verified.PurchasedAt, err = parseGooglePlayTime(subscription.StartTime); err != nil {
+		return nil, err
+	}
+	if verified.ExpiresAt, err = parseGooglePlayTime(lineItem.ExpiryTime); err != nil {
+		return nil, err
+	}
+	autoRenew := lineItem.AutoRenewingPlan != nil && lineItem.AutoRenewingPlan.AutoRenewEnabled
+	verified.AutoRenew = &autoRenew
+	if lineItem.AutoRenewingPlan != nil && lineItem.AutoRenewingPlan.RecurringPrice != nil {
+		verified.Price = googlePlayMoney(lineItem.AutoRenewingPlan.RecurringPrice)
+	}
+
+	if subscription.AcknowledgementState == googlePlayAcknowledgementPending {
+		err := v.publisher.Purchases.Subscriptions.Acknowledge(v.packageName, lineItem.ProductId, receipt.Data, &androidpublisher.SubscriptionPurchasesAcknowledgeRequest{}).Context(ctx).Do()
+		if err != nil {
+			return nil, googlePlayError(err)
+		}
+	}
+	return verified, nil
+}
+
+func (v *googlePlayVerifier) verifyProduct(ctx context.Context, userID string, receipt *StoreReceipt, product *androidpublisher.ProductPurchase) (*VerifiedPurchase, error) {
+	switch product.PurchaseState {
+	case googlePlayProductPurchased:
+	case googlePlayProductPending:
+		return nil, ErrPurchasePending
+	default:
+		return nil, ErrInvalidReceipt // キャンセル済み
+	}
+	if err := checkGooglePlayAccount(userID, product.ObfuscatedExternalAccountId); err != nil {
+		return nil, err
+	}
+
+	verified := &VerifiedPurchase{
+		ProductID:          receipt.ProductID,
+		PurchaseID:         product.OrderId,
+		OriginalPurchaseID: receipt.Data,
+		Environment:        googlePlayEnvironment(product.PurchaseType != nil && *product.PurchaseType == googlePlayPurchaseTypeTest),
+		PurchasedAt:        time.UnixMilli(product.PurchaseTimeMillis),
+	}
+	if verified.PurchaseID == "" {
+		verified.PurchaseID = receipt.Data
+	}
+
+	if product.AcknowledgementState == 0 {
+		err := v.publisher.Purchases.Products.Acknowledge(v.packageName, receipt.ProductID, receipt.Data, &androidpublisher.ProductPurchasesAcknowledgeRequest{}).Context(ctx).Do()
+		if err != nil {
+			return nil, googlePlayError(err)
+		}
+	}
+	return verified, nil
+}
+
+// checkGooglePlayAccount rejects purchases made for another account or without an account ID
+func checkGooglePlayAccount(userID, obfuscatedAccountID string) error {
+	if obfuscatedAccountID == "" {
+		return ErrInvalidReceipt
+	}
+	if obfuscatedAccountID != GooglePlayAccountID(userID) {
+		return ErrPurchaseOwnedByAnotherUser
+	}
+	return nil
+}
+
+func googlePlayEnvironment(test bool) string {
+	if test {
+		return "Sandbox"
+	}
+	return "Production"
+}
+
+// googlePlayMoney converts the API's units and nanos to minor units; unknown currencies give a zero amount
+func googlePlayMoney(m *androidpublisher.Money) models.Money {
+	exp := models.CurrencyExponent(m.CurrencyCode)
+	price, err := models.NewMoney(m.Units*int64(math.Pow10(exp))+m.Nanos/int64(math.Pow10(9-exp)), m.CurrencyCode)
+	if err != nil {
+		return models.Money{}
+	}
+	return price
+}
+
+func parseGooglePlayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v", ErrInvalidReceipt, err)
+	}
+	return t, nil
+}
+
+func isGooglePlayNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusNotFound || apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusGone)
+}
+
+// googlePlayError maps API failures to the purchase errors returned to the app
+func googlePlayError(err error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	switch {
+	case isGooglePlayNotFound(err):
+		return ErrInvalidReceipt
+	case apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500:
+		return fmt.Errorf("%w: %v", ErrStoreUnavailable, err)
+	}
+	return err
+}
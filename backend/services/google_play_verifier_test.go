@@ -0,0 +1,162 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+)
+
+const (
+	testPackageName = "jp.kimiyomi.app"
+	testPlayToken   = "play-token-1"
+)
+
+// googlePlayStub serves canned Developer API responses and records acknowledgements
+type googlePlayStub struct {
+	mu           sync.Mutex
+	subscription map[string]interface{} // nilの場合はサブスクリプションとして404を返す
+	product      map[string]interface{}
+	acknowledged []string
+}
+
+func (s *googlePlayStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := "/androidpublisher/v3/applications/" + testPackageName + "/purchases/"
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":acknowledge"):
+		s.acknowledged = append(s.acknowledged, strings.TrimSuffix(path, ":acknowledge"))
+		w.WriteHeader(http.StatusNoContent)
+	case path == "subscriptionsv2/tokens/"+testPlayToken && s.subscription != nil:
+		json.NewEncoder(w).Encode(s.subscription)
+	case strings.HasPrefix(path, "products/") && s.product != nil:
+		json.NewEncoder(w).Encode(s.product)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{"code": 404, "message": "The purchase token was not found."}})
+	}
+}
+
+func newStubGooglePlayVerifier(t *testing.T, stub *googlePlayStub) PurchaseVerifier {
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	verifier, err := NewGooglePlayVerifier(context.Background(), &GooglePlayConfig{
+		PackageName:   testPackageName,
+		ClientOptions: []option.ClientOption{option.WithEndpoint(server.URL + "/"), option.WithoutAuthentication()},
+	})
+	require.NoError(t, err)
+	return verifier
+}
+
+func activePlaySubscription(accountID string, expiry time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"subscriptionState":    "SUBSCRIPTION_STATE_ACTIVE",
+		"acknowledgementState": "ACKNOWLEDGEMENT_STATE_PENDING",
+		"latestOrderId":        "GPA.3311-2222-1111-00000",
+		"startTime":            "2026-10-01T00:00:00.000Z",
+		"testPurchase":         map[string]interface{}{},
+		"externalAccountIdentifiers": map[string]interface{}{
+			"obfuscatedExternalAccountId": accountID,
+		},
+		"lineItems": []interface{}{
+			map[string]interface{}{
+				"productId":        "premium_monthly",
+				"expiryTime":       expiry.UTC().Format(time.RFC3339Nano),
+				"autoRenewingPlan": map[string]interface{}{"autoRenewEnabled": true},
+			},
+		},
+	}
+}
+
+func TestGooglePlayVerifierVerifiesAndAcknowledgesSubscription(t *testing.T) {
+	expiry := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Millisecond)
+	stub := &googlePlayStub{subscription: activePlaySubscription(GooglePlayAccountID("user-1"), expiry)}
+	verifier := newStubGooglePlayVerifier(t, stub)
+
+	verified, err := verifier.Verify(context.Background(), "user-1", &StoreReceipt{
+		Platform:  "android",
+		ProductID: "premium_monthly",
+		Data:      testPlayToken,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "premium_monthly", verified.ProductID)
+	assert.Equal(t, "GPA.3311-2222-1111-00000", verified.PurchaseID)
+	assert.Equal(t, testPlayToken, verified.OriginalPurchaseID)
+	assert.Equal(t, "Sandbox", verified.Environment)
+	assert.True(t, verified.ExpiresAt.Equal(expiry))
+	require.NotNil(t, verified.AutoRenew)
+	assert.True(t, *verified.AutoRenew)
+	assert.Equal(t, []string{"subscriptions/premium_monthly/tokens/" + testPlayToken}, stub.acknowledged)
+}
+
+func TestGooglePlayVerifierRejectsPurchaseOfAnotherAccount(t *testing.T) {
+	stub := &googlePlayStub{subscription: activePlaySubscription(GooglePlayAccountID("user-2"), time.Now().Add(time.Hour))}
+	verifier := newStubGooglePlayVerifier(t, stub)
+
+	_, err := verifier.Verify(context.Background(), "user-1", &StoreReceipt{Platform: "android", Data: testPlayToken})
+	assert.ErrorIs(t, err, ErrPurchaseOwnedByAnotherUser)
+	assert.Empty(t, stub.acknowledged)
+}
+
+func TestGooglePlayVerifierRejectsPurchaseWithoutAccountID(t *testing.T) {
+	stub := &googlePlayStub{subscription: activePlaySubscription("", time.Now().Add(time.Hour))}
+	verifier := newStubGooglePlayVerifier(t, stub)
+
+	_, err := verifier.Verify(context.Background(), "user-1", &StoreReceipt{Platform: "android", Data: testPlayToken})
+	assert.ErrorIs(t, err, ErrInvalidReceipt)
+	assert.Empty(t, stub.acknowledged)
+}
+
+func TestGooglePlayVerifierReportsPendingSubscription(t *testing.T) {
+	subscription := activePlaySubscription(GooglePlayAccountID("user-1"), time.Now().Add(time.Hour))
+	subscription["subscriptionState"] = "SUBSCRIPTION_STATE_PENDING"
+	stub := &googlePlayStub{subscription: subscription}
+	verifier := newStubGooglePlayVerifier(t, stub)
+
+	_, err := verifier.Verify(context.Background(), "user-1", &StoreReceipt{Platform: "android", Data: testPlayToken})
+	assert.ErrorIs(t, err, ErrPurchasePending)
+	assert.Empty(t, stub.acknowledged)
+}
+
+func TestGooglePlayVerifierFallsBackToOneTimeProduct(t *testing.T) {
+	stub := &googlePlayStub{product: map[string]interface{}{
+		"purchaseState":               0,
+		"acknowledgementState":        0,
+		"orderId":                     "GPA.1234-5678-9012-34567",
+		"purchaseTimeMillis":          "1791331200000",
+		"obfuscatedExternalAccountId": GooglePlayAccountID("user-1"),
+	}}
+	verifier := newStubGooglePlayVerifier(t, stub)
+
+	verified, err := verifier.Verify(context.Background(), "user-1", &StoreReceipt{
+		Platform:  "android",
+		ProductID: "lifetime_premium",
+		Data:      testPlayToken,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "lifetime_premium", verified.ProductID)
+	assert.Equal(t, "GPA.1234-5678-9012-34567", verified.PurchaseID)
+	assert.Equal(t, "Production", verified.Environment)
+	assert.True(t, verified.ExpiresAt.IsZero())
+	assert.Equal(t, time.UnixMilli(1791331200000), verified.PurchasedAt)
+	assert.Equal(t, []string{"products/lifetime_premium/tokens/" + testPlayToken}, stub.acknowledged)
+}
+
+func TestGooglePlayVerifierRejectsUnknownToken(t *testing.T) {
+	verifier := newStubGooglePlayVerifier(t, &googlePlayStub{})
+
+	_, err := verifier.Verify(context.Background(), "user-1", &StoreReceipt{Platform: "android", ProductID: "premium_monthly", Data: testPlayToken})
+	assert.ErrorIs(t, err, ErrInvalidReceipt)
+}
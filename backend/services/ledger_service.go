@@ -0,0 +1,470 @@
+package services
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/balancetransaction"
+	"github.com/stripe/stripe-go/invoice"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidLedgerPeriod is returned for months that are not YYYY-MM or are in the wrong order
+var ErrInvalidLedgerPeriod = errors.New("period must be given as YYYY-MM months with from not after to")
+
+// defaultLedgerMonths is the period reported when no months are given, including the current month
+const defaultLedgerMonths = 12
+
+// LedgerPeriod converts the inclusive JST months "YYYY-MM" to the range [from, to) used by the ledger.
+// Empty months default to the last twelve months up to now.
+func LedgerPeriod(fromMonth, toMonth string, now time.Time) (time.Time, time.Time, error) {
+	y, m, _ := now.In(jst).Date()
+	from := time.Date(y, m-defaultLedgerMonths+1, 1, 0, 0, 0, 0, jst)
+	to := time.Date(y, m, 1, 0, 0, 0, 0, jst)
+	var err error
+	if fromMonth != "" {
+		if from, err = time.ParseInLocation("2006-01", fromMonth, jst); err != nil {
+			return time.Time{}, time.Time{}, ErrInvalidLedgerPeriod
+		}
+	}
+	if toMonth != "" {
+		if to, err = time.ParseInLocation("2006-01", toMonth, jst); err != nil {
+			return time.Time{}, time.Time{}, ErrInvalidLedgerPeriod
+		}
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, ErrInvalidLedgerPeriod
+	}
+	return from, to.AddDate(0, 1, 0), nil
+}
+
+// LedgerConfig holds settings for ledger entries the billing systems do not report themselves
+type LedgerConfig struct {
+	// StoreCommissionRates are keyed by models.LedgerSource*; the stores do not report their commission per transaction
+	StoreCommissionRates map[string]float64
+}
+
+// LedgerMonthSummary totals one month of ledger entries of a source in one currency
+type LedgerMonthSummary struct {
+	Month       string       `json:"month"` // JSTの年月 (例: 2026-10)
+	Source      string       `json:"source"`
+	Currency    string       `json:"currency"`
+	ChargeCount int          `json:"charge_count"`
+	Gross       models.Money `json:"gross"`
+	Refunds     models.Money `json:"refunds"`
+	Disputes    models.Money `json:"disputes"` // 勝訴で戻った金額を差し引いた額
+	Fees        models.Money `json:"fees"`
+	Net         models.Money `json:"net"`
+}
+
+// PurchaseLedger records store purchases in the ledger
+type PurchaseLedger interface {
+	RecordStorePurchase(ctx context.Context, purchase *models.Purchase) error
+}
+
+// LedgerService records charges, refunds, disputes and fees from Stripe, the App Store and Google Play
+// in one append-only ledger and reports revenue from it
+type LedgerService interface {
+	PurchaseLedger
+	RecordStripeCharge(ctx context.Context, charge *stripe.Charge) error
+	RecordStripeRefund(ctx context.Context, refund *stripe.Refund) error
+	RecordStripeDispute(ctx context.Context, dispute *stripe.Dispute) error
+	MonthlySummary(ctx context.Context, from, to time.Time) ([]*LedgerMonthSummary, error)
+	ExportCSV(ctx context.Context, from, to time.Time, w io.Writer) error
+}
+
+type ledgerService struct {
+	repo        repository.LedgerRepository
+	paymentRepo repository.PaymentRepository
+	subRepo     repository.SubscriptionRepository
+	cfg         *LedgerConfig
+}
+
+// NewLedgerService creates a new instance of LedgerService
+func NewLedgerService(repo repository.LedgerRepository, paymentRepo repository.PaymentRepository, subRepo repository.SubscriptionRepository, cfg *LedgerConfig) LedgerService {
+	return &ledgerService{
+		repo:        repo,
+		paymentRepo: paymentRepo,
+		subRepo:     subRepo,
+		cfg:         cfg,
+	}
+}
+
+// ledgerOwner identifies the user and local record an entry belongs to
+type ledgerOwner struct {
+	userID        string
+	referenceType string
+	referenceID   string
+}
+
+// RecordStripeCharge records a succeeded charge and the processing fee of its balance transaction
+func (s *ledgerService) RecordStripeCharge(ctx context.Context, charge *stripe.Charge) error {
+	if charge.Status != "succeeded" {
+		return nil
+	}
+	owner, err := s.stripeChargeOwner(ctx, charge)
+	if err != nil {
+		return err
+	}
+
+	occurredAt := time.Unix(charge.Created, 0)
+	if err := s.append(ctx, owner, &models.LedgerEntry{
+		Source:     models.LedgerSourceStripe,
+		Type:       models.LedgerEntryCharge,
+		SourceRef:  charge.ID,
+		Amount:     stripeMoney(charge.Amount, charge.Currency),
+		OccurredAt: occurredAt,
+	}); err != nil {
+		return err
+	}
+
+	if charge.BalanceTransaction == nil {
+		log.Printf("Stripeの支払い %s に残高取引がないため手数料を記録できません", charge.ID)
+		return nil
+	}
+	bt := charge.BalanceTransaction
+	if bt.Currency == "" {
+		// Webhookのペイロードでは残高取引はIDのみ
+		if bt, err = balancetransaction.Get(bt.ID, nil); err != nil {
+			return err
+		}
+	}
+	return s.append(ctx, owner, &models.LedgerEntry{
+		Source:      models.LedgerSourceStripe,
+		Type:        models.LedgerEntryFee,
+		SourceRef:   charge.ID,
+		Amount:      stripeMoney(-bt.Fee, bt.Currency),
+		Description: "Stripe processing fee",
+		OccurredAt:  occurredAt,
+	})
+}
+
+// RecordStripeRefund records a succeeded refund against the owner of its charge
+func (s *ledgerService) RecordStripeRefund(ctx context.Context, refund *stripe.Refund) error {
+	if refund.Status != stripe.RefundStatusSucceeded || refund.Charge == nil {
+		return nil
+	}
+	owner, err := s.recordedChargeOwner(ctx, refund.Charge.ID)
+	if err != nil {
+		return err
+	}
+	return s.append(ctx, owner, &models.LedgerEntry{
+		Source:      models.LedgerSourceStripe,
+		Type:        models.LedgerEntryRefund,
+		SourceRef:   refund.ID,
+		Amount:      stripeMoney(-refund.Amount, refund.Currency),
+		Description: string(refund.Reason),
+		OccurredAt:  time.Unix(refund.Created, 0),
+	})
+}
+
+// RecordStripeDispute records the disputed amount and dispute fee when a dispute is opened,
+// and their return when it is won
+func (s *ledgerService) RecordStripeDispute(ctx context.Context, dispute *stripe.Dispute) error {
+	var owner *ledgerOwner
+	if dispute.Charge != nil {
+		var err error
+		if owner, err = s.recordedChargeOwner(ctx, dispute.Charge.ID); err != nil {
+			return err
+		}
+	}
+
+	// 残高取引は引き落とし（手数料がプラス）と勝訴時の払い戻し（手数料がマイナス）
+	var fee, feeReturned int64
+	var feeCurrency stripe.Currency
+	for _, bt := range dispute.BalanceTransactions {
+		if bt.Fee > 0 {
+			fee += bt.Fee
+		} else {
+			feeReturned -= bt.Fee
+		}
+		feeCurrency = bt.Currency
+	}
+
+	entries := []*models.LedgerEntry{{
+		Source:      models.LedgerSourceStripe,
+		Type:        models.LedgerEntryDispute,
+		SourceRef:   dispute.ID,
+		Amount:      stripeMoney(-dispute.Amount, dispute.Currency),
+		Description: string(dispute.Reason),
+		OccurredAt:  time.Unix(dispute.Created, 0),
+	}}
+	if fee > 0 {
+		entries = append(entries, &models.LedgerEntry{
+			Source:      models.LedgerSourceStripe,
+			Type:        models.LedgerEntryFee,
+			SourceRef:   dispute.ID,
+			Amount:      stripeMoney(-fee, feeCurrency),
+			Description: "Stripe dispute fee",
+			OccurredAt:  time.Unix(dispute.Created, 0),
+		})
+	}
+	if dispute.Status == stripe.DisputeStatusWon {
+		entries = append(entries, &models.LedgerEntry{
+			Source:     models.LedgerSourceStripe,
+			Type:       models.LedgerEntryDisputeReversal,
+			SourceRef:  dispute.ID,
+			Amount:     stripeMoney(dispute.Amount, dispute.Currency),
+			OccurredAt: time.Now(),
+		})
+		if feeReturned > 0 {
+			entries = append(entries, &models.LedgerEntry{
+				Source:      models.LedgerSourceStripe,
+				Type:        models.LedgerEntryFeeReversal,
+				SourceRef:   dispute.ID,
+				Amount:      stripeMoney(feeReturned, feeCurrency),
+				Description: "Stripe dispute fee",
+				OccurredAt:  time.Now(),
+			})
+		}
+	}
+
+	for _, entry := range entries {
+		if err := s.append(ctx, owner, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordStorePurchase records a store transaction with the store's estimated commission, and its refund once
+// the store revokes it. Transactions without a reported price (free trials, Google Play one-time products) are skipped.
+func (s *ledgerService) RecordStorePurchase(ctx context.Context, purchase *models.Purchase) error {
+	if purchase.Price.Minor <= 0 {
+		return nil
+	}
+	source := models.LedgerSourceAppStore
+	occurredAt := purchase.PurchasedAt
+	if purchase.Platform == models.PurchasePlatformAndroid {
+		source = models.LedgerSourceGooglePlay
+		if !purchase.ExpiresAt.IsZero() && !purchase.CreatedAt.IsZero() {
+			// Google Playは契約開始日時しか返さないため、更新の支払いは記録した日時とする
+			occurredAt = purchase.CreatedAt
+		}
+	}
+	owner := &ledgerOwner{
+		userID:        purchase.UserID,
+		referenceType: models.LedgerReferencePurchase,
+		referenceID:   strconv.FormatUint(uint64(purchase.ID), 10),
+	}
+	var commission int64
+	if s.cfg != nil {
+		commission = int64(math.Round(float64(purchase.Price.Minor) * s.cfg.StoreCommissionRates[source]))
+	}
+
+	entries := []*models.LedgerEntry{{
+		Source:      source,
+		Type:        models.LedgerEntryCharge,
+		SourceRef:   purchase.PurchaseID,
+		Amount:      purchase.Price,
+		Description: purchase.ProductID,
+		OccurredAt:  occurredAt,
+	}}
+	if commission > 0 {
+		entries = append(entries, &models.LedgerEntry{
+			Source:      source,
+			Type:        models.LedgerEntryFee,
+			SourceRef:   purchase.PurchaseID,
+			Amount:      models.Money{Minor: -commission, Currency: purchase.Price.Currency},
+			Estimated:   true,
+			Description: "store commission",
+			OccurredAt:  occurredAt,
+		})
+	}
+	if purchase.RevokedAt != nil {
+		entries = append(entries, &models.LedgerEntry{
+			Source:      source,
+			Type:        models.LedgerEntryRefund,
+			SourceRef:   purchase.PurchaseID,
+			Amount:      models.Money{Minor: -purchase.Price.Minor, Currency: purchase.Price.Currency},
+			Description: purchase.ProductID,
+			OccurredAt:  *purchase.RevokedAt,
+		})
+		if commission > 0 {
+			// ストアは返金時に手数料を返す
+			entries = append(entries, &models.LedgerEntry{
+				Source:      source,
+				Type:        models.LedgerEntryFeeReversal,
+				SourceRef:   purchase.PurchaseID,
+				Amount:      models.Money{Minor: commission, Currency: purchase.Price.Currency},
+				Estimated:   true,
+				Description: "store commission",
+				OccurredAt:  *purchase.RevokedAt,
+			})
+		}
+	}
+
+	for _, entry := range entries {
+		if err := s.append(ctx, owner, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MonthlySummary totals the entries in [from, to) by JST month, source and currency
+func (s *ledgerService) MonthlySummary(ctx context.Context, from, to time.Time) ([]*LedgerMonthSummary, error) {
+	entries, err := s.repo.ListBetween(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := map[string]*LedgerMonthSummary{}
+	for _, entry := range entries {
+		month := entry.OccurredAt.In(jst).Format("2006-01")
+		key := month + "/" + entry.Source + "/" + entry.Amount.Currency
+		summary, ok := summaries[key]
+		if !ok {
+			zero := models.Money{Currency: entry.Amount.Currency}
+			summary = &LedgerMonthSummary{Month: month, Source: entry.Source, Currency: entry.Amount.Currency,
+				Gross: zero, Refunds: zero, Disputes: zero, Fees: zero, Net: zero}
+			summaries[key] = summary
+		}
+
+		switch entry.Type {
+		case models.LedgerEntryCharge:
+			summary.ChargeCount++
+			summary.Gross.Minor += entry.Amount.Minor
+		case models.LedgerEntryRefund:
+			summary.Refunds.Minor += entry.Amount.Minor
+		case models.LedgerEntryDispute, models.LedgerEntryDisputeReversal:
+			summary.Disputes.Minor += entry.Amount.Minor
+		case models.LedgerEntryFee, models.LedgerEntryFeeReversal:
+			summary.Fees.Minor += entry.Amount.Minor
+		}
+		summary.Net.Minor += entry.Amount.Minor
+	}
+
+	result := make([]*LedgerMonthSummary, 0, len(summaries))
+	for _, summary := range summaries {
+		result = append(result, summary)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Month != b.Month {
+			return a.Month < b.Month
+		}
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Currency < b.Currency
+	})
+	return result, nil
+}
+
+// ledgerCSVHeader lists the columns of the CSV export
+var ledgerCSVHeader = []string{
+	"id", "occurred_at", "source", "type", "amount", "currency", "amount_minor",
+	"estimated", "user_id", "reference_type", "reference_id", "source_ref", "description",
+}
+
+// ExportCSV writes the entries in [from, to) as CSV with amounts in major units and times in JST
+func (s *ledgerService) ExportCSV(ctx context.Context, from, to time.Time, w io.Writer) error {
+	entries, err := s.repo.ListBetween(ctx, from, to)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(ledgerCSVHeader); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := writer.Write([]string{
+			strconv.FormatUint(uint64(entry.ID), 10),
+			entry.OccurredAt.In(jst).Format(time.RFC3339),
+			entry.Source,
+			entry.Type,
+			strconv.FormatFloat(entry.Amount.Major(), 'f', models.CurrencyExponent(entry.Amount.Currency), 64),
+			entry.Amount.Currency,
+			strconv.FormatInt(entry.Amount.Minor, 10),
+			strconv.FormatBool(entry.Estimated),
+			entry.UserID,
+			entry.ReferenceType,
+			entry.ReferenceID,
+			entry.SourceRef,
+			entry.Description,
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// append validates and records the entry; entries already in the ledger are left untouched
+func (s *ledgerService) append(ctx context.Context, owner *ledgerOwner, entry *models.LedgerEntry) error {
+	if entry.Amount.Minor == 0 {
+		return nil
+	}
+	if owner != nil {
+		entry.UserID, entry.ReferenceType, entry.ReferenceID = owner.userID, owner.referenceType, owner.referenceID
+	}
+	if err := entry.Validate(); err != nil {
+		return fmt.Errorf("ledger entry %s/%s/%s: %w", entry.Source, entry.Type, entry.SourceRef, err)
+	}
+	_, err := s.repo.Append(ctx, entry)
+	return err
+}
+
+// stripeChargeOwner finds the local payment or subscription a charge was made for
+func (s *ledgerService) stripeChargeOwner(ctx context.Context, charge *stripe.Charge) (*ledgerOwner, error) {
+	if charge.PaymentIntent != "" {
+		payment, err := s.paymentRepo.GetPaymentByStripeID(ctx, charge.PaymentIntent)
+		if err == nil {
+			return &ledgerOwner{userID: payment.UserID, referenceType: models.LedgerReferencePayment, referenceID: payment.ID}, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	if charge.Invoice != nil && charge.Invoice.ID != "" {
+		inv, err := invoice.Get(charge.Invoice.ID, nil)
+		if err != nil {
+			return nil, err
+		}
+		if inv.Subscription != nil {
+			subscription, err := s.subRepo.GetByStripeSubID(ctx, inv.Subscription.ID)
+			if err == nil {
+				return &ledgerOwner{userID: subscription.UserID, referenceType: models.LedgerReferenceSubscription, referenceID: subscription.ID}, nil
+			}
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, err
+			}
+		}
+	}
+
+	// ダッシュボードから作成された支払いなど、ローカルの記録がないものも売上として残す
+	return nil, nil
+}
+
+// recordedChargeOwner copies the owner of a charge that is already in the ledger
+func (s *ledgerService) recordedChargeOwner(ctx context.Context, chargeID string) (*ledgerOwner, error) {
+	entry, err := s.repo.GetBySourceRef(ctx, models.LedgerSourceStripe, models.LedgerEntryCharge, chargeID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ledgerOwner{userID: entry.UserID, referenceType: entry.ReferenceType, referenceID: entry.ReferenceID}, nil
+}
+
+// stripeMoney converts a Stripe amount, which is in minor units with a lowercase currency
+func stripeMoney(minor int64, currency stripe.Currency) models.Money {
+	return models.Money{Minor: minor, Currency: strings.ToUpper(string(currency))}
+}
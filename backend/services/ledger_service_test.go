@@ -0,0 +1,245 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go"
+	"gorm.io/gorm"
+)
+
+// memoryLedgerRepository keeps entries in memory with the same uniqueness as the ledger table
+type memoryLedgerRepository struct {
+	mu      sync.Mutex
+	entries []*models.LedgerEntry
+}
+
+func (r *memoryLedgerRepository) Append(ctx context.Context, entry *models.LedgerEntry) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.entries {
+		if existing.Source == entry.Source && existing.Type == entry.Type && existing.SourceRef == entry.SourceRef {
+			return false, nil
+		}
+	}
+	entry.ID = uint(len(r.entries) + 1)
+	copied := *entry
+	r.entries = append(r.entries, &copied)
+	return true, nil
+}
+
+func (r *memoryLedgerRepository) GetBySourceRef(ctx context.Context, source, entryType, sourceRef string) (*models.LedgerEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, entry := range r.entries {
+		if entry.Source == source && entry.Type == entryType && entry.SourceRef == sourceRef {
+			copied := *entry
+			return &copied, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryLedgerRepository) ListBetween(ctx context.Context, from, to time.Time) ([]*models.LedgerEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var entries []*models.LedgerEntry
+	for _, entry := range r.entries {
+		if !entry.OccurredAt.Before(from) && entry.OccurredAt.Before(to) {
+			copied := *entry
+			entries = append(entries, &copied)
+		}
+	}
+	return entries, nil
+}
+
+type ledgerPaymentRepository struct {
+	repository.PaymentRepository
+	payments map[string]*models.Payment // PaymentIntent IDごと
+}
+
+func (r ledgerPaymentRepository) GetPaymentByStripeID(ctx context.Context, stripeID string) (*models.Payment, error) {
+	if payment, ok := r.payments[stripeID]; ok {
+		return payment, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func newTestLedgerService(payments map[string]*models.Payment) (LedgerService, *memoryLedgerRepository) {
+	repo := &memoryLedgerRepository{}
+	service := NewLedgerService(repo, ledgerPaymentRepository{payments: payments}, stubSubscriptionRepository{}, &LedgerConfig{
+		StoreCommissionRates: map[string]float64{models.LedgerSourceAppStore: 0.15},
+	})
+	return service, repo
+}
+
+func TestRecordStorePurchaseAddsCommissionAndRefundOnce(t *testing.T) {
+	ctx := context.Background()
+	service, repo := newTestLedgerService(nil)
+	purchase := &models.Purchase{
+		ID:          7,
+		UserID:      "user-1",
+		ProductID:   "jp.kimiyomi.premium.monthly",
+		PurchaseID:  "2000000123456789",
+		Platform:    models.PurchasePlatformIOS,
+		PurchasedAt: time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC),
+		Price:       models.Money{Minor: 480, Currency: "JPY"},
+	}
+
+	require.NoError(t, service.RecordStorePurchase(ctx, purchase))
+	revokedAt := time.Date(2026, 10, 5, 12, 0, 0, 0, time.UTC)
+	purchase.RevokedAt = &revokedAt
+	require.NoError(t, service.RecordStorePurchase(ctx, purchase))
+	require.NoError(t, service.RecordStorePurchase(ctx, purchase))
+
+	var amounts []int64
+	for _, entry := range repo.entries {
+		assert.Equal(t, models.LedgerSourceAppStore, entry.Source)
+		assert.Equal(t, "user-1", entry.UserID)
+		assert.Equal(t, models.LedgerReferencePurchase, entry.ReferenceType)
+		assert.Equal(t, "7", entry.ReferenceID)
+		amounts = append(amounts, entry.Amount.Minor)
+	}
+	assert.Equal(t, []int64{480, -72, -480, 72}, amounts)
+	assert.True(t, repo.entries[1].Estimated)
+}
+
+func TestRecordStripeChargeAndRefundShareTheOwner(t *testing.T) {
+	ctx := context.Background()
+	service, repo := newTestLedgerService(map[string]*models.Payment{
+		"pi_123": {ID: "pay-1", UserID: "user-1"},
+	})
+
+	require.NoError(t, service.RecordStripeCharge(ctx, &stripe.Charge{
+		ID:                 "ch_123",
+		Status:             "succeeded",
+		Amount:             1200,
+		Currency:           "jpy",
+		Created:            time.Date(2026, 10, 3, 0, 0, 0, 0, time.UTC).Unix(),
+		PaymentIntent:      "pi_123",
+		BalanceTransaction: &stripe.BalanceTransaction{ID: "txn_123", Fee: 43, Currency: "jpy"},
+	}))
+	require.NoError(t, service.RecordStripeRefund(ctx, &stripe.Refund{
+		ID:       "re_123",
+		Status:   stripe.RefundStatusSucceeded,
+		Amount:   500,
+		Currency: "jpy",
+		Created:  time.Date(2026, 10, 4, 0, 0, 0, 0, time.UTC).Unix(),
+		Charge:   &stripe.Charge{ID: "ch_123"},
+	}))
+
+	require.Len(t, repo.entries, 3)
+	for _, entry := range repo.entries {
+		assert.Equal(t, "user-1", entry.UserID)
+		assert.Equal(t, models.LedgerReferencePayment, entry.ReferenceType)
+		assert.Equal(t, "pay-1", entry.ReferenceID)
+		assert.Equal(t, "JPY", entry.Amount.Currency)
+	}
+	assert.Equal(t, models.LedgerEntryFee, repo.entries[1].Type)
+	assert.Equal(t, int64(-43), repo.entries[1].Amount.Minor)
+	assert.Equal(t, int64(-500), repo.entries[2].Amount.Minor)
+}
+
+func TestRecordStripeDisputeWonReversesAmountAndFee(t *testing.T) {
+	ctx := context.Background()
+	service, repo := newTestLedgerService(nil)
+	dispute := &stripe.Dispute{
+		ID:       "dp_123",
+		Amount:   1200,
+		Currency: "jpy",
+		Status:   stripe.DisputeStatusNeedsResponse,
+		Created:  time.Date(2026, 10, 3, 0, 0, 0, 0, time.UTC).Unix(),
+		Charge:   &stripe.Charge{ID: "ch_unknown"},
+		BalanceTransactions: []*stripe.BalanceTransaction{
+			{Amount: -1200, Fee: 1500, Currency: "jpy"},
+		},
+	}
+	require.NoError(t, service.RecordStripeDispute(ctx, dispute))
+
+	dispute.Status = stripe.DisputeStatusWon
+	dispute.BalanceTransactions = append(dispute.BalanceTransactions, &stripe.BalanceTransaction{Amount: 1200, Fee: -1500, Currency: "jpy"})
+	require.NoError(t, service.RecordStripeDispute(ctx, dispute))
+
+	var total int64
+	for _, entry := range repo.entries {
+		total += entry.Amount.Minor
+	}
+	assert.Len(t, repo.entries, 4)
+	assert.Zero(t, total)
+}
+
+func TestMonthlySummaryGroupsByJSTMonth(t *testing.T) {
+	ctx := context.Background()
+	service, repo := newTestLedgerService(nil)
+	entries := []*models.LedgerEntry{
+		// 9月30日21時(UTC)は日本時間で10月
+		{Source: models.LedgerSourceStripe, Type: models.LedgerEntryCharge, SourceRef: "ch_1", Amount: models.Money{Minor: 1000, Currency: "JPY"}, OccurredAt: time.Date(2026, 9, 30, 21, 0, 0, 0, time.UTC)},
+		{Source: models.LedgerSourceStripe, Type: models.LedgerEntryFee, SourceRef: "ch_1", Amount: models.Money{Minor: -36, Currency: "JPY"}, OccurredAt: time.Date(2026, 9, 30, 21, 0, 0, 0, time.UTC)},
+		{Source: models.LedgerSourceStripe, Type: models.LedgerEntryRefund, SourceRef: "re_1", Amount: models.Money{Minor: -1000, Currency: "JPY"}, OccurredAt: time.Date(2026, 11, 2, 0, 0, 0, 0, time.UTC)},
+		{Source: models.LedgerSourceAppStore, Type: models.LedgerEntryCharge, SourceRef: "2000", Amount: models.Money{Minor: 499, Currency: "USD"}, OccurredAt: time.Date(2026, 10, 10, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, entry := range entries {
+		_, err := repo.Append(ctx, entry)
+		require.NoError(t, err)
+	}
+
+	from, to, err := LedgerPeriod("2026-10", "2026-11", time.Now())
+	require.NoError(t, err)
+	summaries, err := service.MonthlySummary(ctx, from, to)
+	require.NoError(t, err)
+
+	require.Len(t, summaries, 3)
+	assert.Equal(t, "2026-10", summaries[0].Month)
+	assert.Equal(t, models.LedgerSourceAppStore, summaries[0].Source)
+	assert.Equal(t, int64(499), summaries[0].Net.Minor)
+	assert.Equal(t, "2026-10", summaries[1].Month)
+	assert.Equal(t, 1, summaries[1].ChargeCount)
+	assert.Equal(t, int64(1000), summaries[1].Gross.Minor)
+	assert.Equal(t, int64(-36), summaries[1].Fees.Minor)
+	assert.Equal(t, int64(964), summaries[1].Net.Minor)
+	assert.Equal(t, "2026-11", summaries[2].Month)
+	assert.Equal(t, int64(-1000), summaries[2].Refunds.Minor)
+}
+
+func TestExportCSVWritesMajorUnits(t *testing.T) {
+	ctx := context.Background()
+	service, repo := newTestLedgerService(nil)
+	_, err := repo.Append(ctx, &models.LedgerEntry{
+		Source:     models.LedgerSourceAppStore,
+		Type:       models.LedgerEntryCharge,
+		SourceRef:  "2000000123456789",
+		Amount:     models.Money{Minor: 499, Currency: "USD"},
+		UserID:     "user-1",
+		OccurredAt: time.Date(2026, 10, 10, 0, 0, 0, 0, time.UTC),
+	})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, service.ExportCSV(ctx, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), &buf))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, strings.Join(ledgerCSVHeader, ","), lines[0])
+	assert.Equal(t, "1,2026-10-10T09:00:00+09:00,app_store,charge,4.99,USD,499,false,user-1,,,2000000123456789,", lines[1])
+}
+
+func TestLedgerPeriodRejectsReversedMonths(t *testing.T) {
+	_, _, err := LedgerPeriod("2026-10", "2026-09", time.Now())
+	assert.ErrorIs(t, err, ErrInvalidLedgerPeriod)
+	_, _, err = LedgerPeriod("2026/10", "", time.Now())
+	assert.ErrorIs(t, err, ErrInvalidLedgerPeriod)
+
+	from, to, err := LedgerPeriod("", "", time.Date(2026, 10, 19, 0, 0, 0, 0, jst))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2025, 11, 1, 0, 0, 0, 0, jst), from)
+	assert.Equal(t, time.Date(2026, 11, 1, 0, 0, 0, 0, jst), to)
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// NotificationDeliveryJobName is the scheduler job name of the notification delivery
+const NotificationDeliveryJobName = "notification-delivery"
+
+const (
+	notificationDeliveryBatchSize  = 100
+	notificationMaxAttempts        = 8
+	notificationRetryBase          = time.Minute
+	notificationRetryMaxInterval   = 6 * time.Hour
+	notificationTopicPrefix        = "user-"
+	notificationDeadlineDataFormat = time.RFC3339
+)
+
+// NotificationSender delivers a notification event to the user's devices
+type NotificationSender interface {
+	Send(ctx context.Context, event *models.NotificationEvent) error
+}
+
+// NotificationDeliveryJob delivers the pending events of the notification outbox
+type NotificationDeliveryJob struct {
+	repo   repository.NotificationRepository
+	sender NotificationSender
+}
+
+// NewNotificationDeliveryJob creates a new instance of NotificationDeliveryJob
+func NewNotificationDeliveryJob(repo repository.NotificationRepository, sender NotificationSender) *NotificationDeliveryJob {
+	return &NotificationDeliveryJob{repo: repo, sender: sender}
+}
+
+// Run delivers the due events. A failed event is retried with exponential backoff
+// and given up after notificationMaxAttempts, so it never blocks the events behind it.
+func (j *NotificationDeliveryJob) Run(ctx context.Context) error {
+	now := time.Now()
+	for {
+		events, err := j.repo.ListPending(ctx, now, notificationDeliveryBatchSize)
+		if err != nil {
+			return fmt.Errorf("未配信の通知の取得に失敗: %w", err)
+		}
+		for _, event := range events {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			j.deliver(ctx, event, now)
+		}
+		if len(events) < notificationDeliveryBatchSize {
+			return nil
+		}
+	}
+}
+
+func (j *NotificationDeliveryJob) deliver(ctx context.Context, event *models.NotificationEvent, now time.Time) {
+	sendErr := j.sender.Send(ctx, event)
+	if sendErr == nil {
+		if err := j.repo.MarkSent(ctx, event.ID); err != nil {
+			log.Printf("通知 %d の配信済みへの更新に失敗: %v", event.ID, err)
+		}
+		return
+	}
+
+	event.Attempts++
+	event.LastError = sendErr.Error()
+	if event.Attempts >= notificationMaxAttempts {
+		event.Status = models.NotificationStatusFailed
+		event.NextAttemptAt = nil
+	} else {
+		retryAt := now.Add(notificationRetryDelay(event.Attempts))
+		event.NextAttemptAt = &retryAt
+	}
+	log.Printf("通知 %d の配信に失敗 (%d回目): %v", event.ID, event.Attempts, sendErr)
+	if err := j.repo.MarkFailed(ctx, event); err != nil {
+		log.Printf("通知 %d の配信失敗の記録に失敗: %v", event.ID, err)
+	}
+}
+
+// notificationRetryDelay doubles the wait after each failed attempt, up to notificationRetryMaxInterval
+func notificationRetryDelay(attempts int) time.Duration {
+	delay := notificationRetryBase
+	for i := 1; i < attempts && delay < notificationRetryMaxInterval; i++ {
+		delay *= 2
+	}
+	if delay > notificationRetryMaxInterval {
+		delay = notificationRetryMaxInterval
+	}
+	return delay
+}
+
+// NotificationTopic is the FCM topic the app subscribes to after the user signs in
+func NotificationTopic(userID string) string {
+	return notificationTopicPrefix + userID
+}
+
+// FCMNotificationSender sends notifications as FCM data messages to the user's topic.
+// The message carries only the type and resource, and the app fetches the details itself.
+type FCMNotificationSender struct {
+	client *messaging.Client
+}
+
+// NewFCMNotificationSender creates a new instance of FCMNotificationSender
+func NewFCMNotificationSender(client *messaging.Client) *FCMNotificationSender {
+	return &FCMNotificationSender{client: client}
+}
+
+func (s *FCMNotificationSender) Send(ctx context.Context, event *models.NotificationEvent) error {
+	data := map[string]string{
+		"type":          event.Type,
+		"resource_type": event.ResourceType,
+		"resource_id":   event.ResourceID,
+	}
+	if event.DeadlineAt != nil {
+		data["deadline_at"] = event.DeadlineAt.Format(notificationDeadlineDataFormat)
+	}
+	_, err := s.client.Send(ctx, &messaging.Message{Topic: NotificationTopic(event.UserID), Data: data})
+	return err
+}
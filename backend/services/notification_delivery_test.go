@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memoryNotificationRepository keeps the outbox in insertion order
+type memoryNotificationRepository struct {
+	repository.NotificationRepository
+	events []*models.NotificationEvent
+}
+
+func (r *memoryNotificationRepository) ListPending(ctx context.Context, now time.Time, limit int) ([]*models.NotificationEvent, error) {
+	var events []*models.NotificationEvent
+	for _, event := range r.events {
+		if event.Status != models.NotificationStatusPending || (event.NextAttemptAt != nil && event.NextAttemptAt.After(now)) {
+			continue
+		}
+		copied := *event
+		events = append(events, &copied)
+		if len(events) == limit {
+			break
+		}
+	}
+	return events, nil
+}
+
+func (r *memoryNotificationRepository) MarkSent(ctx context.Context, id uint) error {
+	r.events[id-1].Status = models.NotificationStatusSent
+	return nil
+}
+
+func (r *memoryNotificationRepository) MarkFailed(ctx context.Context, event *models.NotificationEvent) error {
+	stored := r.events[event.ID-1]
+	stored.Status = event.Status
+	stored.Attempts = event.Attempts
+	stored.NextAttemptAt = event.NextAttemptAt
+	stored.LastError = event.LastError
+	return nil
+}
+
+// failingSender fails for the listed users and records the rest
+type failingSender struct {
+	failFor map[string]bool
+	sent    []uint
+}
+
+func (s *failingSender) Send(ctx context.Context, event *models.NotificationEvent) error {
+	if s.failFor[event.UserID] {
+		return errors.New("unavailable")
+	}
+	s.sent = append(s.sent, event.ID)
+	return nil
+}
+
+func TestNotificationDeliveryRetriesFailuresWithoutBlocking(t *testing.T) {
+	repo := &memoryNotificationRepository{}
+	for i := 1; i <= notificationDeliveryBatchSize+2; i++ {
+		userID := "user-ok"
+		if i <= notificationDeliveryBatchSize {
+			userID = "user-broken"
+		}
+		repo.events = append(repo.events, &models.NotificationEvent{ID: uint(i), UserID: userID, Status: models.NotificationStatusPending})
+	}
+	sender := &failingSender{failFor: map[string]bool{"user-broken": true}}
+	job := NewNotificationDeliveryJob(repo, sender)
+
+	// 先頭の1バッチ分が失敗しても後ろの通知は配信される
+	require.NoError(t, job.Run(context.Background()))
+	assert.Equal(t, []uint{101, 102}, sender.sent)
+	broken := repo.events[0]
+	assert.Equal(t, models.NotificationStatusPending, broken.Status)
+	assert.Equal(t, 1, broken.Attempts)
+	assert.Equal(t, "unavailable", broken.LastError)
+	require.NotNil(t, broken.NextAttemptAt)
+
+	// 再試行時刻まではリストに出ない
+	require.NoError(t, job.Run(context.Background()))
+	assert.Equal(t, 1, repo.events[0].Attempts)
+
+	for attempts := 1; attempts < notificationMaxAttempts; attempts++ {
+		repo.events[0].NextAttemptAt = nil
+		job.deliver(context.Background(), repo.events[0], time.Now())
+	}
+	assert.Equal(t, models.NotificationStatusFailed, repo.events[0].Status)
+	assert.Equal(t, notificationMaxAttempts, repo.events[0].Attempts)
+}
+
+func TestNotificationRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, notificationRetryDelay(1))
+	assert.Equal(t, 2*time.Minute, notificationRetryDelay(2))
+	assert.Equal(t, 64*time.Minute, notificationRetryDelay(7))
+	assert.Equal(t, notificationRetryMaxInterval, notificationRetryDelay(20))
+}
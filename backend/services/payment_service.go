@@ -3,75 +3,182 @@ package services
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	"kimiyomi/models"
 	"kimiyomi/repository"
 
+	"github.com/google/uuid"
 	"github.com/stripe/stripe-go"
 	"github.com/stripe/stripe-go/paymentintent"
 	"github.com/stripe/stripe-go/refund"
-	// "gorm.io/gorm" // Remove gorm import
+	"gorm.io/gorm"
 )
 
+// ErrContentNotForSale is returned when a content item does not exist, is unpublished or is free
+var ErrContentNotForSale = errors.New("content is not for sale")
+
+// ErrRefundOutcomeUnknown is returned when Stripe could not be reached or failed while refunding.
+// The refund stays pending and is settled by the webhook or ReconcilePendingRefunds.
+var ErrRefundOutcomeUnknown = errors.New("refund outcome is unknown; it stays pending until Stripe confirms it")
+
 // PaymentService handles all payment related business logic
 type PaymentService interface {
-	CreatePaymentIntent(ctx context.Context, userID string, amount float64, currency string) (*models.Payment, *stripe.PaymentIntent, error)
+	CreatePaymentIntent(ctx context.Context, principal *Principal, amount models.Money, couponCode string) (*models.Payment, *stripe.PaymentIntent, error)
+	PurchaseContent(ctx context.Context, principal *Principal, contentID string, couponCode string) (*models.Payment, *stripe.PaymentIntent, error)
+	ContentPrice(ctx context.Context, contentID string) (models.Money, error)
 	GetPaymentByID(ctx context.Context, paymentID string) (*models.Payment, error)
 	ListUserPayments(ctx context.Context, userID string) ([]*models.Payment, error)
 	UpdatePaymentStatus(ctx context.Context, paymentID string, status string) error
-	ProcessRefund(ctx context.Context, paymentID string) error
+	ApplyStripeStatus(ctx context.Context, paymentIntentID string, status string) error
+	ProcessRefund(ctx context.Context, paymentID string, amount float64, reason string) (*models.Refund, error)
+	SyncStripeRefund(ctx context.Context, paymentIntentID string, stripeRefund *stripe.Refund) error
+	ReconcilePendingPayments(ctx context.Context) error
+	ReconcilePendingRefunds(ctx context.Context) error
 }
 
 // paymentService implements PaymentService
 type paymentService struct {
-	payRepo  repository.PaymentRepository // Use repository.PaymentRepository
-	userRepo repository.UserRepository    // Use repository.UserRepository (optional, depending on needs)
+	payRepo         repository.PaymentRepository // Use repository.PaymentRepository
+	refundRepo      repository.RefundRepository
+	userRepo        repository.UserRepository // Use repository.UserRepository (optional, depending on needs)
+	contentRepo     repository.ContentRepository
+	customerService CustomerService
+	couponService   CouponService
+	entitlements    EntitlementInvalidator
+	taxRules        models.TaxRules
 }
 
 // NewPaymentService creates a new instance of PaymentService
-func NewPaymentService(payRepo repository.PaymentRepository, userRepo repository.UserRepository) PaymentService {
+func NewPaymentService(payRepo repository.PaymentRepository, refundRepo repository.RefundRepository, userRepo repository.UserRepository, contentRepo repository.ContentRepository, customerService CustomerService, couponService CouponService, entitlements EntitlementInvalidator, taxRules models.TaxRules) PaymentService {
 	return &paymentService{
-		payRepo:  payRepo,
-		userRepo: userRepo,
+		payRepo:         payRepo,
+		refundRepo:      refundRepo,
+		userRepo:        userRepo,
+		contentRepo:     contentRepo,
+		customerService: customerService,
+		couponService:   couponService,
+		entitlements:    entitlements,
+		taxRules:        taxRules,
 	}
 }
 
-// CreatePaymentIntent creates a new payment intent and saves the initial payment record
-func (s *paymentService) CreatePaymentIntent(ctx context.Context, userID string, amount float64, currency string) (*models.Payment, *stripe.PaymentIntent, error) {
-	// TODO: Validate user existence using userRepo if necessary
+// CreatePaymentIntent records a pending payment first and then creates its Stripe PaymentIntent.
+// The intent is created with an idempotency key derived from the payment ID, so a record that
+// never got its Stripe ID attached can be resolved later by ReconcilePendingPayments.
+// A non-empty couponCode is redeemed for the payment and lowers the charged amount.
+func (s *paymentService) CreatePaymentIntent(ctx context.Context, principal *Principal, amount models.Money, couponCode string) (*models.Payment, *stripe.PaymentIntent, error) {
+	return s.createPaymentIntent(ctx, principal, amount, "", couponCode, s.taxRules.Rule(models.TaxProductOther))
+}
 
-	params := &stripe.PaymentIntentParams{
-		Amount:   stripe.Int64(int64(amount * 100)), // Amount in cents
-		Currency: stripe.String(currency),
-		// Add customer ID if available: Customer: stripe.String(user.StripeCustomerID),
-		// Add other necessary params like metadata, description, etc.
+// PurchaseContent starts a one-off purchase of a content item at its catalog price.
+// The content is unlocked once the payment succeeds.
+func (s *paymentService) PurchaseContent(ctx context.Context, principal *Principal, contentID string, couponCode string) (*models.Payment, *stripe.PaymentIntent, error) {
+	price, err := s.ContentPrice(ctx, contentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.createPaymentIntent(ctx, principal, price, contentID, couponCode, s.taxRules.Rule(models.TaxProductContent))
+}
+
+// ContentPrice returns the catalog price of a content item that is for sale
+func (s *paymentService) ContentPrice(ctx context.Context, contentID string) (models.Money, error) {
+	content, err := s.contentRepo.GetByID(ctx, contentID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return models.Money{}, ErrContentNotForSale
 	}
+	if err != nil {
+		return models.Money{}, err
+	}
+	if content.Status != models.ContentStatusPublished || content.Price.Minor <= 0 {
+		return models.Money{}, ErrContentNotForSale
+	}
+	return content.Price, nil
+}
 
-	pi, err := paymentintent.New(params)
+// createPaymentIntent charges the amount after coupons plus any consumption tax not included in it
+func (s *paymentService) createPaymentIntent(ctx context.Context, principal *Principal, amount models.Money, contentID string, couponCode string, tax models.TaxRule) (*models.Payment, *stripe.PaymentIntent, error) {
+	c, err := s.customerService.EnsureCustomer(ctx, principal)
 	if err != nil {
-		return nil, nil, err // Return payment intent error
+		return nil, nil, err
 	}
 
 	payment := &models.Payment{
-		UserID:        userID,
-		Amount:        amount,
-		Currency:      currency,
-		Status:        models.PaymentStatusPending,
-		PaymentMethod: models.PaymentMethodCard, // Or determine dynamically
-		StripeID:      pi.ID,
-		// CreatedAt and UpdatedAt are handled by GORM/repository
+		ID:               uuid.NewString(),
+		UserID:           principal.UID,
+		Amount:           amount,
+		Status:           models.PaymentStatusPending,
+		PaymentMethod:    models.PaymentMethodCard, // Or determine dynamically
+		StripeCustomerID: c.ID,
+		ContentID:        contentID,
+	}
+	if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil {
+		payment.StripePaymentMethodID = c.InvoiceSettings.DefaultPaymentMethod.ID
+	}
+	if err := payment.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if couponCode != "" {
+		quote, err := s.couponService.Redeem(ctx, principal.UID, couponCode, CouponTarget{Amount: amount}, &models.CouponRedemption{PaymentID: payment.ID})
+		if err != nil {
+			return nil, nil, err
+		}
+		payment.Amount = quote.Total
+		payment.Discount = quote.Discount
+		payment.CouponCode = quote.Coupon.Code
 	}
+	// 税額は割引後の金額から計算する
+	payment.SetPrice(payment.Amount, tax)
 
 	// Use repository to create payment
 	if err := s.payRepo.CreatePayment(ctx, payment); err != nil {
-		// TODO: Consider canceling the payment intent if db creation fails
-		return nil, pi, err // Return db error, but also the created payment intent
+		s.releaseCoupon(ctx, payment)
+		return nil, nil, err
+	}
+
+	pi, err := paymentintent.New(s.paymentIntentParams(payment))
+	if err != nil {
+		// The pending record is left for the reconciler, which replays the same idempotent request
+		return nil, nil, err
+	}
+
+	payment.StripeID = pi.ID
+	if err := s.payRepo.UpdatePayment(ctx, payment); err != nil {
+		return nil, nil, err
 	}
 
 	return payment, pi, nil
 }
 
+// paymentIntentParams builds the PaymentIntent request for a payment.
+// The same payment always yields the same request, which makes replays idempotent.
+func (s *paymentService) paymentIntentParams(payment *models.Payment) *stripe.PaymentIntentParams {
+	params := &stripe.PaymentIntentParams{
+		Amount:   stripe.Int64(payment.Amount.Minor), // Stripe expects the currency's minor unit (yen for JPY)
+		Currency: stripe.String(strings.ToLower(payment.Amount.Currency)),
+	}
+	if payment.StripeCustomerID != "" {
+		params.Customer = stripe.String(payment.StripeCustomerID)
+	}
+	if payment.StripePaymentMethodID != "" {
+		params.PaymentMethod = stripe.String(payment.StripePaymentMethodID)
+	}
+	params.SetIdempotencyKey("payment-intent-" + payment.ID)
+	params.AddMetadata("payment_id", payment.ID)
+	params.AddMetadata("user_id", payment.UserID)
+	if payment.ContentID != "" {
+		params.AddMetadata("content_id", payment.ContentID)
+	}
+	if payment.CouponCode != "" {
+		params.AddMetadata("coupon_code", payment.CouponCode)
+	}
+	return params
+}
+
 // GetPaymentByID retrieves a payment by its ID using the repository
 func (s *paymentService) GetPaymentByID(ctx context.Context, paymentID string) (*models.Payment, error) {
 	payment, err := s.payRepo.GetPaymentByID(ctx, paymentID)
@@ -95,32 +202,323 @@ func (s *paymentService) UpdatePaymentStatus(ctx context.Context, paymentID stri
 	}
 	payment.Status = status
 	payment.UpdatedAt = time.Now() // Manually update UpdatedAt or handle in repo
-	return s.payRepo.UpdatePayment(ctx, payment)
+	if err := s.payRepo.UpdatePayment(ctx, payment); err != nil {
+		return err
+	}
+	s.invalidateEntitlements(ctx, payment.UserID)
+	return nil
 }
 
-// ProcessRefund processes a refund for a payment
-func (s *paymentService) ProcessRefund(ctx context.Context, paymentID string) error {
-	payment, err := s.payRepo.GetPaymentByID(ctx, paymentID)
+// ApplyStripeStatus applies a status reported by Stripe to the payment of the given PaymentIntent.
+// Out-of-order transitions are ignored.
+func (s *paymentService) ApplyStripeStatus(ctx context.Context, paymentIntentID string, status string) error {
+	payment, err := s.payRepo.GetPaymentByStripeID(ctx, paymentIntentID)
 	if err != nil {
 		return err
 	}
+	if payment.Status == status || !payment.CanTransitionTo(status) {
+		return nil
+	}
+	payment.Status = status
+	payment.UpdatedAt = time.Now()
+	if err := s.payRepo.UpdatePayment(ctx, payment); err != nil {
+		return err
+	}
+	s.invalidateEntitlements(ctx, payment.UserID)
+	if status == models.PaymentStatusCanceled {
+		s.releaseCoupon(ctx, payment)
+	}
+	return nil
+}
+
+// releaseCoupon gives back the coupon of a payment that will never be captured.
+// Failures are only logged; the slot stays used, which never lets a coupon exceed its limits.
+func (s *paymentService) releaseCoupon(ctx context.Context, payment *models.Payment) {
+	if payment.CouponCode == "" {
+		return
+	}
+	if err := s.couponService.ReleaseForPayment(ctx, payment.ID); err != nil {
+		log.Printf("決済 %s のクーポン利用枠の解放に失敗: %v", payment.ID, err)
+	}
+}
+
+// invalidateEntitlements drops cached entitlements after a payment changed.
+// Failures are only logged; the cache expires on its own shortly after.
+func (s *paymentService) invalidateEntitlements(ctx context.Context, userID string) {
+	if s.entitlements == nil {
+		return
+	}
+	if err := s.entitlements.Invalidate(ctx, userID); err != nil {
+		log.Printf("ユーザー %s の権利情報キャッシュの削除に失敗: %v", userID, err)
+	}
+}
+
+// ProcessRefund refunds part or all of a payment.
+// amount is given in major units of the payment's currency; zero refunds the remaining balance. The refund is reserved locally before Stripe is called,
+// so concurrent requests cannot refund more than was captured.
+func (s *paymentService) ProcessRefund(ctx context.Context, paymentID string, amount float64, reason string) (*models.Refund, error) {
+	payment, err := s.payRepo.GetPaymentByID(ctx, paymentID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !payment.IsCaptured() {
+		return nil, models.ErrPaymentNotRefundable
+	}
+	refundAmount := payment.RemainingRefundable()
+	if amount != 0 {
+		if refundAmount, err = models.NewMoneyFromMajor(amount, payment.Amount.Currency); err != nil {
+			return nil, err
+		}
+	}
 
-	if payment.Status != models.PaymentStatusSucceeded {
-		return errors.New("payment cannot be refunded as it has not succeeded")
+	rf := &models.Refund{
+		ID:        uuid.NewString(),
+		PaymentID: payment.ID,
+		Amount:    refundAmount,
+		Reason:    reason,
+		Status:    models.RefundStatusPending,
+	}
+	if err := rf.Validate(); err != nil {
+		return nil, err
+	}
+	if err := s.refundRepo.CreateRefund(ctx, rf); err != nil {
+		return nil, err
 	}
 
 	// Process refund through Stripe using Payment Intent ID
 	refundParams := &stripe.RefundParams{
 		PaymentIntent: stripe.String(payment.StripeID),
-		// Add other refund params like amount, reason, metadata if needed
+		Amount:        stripe.Int64(rf.Amount.Minor),
+	}
+	if reason != "" {
+		refundParams.Reason = stripe.String(reason)
 	}
-	_, err = refund.New(refundParams)
+	refundParams.SetIdempotencyKey("refund-" + rf.ID)
+	refundParams.AddMetadata("refund_id", rf.ID)
+	refundParams.AddMetadata("payment_id", payment.ID)
+
+	stripeRefund, err := refund.New(refundParams)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if !errors.As(err, &stripeErr) || stripeErr.HTTPStatusCode >= 500 {
+			// 通信エラーやStripeの障害ではStripe側で返金済みの可能性があるため、予約を残してWebhookか照合ジョブでの反映を待つ
+			log.Printf("返金 %s の結果が不明のため保留のままにします: %v", rf.ID, err)
+			return nil, fmt.Errorf("%w: %v", ErrRefundOutcomeUnknown, err)
+		}
+		// Stripeが拒否した場合だけ予約を解除して返金可能額を戻す
+		rf.Status = models.RefundStatusFailed
+		if updateErr := s.refundRepo.UpdateRefund(ctx, rf); updateErr != nil {
+			log.Printf("返金 %s の状態更新に失敗: %v", rf.ID, updateErr)
+		}
+		return nil, err // Return Stripe refund error
+	}
+
+	rf.StripeRefundID = &stripeRefund.ID
+	rf.Status = string(stripeRefund.Status)
+	if err := s.refundRepo.UpdateRefund(ctx, rf); err != nil {
+		return nil, err
+	}
+	s.invalidateEntitlements(ctx, payment.UserID)
+	return rf, nil
+}
+
+// SyncStripeRefund records a refund reported by a Stripe webhook, including refunds made from the dashboard
+func (s *paymentService) SyncStripeRefund(ctx context.Context, paymentIntentID string, stripeRefund *stripe.Refund) error {
+	payment, err := s.payRepo.GetPaymentByStripeID(ctx, paymentIntentID)
 	if err != nil {
-		return err // Return Stripe refund error
+		return err
 	}
 
-	// Update local payment status using the dedicated method
-	return s.UpdatePaymentStatus(ctx, paymentID, models.PaymentStatusRefunded)
+	rf := &models.Refund{
+		ID:             stripeRefund.Metadata["refund_id"],
+		PaymentID:      payment.ID,
+		StripeRefundID: &stripeRefund.ID,
+		Amount:         models.Money{Minor: stripeRefund.Amount, Currency: payment.Amount.Currency},
+		Reason:         string(stripeRefund.Reason),
+		Status:         string(stripeRefund.Status),
+	}
+	if rf.ID == "" {
+		rf.ID = uuid.NewString() // Refunds created outside this API are matched by their Stripe ID
+	}
+	if err := s.refundRepo.SyncStripeRefund(ctx, rf); err != nil {
+		return err
+	}
+	s.invalidateEntitlements(ctx, payment.UserID)
+	return nil
+}
+
+const (
+	// orphanedPaymentAge is how long a payment may wait for its Stripe ID before it is reconciled
+	orphanedPaymentAge = 15 * time.Minute
+	// abandonedPaymentAge is how long an attached intent may stay unfinished before it is canceled
+	abandonedPaymentAge = 24 * time.Hour
+	// idempotencyKeyLifetime is slightly shorter than Stripe's 24h idempotency window
+	idempotencyKeyLifetime = 23 * time.Hour
+	reconcileBatchSize     = 100
+	// stalePendingRefundAge is how long a refund may stay pending before it is looked up in Stripe
+	stalePendingRefundAge = 15 * time.Minute
+)
+
+// ReconcilePendingPayments cancels or finalizes PaymentIntents whose local record never finalized.
+// Payments that stay pending, because reconciling failed or Stripe is still processing them,
+// are touched so that they wait a full period before the next attempt and do not hold back the others.
+func (s *paymentService) ReconcilePendingPayments(ctx context.Context) error {
+	now := time.Now()
+	payments, err := s.payRepo.ListStalePendingPayments(ctx, now.Add(-orphanedPaymentAge), now.Add(-abandonedPaymentAge), reconcileBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, payment := range payments {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		var reconcileErr error
+		if payment.StripeID == "" {
+			reconcileErr = s.reconcileOrphanedPayment(ctx, payment)
+		} else {
+			reconcileErr = s.reconcileAbandonedPayment(ctx, payment)
+		}
+		if reconcileErr != nil {
+			log.Printf("決済 %s の照合に失敗: %v", payment.ID, reconcileErr)
+		}
+		if payment.Status == models.PaymentStatusPending {
+			if err := s.payRepo.TouchPayment(ctx, payment.ID); err != nil {
+				log.Printf("決済 %s の照合時刻の更新に失敗: %v", payment.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileOrphanedPayment resolves a payment whose PaymentIntent ID was never stored
+func (s *paymentService) reconcileOrphanedPayment(ctx context.Context, payment *models.Payment) error {
+	if time.Since(payment.CreatedAt) > idempotencyKeyLifetime {
+		// The idempotency key has expired, so a replay would create a new intent
+		return s.finalizePayment(ctx, payment, "", models.PaymentStatusCanceled)
+	}
+
+	// Replaying the original request returns the intent Stripe created, if any
+	pi, err := paymentintent.New(s.paymentIntentParams(payment))
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) && stripeErr.Type == stripe.ErrorTypeInvalidRequest {
+			return s.finalizePayment(ctx, payment, "", models.PaymentStatusFailed)
+		}
+		return err
+	}
+	return s.cancelIntent(ctx, payment, pi)
+}
+
+// reconcileAbandonedPayment resolves an intent that never reached a final state
+func (s *paymentService) reconcileAbandonedPayment(ctx context.Context, payment *models.Payment) error {
+	pi, err := paymentintent.Get(payment.StripeID, nil)
+	if err != nil {
+		return err
+	}
+	return s.cancelIntent(ctx, payment, pi)
+}
+
+// cancelIntent cancels an unfinished intent and records its final state locally
+func (s *paymentService) cancelIntent(ctx context.Context, payment *models.Payment, pi *stripe.PaymentIntent) error {
+	switch pi.Status {
+	case stripe.PaymentIntentStatusSucceeded:
+		return s.finalizePayment(ctx, payment, pi.ID, models.PaymentStatusSucceeded)
+	case stripe.PaymentIntentStatusCanceled:
+		return s.finalizePayment(ctx, payment, pi.ID, models.PaymentStatusCanceled)
+	case stripe.PaymentIntentStatusProcessing:
+		return nil // Wait for the webhook
+	}
+
+	if _, err := paymentintent.Cancel(pi.ID, nil); err != nil {
+		return err
+	}
+	return s.finalizePayment(ctx, payment, pi.ID, models.PaymentStatusCanceled)
+}
+
+func (s *paymentService) finalizePayment(ctx context.Context, payment *models.Payment, stripeID string, status string) error {
+	if stripeID != "" {
+		payment.StripeID = stripeID
+	}
+	payment.Status = status
+	payment.UpdatedAt = time.Now()
+	if err := s.payRepo.UpdatePayment(ctx, payment); err != nil {
+		return err
+	}
+	s.invalidateEntitlements(ctx, payment.UserID)
+	if status == models.PaymentStatusCanceled || status == models.PaymentStatusFailed {
+		s.releaseCoupon(ctx, payment) // 照合で確定した失敗はクライアントから再試行されない
+	}
+	return nil
+}
+
+// ReconcilePendingRefunds settles refunds left pending because the outcome of the Stripe call was unknown.
+// Each refund is looked up in Stripe by the refund_id metadata it was created with; a refund Stripe never
+// received is marked failed so that its reservation no longer holds back the refundable balance.
+func (s *paymentService) ReconcilePendingRefunds(ctx context.Context) error {
+	refunds, err := s.refundRepo.ListStalePendingRefunds(ctx, time.Now().Add(-stalePendingRefundAge), reconcileBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, rf := range refunds {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.reconcileRefund(ctx, rf); err != nil {
+			log.Printf("返金 %s の照合に失敗: %v", rf.ID, err)
+		}
+		if rf.Status == models.RefundStatusPending {
+			if err := s.refundRepo.TouchRefund(ctx, rf.ID); err != nil {
+				log.Printf("返金 %s の照合時刻の更新に失敗: %v", rf.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reconcileRefund records the Stripe state of a pending refund
+func (s *paymentService) reconcileRefund(ctx context.Context, rf *models.Refund) error {
+	payment, err := s.payRepo.GetPaymentByID(ctx, rf.PaymentID)
+	if err != nil {
+		return err
+	}
+
+	stripeRefund, err := s.findStripeRefund(rf, payment)
+	if err != nil {
+		return err
+	}
+	if stripeRefund == nil {
+		// Stripeに届いていない返金は失敗として予約を解除する
+		rf.Status = models.RefundStatusFailed
+	} else {
+		rf.StripeRefundID = &stripeRefund.ID
+		rf.Status = string(stripeRefund.Status)
+	}
+	if rf.Status == models.RefundStatusPending {
+		return nil // Stripe側で処理中。Webhookで確定する
+	}
+	if err := s.refundRepo.UpdateRefund(ctx, rf); err != nil {
+		return err
+	}
+	s.invalidateEntitlements(ctx, payment.UserID)
+	return nil
+}
+
+// findStripeRefund returns the Stripe refund created for rf, or nil if Stripe has none
+func (s *paymentService) findStripeRefund(rf *models.Refund, payment *models.Payment) (*stripe.Refund, error) {
+	if rf.StripeRefundID != nil {
+		return refund.Get(*rf.StripeRefundID, nil)
+	}
+	iter := refund.List(&stripe.RefundListParams{PaymentIntent: stripe.String(payment.StripeID)})
+	for iter.Next() {
+		if r := iter.Refund(); r.Metadata["refund_id"] == rf.ID {
+			return r, nil
+		}
+	}
+	return nil, iter.Err()
 }
 
 /*
@@ -0,0 +1,305 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go"
+	"gorm.io/gorm"
+)
+
+// memoryPaymentRepository stores payments and reserves refunds against them like the row-locking refundRepository
+type memoryPaymentRepository struct {
+	repository.RefundRepository
+	repository.PaymentRepository
+	mu       sync.Mutex
+	payments map[string]*models.Payment
+	refunds  map[string]*models.Refund
+}
+
+func newMemoryPaymentRepository(payments ...*models.Payment) *memoryPaymentRepository {
+	repo := &memoryPaymentRepository{payments: map[string]*models.Payment{}, refunds: map[string]*models.Refund{}}
+	for _, payment := range payments {
+		repo.payments[payment.ID] = payment
+	}
+	return repo
+}
+
+func (r *memoryPaymentRepository) GetPaymentByID(ctx context.Context, paymentID string) (*models.Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if payment, ok := r.payments[paymentID]; ok {
+		copied := *payment
+		return &copied, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryPaymentRepository) UpdatePayment(ctx context.Context, payment *models.Payment) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *payment
+	r.payments[payment.ID] = &copied
+	return nil
+}
+
+func (r *memoryPaymentRepository) ListStalePendingPayments(ctx context.Context, orphanedBefore time.Time, abandonedBefore time.Time, limit int) ([]*models.Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var payments []*models.Payment
+	for _, payment := range r.payments {
+		stale := payment.UpdatedAt.Before(abandonedBefore) || (payment.StripeID == "" && payment.UpdatedAt.Before(orphanedBefore))
+		if payment.Status == models.PaymentStatusPending && stale && len(payments) < limit {
+			copied := *payment
+			payments = append(payments, &copied)
+		}
+	}
+	return payments, nil
+}
+
+func (r *memoryPaymentRepository) TouchPayment(ctx context.Context, paymentID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payments[paymentID].UpdatedAt = time.Now()
+	return nil
+}
+
+func (r *memoryPaymentRepository) CreateRefund(ctx context.Context, refund *models.Refund) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	payment := r.payments[refund.PaymentID]
+	if !payment.IsCaptured() {
+		return models.ErrPaymentNotRefundable
+	}
+	var reserved int64
+	for _, existing := range r.refunds {
+		if existing.PaymentID == refund.PaymentID && (existing.Status == models.RefundStatusPending || existing.Status == models.RefundStatusSucceeded) {
+			reserved += existing.Amount.Minor
+		}
+	}
+	if payment.ExceedsRefundable(reserved, refund.Amount.Minor) {
+		return models.ErrRefundExceedsPayment
+	}
+	copied := *refund
+	r.refunds[refund.ID] = &copied
+	return nil
+}
+
+func (r *memoryPaymentRepository) UpdateRefund(ctx context.Context, refund *models.Refund) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *refund
+	r.refunds[refund.ID] = &copied
+
+	var refunded int64
+	for _, existing := range r.refunds {
+		if existing.PaymentID == refund.PaymentID && existing.Status == models.RefundStatusSucceeded {
+			refunded += existing.Amount.Minor
+		}
+	}
+	r.payments[refund.PaymentID].SetRefundedAmount(refunded)
+	return nil
+}
+
+func (r *memoryPaymentRepository) ListStalePendingRefunds(ctx context.Context, before time.Time, limit int) ([]*models.Refund, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var refunds []*models.Refund
+	for _, refund := range r.refunds {
+		if refund.Status == models.RefundStatusPending && refund.UpdatedAt.Before(before) && len(refunds) < limit {
+			copied := *refund
+			refunds = append(refunds, &copied)
+		}
+	}
+	return refunds, nil
+}
+
+func (r *memoryPaymentRepository) TouchRefund(ctx context.Context, refundID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refunds[refundID].UpdatedAt = time.Now()
+	return nil
+}
+
+func (r *memoryPaymentRepository) statuses() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	statuses := map[string]int{}
+	for _, refund := range r.refunds {
+		statuses[refund.Status]++
+	}
+	return statuses
+}
+
+func newTestRefundService(payment *models.Payment) (PaymentService, *memoryPaymentRepository) {
+	repo := newMemoryPaymentRepository(payment)
+	return NewPaymentService(repo, repo, nil, nil, nil, nil, nil, nil), repo
+}
+
+func capturedPayment() *models.Payment {
+	return &models.Payment{
+		ID:       "pay-1",
+		UserID:   "user-1",
+		StripeID: "pi_123",
+		Amount:   models.Money{Minor: 1200, Currency: "JPY"},
+		Status:   models.PaymentStatusSucceeded,
+	}
+}
+
+func TestProcessRefundReleasesReservationWhenStripeDeclines(t *testing.T) {
+	useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+		return "", &stripe.Error{Type: stripe.ErrorTypeInvalidRequest, Code: stripe.ErrorCodeChargeAlreadyRefunded, HTTPStatusCode: 400, Msg: "Charge has already been refunded."}
+	})
+	service, repo := newTestRefundService(capturedPayment())
+
+	_, err := service.ProcessRefund(context.Background(), "pay-1", 0, "")
+	var stripeErr *stripe.Error
+	require.ErrorAs(t, err, &stripeErr)
+	assert.Equal(t, map[string]int{models.RefundStatusFailed: 1}, repo.statuses())
+}
+
+func TestProcessRefundKeepsReservationWhenOutcomeUnknown(t *testing.T) {
+	for name, stripeErr := range map[string]error{
+		"network":   errors.New("connection reset by peer"),
+		"api_error": &stripe.Error{Type: stripe.ErrorTypeAPI, HTTPStatusCode: 500, Msg: "An unknown error occurred"},
+	} {
+		backend := useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+			return "", stripeErr
+		})
+		service, repo := newTestRefundService(capturedPayment())
+
+		_, err := service.ProcessRefund(context.Background(), "pay-1", 0, "")
+		require.Error(t, err, name)
+		// Stripe側で返金されたかもしれないので、Webhookが届くまで返金可能額は戻さない
+		assert.Equal(t, map[string]int{models.RefundStatusPending: 1}, repo.statuses(), name)
+
+		_, err = service.ProcessRefund(context.Background(), "pay-1", 100, "")
+		assert.ErrorIs(t, err, models.ErrRefundExceedsPayment, name)
+		assert.Len(t, backend.callsTo("POST", "/v1/refunds"), 1, name)
+	}
+}
+
+func TestProcessRefundLimitsPartialRefundsToCapturedAmount(t *testing.T) {
+	backend := useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+		amount := *params.(*stripe.RefundParams).Amount
+		return fmt.Sprintf(`{"id": "re_%d", "amount": %d, "status": "succeeded"}`, amount, amount), nil
+	})
+	service, repo := newTestRefundService(capturedPayment())
+	ctx := context.Background()
+
+	_, err := service.ProcessRefund(ctx, "pay-1", 500, "")
+	require.NoError(t, err)
+	assert.Equal(t, models.PaymentStatusPartiallyRefunded, repo.payments["pay-1"].Status)
+
+	// 残額を超える返金はStripeに送らない
+	_, err = service.ProcessRefund(ctx, "pay-1", 701, "")
+	assert.ErrorIs(t, err, models.ErrRefundExceedsPayment)
+
+	// 金額を省略すると残額だけを返金する
+	rf, err := service.ProcessRefund(ctx, "pay-1", 0, "")
+	require.NoError(t, err)
+	assert.Equal(t, models.Money{Minor: 700, Currency: "JPY"}, rf.Amount)
+	assert.Equal(t, models.PaymentStatusRefunded, repo.payments["pay-1"].Status)
+	assert.Equal(t, int64(1200), repo.payments["pay-1"].RefundedAmount.Minor)
+
+	_, err = service.ProcessRefund(ctx, "pay-1", 1, "")
+	assert.ErrorIs(t, err, models.ErrRefundExceedsPayment)
+	assert.Len(t, backend.callsTo("POST", "/v1/refunds"), 2)
+	assert.Equal(t, map[string]int{models.RefundStatusSucceeded: 2}, repo.statuses())
+}
+
+func TestProcessRefundRejectsAmountFinerThanCurrency(t *testing.T) {
+	backend := useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+		return "", errors.New("unexpected call")
+	})
+	service, repo := newTestRefundService(capturedPayment())
+
+	_, err := service.ProcessRefund(context.Background(), "pay-1", 100.5, "")
+	assert.ErrorIs(t, err, models.ErrInvalidMoneyPrecision)
+	assert.Empty(t, backend.calls)
+	assert.Empty(t, repo.statuses())
+}
+
+func TestReconcilePendingRefundsSettlesUnknownOutcomes(t *testing.T) {
+	backend := useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+		switch {
+		case method == "GET" && path == "/v1/refunds":
+			// ref-sent はStripeに届いていたが、ref-lost は届いていなかった
+			return `{"object": "list", "has_more": false, "data": [
+				{"id": "re_sent", "amount": 500, "status": "succeeded", "metadata": {"refund_id": "ref-sent"}},
+				{"id": "re_other", "amount": 100, "status": "succeeded", "metadata": {"refund_id": "ref-other"}}]}`, nil
+		case method == "GET" && path == "/v1/refunds/re_processing":
+			return `{"id": "re_processing", "amount": 200, "status": "pending"}`, nil
+		}
+		return "", fmt.Errorf("unexpected Stripe call %s %s", method, path)
+	})
+	service, repo := newTestRefundService(capturedPayment())
+	stale := time.Now().Add(-time.Hour)
+	processingID := "re_processing"
+	for _, rf := range []*models.Refund{
+		{ID: "ref-sent", PaymentID: "pay-1", Amount: models.Money{Minor: 500, Currency: "JPY"}, Status: models.RefundStatusPending, UpdatedAt: stale},
+		{ID: "ref-lost", PaymentID: "pay-1", Amount: models.Money{Minor: 300, Currency: "JPY"}, Status: models.RefundStatusPending, UpdatedAt: stale},
+		{ID: "ref-processing", PaymentID: "pay-1", StripeRefundID: &processingID, Amount: models.Money{Minor: 200, Currency: "JPY"}, Status: models.RefundStatusPending, UpdatedAt: stale},
+		// 直近の返金はまだ照合しない
+		{ID: "ref-recent", PaymentID: "pay-1", Amount: models.Money{Minor: 100, Currency: "JPY"}, Status: models.RefundStatusPending, UpdatedAt: time.Now()},
+	} {
+		repo.refunds[rf.ID] = rf
+	}
+
+	require.NoError(t, service.ReconcilePendingRefunds(context.Background()))
+	assert.Equal(t, models.RefundStatusSucceeded, repo.refunds["ref-sent"].Status)
+	assert.Equal(t, "re_sent", *repo.refunds["ref-sent"].StripeRefundID)
+	assert.Equal(t, models.RefundStatusFailed, repo.refunds["ref-lost"].Status)
+	assert.Equal(t, models.RefundStatusPending, repo.refunds["ref-processing"].Status)
+	assert.True(t, repo.refunds["ref-processing"].UpdatedAt.After(stale))
+	assert.Equal(t, models.RefundStatusPending, repo.refunds["ref-recent"].Status)
+	assert.Equal(t, int64(500), repo.payments["pay-1"].RefundedAmount.Minor)
+	assert.Len(t, backend.callsTo("GET", "/v1/refunds"), 2)
+
+	// 届いていなかった返金の予約が外れ、残額を返金し直せる
+	_, err := service.ProcessRefund(context.Background(), "pay-1", 300, "")
+	assert.NotErrorIs(t, err, models.ErrRefundExceedsPayment)
+}
+
+func TestReconcilePendingPaymentsBacksOffUnresolvedPayments(t *testing.T) {
+	backend := useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+		switch path {
+		case "/v1/payment_intents/pi_processing":
+			return `{"id": "pi_processing", "status": "processing"}`, nil
+		case "/v1/payment_intents/pi_canceled":
+			return `{"id": "pi_canceled", "status": "canceled"}`, nil
+		}
+		return "", errors.New("connection reset by peer")
+	})
+	dayAgo := time.Now().Add(-25 * time.Hour)
+	repo := newMemoryPaymentRepository(
+		&models.Payment{ID: "pay-processing", StripeID: "pi_processing", Status: models.PaymentStatusPending, UpdatedAt: dayAgo},
+		&models.Payment{ID: "pay-unreachable", StripeID: "pi_unreachable", Status: models.PaymentStatusPending, UpdatedAt: dayAgo},
+		&models.Payment{ID: "pay-canceled", StripeID: "pi_canceled", Status: models.PaymentStatusPending, UpdatedAt: dayAgo},
+		// 24時間以内のPaymentIntentはまだ照合しない
+		&models.Payment{ID: "pay-recent", StripeID: "pi_recent", Status: models.PaymentStatusPending, UpdatedAt: time.Now().Add(-time.Hour)},
+	)
+	service := NewPaymentService(repo, repo, nil, nil, nil, nil, nil, nil)
+
+	require.NoError(t, service.ReconcilePendingPayments(context.Background()))
+	assert.Equal(t, models.PaymentStatusCanceled, repo.payments["pay-canceled"].Status)
+	for _, id := range []string{"pay-processing", "pay-unreachable"} {
+		assert.Equal(t, models.PaymentStatusPending, repo.payments[id].Status, id)
+		assert.True(t, repo.payments[id].UpdatedAt.After(dayAgo), id)
+	}
+	assert.Empty(t, backend.callsTo("GET", "/v1/payment_intents/pi_recent"))
+
+	// 保留のままの決済は次の期間まで対象にならない
+	calls := len(backend.calls)
+	require.NoError(t, service.ReconcilePendingPayments(context.Background()))
+	assert.Len(t, backend.calls, calls)
+}
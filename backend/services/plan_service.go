@@ -0,0 +1,127 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"gorm.io/gorm"
+)
+
+// Common errors for PlanService
+var (
+	// ErrUnknownPlan is returned when a plan does not exist, is retired or is not sold for the billing cycle
+	ErrUnknownPlan = errors.New("unknown or retired plan")
+	// ErrPlanNotFound is returned by catalog administration for a missing plan
+	ErrPlanNotFound = errors.New("plan not found")
+)
+
+// PlanPrice is what a subscription to a plan is billed at
+type PlanPrice struct {
+	StripePriceID string
+	Amount        models.Money
+	TrialDays     int // 0はトライアルなし
+}
+
+// PlanPriceResolver maps an app plan and billing cycle to its price, and back
+type PlanPriceResolver interface {
+	ResolvePrice(ctx context.Context, planID string, billingCycle string) (*PlanPrice, error)
+	ResolveStripePrice(ctx context.Context, stripePriceID string) (planID string, billingCycle string, err error)
+}
+
+// PlanService manages the plan catalog
+type PlanService interface {
+	PlanPriceResolver
+	ListPlans(ctx context.Context, includeRetired bool) ([]*models.Plan, error)
+	GetPlan(ctx context.Context, id string) (*models.Plan, error)
+	CreatePlan(ctx context.Context, plan *models.Plan) error
+	UpdatePlan(ctx context.Context, plan *models.Plan) error
+	RetirePlan(ctx context.Context, id string) error
+}
+
+type planService struct {
+	repo repository.PlanRepository
+}
+
+// NewPlanService creates a new instance of PlanService
+func NewPlanService(repo repository.PlanRepository) PlanService {
+	return &planService{repo: repo}
+}
+
+// ListPlans returns the catalog; retired plans are only included for administration
+func (s *planService) ListPlans(ctx context.Context, includeRetired bool) ([]*models.Plan, error) {
+	return s.repo.List(ctx, !includeRetired)
+}
+
+func (s *planService) GetPlan(ctx context.Context, id string) (*models.Plan, error) {
+	plan, err := s.repo.GetByID(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPlanNotFound
+	}
+	return plan, err
+}
+
+func (s *planService) CreatePlan(ctx context.Context, plan *models.Plan) error {
+	if err := plan.Validate(); err != nil {
+		return err
+	}
+	return s.repo.Create(ctx, plan)
+}
+
+func (s *planService) UpdatePlan(ctx context.Context, plan *models.Plan) error {
+	if err := plan.Validate(); err != nil {
+		return err
+	}
+	if _, err := s.GetPlan(ctx, plan.ID); err != nil {
+		return err
+	}
+	return s.repo.Update(ctx, plan)
+}
+
+// RetirePlan stops new subscriptions to the plan; existing subscriptions keep running
+func (s *planService) RetirePlan(ctx context.Context, id string) error {
+	plan, err := s.GetPlan(ctx, id)
+	if err != nil {
+		return err
+	}
+	plan.Active = false
+	return s.repo.Update(ctx, plan)
+}
+
+// ResolvePrice returns the catalog price for an active plan
+func (s *planService) ResolvePrice(ctx context.Context, planID string, billingCycle string) (*PlanPrice, error) {
+	plan, err := s.repo.GetByID(ctx, planID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUnknownPlan
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !plan.Active {
+		return nil, ErrUnknownPlan
+	}
+
+	amount, stripePriceID, ok := plan.Price(billingCycle)
+	if !ok || stripePriceID == "" {
+		return nil, ErrUnknownPlan
+	}
+	return &PlanPrice{StripePriceID: stripePriceID, Amount: amount, TrialDays: plan.TrialDays}, nil
+}
+
+// ResolveStripePrice returns the plan and billing cycle of a Stripe price.
+// Retired plans are included because existing subscriptions keep their price.
+func (s *planService) ResolveStripePrice(ctx context.Context, stripePriceID string) (string, string, error) {
+	plan, err := s.repo.GetByStripePriceID(ctx, stripePriceID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", "", ErrUnknownPlan
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if plan.StripeYearlyPriceID == stripePriceID {
+		return plan.ID, models.BillingCycleYearly, nil
+	}
+	return plan.ID, models.BillingCycleMonthly, nil
+}
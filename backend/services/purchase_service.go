@@ -0,0 +1,249 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"gorm.io/gorm"
+)
+
+// Common errors for PurchaseService
+var (
+	// ErrUnsupportedPlatform is returned for stores without a configured verifier
+	ErrUnsupportedPlatform = errors.New("unsupported purchase platform")
+	// ErrInvalidReceipt is returned when the store does not confirm the purchase
+	ErrInvalidReceipt = errors.New("purchase could not be verified")
+	// ErrPurchaseOwnedByAnotherUser is returned when the transaction was already claimed by another account
+	ErrPurchaseOwnedByAnotherUser = errors.New("purchase belongs to another user")
+	// ErrPurchasePending is returned while the store is still waiting for the payment (e.g. convenience store payment)
+	ErrPurchasePending = errors.New("purchase is pending payment")
+	// ErrStoreUnavailable is returned when the store could not be reached; the app should retry later
+	ErrStoreUnavailable = errors.New("store is temporarily unavailable")
+)
+
+// StoreReceipt is what the app sends after a store purchase
+type StoreReceipt struct {
+	Platform      string
+	ProductID     string
+	TransactionID string // App Storeの取引ID
+	Data          string // serverVerificationData: App Storeの署名付き取引（JWS）やGoogle Playの購入トークン
+}
+
+// VerifiedPurchase is a transaction as reported by the store itself
+type VerifiedPurchase struct {
+	ProductID          string
+	PurchaseID         string
+	OriginalPurchaseID string
+	Environment        string
+	PurchasedAt        time.Time
+	ExpiresAt          time.Time    // ゼロ値は買い切り
+	RevokedAt          *time.Time   // 返金などで取り消された場合
+	AutoRenew          *bool        // nilはストアから取得できなかった
+	Price              models.Money // ゼロ値はストアから取得できなかった
+}
+
+// PurchaseVerifier confirms a purchase with one store.
+// Implementations must only trust data signed or returned by the store, never the app.
+type PurchaseVerifier interface {
+	Verify(ctx context.Context, userID string, receipt *StoreReceipt) (*VerifiedPurchase, error)
+}
+
+// PurchaseService records in-app purchases after verifying them with the store
+type PurchaseService interface {
+	ConfirmPurchase(ctx context.Context, principal *Principal, receipt *StoreReceipt) (*models.Purchase, error)
+	// The following apply store notifications to purchases the app has already confirmed;
+	// they return gorm.ErrRecordNotFound when no user owns the original purchase yet
+	ApplyStoreUpdate(ctx context.Context, platform string, verified *VerifiedPurchase) error
+	RefreshStorePurchase(ctx context.Context, originalPurchaseID string, receipt *StoreReceipt) error
+	RevokeStorePurchase(ctx context.Context, originalPurchaseID, purchaseID string, revokedAt time.Time) error
+}
+
+type purchaseService struct {
+	repo         repository.PurchaseRepository
+	verifiers    map[string]PurchaseVerifier // プラットフォームごとの検証
+	entitlements EntitlementInvalidator
+	ledger       PurchaseLedger
+}
+
+// NewPurchaseService creates a new instance of PurchaseService; verifiers are keyed by models.PurchasePlatform*
+func NewPurchaseService(repo repository.PurchaseRepository, verifiers map[string]PurchaseVerifier, entitlements EntitlementInvalidator, ledger PurchaseLedger) PurchaseService {
+	return &purchaseService{
+		repo:         repo,
+		verifiers:    verifiers,
+		entitlements: entitlements,
+		ledger:       ledger,
+	}
+}
+
+// ConfirmPurchase verifies the receipt with its store and records the purchase for the user.
+// Confirming the same transaction again refreshes it, e.g. after a restore.
+func (s *purchaseService) ConfirmPurchase(ctx context.Context, principal *Principal, receipt *StoreReceipt) (*models.Purchase, error) {
+	verifier, ok := s.verifiers[receipt.Platform]
+	if !ok {
+		return nil, ErrUnsupportedPlatform
+	}
+
+	verified, err := verifier.Verify(ctx, principal.UID, receipt)
+	if err != nil {
+		return nil, err
+	}
+	if verified.OriginalPurchaseID == "" {
+		verified.OriginalPurchaseID = verified.PurchaseID // 買い切りの商品
+	}
+
+	// 同じ取引（更新を含む）を別アカウントで使い回させない
+	if err := s.checkOwner(ctx, principal.UID, verified); err != nil {
+		return nil, err
+	}
+
+	purchase := newStorePurchase(principal.UID, receipt.Platform, receipt.Data, verified)
+	if err := s.repo.UpsertByPurchaseID(ctx, purchase); err != nil {
+		return nil, err
+	}
+	// 別アカウントが同時に同じ取引を確認した場合、先に記録された所有者が残る
+	if purchase.UserID != principal.UID {
+		return nil, ErrPurchaseOwnedByAnotherUser
+	}
+	if err := s.recordLedger(ctx, purchase); err != nil {
+		// 台帳はストア通知の再送やリストアでも記録されるため、購入の確認は失敗させない
+		log.Printf("購入 %s の台帳への記録に失敗: %v", purchase.PurchaseID, err)
+	}
+
+	s.invalidate(ctx, principal.UID)
+	return purchase, nil
+}
+
+// ApplyStoreUpdate records a transaction reported by the store for the user who owns its original purchase
+func (s *purchaseService) ApplyStoreUpdate(ctx context.Context, platform string, verified *VerifiedPurchase) error {
+	if verified.OriginalPurchaseID == "" {
+		verified.OriginalPurchaseID = verified.PurchaseID
+	}
+	owner, err := s.owner(ctx, verified.OriginalPurchaseID)
+	if err != nil {
+		return err
+	}
+
+	// 更新の取引にはアプリからのレシートがないため、保存済みのレシートはリポジトリが引き継ぐ
+	purchase := newStorePurchase(owner.UserID, platform, "", verified)
+	if err := s.repo.UpsertByPurchaseID(ctx, purchase); err != nil {
+		return err
+	}
+	if err := s.recordLedger(ctx, purchase); err != nil {
+		return err
+	}
+	s.invalidate(ctx, owner.UserID)
+	return nil
+}
+
+// RefreshStorePurchase verifies the purchase with its store again on behalf of its owner and records the result
+func (s *purchaseService) RefreshStorePurchase(ctx context.Context, originalPurchaseID string, receipt *StoreReceipt) error {
+	verifier, ok := s.verifiers[receipt.Platform]
+	if !ok {
+		return ErrUnsupportedPlatform
+	}
+	owner, err := s.owner(ctx, originalPurchaseID)
+	if err != nil {
+		return err
+	}
+
+	verified, err := verifier.Verify(ctx, owner.UserID, receipt)
+	if err != nil {
+		return err
+	}
+	return s.ApplyStoreUpdate(ctx, receipt.Platform, verified)
+}
+
+// RevokeStorePurchase marks a refunded or revoked purchase; an empty purchaseID revokes every
+// transaction of the original purchase
+func (s *purchaseService) RevokeStorePurchase(ctx context.Context, originalPurchaseID, purchaseID string, revokedAt time.Time) error {
+	purchases, err := s.repo.ListByOriginalPurchaseID(ctx, originalPurchaseID)
+	if err != nil {
+		return err
+	}
+
+	matched := false
+	for _, purchase := range purchases {
+		if purchaseID != "" && purchase.PurchaseID != purchaseID {
+			continue
+		}
+		matched = true
+		if purchase.RevokedAt != nil {
+			continue
+		}
+		purchase.RevokedAt = &revokedAt
+		if err := s.repo.UpsertByPurchaseID(ctx, purchase); err != nil {
+			return err
+		}
+		if err := s.recordLedger(ctx, purchase); err != nil {
+			return err
+		}
+	}
+	if !matched {
+		return gorm.ErrRecordNotFound
+	}
+	s.invalidate(ctx, purchases[0].UserID)
+	return nil
+}
+
+// owner returns the most recent purchase of the original purchase, which tells whose it is
+func (s *purchaseService) owner(ctx context.Context, originalPurchaseID string) (*models.Purchase, error) {
+	purchases, err := s.repo.ListByOriginalPurchaseID(ctx, originalPurchaseID)
+	if err != nil {
+		return nil, err
+	}
+	if len(purchases) == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return purchases[0], nil
+}
+
+func (s *purchaseService) recordLedger(ctx context.Context, purchase *models.Purchase) error {
+	if s.ledger == nil {
+		return nil
+	}
+	return s.ledger.RecordStorePurchase(ctx, purchase)
+}
+
+func (s *purchaseService) invalidate(ctx context.Context, userID string) {
+	if s.entitlements == nil {
+		return
+	}
+	if err := s.entitlements.Invalidate(ctx, userID); err != nil {
+		log.Printf("ユーザー %s の権利情報キャッシュの削除に失敗: %v", userID, err)
+	}
+}
+
+func newStorePurchase(userID, platform, receipt string, verified *VerifiedPurchase) *models.Purchase {
+	return &models.Purchase{
+		UserID:             userID,
+		ProductID:          verified.ProductID,
+		PurchaseID:         verified.PurchaseID,
+		OriginalPurchaseID: verified.OriginalPurchaseID,
+		Platform:           platform,
+		Environment:        verified.Environment,
+		Receipt:            receipt,
+		PurchasedAt:        verified.PurchasedAt,
+		ExpiresAt:          verified.ExpiresAt,
+		RevokedAt:          verified.RevokedAt,
+		AutoRenew:          verified.AutoRenew,
+		Price:              verified.Price,
+	}
+}
+
+func (s *purchaseService) checkOwner(ctx context.Context, userID string, verified *VerifiedPurchase) error {
+	existing, err := s.repo.ListByOriginalPurchaseID(ctx, verified.OriginalPurchaseID)
+	if err != nil {
+		return err
+	}
+	for _, purchase := range existing {
+		if purchase.UserID != userID {
+			return ErrPurchaseOwnedByAnotherUser
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// fakeVerifier stands in for a store; it returns the configured purchase for every receipt
+type fakeVerifier struct {
+	mu       sync.Mutex
+	purchase *VerifiedPurchase
+	err      error
+	receipts []*StoreReceipt
+}
+
+func (v *fakeVerifier) Verify(ctx context.Context, userID string, receipt *StoreReceipt) (*VerifiedPurchase, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.receipts = append(v.receipts, receipt)
+	if v.err != nil {
+		return nil, v.err
+	}
+	verified := *v.purchase
+	return &verified, nil
+}
+
+// memoryPurchaseRepository keeps purchases in memory, keyed by purchase ID
+type memoryPurchaseRepository struct {
+	mu        sync.Mutex
+	purchases map[string]*models.Purchase
+	nextID    uint
+}
+
+func newMemoryPurchaseRepository() *memoryPurchaseRepository {
+	return &memoryPurchaseRepository{purchases: map[string]*models.Purchase{}}
+}
+
+func (r *memoryPurchaseRepository) GetByPurchaseID(ctx context.Context, purchaseID string) (*models.Purchase, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	purchase, ok := r.purchases[purchaseID]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copied := *purchase
+	return &copied, nil
+}
+
+func (r *memoryPurchaseRepository) ListByUserID(ctx context.Context, userID string) ([]*models.Purchase, error) {
+	return r.list(func(p *models.Purchase) bool { return p.UserID == userID }), nil
+}
+
+func (r *memoryPurchaseRepository) ListByOriginalPurchaseID(ctx context.Context, originalPurchaseID string) ([]*models.Purchase, error) {
+	return r.list(func(p *models.Purchase) bool { return p.OriginalPurchaseID == originalPurchaseID }), nil
+}
+
+// UpsertByPurchaseID mirrors the ON CONFLICT statement: the owner and a stored receipt of an existing record are kept
+func (r *memoryPurchaseRepository) UpsertByPurchaseID(ctx context.Context, purchase *models.Purchase) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing, ok := r.purchases[purchase.PurchaseID]; ok {
+		purchase.ID = existing.ID
+		purchase.UserID = existing.UserID
+		if purchase.Receipt == "" {
+			purchase.Receipt = existing.Receipt
+		}
+	} else {
+		r.nextID++
+		purchase.ID = r.nextID
+	}
+	copied := *purchase
+	r.purchases[purchase.PurchaseID] = &copied
+	return nil
+}
+
+func (r *memoryPurchaseRepository) list(match func(*models.Purchase) bool) []*models.Purchase {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var purchases []*models.Purchase
+	for _, purchase := range r.purchases {
+		if match(purchase) {
+			copied := *purchase
+			purchases = append(purchases, &copied)
+		}
+	}
+	return purchases
+}
+
+// Only the methods used by the entitlement service are implemented; the rest panic through the nil interface
+type stubSubscriptionRepository struct {
+	repository.SubscriptionRepository
+}
+
+func (stubSubscriptionRepository) GetByUserID(ctx context.Context, userID string) ([]*models.Subscription, error) {
+	return nil, nil
+}
+
+type stubPaymentRepository struct{ repository.PaymentRepository }
+
+func (stubPaymentRepository) ListContentPurchases(ctx context.Context, userID string) ([]*models.Payment, error) {
+	return nil, nil
+}
+
+type stubPlanRepository struct {
+	repository.PlanRepository
+	plans []*models.Plan
+}
+
+func (r stubPlanRepository) List(ctx context.Context, activeOnly bool) ([]*models.Plan, error) {
+	return r.plans, nil
+}
+
+type recordingInvalidator struct {
+	mu    sync.Mutex
+	users []string
+}
+
+func (i *recordingInvalidator) Invalidate(ctx context.Context, userID string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.users = append(i.users, userID)
+	return nil
+}
+
+func newTestPurchaseService(verifier PurchaseVerifier) (PurchaseService, *memoryPurchaseRepository, *recordingInvalidator) {
+	repo := newMemoryPurchaseRepository()
+	invalidator := &recordingInvalidator{}
+	service := NewPurchaseService(repo, map[string]PurchaseVerifier{models.PurchasePlatformIOS: verifier}, invalidator, nil)
+	return service, repo, invalidator
+}
+
+func monthlyStorePurchase(expiresAt time.Time) *VerifiedPurchase {
+	return &VerifiedPurchase{
+		ProductID:          "jp.kimiyomi.premium.monthly",
+		PurchaseID:         "2000000123456789",
+		OriginalPurchaseID: "2000000100000000",
+		Environment:        "Sandbox",
+		PurchasedAt:        expiresAt.AddDate(0, -1, 0),
+		ExpiresAt:          expiresAt,
+	}
+}
+
+func TestConfirmPurchaseRecordsVerifiedPurchaseAndGrantsPlan(t *testing.T) {
+	ctx := context.Background()
+	verifier := &fakeVerifier{purchase: monthlyStorePurchase(time.Now().Add(24 * time.Hour))}
+	service, repo, invalidator := newTestPurchaseService(verifier)
+	principal := &Principal{UID: "user-1"}
+
+	purchase, err := service.ConfirmPurchase(ctx, principal, &StoreReceipt{
+		Platform:      models.PurchasePlatformIOS,
+		TransactionID: "2000000123456789",
+		Data:          "signed-transaction",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", purchase.UserID)
+	assert.Equal(t, "2000000100000000", purchase.OriginalPurchaseID)
+	assert.Equal(t, []string{"user-1"}, invalidator.users)
+	require.Len(t, verifier.receipts, 1)
+	assert.Equal(t, "2000000123456789", verifier.receipts[0].TransactionID)
+
+	entitlements := NewEntitlementService(stubSubscriptionRepository{}, repo, stubPaymentRepository{}, stubPlanRepository{plans: []*models.Plan{
+		{ID: "premium", StoreProductIDs: []string{"jp.kimiyomi.premium.monthly"}},
+	}}, nil)
+	granted, err := entitlements.Get(ctx, "user-1")
+	require.NoError(t, err)
+	assert.True(t, granted.HasFeature(FeaturePremium))
+	require.Len(t, granted.Grants, 1)
+	assert.Equal(t, EntitlementSourceStore, granted.Grants[0].Source)
+	assert.Equal(t, "premium", granted.Grants[0].PlanID)
+}
+
+func TestConfirmPurchaseTwiceUpdatesTheSameRecord(t *testing.T) {
+	ctx := context.Background()
+	verifier := &fakeVerifier{purchase: monthlyStorePurchase(time.Now().Add(24 * time.Hour))}
+	service, repo, _ := newTestPurchaseService(verifier)
+	principal := &Principal{UID: "user-1"}
+	receipt := &StoreReceipt{Platform: models.PurchasePlatformIOS, TransactionID: "2000000123456789"}
+
+	first, err := service.ConfirmPurchase(ctx, principal, receipt)
+	require.NoError(t, err)
+
+	revokedAt := time.Now()
+	verifier.purchase.RevokedAt = &revokedAt
+	second, err := service.ConfirmPurchase(ctx, principal, receipt)
+	require.NoError(t, err)
+
+	assert.Equal(t, first.ID, second.ID)
+	stored, err := repo.GetByPurchaseID(ctx, "2000000123456789")
+	require.NoError(t, err)
+	assert.False(t, stored.IsActiveAt(time.Now()))
+}
+
+func TestConfirmPurchaseRejectsTransactionOfAnotherUser(t *testing.T) {
+	ctx := context.Background()
+	verifier := &fakeVerifier{purchase: monthlyStorePurchase(time.Now().Add(24 * time.Hour))}
+	service, repo, _ := newTestPurchaseService(verifier)
+	receipt := &StoreReceipt{Platform: models.PurchasePlatformIOS, TransactionID: "2000000123456789"}
+
+	_, err := service.ConfirmPurchase(ctx, &Principal{UID: "user-1"}, receipt)
+	require.NoError(t, err)
+
+	// 更新後の別の取引でも元の購入IDが同じなら拒否する
+	verifier.purchase.PurchaseID = "2000000987654321"
+	_, err = service.ConfirmPurchase(ctx, &Principal{UID: "user-2"}, receipt)
+	assert.ErrorIs(t, err, ErrPurchaseOwnedByAnotherUser)
+
+	purchases, err := repo.ListByUserID(ctx, "user-2")
+	require.NoError(t, err)
+	assert.Empty(t, purchases)
+}
+
+func TestConfirmPurchaseDoesNotRecordUnverifiedReceipts(t *testing.T) {
+	ctx := context.Background()
+	service, repo, invalidator := newTestPurchaseService(&fakeVerifier{err: ErrInvalidReceipt})
+
+	_, err := service.ConfirmPurchase(ctx, &Principal{UID: "user-1"}, &StoreReceipt{Platform: models.PurchasePlatformIOS, Data: "forged"})
+	assert.ErrorIs(t, err, ErrInvalidReceipt)
+	assert.Empty(t, repo.purchases)
+	assert.Empty(t, invalidator.users)
+}
+
+func TestConfirmPurchaseRejectsPlatformWithoutVerifier(t *testing.T) {
+	service, _, _ := newTestPurchaseService(&fakeVerifier{})
+
+	_, err := service.ConfirmPurchase(context.Background(), &Principal{UID: "user-1"}, &StoreReceipt{Platform: models.PurchasePlatformAndroid})
+	assert.ErrorIs(t, err, ErrUnsupportedPlatform)
+}
+
+func TestConfirmPurchaseFromTwoDevicesConcurrently(t *testing.T) {
+	ctx := context.Background()
+	verifier := &fakeVerifier{purchase: monthlyStorePurchase(time.Now().Add(24 * time.Hour))}
+	service, repo, _ := newTestPurchaseService(verifier)
+	principal := &Principal{UID: "user-1"}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = service.ConfirmPurchase(ctx, principal, &StoreReceipt{Platform: models.PurchasePlatformIOS, TransactionID: "2000000123456789"})
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	purchases, err := repo.ListByUserID(ctx, "user-1")
+	require.NoError(t, err)
+	assert.Len(t, purchases, 1)
+}
+
+func TestConfirmPurchaseRaceKeepsFirstOwner(t *testing.T) {
+	ctx := context.Background()
+	verifier := &fakeVerifier{purchase: monthlyStorePurchase(time.Now().Add(24 * time.Hour))}
+	service, repo, _ := newTestPurchaseService(verifier)
+	// 所有者の確認の後、記録までの間に別アカウントが同じ取引を記録した状態
+	require.NoError(t, repo.UpsertByPurchaseID(ctx, &models.Purchase{UserID: "user-2", PurchaseID: "2000000123456789", OriginalPurchaseID: "other"}))
+
+	_, err := service.ConfirmPurchase(ctx, &Principal{UID: "user-1"}, &StoreReceipt{Platform: models.PurchasePlatformIOS, TransactionID: "2000000123456789"})
+	assert.ErrorIs(t, err, ErrPurchaseOwnedByAnotherUser)
+
+	stored, err := repo.GetByPurchaseID(ctx, "2000000123456789")
+	require.NoError(t, err)
+	assert.Equal(t, "user-2", stored.UserID)
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"kimiyomi/models"
+)
+
+// A4縦（ポイント単位）
+const (
+	pdfPageWidth  = 595.28
+	pdfPageHeight = 841.89
+	pdfMargin     = 56.0
+)
+
+// receiptFont is one of the standard Japanese fonts that PDF viewers provide, so the PDF does not embed a font file
+const receiptFont = "HeiseiKakuGo-W5"
+
+// pdfCanvas collects the drawing operators of a single page.
+// Text is encoded for the UniJIS-UCS2-HW-H CMap: ASCII is half-width, everything else full-width.
+type pdfCanvas struct {
+	buf bytes.Buffer
+}
+
+func (c *pdfCanvas) text(x, y, size float64, s string) {
+	fmt.Fprintf(&c.buf, "BT /F1 %s Tf %s %s Td <%s> Tj ET\n", pdfNumber(size), pdfNumber(x), pdfNumber(y), pdfUTF16(s))
+}
+
+func (c *pdfCanvas) textRight(right, y, size float64, s string) {
+	c.text(right-pdfTextWidth(s, size), y, size, s)
+}
+
+func (c *pdfCanvas) textCenter(y, size float64, s string) {
+	c.text((pdfPageWidth-pdfTextWidth(s, size))/2, y, size, s)
+}
+
+func (c *pdfCanvas) line(x1, y1, x2, y2, width float64) {
+	fmt.Fprintf(&c.buf, "%s w %s %s m %s %s l S\n", pdfNumber(width), pdfNumber(x1), pdfNumber(y1), pdfNumber(x2), pdfNumber(y2))
+}
+
+func (c *pdfCanvas) rect(x, y, w, h, width float64) {
+	fmt.Fprintf(&c.buf, "%s w %s %s %s %s re S\n", pdfNumber(width), pdfNumber(x), pdfNumber(y), pdfNumber(w), pdfNumber(h))
+}
+
+// pdfTextWidth approximates the width of the text with half-width ASCII and full-width everything else
+func pdfTextWidth(s string, size float64) float64 {
+	var em float64
+	for _, r := range s {
+		if r < 0x80 {
+			em += 0.5
+		} else {
+			em += 1
+		}
+	}
+	return em * size
+}
+
+// pdfUTF16 encodes the text as a hex string; UCS-2 cannot express characters outside the BMP
+func pdfUTF16(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r > 0xFFFF || (r >= 0xD800 && r <= 0xDFFF) {
+			r = '?'
+		}
+		fmt.Fprintf(&b, "%04X", r)
+	}
+	return b.String()
+}
+
+func pdfNumber(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+// writePDF wraps the page content into a one-page PDF document
+func writePDF(content []byte) []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Resources << /Font << /F1 5 0 R >> >> /Contents 4 0 R >>",
+			pdfNumber(pdfPageWidth), pdfNumber(pdfPageHeight)),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		fmt.Sprintf("<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /UniJIS-UCS2-HW-H /DescendantFonts [6 0 R] >>", receiptFont),
+		fmt.Sprintf("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /%s /CIDSystemInfo << /Registry (Adobe) /Ordering (Japan1) /Supplement 2 >> /FontDescriptor 7 0 R /DW 1000 /W [231 325 500] >>", receiptFont),
+		fmt.Sprintf("<< /Type /FontDescriptor /FontName /%s /Flags 4 /FontBBox [-92 -250 1010 922] /ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 737 /StemV 93 >>", receiptFont),
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+// renderReceiptPDF lays out the receipt on one A4 page.
+// The output depends only on the receipt, so rendering it again gives the same bytes.
+func renderReceiptPDF(r *models.Receipt) []byte {
+	var c pdfCanvas
+	right := pdfPageWidth - pdfMargin
+
+	c.textRight(right, 790, 10, "No. "+r.Number)
+	c.textRight(right, 774, 10, "発行日 "+r.IssuedAt.In(jst).Format("2006年1月2日"))
+	c.textCenter(730, 28, "領 収 書")
+
+	recipient := r.RecipientName
+	if recipient == "" {
+		recipient = "　　　　　　　　"
+	}
+	c.text(pdfMargin, 670, 16, recipient+" 様")
+	c.line(pdfMargin, 664, 330, 664, 1)
+
+	c.rect(pdfMargin, 590, right-pdfMargin, 50, 1.5)
+	c.text(pdfMargin+16, 609, 12, "金額")
+	c.textCenter(605, 24, formatReceiptAmount(r.Amount)+"（税込）")
+
+	description := "但し " + r.Description
+	if r.TaxRate == models.TaxRateReduced {
+		description += "※"
+	}
+	c.text(pdfMargin, 556, 12, description)
+	c.text(pdfMargin, 536, 12, "上記正に領収いたしました。")
+
+	c.text(pdfMargin, 480, 11, "内訳")
+	c.line(pdfMargin, 474, 330, 474, 0.5)
+	c.text(pdfMargin+8, 456, 11, fmt.Sprintf("%d%%対象", r.TaxRate))
+	c.textRight(322, 456, 11, formatReceiptAmount(r.Amount))
+	c.text(pdfMargin+8, 438, 11, "内消費税等")
+	c.textRight(322, 438, 11, formatReceiptAmount(r.TaxAmount))
+	c.line(pdfMargin, 430, 330, 430, 0.5)
+	if r.TaxRate == models.TaxRateReduced {
+		c.text(pdfMargin, 414, 9, "※は軽減税率対象")
+	}
+
+	registration := ""
+	if r.RegistrationNumber != "" {
+		registration = "登録番号 " + r.RegistrationNumber
+	}
+	y := 380.0
+	for _, seller := range []struct {
+		size float64
+		text string
+	}{
+		{13, r.SellerName},
+		{10, registration},
+		{10, r.SellerAddress},
+		{10, r.SellerContact},
+	} {
+		if seller.text == "" {
+			continue
+		}
+		c.text(350, y, seller.size, seller.text)
+		y -= seller.size + 8
+	}
+
+	c.text(pdfMargin, 80, 8, "お支払いID: "+r.PaymentID)
+	return writePDF(c.buf.Bytes())
+}
+
+// formatReceiptAmount formats the amount for a receipt, e.g. 1,200円 or 12.00 USD
+func formatReceiptAmount(m models.Money) string {
+	exp := models.CurrencyExponent(m.Currency)
+	minor := m.Minor
+	sign := ""
+	if minor < 0 {
+		sign = "-"
+		minor = -minor
+	}
+	unit := int64(math.Pow10(exp))
+
+	digits := strconv.FormatInt(minor/unit, 10)
+	var b strings.Builder
+	b.WriteString(sign)
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	if exp > 0 {
+		fmt.Fprintf(&b, ".%0*d", exp, minor%unit)
+	}
+	if m.Currency == "JPY" {
+		b.WriteString("円")
+	} else {
+		b.WriteString(" " + m.Currency)
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// ErrReceiptUnavailable is returned when a receipt is requested for a payment that has not been paid or was fully refunded
+var ErrReceiptUnavailable = errors.New("receipts are only issued for succeeded payments")
+
+// ReceiptConfig holds the seller shown on receipts
+type ReceiptConfig struct {
+	SellerName    string
+	SellerAddress string
+	SellerContact string
+	// RegistrationNumber is the qualified invoice issuer number (T and 13 digits) that makes the receipt a 適格簡易請求書
+	RegistrationNumber string
+}
+
+// ReceiptService issues receipts (領収書) for Stripe payments
+type ReceiptService interface {
+	GetOrIssueReceipt(ctx context.Context, payment *models.Payment) (*models.Receipt, error)
+}
+
+type receiptService struct {
+	repo        repository.ReceiptRepository
+	userRepo    repository.UserRepository
+	contentRepo repository.ContentRepository
+	cfg         *ReceiptConfig
+}
+
+// NewReceiptService creates a new instance of ReceiptService
+func NewReceiptService(repo repository.ReceiptRepository, userRepo repository.UserRepository, contentRepo repository.ContentRepository, cfg *ReceiptConfig) ReceiptService {
+	return &receiptService{
+		repo:        repo,
+		userRepo:    userRepo,
+		contentRepo: contentRepo,
+		cfg:         cfg,
+	}
+}
+
+// GetOrIssueReceipt returns the stored receipt of the payment, issuing it on the first request.
+// A receipt once issued is returned as is, even if the payment is refunded later.
+func (s *receiptService) GetOrIssueReceipt(ctx context.Context, payment *models.Payment) (*models.Receipt, error) {
+	receipt, err := s.repo.GetByPaymentID(ctx, payment.ID)
+	if err == nil {
+		return receipt, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	// 全額返金・チャージバック中の支払いには新たに発行しない
+	if payment.Status != models.PaymentStatusSucceeded && payment.Status != models.PaymentStatusPartiallyRefunded {
+		return nil, ErrReceiptUnavailable
+	}
+
+	received, tax := payment.Amount, payment.Tax
+	if payment.RefundedAmount.Minor > 0 && payment.RefundedAmount.Currency == received.Currency {
+		received.Minor -= payment.RefundedAmount.Minor
+		tax = models.IncludedTax(received, payment.TaxRate)
+	}
+	issuedAt := time.Now()
+	receipt = &models.Receipt{
+		ID:                 uuid.NewString(),
+		PaymentID:          payment.ID,
+		UserID:             payment.UserID,
+		RecipientName:      s.recipientName(ctx, payment.UserID),
+		Description:        s.description(ctx, payment),
+		Amount:             received,
+		TaxRate:            payment.TaxRate,
+		TaxAmount:          tax,
+		SellerName:         s.cfg.SellerName,
+		SellerAddress:      s.cfg.SellerAddress,
+		SellerContact:      s.cfg.SellerContact,
+		RegistrationNumber: s.cfg.RegistrationNumber,
+		IssuedAt:           issuedAt,
+	}
+	created, err := s.repo.Issue(ctx, issuedAt.In(jst).Year(), receipt, func(r *models.Receipt) error {
+		r.PDF = renderReceiptPDF(r)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue receipt: %w", err)
+	}
+	if !created {
+		// 同時に発行された領収書を返す
+		return s.repo.GetByPaymentID(ctx, payment.ID)
+	}
+	return receipt, nil
+}
+
+// recipientName returns the user's name for the receipt; the receipt is still issued without one
+func (s *receiptService) recipientName(ctx context.Context, userID string) string {
+	user, err := s.userRepo.GetByFirebaseUID(ctx, userID)
+	if err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error loading user %s for receipt: %v", userID, err)
+		}
+		return ""
+	}
+	return user.Name
+}
+
+// description returns the 但し書き of the receipt
+func (s *receiptService) description(ctx context.Context, payment *models.Payment) string {
+	if payment.ContentID != "" {
+		content, err := s.contentRepo.GetByID(ctx, payment.ContentID)
+		if err == nil && content.Title != "" {
+			return "「" + content.Title + "」代として"
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Error loading content %s for receipt: %v", payment.ContentID, err)
+		}
+	}
+	return "コンテンツ利用料として"
+}
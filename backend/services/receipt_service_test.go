@@ -0,0 +1,173 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// memoryReceiptRepository numbers receipts per year like the receipt_sequences table
+type memoryReceiptRepository struct {
+	mu        sync.Mutex
+	sequences map[int]int64
+	receipts  map[string]*models.Receipt // 支払いIDごと
+}
+
+func newMemoryReceiptRepository() *memoryReceiptRepository {
+	return &memoryReceiptRepository{sequences: map[int]int64{}, receipts: map[string]*models.Receipt{}}
+}
+
+func (r *memoryReceiptRepository) GetByPaymentID(ctx context.Context, paymentID string) (*models.Receipt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if receipt, ok := r.receipts[paymentID]; ok {
+		copied := *receipt
+		return &copied, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memoryReceiptRepository) Issue(ctx context.Context, year int, receipt *models.Receipt, render func(*models.Receipt) error) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.receipts[receipt.PaymentID]; ok {
+		return false, nil
+	}
+	receipt.Number = models.ReceiptNumber(year, r.sequences[year]+1)
+	if err := render(receipt); err != nil {
+		return false, err
+	}
+	r.sequences[year]++
+	copied := *receipt
+	r.receipts[receipt.PaymentID] = &copied
+	return true, nil
+}
+
+type stubUserRepository struct {
+	repository.UserRepository
+	users map[string]*models.User // Firebase UIDごと
+}
+
+func (r stubUserRepository) GetByFirebaseUID(ctx context.Context, uid string) (*models.User, error) {
+	if user, ok := r.users[uid]; ok {
+		return user, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+type stubContentRepository struct {
+	repository.ContentRepository
+	contents map[string]*models.Content
+}
+
+func (r stubContentRepository) GetByID(ctx context.Context, id string) (*models.Content, error) {
+	if content, ok := r.contents[id]; ok {
+		return content, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func newTestReceiptService() (ReceiptService, *memoryReceiptRepository) {
+	repo := newMemoryReceiptRepository()
+	service := NewReceiptService(repo,
+		stubUserRepository{users: map[string]*models.User{"user-1": {Name: "山田 太郎"}}},
+		stubContentRepository{contents: map[string]*models.Content{"content-1": {ID: "content-1", Title: "相性診断プレミアム"}}},
+		&ReceiptConfig{SellerName: "株式会社キミヨミ", SellerAddress: "東京都渋谷区1-2-3", SellerContact: "support@kimiyomi.jp", RegistrationNumber: "T1234567890123"},
+	)
+	return service, repo
+}
+
+func TestGetOrIssueReceiptIssuesOncePerPayment(t *testing.T) {
+	ctx := context.Background()
+	service, _ := newTestReceiptService()
+	payment := &models.Payment{
+		ID:        "pay-1",
+		UserID:    "user-1",
+		Amount:    models.Money{Minor: 1200, Currency: "JPY"},
+		Tax:       models.Money{Minor: 109, Currency: "JPY"},
+		TaxRate:   models.TaxRateStandard,
+		Status:    models.PaymentStatusSucceeded,
+		ContentID: "content-1",
+	}
+
+	receipt, err := service.GetOrIssueReceipt(ctx, payment)
+	require.NoError(t, err)
+	year := time.Now().In(jst).Year()
+	assert.Equal(t, fmt.Sprintf("KY-%d-000001", year), receipt.Number)
+	assert.Equal(t, "山田 太郎", receipt.RecipientName)
+	assert.Equal(t, "「相性診断プレミアム」代として", receipt.Description)
+	assert.Equal(t, int64(109), receipt.TaxAmount.Minor)
+	assert.Equal(t, 10, receipt.TaxRate)
+	assert.True(t, bytes.HasPrefix(receipt.PDF, []byte("%PDF-1.4\n")))
+	assert.True(t, bytes.HasSuffix(receipt.PDF, []byte("%%EOF\n")))
+	assert.Contains(t, string(receipt.PDF), pdfUTF16("山田 太郎 様"))
+	assert.Contains(t, string(receipt.PDF), pdfUTF16("1,200円（税込）"))
+	assert.Contains(t, string(receipt.PDF), pdfUTF16("株式会社キミヨミ"))
+	assert.Contains(t, string(receipt.PDF), pdfUTF16("登録番号 T1234567890123"))
+	assert.NotContains(t, string(receipt.PDF), pdfUTF16("軽減税率"))
+
+	// 再ダウンロードでは同じ番号・同じPDFを返す
+	again, err := service.GetOrIssueReceipt(ctx, payment)
+	require.NoError(t, err)
+	assert.Equal(t, receipt.Number, again.Number)
+	assert.Equal(t, receipt.PDF, again.PDF)
+
+	other, err := service.GetOrIssueReceipt(ctx, &models.Payment{
+		ID:      "pay-2",
+		UserID:  "user-2",
+		Amount:  models.Money{Minor: 540, Currency: "JPY"},
+		Tax:     models.Money{Minor: 40, Currency: "JPY"},
+		TaxRate: models.TaxRateReduced,
+		Status:  models.PaymentStatusSucceeded,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("KY-%d-000002", year), other.Number)
+	assert.Empty(t, other.RecipientName)
+	assert.Equal(t, "コンテンツ利用料として", other.Description)
+	assert.Equal(t, int64(40), other.TaxAmount.Minor)
+	assert.Contains(t, string(other.PDF), pdfUTF16("※は軽減税率対象"))
+}
+
+func TestGetOrIssueReceiptOnlyForPaidPayments(t *testing.T) {
+	ctx := context.Background()
+	service, repo := newTestReceiptService()
+
+	for _, status := range []string{models.PaymentStatusPending, models.PaymentStatusFailed, models.PaymentStatusRefunded, models.PaymentStatusDisputed} {
+		_, err := service.GetOrIssueReceipt(ctx, &models.Payment{
+			ID:     "pay-" + status,
+			Amount: models.Money{Minor: 1200, Currency: "JPY"},
+			Status: status,
+		})
+		assert.ErrorIs(t, err, ErrReceiptUnavailable, status)
+	}
+	assert.Empty(t, repo.receipts)
+
+	receipt, err := service.GetOrIssueReceipt(ctx, &models.Payment{
+		ID:             "pay-partial",
+		Amount:         models.Money{Minor: 1200, Currency: "JPY"},
+		RefundedAmount: models.Money{Minor: 100, Currency: "JPY"},
+		Tax:            models.Money{Minor: 109, Currency: "JPY"},
+		TaxRate:        models.TaxRateStandard,
+		Status:         models.PaymentStatusPartiallyRefunded,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1100), receipt.Amount.Minor)
+	assert.Equal(t, int64(100), receipt.TaxAmount.Minor)
+}
+
+func TestFormatReceiptAmount(t *testing.T) {
+	assert.Equal(t, "0円", formatReceiptAmount(models.Money{Currency: "JPY"}))
+	assert.Equal(t, "1,234,567円", formatReceiptAmount(models.Money{Minor: 1234567, Currency: "JPY"}))
+	assert.Equal(t, "12.05 USD", formatReceiptAmount(models.Money{Minor: 1205, Currency: "USD"}))
+	assert.Equal(t, "1,000.500 KWD", formatReceiptAmount(models.Money{Minor: 1000500, Currency: "KWD"}))
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/robfig/cron/v3"
+)
+
+// ScheduledJob 定期実行ジョブの定義
+type ScheduledJob struct {
+	Name     string        // ジョブ名（ロックキーと実行履歴に使用）
+	Schedule string        // cron式（分 時 日 月 曜日、JST）
+	Timeout  time.Duration // 1回の実行の制限時間
+	Run      func(ctx context.Context) error
+}
+
+// Scheduler cron形式でジョブを実行するスケジューラー。
+// 同じジョブは全レプリカの中で1つだけが実行する。
+type Scheduler struct {
+	cron     *cron.Cron
+	jobRepo  repository.JobRepository
+	instance string
+}
+
+// NewScheduler creates a new instance of Scheduler
+func NewScheduler(jobRepo repository.JobRepository) *Scheduler {
+	instance, err := os.Hostname()
+	if err != nil {
+		instance = "unknown"
+	}
+
+	return &Scheduler{
+		cron: cron.New(
+			cron.WithLocation(jst),
+			cron.WithChain(cron.Recover(cron.DefaultLogger), cron.SkipIfStillRunning(cron.DefaultLogger)),
+		),
+		jobRepo:  jobRepo,
+		instance: instance,
+	}
+}
+
+// Register ジョブを登録する（Startの前に呼ぶ）
+func (s *Scheduler) Register(job ScheduledJob) error {
+	if job.Name == "" || job.Run == nil {
+		return fmt.Errorf("ジョブ名と実行関数は必須です")
+	}
+	if job.Timeout <= 0 {
+		return fmt.Errorf("ジョブ %s のタイムアウトが設定されていません", job.Name)
+	}
+	var id cron.EntryID
+	id, err := s.cron.AddFunc(job.Schedule, func() { s.execute(job, scheduledTime(s.cron.Entry(id), time.Now())) })
+	if err != nil {
+		return fmt.Errorf("ジョブ %s のcron式が不正です: %w", job.Name, err)
+	}
+	return nil
+}
+
+// scheduledTime その回の予定時刻（JST）を返す。
+// 起動が遅れて分をまたいでも同じ回になるよう、現在時刻ではなくcronが起動した予定時刻を使う。
+func scheduledTime(entry cron.Entry, now time.Time) time.Time {
+	if entry.Prev.IsZero() {
+		return now.In(jst).Truncate(time.Minute)
+	}
+	return entry.Prev.In(jst)
+}
+
+// Start スケジューラーを開始する
+func (s *Scheduler) Start() {
+	s.cron.Start()
+}
+
+// Stop 新しい実行を止め、実行中のジョブの終了を待つ
+func (s *Scheduler) Stop(ctx context.Context) {
+	select {
+	case <-s.cron.Stop().Done():
+	case <-ctx.Done():
+	}
+}
+
+// execute ロックを取得してジョブを実行し、履歴を記録する。
+// ロックは前回の実行との重複を防ぐだけなので、予定時刻ごとの実行履歴で同じ回の二重実行を防ぐ。
+func (s *Scheduler) execute(job ScheduledJob, scheduledAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), job.Timeout)
+	defer cancel()
+
+	acquired, err := s.jobRepo.WithLock(ctx, "job:"+job.Name, func(ctx context.Context) error {
+		run := &models.JobRun{
+			JobName:     job.Name,
+			ScheduledAt: scheduledAt,
+			Instance:    s.instance,
+			Status:      models.JobStatusRunning,
+			StartedAt:   time.Now(),
+		}
+		created, err := s.jobRepo.CreateRun(ctx, run)
+		if err != nil {
+			return fmt.Errorf("実行履歴の作成に失敗: %w", err)
+		}
+		if !created {
+			log.Printf("ジョブ %s の %s の回は別のレプリカで実行済みのためスキップしました", job.Name, scheduledAt.In(jst).Format(time.RFC3339))
+			return nil
+		}
+
+		runErr := job.Run(ctx)
+
+		finishedAt := time.Now()
+		run.FinishedAt = &finishedAt
+		run.Status = models.JobStatusSucceeded
+		if runErr != nil {
+			run.Status = models.JobStatusFailed
+			run.Error = runErr.Error()
+		}
+		// タイムアウト後でも履歴は残す
+		if err := s.jobRepo.UpdateRun(context.Background(), run); err != nil {
+			log.Printf("実行履歴の更新に失敗 (%s): %v", job.Name, err)
+		}
+		return runErr
+	})
+	if err != nil {
+		log.Printf("ジョブ %s が失敗しました: %v", job.Name, err)
+		return
+	}
+	if !acquired {
+		log.Printf("ジョブ %s は別のレプリカで実行中のためスキップしました", job.Name)
+	}
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryJobRepository keeps one run per job and scheduled time like the job_runs unique index
+type memoryJobRepository struct {
+	repository.JobRepository
+	mu   sync.Mutex
+	runs map[string]*models.JobRun
+}
+
+func (r *memoryJobRepository) CreateRun(ctx context.Context, run *models.JobRun) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := run.JobName + "@" + run.ScheduledAt.UTC().Format(time.RFC3339)
+	if _, ok := r.runs[key]; ok {
+		return false, nil
+	}
+	r.runs[key] = run
+	return true, nil
+}
+
+func (r *memoryJobRepository) UpdateRun(ctx context.Context, run *models.JobRun) error {
+	return nil
+}
+
+// WithLock never contends, as when the first replica has already finished the run
+func (r *memoryJobRepository) WithLock(ctx context.Context, name string, fn func(ctx context.Context) error) (bool, error) {
+	return true, fn(ctx)
+}
+
+func TestSchedulerRunsEachScheduledTimeOnce(t *testing.T) {
+	repo := &memoryJobRepository{runs: map[string]*models.JobRun{}}
+	replicaA, replicaB := NewScheduler(repo), NewScheduler(repo)
+
+	runs := 0
+	job := ScheduledJob{Name: "daily", Schedule: "0 3 * * *", Timeout: time.Minute, Run: func(ctx context.Context) error {
+		runs++
+		return nil
+	}}
+
+	tick := time.Date(2026, 10, 19, 3, 0, 0, 0, jst)
+	replicaA.execute(job, tick)
+	replicaB.execute(job, tick)
+	assert.Equal(t, 1, runs)
+
+	replicaB.execute(job, tick.AddDate(0, 0, 1))
+	assert.Equal(t, 2, runs)
+	assert.Len(t, repo.runs, 2)
+}
+
+func TestScheduledTimeUsesTheCronSlot(t *testing.T) {
+	slot := time.Date(2026, 10, 19, 3, 0, 0, 0, jst)
+
+	// 起動が遅れて分をまたいでも、cronが起動した予定時刻の回として扱う
+	assert.Equal(t, slot, scheduledTime(cron.Entry{Prev: slot}, slot.Add(90*time.Second)))
+	assert.Equal(t, slot, scheduledTime(cron.Entry{Prev: slot.UTC()}, slot.Add(time.Second)))
+	assert.Equal(t, jst, scheduledTime(cron.Entry{Prev: slot.UTC()}, slot).Location())
+}
@@ -0,0 +1,289 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"google.golang.org/api/idtoken"
+	"gorm.io/gorm"
+)
+
+// Google Play subscription notification types that need more than a refresh from the Developer API
+const (
+	googlePlaySubscriptionPurchased = 4
+	googlePlaySubscriptionRevoked   = 12
+)
+
+// GooglePlayNotificationConfig describes the Pub/Sub push subscription that delivers
+// real-time developer notifications
+type GooglePlayNotificationConfig struct {
+	PackageName string
+	// Audience and ServiceAccountEmail must match the push subscription's authentication settings
+	Audience            string
+	ServiceAccountEmail string
+}
+
+// StoreNotificationService applies App Store Server Notifications and Google Play real-time
+// developer notifications to recorded purchases
+type StoreNotificationService interface {
+	HandleAppStoreNotification(ctx context.Context, payload []byte) error
+	HandleGooglePlayNotification(ctx context.Context, payload []byte, authorization string) error
+}
+
+type storeNotificationService struct {
+	eventRepo       repository.WebhookEventRepository
+	purchaseService PurchaseService
+	appStore        *AppStoreConfig               // nilの場合はApp Storeの通知を受け付けない
+	googlePlay      *GooglePlayNotificationConfig // nilの場合はGoogle Playの通知を受け付けない
+	validateToken   func(ctx context.Context, token, audience string) (*idtoken.Payload, error)
+}
+
+// NewStoreNotificationService creates a new instance of StoreNotificationService; a nil config disables that store
+func NewStoreNotificationService(eventRepo repository.WebhookEventRepository, purchaseService PurchaseService, appStore *AppStoreConfig, googlePlay *GooglePlayNotificationConfig) StoreNotificationService {
+	return &storeNotificationService{
+		eventRepo:       eventRepo,
+		purchaseService: purchaseService,
+		appStore:        appStore,
+		googlePlay:      googlePlay,
+		validateToken:   idtoken.Validate,
+	}
+}
+
+// appStoreNotification is the decoded signedPayload of App Store Server Notifications V2
+type appStoreNotification struct {
+	NotificationType string `json:"notificationType"`
+	Subtype          string `json:"subtype"`
+	NotificationUUID string `json:"notificationUUID"`
+	Data             struct {
+		BundleID              string `json:"bundleId"`
+		Environment           string `json:"environment"`
+		SignedTransactionInfo string `json:"signedTransactionInfo"`
+		SignedRenewalInfo     string `json:"signedRenewalInfo"`
+	} `json:"data"`
+}
+
+// appStoreRenewalInfo is the decoded signedRenewalInfo (JWSRenewalInfoDecodedPayload)
+type appStoreRenewalInfo struct {
+	OriginalTransactionID  string `json:"originalTransactionId"`
+	AutoRenewStatus        int    `json:"autoRenewStatus"`        // 1: 自動更新オン
+	GracePeriodExpiresDate int64  `json:"gracePeriodExpiresDate"` // ミリ秒
+}
+
+// HandleAppStoreNotification verifies the signed notification and applies the transaction it carries.
+// Notifications are processed once per notificationUUID.
+func (s *storeNotificationService) HandleAppStoreNotification(ctx context.Context, payload []byte) error {
+	if s.appStore == nil {
+		return ErrUnsupportedPlatform
+	}
+
+	var body struct {
+		SignedPayload string `json:"signedPayload"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil || body.SignedPayload == "" {
+		return ErrInvalidWebhookSignature
+	}
+	var notification appStoreNotification
+	if err := verifyAppleJWS(body.SignedPayload, s.appStore.RootCAs, time.Now(), &notification); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+	}
+	if notification.NotificationUUID == "" {
+		return ErrInvalidWebhookSignature
+	}
+	if notification.Data.BundleID != s.appStore.BundleID {
+		log.Printf("別のアプリ (%s) 宛てのApp Store通知を無視します", notification.Data.BundleID)
+		return nil
+	}
+
+	return s.process(ctx, models.WebhookSourceAppStore, notification.NotificationUUID, notification.NotificationType, func() error {
+		return s.applyAppStoreNotification(ctx, &notification)
+	})
+}
+
+func (s *storeNotificationService) applyAppStoreNotification(ctx context.Context, notification *appStoreNotification) error {
+	if notification.Data.SignedTransactionInfo == "" {
+		return nil // TESTなど取引を含まない通知
+	}
+
+	var transaction appStoreTransaction
+	if err := verifyAppleJWS(notification.Data.SignedTransactionInfo, s.appStore.RootCAs, time.Now(), &transaction); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+	}
+	if transaction.BundleID != s.appStore.BundleID {
+		return ErrInvalidWebhookSignature
+	}
+	// 返金・取り消し（REFUND/REVOKE）は取引のrevocationDateに、返金の撤回はその消去に反映される
+	verified := transaction.verifiedPurchase()
+
+	if notification.Data.SignedRenewalInfo != "" {
+		var renewal appStoreRenewalInfo
+		if err := verifyAppleJWS(notification.Data.SignedRenewalInfo, s.appStore.RootCAs, time.Now(), &renewal); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+		}
+		autoRenew := renewal.AutoRenewStatus == 1
+		verified.AutoRenew = &autoRenew
+		// 請求の猶予期間中は利用を続けられる
+		if gracePeriodEnd := time.UnixMilli(renewal.GracePeriodExpiresDate); renewal.GracePeriodExpiresDate > 0 && gracePeriodEnd.After(verified.ExpiresAt) {
+			verified.ExpiresAt = gracePeriodEnd
+		}
+	}
+
+	err := s.purchaseService.ApplyStoreUpdate(ctx, models.PurchasePlatformIOS, verified)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// アプリからの確認前の購入は、確認時にストアから最新の状態を取得する
+		log.Printf("App Storeの取引 %s に対応する購入が見つかりません (%s)", verified.OriginalPurchaseID, notification.NotificationType)
+		return nil
+	}
+	return err
+}
+
+// googlePlayPushMessage is the body Pub/Sub posts to push endpoints
+type googlePlayPushMessage struct {
+	Message struct {
+		Data      string `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// googlePlayDeveloperNotification is the message data of a real-time developer notification
+type googlePlayDeveloperNotification struct {
+	PackageName              string `json:"packageName"`
+	SubscriptionNotification *struct {
+		NotificationType int    `json:"notificationType"`
+		PurchaseToken    string `json:"purchaseToken"`
+		SubscriptionID   string `json:"subscriptionId"`
+	} `json:"subscriptionNotification"`
+	OneTimeProductNotification *struct {
+		NotificationType int    `json:"notificationType"`
+		PurchaseToken    string `json:"purchaseToken"`
+		SKU              string `json:"sku"`
+	} `json:"oneTimeProductNotification"`
+	VoidedPurchaseNotification *struct {
+		PurchaseToken string `json:"purchaseToken"`
+		OrderID       string `json:"orderId"`
+	} `json:"voidedPurchaseNotification"`
+	TestNotification *struct{} `json:"testNotification"`
+}
+
+// HandleGooglePlayNotification authenticates the Pub/Sub push request and refreshes the purchase it refers to.
+// Notifications are processed once per Pub/Sub message ID.
+func (s *storeNotificationService) HandleGooglePlayNotification(ctx context.Context, payload []byte, authorization string) error {
+	if s.googlePlay == nil {
+		return ErrUnsupportedPlatform
+	}
+	if err := s.authenticatePush(ctx, authorization); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+	}
+
+	var push googlePlayPushMessage
+	if err := json.Unmarshal(payload, &push); err != nil || push.Message.MessageID == "" {
+		return ErrInvalidWebhookSignature
+	}
+	data, err := base64.StdEncoding.DecodeString(push.Message.Data)
+	if err != nil {
+		return ErrInvalidWebhookSignature
+	}
+	var notification googlePlayDeveloperNotification
+	if err := json.Unmarshal(data, &notification); err != nil {
+		return ErrInvalidWebhookSignature
+	}
+	if notification.PackageName != s.googlePlay.PackageName {
+		log.Printf("別のアプリ (%s) 宛てのGoogle Play通知を無視します", notification.PackageName)
+		return nil
+	}
+
+	return s.process(ctx, models.WebhookSourceGooglePlay, push.Message.MessageID, googlePlayNotificationType(&notification), func() error {
+		return s.applyGooglePlayNotification(ctx, &notification)
+	})
+}
+
+// authenticatePush checks the OIDC token Pub/Sub attaches for the push subscription's service account
+func (s *storeNotificationService) authenticatePush(ctx context.Context, authorization string) error {
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == "" || token == authorization {
+		return errors.New("missing bearer token")
+	}
+	payload, err := s.validateToken(ctx, token, s.googlePlay.Audience)
+	if err != nil {
+		return err
+	}
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if !verified || email != s.googlePlay.ServiceAccountEmail {
+		return fmt.Errorf("unexpected push sender %q", email)
+	}
+	return nil
+}
+
+func (s *storeNotificationService) applyGooglePlayNotification(ctx context.Context, notification *googlePlayDeveloperNotification) error {
+	var err error
+	switch {
+	case notification.SubscriptionNotification != nil:
+		n := notification.SubscriptionNotification
+		switch n.NotificationType {
+		case googlePlaySubscriptionPurchased:
+			return nil // 新規購入はアプリからの確認で記録する
+		case googlePlaySubscriptionRevoked:
+			err = s.purchaseService.RevokeStorePurchase(ctx, n.PurchaseToken, "", time.Now())
+		default:
+			// 更新・解約・保留などの詳細は通知に含まれないため、Developer APIから最新の状態を取得する
+			err = s.purchaseService.RefreshStorePurchase(ctx, n.PurchaseToken, &StoreReceipt{
+				Platform:  models.PurchasePlatformAndroid,
+				ProductID: n.SubscriptionID,
+				Data:      n.PurchaseToken,
+			})
+		}
+	case notification.OneTimeProductNotification != nil:
+		n := notification.OneTimeProductNotification
+		err = s.purchaseService.RefreshStorePurchase(ctx, n.PurchaseToken, &StoreReceipt{
+			Platform:  models.PurchasePlatformAndroid,
+			ProductID: n.SKU,
+			Data:      n.PurchaseToken,
+		})
+	case notification.VoidedPurchaseNotification != nil:
+		n := notification.VoidedPurchaseNotification
+		err = s.purchaseService.RevokeStorePurchase(ctx, n.PurchaseToken, n.OrderID, time.Now())
+	default:
+		return nil // テスト通知
+	}
+
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		log.Printf("Google Playの購入トークンに対応する購入が見つかりません (%s)", googlePlayNotificationType(notification))
+		return nil
+	case errors.Is(err, ErrPurchasePending), errors.Is(err, ErrInvalidReceipt), errors.Is(err, ErrPurchaseOwnedByAnotherUser):
+		// 再送しても結果は変わらないため、記録だけして通知は処理済みとする
+		log.Printf("Google Playの通知を適用できません (%s): %v", googlePlayNotificationType(notification), err)
+		return nil
+	}
+	return err
+}
+
+// process runs apply once per notification under the same lease as the Stripe webhook,
+// so a notification abandoned mid-way is processed again on the store's retry
+func (s *storeNotificationService) process(ctx context.Context, source, eventID, eventType string, apply func() error) error {
+	return processWebhookEvent(ctx, s.eventRepo, source, eventID, eventType, apply)
+}
+
+// googlePlayNotificationType names the notification for the processed event record
+func googlePlayNotificationType(notification *googlePlayDeveloperNotification) string {
+	switch {
+	case notification.SubscriptionNotification != nil:
+		return "subscription:" + strconv.Itoa(notification.SubscriptionNotification.NotificationType)
+	case notification.OneTimeProductNotification != nil:
+		return "one_time_product:" + strconv.Itoa(notification.OneTimeProductNotification.NotificationType)
+	case notification.VoidedPurchaseNotification != nil:
+		return "voided_purchase"
+	}
+	return "test"
+}
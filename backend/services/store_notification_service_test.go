@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/idtoken"
+)
+
+const testPushSender = "rtdn-push@kimiyomi.iam.gserviceaccount.com"
+
+// memoryWebhookEventRepository records the processing state of claimed events in memory
+type memoryWebhookEventRepository struct {
+	mu     sync.Mutex
+	events map[string]string
+}
+
+func (r *memoryWebhookEventRepository) Claim(ctx context.Context, source string, eventID string, eventType string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.events[source+"/"+eventID] {
+	case models.WebhookEventStatusProcessed:
+		return false, nil
+	case models.WebhookEventStatusProcessing:
+		return false, models.ErrWebhookEventInProgress
+	}
+	r.events[source+"/"+eventID] = models.WebhookEventStatusProcessing
+	return true, nil
+}
+
+func (r *memoryWebhookEventRepository) Complete(ctx context.Context, source string, eventID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events[source+"/"+eventID] = models.WebhookEventStatusProcessed
+	return nil
+}
+
+func (r *memoryWebhookEventRepository) Release(ctx context.Context, source string, eventID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.events[source+"/"+eventID] == models.WebhookEventStatusProcessing {
+		delete(r.events, source+"/"+eventID)
+	}
+	return nil
+}
+
+func newTestGooglePlayNotificationService(verifier PurchaseVerifier) (*storeNotificationService, *memoryPurchaseRepository, *memoryWebhookEventRepository) {
+	repo := newMemoryPurchaseRepository()
+	events := &memoryWebhookEventRepository{events: map[string]string{}}
+	purchases := NewPurchaseService(repo, map[string]PurchaseVerifier{models.PurchasePlatformAndroid: verifier}, &recordingInvalidator{}, nil)
+	service := NewStoreNotificationService(events, purchases, nil, &GooglePlayNotificationConfig{
+		PackageName:         testPackageName,
+		Audience:            "https://api.kimiyomi.jp/api/v1/payments/google-play/notifications",
+		ServiceAccountEmail: testPushSender,
+	}).(*storeNotificationService)
+	service.validateToken = func(ctx context.Context, token, audience string) (*idtoken.Payload, error) {
+		if token != "valid-token" {
+			return nil, errors.New("invalid token")
+		}
+		return &idtoken.Payload{Audience: audience, Claims: map[string]interface{}{"email": testPushSender, "email_verified": true}}, nil
+	}
+	return service, repo, events
+}
+
+func pubSubPush(t *testing.T, messageID string, notification map[string]interface{}) []byte {
+	notification["packageName"] = testPackageName
+	data, err := json.Marshal(notification)
+	require.NoError(t, err)
+	payload, err := json.Marshal(map[string]interface{}{
+		"message":      map[string]interface{}{"data": base64.StdEncoding.EncodeToString(data), "messageId": messageID},
+		"subscription": "projects/kimiyomi/subscriptions/play-rtdn",
+	})
+	require.NoError(t, err)
+	return payload
+}
+
+func TestGooglePlayNotificationRefreshesExpiryOnce(t *testing.T) {
+	ctx := context.Background()
+	verifier := &fakeVerifier{purchase: &VerifiedPurchase{
+		ProductID:          "premium_monthly",
+		PurchaseID:         "GPA.3311-2222-1111-00000",
+		OriginalPurchaseID: testPlayToken,
+		ExpiresAt:          time.Now().Add(24 * time.Hour),
+	}}
+	service, repo, events := newTestGooglePlayNotificationService(verifier)
+	require.NoError(t, repo.UpsertByPurchaseID(ctx, &models.Purchase{UserID: "user-1", PurchaseID: "GPA.3311-2222-1111-00000", OriginalPurchaseID: testPlayToken, Receipt: testPlayToken}))
+
+	renewedUntil := time.Now().Add(31 * 24 * time.Hour)
+	verifier.purchase.PurchaseID = "GPA.3311-2222-1111-00000..0"
+	verifier.purchase.ExpiresAt = renewedUntil
+	payload := pubSubPush(t, "message-1", map[string]interface{}{
+		"subscriptionNotification": map[string]interface{}{"notificationType": 2, "purchaseToken": testPlayToken, "subscriptionId": "premium_monthly"},
+	})
+
+	require.NoError(t, service.HandleGooglePlayNotification(ctx, payload, "Bearer valid-token"))
+	require.NoError(t, service.HandleGooglePlayNotification(ctx, payload, "Bearer valid-token"))
+
+	require.Len(t, verifier.receipts, 1, "redelivered message must not be processed again")
+	assert.Equal(t, models.WebhookEventStatusProcessed, events.events[models.WebhookSourceGooglePlay+"/message-1"])
+	renewed, err := repo.GetByPurchaseID(ctx, "GPA.3311-2222-1111-00000..0")
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", renewed.UserID)
+	assert.True(t, renewed.ExpiresAt.Equal(renewedUntil))
+}
+
+func TestGooglePlayNotificationRevokesVoidedOrder(t *testing.T) {
+	ctx := context.Background()
+	service, repo, _ := newTestGooglePlayNotificationService(&fakeVerifier{})
+	require.NoError(t, repo.UpsertByPurchaseID(ctx, &models.Purchase{UserID: "user-1", PurchaseID: "GPA.1234-5678-9012-34567", OriginalPurchaseID: testPlayToken}))
+
+	err := service.HandleGooglePlayNotification(ctx, pubSubPush(t, "message-2", map[string]interface{}{
+		"voidedPurchaseNotification": map[string]interface{}{"purchaseToken": testPlayToken, "orderId": "GPA.1234-5678-9012-34567", "productType": 2},
+	}), "Bearer valid-token")
+	require.NoError(t, err)
+
+	revoked, err := repo.GetByPurchaseID(ctx, "GPA.1234-5678-9012-34567")
+	require.NoError(t, err)
+	assert.False(t, revoked.IsActiveAt(time.Now()))
+}
+
+func TestGooglePlayNotificationRejectsUnauthenticatedPush(t *testing.T) {
+	service, _, events := newTestGooglePlayNotificationService(&fakeVerifier{})
+
+	err := service.HandleGooglePlayNotification(context.Background(), pubSubPush(t, "message-3", map[string]interface{}{
+		"testNotification": map[string]interface{}{"version": "1.0"},
+	}), "Bearer forged-token")
+	assert.ErrorIs(t, err, ErrInvalidWebhookSignature)
+	assert.Empty(t, events.events)
+}
+
+func TestGooglePlayNotificationIgnoresUnknownPurchase(t *testing.T) {
+	verifier := &fakeVerifier{}
+	service, _, _ := newTestGooglePlayNotificationService(verifier)
+
+	err := service.HandleGooglePlayNotification(context.Background(), pubSubPush(t, "message-4", map[string]interface{}{
+		"subscriptionNotification": map[string]interface{}{"notificationType": 3, "purchaseToken": "unknown-token", "subscriptionId": "premium_monthly"},
+	}), "Bearer valid-token")
+	require.NoError(t, err)
+	assert.Empty(t, verifier.receipts)
+}
+
+func newTestAppStoreNotificationService(t *testing.T) (*storeNotificationService, *memoryPurchaseRepository, *memoryWebhookEventRepository, *testAppleChain) {
+	chain := newTestAppleChain(t, true)
+	repo := newMemoryPurchaseRepository()
+	events := &memoryWebhookEventRepository{events: map[string]string{}}
+	purchases := NewPurchaseService(repo, nil, &recordingInvalidator{}, nil)
+	service := NewStoreNotificationService(events, purchases, &AppStoreConfig{BundleID: testBundleID, RootCAs: chain.roots}, nil).(*storeNotificationService)
+	return service, repo, events, chain
+}
+
+// appStoreNotificationPayload signs the transaction and the notification like App Store Server Notifications V2
+func appStoreNotificationPayload(t *testing.T, chain *testAppleChain, uuid, notificationType, bundleID string, transaction map[string]interface{}) []byte {
+	transaction["bundleId"] = bundleID
+	payload, err := json.Marshal(map[string]string{"signedPayload": chain.sign(t, map[string]interface{}{
+		"notificationType": notificationType,
+		"notificationUUID": uuid,
+		"data": map[string]interface{}{
+			"bundleId":              bundleID,
+			"environment":           "Production",
+			"signedTransactionInfo": chain.sign(t, transaction),
+		},
+	})})
+	require.NoError(t, err)
+	return payload
+}
+
+func TestAppStoreNotificationAppliesRenewalOnce(t *testing.T) {
+	ctx := context.Background()
+	service, repo, _, chain := newTestAppStoreNotificationService(t)
+	require.NoError(t, repo.UpsertByPurchaseID(ctx, &models.Purchase{UserID: "user-1", PurchaseID: "2000000000000001", OriginalPurchaseID: "2000000000000001", Receipt: "receipt"}))
+
+	renewedUntil := time.Now().Add(31 * 24 * time.Hour).Truncate(time.Millisecond)
+	payload := appStoreNotificationPayload(t, chain, "uuid-1", "DID_RENEW", testBundleID, map[string]interface{}{
+		"transactionId":         "2000000000000002",
+		"originalTransactionId": "2000000000000001",
+		"productId":             "premium_monthly",
+		"purchaseDate":          time.Now().UnixMilli(),
+		"expiresDate":           renewedUntil.UnixMilli(),
+	})
+	require.NoError(t, service.HandleAppStoreNotification(ctx, payload))
+
+	renewed, err := repo.GetByPurchaseID(ctx, "2000000000000002")
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", renewed.UserID)
+	assert.True(t, renewed.ExpiresAt.Equal(renewedUntil))
+
+	// 同じnotificationUUIDの再送は処理しない
+	repo.purchases["2000000000000002"].ExpiresAt = time.Time{}
+	require.NoError(t, service.HandleAppStoreNotification(ctx, payload))
+	assert.True(t, repo.purchases["2000000000000002"].ExpiresAt.IsZero())
+}
+
+func TestAppStoreNotificationRevokesRefundedTransaction(t *testing.T) {
+	ctx := context.Background()
+	service, repo, _, chain := newTestAppStoreNotificationService(t)
+	require.NoError(t, repo.UpsertByPurchaseID(ctx, &models.Purchase{UserID: "user-1", PurchaseID: "2000000000000001", OriginalPurchaseID: "2000000000000001", ExpiresAt: time.Now().Add(24 * time.Hour)}))
+
+	for i, notificationType := range []string{"REFUND", "REVOKE"} {
+		payload := appStoreNotificationPayload(t, chain, fmt.Sprintf("uuid-revoke-%d", i), notificationType, testBundleID, map[string]interface{}{
+			"transactionId":         "2000000000000001",
+			"originalTransactionId": "2000000000000001",
+			"productId":             "premium_monthly",
+			"purchaseDate":          time.Now().Add(-time.Hour).UnixMilli(),
+			"expiresDate":           time.Now().Add(24 * time.Hour).UnixMilli(),
+			"revocationDate":        time.Now().UnixMilli(),
+		})
+		require.NoError(t, service.HandleAppStoreNotification(ctx, payload), notificationType)
+
+		revoked, err := repo.GetByPurchaseID(ctx, "2000000000000001")
+		require.NoError(t, err)
+		assert.False(t, revoked.IsActiveAt(time.Now()), notificationType)
+		assert.NotNil(t, revoked.RevokedAt, notificationType)
+	}
+}
+
+func TestAppStoreNotificationIgnoresOtherBundle(t *testing.T) {
+	ctx := context.Background()
+	service, repo, events, chain := newTestAppStoreNotificationService(t)
+
+	payload := appStoreNotificationPayload(t, chain, "uuid-other", "DID_RENEW", "com.example.other", map[string]interface{}{
+		"transactionId": "3000000000000001", "originalTransactionId": "3000000000000001", "productId": "premium_monthly",
+	})
+	require.NoError(t, service.HandleAppStoreNotification(ctx, payload))
+	assert.Empty(t, events.events)
+	assert.Empty(t, repo.purchases)
+}
+
+func TestAppStoreNotificationRejectsForgedPayload(t *testing.T) {
+	ctx := context.Background()
+	service, _, events, _ := newTestAppStoreNotificationService(t)
+
+	// 信頼していないルートの証明書で署名された通知
+	forged := appStoreNotificationPayload(t, newTestAppleChain(t, true), "uuid-forged", "REFUND", testBundleID, map[string]interface{}{
+		"transactionId": "2000000000000001", "originalTransactionId": "2000000000000001",
+	})
+	assert.ErrorIs(t, service.HandleAppStoreNotification(ctx, forged), ErrInvalidWebhookSignature)
+	assert.Empty(t, events.events)
+
+	// 署名と一致しない本文
+	service, _, events, chain := newTestAppStoreNotificationService(t)
+	var body struct {
+		SignedPayload string `json:"signedPayload"`
+	}
+	require.NoError(t, json.Unmarshal(appStoreNotificationPayload(t, chain, "uuid-tampered", "DID_RENEW", testBundleID, map[string]interface{}{
+		"transactionId": "2000000000000001", "originalTransactionId": "2000000000000001",
+	}), &body))
+	parts := strings.Split(body.SignedPayload, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"notificationType":"REFUND","notificationUUID":"uuid-tampered"}`))
+	tampered, err := json.Marshal(map[string]string{"signedPayload": strings.Join(parts, ".")})
+	require.NoError(t, err)
+	assert.ErrorIs(t, service.HandleAppStoreNotification(ctx, tampered), ErrInvalidWebhookSignature)
+	assert.Empty(t, events.events)
+}
+
+func TestGooglePlayNotificationRetriesWhileAnotherDeliveryIsProcessing(t *testing.T) {
+	verifier := &fakeVerifier{}
+	service, _, events := newTestGooglePlayNotificationService(verifier)
+	// 処理中に落ちた配信のリースが残っている
+	events.events[models.WebhookSourceGooglePlay+"/message-9"] = models.WebhookEventStatusProcessing
+
+	err := service.HandleGooglePlayNotification(context.Background(), pubSubPush(t, "message-9", map[string]interface{}{
+		"subscriptionNotification": map[string]interface{}{"notificationType": 2, "purchaseToken": testPlayToken, "subscriptionId": "premium_monthly"},
+	}), "Bearer valid-token")
+	// 処理済みとはみなさず、Pub/Subに再送させる
+	assert.ErrorIs(t, err, models.ErrWebhookEventInProgress)
+	assert.Empty(t, verifier.receipts)
+}
@@ -0,0 +1,73 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/form"
+)
+
+// stripeCall is one request the code under test made to the Stripe API
+type stripeCall struct {
+	Method string
+	Path   string
+	Params stripe.ParamsContainer
+}
+
+// fakeStripeBackend answers Stripe API calls in tests.
+// respond returns the JSON body for a call, or an error such as *stripe.Error.
+type fakeStripeBackend struct {
+	mu      sync.Mutex
+	calls   []stripeCall
+	respond func(method, path string, params stripe.ParamsContainer) (string, error)
+}
+
+// useFakeStripe replaces the Stripe API backend until the test ends
+func useFakeStripe(t *testing.T, respond func(method, path string, params stripe.ParamsContainer) (string, error)) *fakeStripeBackend {
+	t.Helper()
+	previous := stripe.GetBackend(stripe.APIBackend)
+	backend := &fakeStripeBackend{respond: respond}
+	stripe.SetBackend(stripe.APIBackend, backend)
+	t.Cleanup(func() { stripe.SetBackend(stripe.APIBackend, previous) })
+	return backend
+}
+
+func (b *fakeStripeBackend) Call(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+	b.mu.Lock()
+	b.calls = append(b.calls, stripeCall{Method: method, Path: path, Params: params})
+	b.mu.Unlock()
+
+	body, err := b.respond(method, path, params)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(body), v)
+}
+
+// CallRaw serves list requests, whose query is passed as form values instead of params
+func (b *fakeStripeBackend) CallRaw(method, path, key string, body *form.Values, params *stripe.Params, v interface{}) error {
+	return b.Call(method, path, key, nil, v)
+}
+
+func (b *fakeStripeBackend) CallMultipart(method, path, key, boundary string, body *bytes.Buffer, params *stripe.Params, v interface{}) error {
+	return fmt.Errorf("unexpected multipart Stripe call %s %s", method, path)
+}
+
+func (b *fakeStripeBackend) SetMaxNetworkRetries(maxNetworkRetries int) {}
+
+// callsTo returns the calls made with the method and path
+func (b *fakeStripeBackend) callsTo(method, path string) []stripeCall {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var calls []stripeCall
+	for _, call := range b.calls {
+		if call.Method == method && call.Path == path {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
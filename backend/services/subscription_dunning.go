@@ -0,0 +1,239 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"kimiyomi/models"
+
+	"github.com/stripe/stripe-go/invoice"
+	"github.com/stripe/stripe-go/sub"
+)
+
+// DunningConfig 更新時の支払い失敗と期限切れの扱いの設定
+type DunningConfig struct {
+	GracePeriod    time.Duration   // past_dueになってから期限切れにするまでの猶予期間
+	RetryIntervals []time.Duration // past_dueになってからの再請求のタイミング（回数分）
+	ReminderBefore time.Duration   // 利用できなくなる何時間前に通知するか
+}
+
+const (
+	subscriptionSweepBatchSize = 500
+	// renewalSlack is how long Stripe may take to report a renewal before the subscription is re-synced
+	renewalSlack = time.Hour
+)
+
+// SweepSubscriptions expires subscriptions whose period ended without renewal, retries failed
+// renewals, expires past-due subscriptions after the grace period, and emits reminders before
+// the user loses access. Failures on single subscriptions are logged and retried on the next run.
+func (s *subscriptionService) SweepSubscriptions(ctx context.Context) error {
+	now := time.Now()
+	if err := s.sweepExpiring(ctx, now); err != nil {
+		return err
+	}
+	if err := s.sweepOverdueRenewals(ctx, now); err != nil {
+		return err
+	}
+	return s.sweepPastDue(ctx, now)
+}
+
+// sweepExpiring expires non-renewing subscriptions at EndDate and reminds users shortly before.
+// Subscriptions only being reminded stay in the results, so it pages through all of them.
+func (s *subscriptionService) sweepExpiring(ctx context.Context, now time.Time) error {
+	afterID := ""
+	for {
+		subscriptions, err := s.repo.ListExpiring(ctx, now.Add(s.dunning.ReminderBefore), afterID, subscriptionSweepBatchSize)
+		if err != nil {
+			return fmt.Errorf("期限切れ対象の取得に失敗: %w", err)
+		}
+
+		for _, subscription := range subscriptions {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if subscription.EndDate.After(now) {
+				s.notify(ctx, subscription, models.NotificationTypeSubscriptionExpiring, subscription.EndDate)
+				continue
+			}
+			// 解約予約済みのStripeサブスクリプションはStripe側で終了するので、ここでは記録だけ更新する
+			if err := s.expire(ctx, subscription, false, now); err != nil {
+				log.Printf("サブスクリプション %s の期限切れ処理に失敗: %v", subscription.ID, err)
+			}
+		}
+		if len(subscriptions) < subscriptionSweepBatchSize {
+			return nil
+		}
+		afterID = subscriptions[len(subscriptions)-1].ID
+	}
+}
+
+// sweepOverdueRenewals re-syncs renewing subscriptions whose renewal webhook never arrived
+func (s *subscriptionService) sweepOverdueRenewals(ctx context.Context, now time.Time) error {
+	subscriptions, err := s.repo.ListOverdueRenewals(ctx, now.Add(-renewalSlack), subscriptionSweepBatchSize)
+	if err != nil {
+		return fmt.Errorf("更新未反映の契約の取得に失敗: %w", err)
+	}
+
+	for _, subscription := range subscriptions {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := s.SyncFromStripe(ctx, subscription.StripeSubID); err != nil {
+			log.Printf("サブスクリプション %s の同期に失敗: %v", subscription.ID, err)
+		}
+	}
+	return nil
+}
+
+// sweepPastDue retries failed renewals and expires subscriptions whose grace period is over.
+// It pages through every due subscription, so failing ones cannot hold back the rest.
+func (s *subscriptionService) sweepPastDue(ctx context.Context, now time.Time) error {
+	afterID := ""
+	for {
+		subscriptions, err := s.repo.ListDuePastDue(ctx, now, now.Add(s.dunning.ReminderBefore), afterID, subscriptionSweepBatchSize)
+		if err != nil {
+			return fmt.Errorf("支払い遅延中の契約の取得に失敗: %w", err)
+		}
+
+		for _, subscription := range subscriptions {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := s.sweepPastDueSubscription(ctx, subscription, now); err != nil {
+				log.Printf("サブスクリプション %s の再請求処理に失敗: %v", subscription.ID, err)
+			}
+		}
+		if len(subscriptions) < subscriptionSweepBatchSize {
+			return nil
+		}
+		afterID = subscriptions[len(subscriptions)-1].ID
+	}
+}
+
+func (s *subscriptionService) sweepPastDueSubscription(ctx context.Context, subscription *models.Subscription, now time.Time) error {
+	if subscription.GraceUntil == nil {
+		// 猶予期間の設定前にpast_dueになった契約
+		s.startDunning(subscription, now)
+		if err := s.saveSubscription(ctx, subscription); err != nil {
+			return err
+		}
+		s.notify(ctx, subscription, models.NotificationTypeSubscriptionPaymentFailed, *subscription.GraceUntil)
+		return nil
+	}
+
+	if !now.Before(*subscription.GraceUntil) {
+		return s.expire(ctx, subscription, true, now)
+	}
+
+	if subscription.NextRetryAt != nil && !now.Before(*subscription.NextRetryAt) {
+		recovered, err := s.retryRenewal(ctx, subscription)
+		if err != nil || recovered {
+			return err
+		}
+	}
+
+	if subscription.GraceUntil.Sub(now) <= s.dunning.ReminderBefore {
+		s.notify(ctx, subscription, models.NotificationTypeSubscriptionGraceEnding, *subscription.GraceUntil)
+	}
+	return nil
+}
+
+// retryRenewal tries to pay the open renewal invoice again with the customer's default payment method
+func (s *subscriptionService) retryRenewal(ctx context.Context, subscription *models.Subscription) (bool, error) {
+	if subscription.StripeSubID != "" {
+		stripeSub, err := sub.Get(subscription.StripeSubID, nil)
+		if err != nil {
+			return false, err
+		}
+		if stripeSub.LatestInvoice != nil && stripeSub.LatestInvoice.ID != "" {
+			_, err := invoice.Pay(stripeSub.LatestInvoice.ID, nil)
+			if err == nil {
+				// 支払いが通ればStripe側がactiveに戻る
+				return true, s.SyncFromStripe(ctx, subscription.StripeSubID)
+			}
+			log.Printf("サブスクリプション %s の再請求に失敗: %v", subscription.ID, err)
+		}
+	}
+
+	subscription.RenewalAttempts++
+	subscription.NextRetryAt = s.nextRetryAt(subscription)
+	return false, s.saveSubscription(ctx, subscription)
+}
+
+// NotifyTrialEnding refreshes a trialing subscription and reminds the user before the first charge.
+// Stripe sends customer.subscription.trial_will_end three days before the trial ends.
+func (s *subscriptionService) NotifyTrialEnding(ctx context.Context, stripeSubID string) error {
+	if err := s.SyncFromStripe(ctx, stripeSubID); err != nil {
+		return err
+	}
+	subscription, err := s.repo.GetByStripeSubID(ctx, stripeSubID)
+	if err != nil {
+		return err
+	}
+	if subscription.Status != models.SubscriptionStatusTrialing || subscription.TrialEnd == nil {
+		return nil
+	}
+	s.notify(ctx, subscription, models.NotificationTypeSubscriptionTrialEnding, *subscription.TrialEnd)
+	return nil
+}
+
+// startDunning starts the grace period of a subscription that just became past due
+func (s *subscriptionService) startDunning(subscription *models.Subscription, now time.Time) {
+	graceUntil := now.Add(s.dunning.GracePeriod)
+	subscription.PastDueSince = &now
+	subscription.GraceUntil = &graceUntil
+	subscription.RenewalAttempts = 0
+	subscription.NextRetryAt = s.nextRetryAt(subscription)
+}
+
+// nextRetryAt returns when to retry next, or nil when every configured retry was used
+func (s *subscriptionService) nextRetryAt(subscription *models.Subscription) *time.Time {
+	if subscription.PastDueSince == nil || subscription.RenewalAttempts >= len(s.dunning.RetryIntervals) {
+		return nil
+	}
+	retryAt := subscription.PastDueSince.Add(s.dunning.RetryIntervals[subscription.RenewalAttempts])
+	return &retryAt
+}
+
+// expire ends access to the subscription. cancelStripe also stops billing on Stripe,
+// for past-due subscriptions that Stripe would otherwise keep retrying.
+func (s *subscriptionService) expire(ctx context.Context, subscription *models.Subscription, cancelStripe bool, now time.Time) error {
+	if cancelStripe && subscription.StripeSubID != "" {
+		if _, err := sub.Cancel(subscription.StripeSubID, nil); err != nil {
+			return err
+		}
+	}
+
+	if subscription.EndDate.After(now) {
+		subscription.EndDate = now
+	}
+	subscription.Status = models.SubscriptionStatusExpired
+	subscription.AutoRenew = false
+	subscription.ClearDunning()
+	subscription.ClearPendingChange()
+	if err := s.saveSubscription(ctx, subscription); err != nil {
+		return err
+	}
+	s.notify(ctx, subscription, models.NotificationTypeSubscriptionExpired, subscription.EndDate)
+	return nil
+}
+
+// notify emits a notification once per subscription, type and deadline
+func (s *subscriptionService) notify(ctx context.Context, subscription *models.Subscription, notificationType string, deadline time.Time) {
+	if s.notificationRepo == nil {
+		return
+	}
+	event := &models.NotificationEvent{
+		UserID:       subscription.UserID,
+		Type:         notificationType,
+		ResourceType: "subscription",
+		ResourceID:   subscription.ID,
+		DeadlineAt:   &deadline,
+		DedupeKey:    fmt.Sprintf("%s:%s:%d", notificationType, subscription.ID, deadline.Unix()),
+	}
+	if _, err := s.notificationRepo.Enqueue(ctx, event); err != nil {
+		log.Printf("通知 %s の登録に失敗 (%s): %v", notificationType, subscription.ID, err)
+	}
+}
@@ -3,43 +3,530 @@ package services
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
 	"time"
 
 	"kimiyomi/models"
 	"kimiyomi/repository"
+
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/refund"
+	"github.com/stripe/stripe-go/sub"
+	"github.com/stripe/stripe-go/subschedule"
+	"gorm.io/gorm"
+)
+
+// Common errors for SubscriptionService
+var (
+	// ErrSubscriptionNotChangeable is returned for plan changes on subscriptions that are not renewing through Stripe
+	ErrSubscriptionNotChangeable = errors.New("only active, renewing Stripe subscriptions can change plans")
+	// ErrPlanUnchanged is returned when the subscription is already on the requested plan
+	ErrPlanUnchanged = errors.New("subscription is already on this plan")
+	// ErrSubscriptionNotCancelable is returned when the subscription has already ended or will not renew
+	ErrSubscriptionNotCancelable = errors.New("subscription is not renewing")
+	// ErrSubscriptionNotReactivatable is returned when the subscription is renewing or its period has ended
+	ErrSubscriptionNotReactivatable = errors.New("only subscriptions canceled within the current period can be reactivated")
+	// ErrInvalidRefundMode is returned for unknown refund modes of an immediate cancellation
+	ErrInvalidRefundMode = errors.New("refund must be none, prorated or full")
+	// ErrNoActiveSubscription is returned when neither Stripe nor a store gives the user a plan
+	ErrNoActiveSubscription = errors.New("no active subscription")
+)
+
+// Refund modes for an immediate cancellation
+const (
+	CancelRefundNone     = "none"     // 返金しない
+	CancelRefundProrated = "prorated" // 未使用期間分を日割りで返金
+	CancelRefundFull     = "full"     // 直近の請求を全額返金
 )
 
 // SubscriptionService handles subscription-related business logic
 type SubscriptionService interface {
-	CreateSubscription(ctx context.Context, subscription *models.Subscription) error
+	CreateSubscription(ctx context.Context, principal *Principal, subscription *models.Subscription) (*stripe.PaymentIntent, error)
 	GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error)
+	ListUserSubscriptions(ctx context.Context, userID string, filter models.SubscriptionFilter) ([]*models.Subscription, error)
+	GetCurrentSubscription(ctx context.Context, userID string) (*CurrentSubscription, error)
 	UpdateSubscription(ctx context.Context, subscription *models.Subscription) error
 	CancelSubscription(ctx context.Context, subscriptionID string) error
+	ReactivateSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error)
+	TerminateSubscription(ctx context.Context, subscriptionID string, refundMode string) (*models.Subscription, models.Money, error)
+	ChangePlan(ctx context.Context, subscriptionID string, planID string, billingCycle string) (*models.Subscription, *stripe.PaymentIntent, error)
+	SyncFromStripe(ctx context.Context, stripeSubID string) error
+	SweepSubscriptions(ctx context.Context) error
+	NotifyTrialEnding(ctx context.Context, stripeSubID string) error
 }
 
 type subscriptionService struct {
-	repo repository.SubscriptionRepository
+	repo             repository.SubscriptionRepository
+	customerService  CustomerService
+	priceResolver    PlanPriceResolver
+	entitlements     EntitlementService
+	purchaseRepo     repository.PurchaseRepository
+	trialRepo        repository.TrialRepository
+	notificationRepo repository.NotificationRepository
+	couponService    CouponService
+	dunning          *DunningConfig
+	taxRules         models.TaxRules
 }
 
 // NewSubscriptionService creates a new subscription service instance
-func NewSubscriptionService(repo repository.SubscriptionRepository) SubscriptionService {
+func NewSubscriptionService(repo repository.SubscriptionRepository, customerService CustomerService, priceResolver PlanPriceResolver, entitlements EntitlementService, purchaseRepo repository.PurchaseRepository, trialRepo repository.TrialRepository, notificationRepo repository.NotificationRepository, couponService CouponService, dunning *DunningConfig, taxRules models.TaxRules) SubscriptionService {
 	return &subscriptionService{
-		repo: repo,
+		repo:             repo,
+		purchaseRepo:     purchaseRepo,
+		trialRepo:        trialRepo,
+		customerService:  customerService,
+		priceResolver:    priceResolver,
+		entitlements:     entitlements,
+		notificationRepo: notificationRepo,
+		couponService:    couponService,
+		dunning:          dunning,
+		taxRules:         taxRules,
 	}
 }
 
-func (s *subscriptionService) CreateSubscription(ctx context.Context, subscription *models.Subscription) error {
+// CreateSubscription starts a Stripe subscription for the plan and mirrors it locally.
+// When the first invoice needs customer action (e.g. 3-D Secure), the subscription stays
+// incomplete and the returned PaymentIntent must be confirmed on the client.
+// Plans with trial days start with a free trial if the user has never had one; Stripe
+// then bills the saved payment method when the trial ends.
+// A CouponCode on the subscription is redeemed and attached as the matching Stripe coupon.
+func (s *subscriptionService) CreateSubscription(ctx context.Context, principal *Principal, subscription *models.Subscription) (*stripe.PaymentIntent, error) {
+	subscription.ID = uuid.NewString()
+	subscription.UserID = principal.UID
+	subscription.Status = models.SubscriptionStatusIncomplete
+
 	// Validate subscription data
 	if err := subscription.Validate(); err != nil {
+		return nil, err
+	}
+
+	// 金額はクライアントの値ではなくカタログから決める
+	price, err := s.priceResolver.ResolvePrice(ctx, subscription.PlanID, subscription.BillingCycle)
+	if err != nil {
+		return nil, err
+	}
+	tax := s.taxRules.Rule(models.TaxProductSubscription)
+	subscription.SetPrice(price.Amount, models.Money{}, tax)
+	c, err := s.customerService.EnsureCustomer(ctx, principal)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		stripeCouponID string
+		redemption     *models.CouponRedemption
+	)
+	if subscription.CouponCode != "" {
+		redemption = &models.CouponRedemption{SubscriptionID: subscription.ID}
+		quote, err := s.couponService.Redeem(ctx, subscription.UserID, subscription.CouponCode, CouponTarget{PlanID: subscription.PlanID, Amount: price.Amount}, redemption)
+		if err != nil {
+			return nil, err
+		}
+		subscription.CouponCode = quote.Coupon.Code
+		stripeCouponID = quote.Coupon.StripeCouponID
+		subscription.SetPrice(price.Amount, quote.Discount, tax)
+	}
+
+	// 先にローカルの記録を作り、Stripe側のメタデータから辿れるようにする
+	if err := s.repo.Create(ctx, subscription); err != nil {
+		s.releaseCoupon(ctx, redemption)
+		return nil, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Customer: stripe.String(c.ID),
+		Items: []*stripe.SubscriptionItemsParams{
+			{Plan: stripe.String(price.StripePriceID)}, // Stripe accepts price IDs in place of plan IDs
+		},
+		PaymentBehavior: stripe.String("allow_incomplete"),
+	}
+	if tax.StripeTaxRateID != "" {
+		params.DefaultTaxRates = []*string{stripe.String(tax.StripeTaxRateID)}
+	}
+	if c.InvoiceSettings != nil && c.InvoiceSettings.DefaultPaymentMethod != nil {
+		params.DefaultPaymentMethod = stripe.String(c.InvoiceSettings.DefaultPaymentMethod.ID)
+	}
+	params.AddExpand("latest_invoice.payment_intent")
+	params.SetIdempotencyKey("subscription-" + subscription.ID)
+	params.AddMetadata("subscription_id", subscription.ID)
+	params.AddMetadata("user_id", subscription.UserID)
+	if stripeCouponID != "" {
+		params.Coupon = stripe.String(stripeCouponID)
+		params.AddMetadata("coupon_code", subscription.CouponCode)
+	}
+
+	trial := false
+	if price.TrialDays > 0 {
+		// トライアルは解約後も含めて1ユーザー1回まで
+		trial, err = s.trialRepo.Redeem(ctx, &models.TrialRedemption{
+			UserID:         subscription.UserID,
+			PlanID:         subscription.PlanID,
+			SubscriptionID: subscription.ID,
+		})
+		if err != nil {
+			s.releaseCoupon(ctx, redemption)
+			return nil, err
+		}
+		if trial {
+			params.TrialPeriodDays = stripe.Int64(int64(price.TrialDays))
+		}
+	}
+
+	stripeSub, err := sub.New(params)
+	if err != nil {
+		var stripeErr *stripe.Error
+		if errors.As(err, &stripeErr) {
+			// Stripeが作成を拒否した場合だけトライアルとクーポンを戻す（通信エラーでは作成済みの可能性がある）
+			if trial {
+				if releaseErr := s.trialRepo.Release(ctx, subscription.UserID, subscription.ID); releaseErr != nil {
+					log.Printf("トライアル利用記録の取り消しに失敗 (%s): %v", subscription.ID, releaseErr)
+				}
+			}
+			s.releaseCoupon(ctx, redemption)
+		}
+		// Stripe側で作成されていればWebhookがメタデータ経由で記録を復旧する
+		subscription.Status = models.SubscriptionStatusExpired
+		if updateErr := s.repo.Update(ctx, subscription); updateErr != nil {
+			log.Printf("サブスクリプション %s の状態更新に失敗: %v", subscription.ID, updateErr)
+		}
+		return nil, err
+	}
+
+	applyStripeSubscription(subscription, stripeSub, tax)
+	if err := s.repo.Update(ctx, subscription); err != nil {
+		return nil, err
+	}
+	s.invalidateEntitlements(ctx, subscription.UserID)
+
+	if subscription.Status == models.SubscriptionStatusIncomplete && stripeSub.LatestInvoice != nil {
+		return stripeSub.LatestInvoice.PaymentIntent, nil
+	}
+	return nil, nil
+}
+
+// SyncFromStripe refreshes the local subscription from Stripe.
+// The subscription is fetched instead of trusting the webhook payload, so out-of-order events cannot roll it back.
+func (s *subscriptionService) SyncFromStripe(ctx context.Context, stripeSubID string) error {
+	stripeSub, err := sub.Get(stripeSubID, nil)
+	if err != nil {
+		return err
+	}
+
+	subscription, err := s.repo.GetByStripeSubID(ctx, stripeSubID)
+	if errors.Is(err, gorm.ErrRecordNotFound) && stripeSub.Metadata["subscription_id"] != "" {
+		// Stripe ID was never attached because the creation response was lost
+		subscription, err = s.repo.GetByID(ctx, stripeSub.Metadata["subscription_id"])
+	}
+	if err != nil {
+		return err
+	}
+
+	applyStripeSubscription(subscription, stripeSub, s.taxRules.Rule(models.TaxProductSubscription))
+	if priceID := stripeSubscriptionPriceID(stripeSub); priceID != "" {
+		// 予定していたプラン変更はStripe側の価格が切り替わった時点で反映する
+		planID, billingCycle, err := s.priceResolver.ResolveStripePrice(ctx, priceID)
+		if err == nil {
+			subscription.PlanID = planID
+			subscription.BillingCycle = billingCycle
+		} else if !errors.Is(err, ErrUnknownPlan) {
+			return err
+		}
+	}
+	if subscription.HasPendingChange() &&
+		(stripeSub.Schedule == nil || (subscription.PlanID == subscription.PendingPlanID && subscription.BillingCycle == subscription.PendingBillingCycle)) {
+		subscription.ClearPendingChange()
+	}
+
+	// 更新の支払いに失敗したら猶予期間を開始する
+	startedDunning := false
+	if subscription.Status == models.SubscriptionStatusPastDue {
+		if subscription.PastDueSince == nil {
+			s.startDunning(subscription, time.Now())
+			startedDunning = true
+		}
+	} else {
+		subscription.ClearDunning()
+	}
+
+	if err := s.repo.Update(ctx, subscription); err != nil {
+		return err
+	}
+	s.invalidateEntitlements(ctx, subscription.UserID)
+	if startedDunning {
+		s.notify(ctx, subscription, models.NotificationTypeSubscriptionPaymentFailed, *subscription.GraceUntil)
+	}
+	return nil
+}
+
+// ChangePlan moves a subscription to another plan or billing cycle.
+// Upgrades are prorated and invoiced immediately; downgrades are scheduled on Stripe for the end of
+// the current period and stored as a pending change until then. Requesting the current plan while a
+// downgrade is pending cancels the downgrade.
+func (s *subscriptionService) ChangePlan(ctx context.Context, subscriptionID string, planID string, billingCycle string) (*models.Subscription, *stripe.PaymentIntent, error) {
+	subscription, err := s.repo.GetByID(ctx, subscriptionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !subscription.IsCurrent() || !subscription.AutoRenew || subscription.StripeSubID == "" {
+		return nil, nil, ErrSubscriptionNotChangeable
+	}
+
+	stripeSub, err := sub.Get(subscription.StripeSubID, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stripeSubscriptionItemID(stripeSub) == "" {
+		return nil, nil, fmt.Errorf("Stripe subscription %s has no items", stripeSub.ID)
+	}
+
+	if planID == subscription.PlanID && billingCycle == subscription.BillingCycle {
+		if !subscription.HasPendingChange() {
+			return nil, nil, ErrPlanUnchanged
+		}
+		if err := releaseSchedule(stripeSub); err != nil {
+			return nil, nil, err
+		}
+		subscription.ClearPendingChange()
+		return subscription, nil, s.saveSubscription(ctx, subscription)
+	}
+
+	price, err := s.priceResolver.ResolvePrice(ctx, planID, billingCycle)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// 現在の請求額と同じく税込・割引前で比べる
+	amount, _ := s.taxRules.Rule(models.TaxProductSubscription).Apply(price.Amount)
+	if isUpgrade(subscription, billingCycle, amount) {
+		return s.upgrade(ctx, subscription, stripeSub, planID, billingCycle, price)
+	}
+	return s.scheduleDowngrade(ctx, subscription, stripeSub, planID, billingCycle, price)
+}
+
+// upgrade switches the Stripe price now and invoices the prorated difference immediately.
+// If the invoice needs customer action, Stripe keeps the old price until it is paid and the
+// returned PaymentIntent must be confirmed on the client; the webhook then applies the change.
+func (s *subscriptionService) upgrade(ctx context.Context, subscription *models.Subscription, stripeSub *stripe.Subscription, planID string, billingCycle string, price *PlanPrice) (*models.Subscription, *stripe.PaymentIntent, error) {
+	// 予定していたダウングレードは取り消す
+	if err := releaseSchedule(stripeSub); err != nil {
+		return nil, nil, err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{ID: stripe.String(stripeSubscriptionItemID(stripeSub)), Plan: stripe.String(price.StripePriceID)},
+		},
+		ProrationBehavior: stripe.String(string(stripe.SubscriptionProrationBehaviorAlwaysInvoice)),
+		PaymentBehavior:   stripe.String(string(stripe.SubscriptionPaymentBehaviorPendingIfIncomplete)),
+	}
+	params.AddExpand("latest_invoice.payment_intent")
+
+	updated, err := sub.Update(stripeSub.ID, params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	subscription.ClearPendingChange()
+	if updated.PendingUpdate != nil {
+		var pi *stripe.PaymentIntent
+		if updated.LatestInvoice != nil {
+			pi = updated.LatestInvoice.PaymentIntent
+		}
+		return subscription, pi, s.saveSubscription(ctx, subscription)
+	}
+
+	applyStripeSubscription(subscription, updated, s.taxRules.Rule(models.TaxProductSubscription))
+	subscription.PlanID = planID
+	subscription.BillingCycle = billingCycle
+	subscription.SetPrice(price.Amount, stripeDiscount(price.Amount, updated.Discount), s.taxRules.Rule(models.TaxProductSubscription))
+	return subscription, nil, s.saveSubscription(ctx, subscription)
+}
+
+// scheduleDowngrade keeps the current price until the period ends and then switches to the new one
+// through a Stripe subscription schedule, which is released again after the switch.
+func (s *subscriptionService) scheduleDowngrade(ctx context.Context, subscription *models.Subscription, stripeSub *stripe.Subscription, planID string, billingCycle string, price *PlanPrice) (*models.Subscription, *stripe.PaymentIntent, error) {
+	var scheduleID string
+	if stripeSub.Schedule != nil {
+		scheduleID = stripeSub.Schedule.ID
+	} else {
+		schedule, err := subschedule.New(&stripe.SubscriptionScheduleParams{
+			FromSubscription: stripe.String(stripeSub.ID),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		scheduleID = schedule.ID
+	}
+
+	params := &stripe.SubscriptionScheduleParams{
+		EndBehavior: stripe.String(string(stripe.SubscriptionScheduleEndBehaviorRelease)),
+		Phases: []*stripe.SubscriptionSchedulePhaseParams{
+			{
+				Plans:     []*stripe.SubscriptionSchedulePhaseItemParams{{Plan: stripe.String(stripeSubscriptionPriceID(stripeSub))}},
+				StartDate: stripe.Int64(stripeSub.CurrentPeriodStart),
+				EndDate:   stripe.Int64(stripeSub.CurrentPeriodEnd),
+			},
+			{
+				Plans:      []*stripe.SubscriptionSchedulePhaseItemParams{{Plan: stripe.String(price.StripePriceID)}},
+				Iterations: stripe.Int64(1),
+			},
+		},
+	}
+	params.AddMetadata("subscription_id", subscription.ID)
+	if _, err := subschedule.Update(scheduleID, params); err != nil {
+		return nil, nil, err
+	}
+
+	changeAt := time.Unix(stripeSub.CurrentPeriodEnd, 0)
+	subscription.PendingPlanID = planID
+	subscription.PendingBillingCycle = billingCycle
+	subscription.PendingChangeAt = &changeAt
+	return subscription, nil, s.saveSubscription(ctx, subscription)
+}
+
+// saveSubscription stores a subscription changed by this service
+func (s *subscriptionService) saveSubscription(ctx context.Context, subscription *models.Subscription) error {
+	subscription.UpdatedAt = time.Now()
+	if err := s.repo.Update(ctx, subscription); err != nil {
+		return err
+	}
+	s.invalidateEntitlements(ctx, subscription.UserID)
+	return nil
+}
+
+// isUpgrade reports whether a change should take effect immediately.
+// Moving from monthly to yearly billing is charged up front and counts as an upgrade;
+// within the same billing cycle the more expensive plan before discounts is the upgrade.
+func isUpgrade(current *models.Subscription, billingCycle string, amount models.Money) bool {
+	if current.BillingCycle != billingCycle {
+		return billingCycle == models.BillingCycleYearly
+	}
+	return amount.Minor > current.ListAmount().Minor
+}
+
+// releaseSchedule detaches a pending subscription schedule, dropping the changes it would make
+func releaseSchedule(stripeSub *stripe.Subscription) error {
+	if stripeSub.Schedule == nil {
+		return nil
+	}
+	if _, err := subschedule.Release(stripeSub.Schedule.ID, nil); err != nil {
 		return err
 	}
+	stripeSub.Schedule = nil
+	return nil
+}
+
+// stripeSubscriptionItemID returns the ID of the single item of an app subscription
+func stripeSubscriptionItemID(stripeSub *stripe.Subscription) string {
+	if stripeSub.Items == nil || len(stripeSub.Items.Data) == 0 {
+		return ""
+	}
+	return stripeSub.Items.Data[0].ID
+}
+
+// stripeSubscriptionPriceID returns the price currently billed by a Stripe subscription
+func stripeSubscriptionPriceID(stripeSub *stripe.Subscription) string {
+	if stripeSub.Items != nil && len(stripeSub.Items.Data) > 0 && stripeSub.Items.Data[0].Plan != nil {
+		return stripeSub.Items.Data[0].Plan.ID
+	}
+	if stripeSub.Plan != nil {
+		return stripeSub.Plan.ID
+	}
+	return ""
+}
+
+// invalidateEntitlements drops cached entitlements after a subscription changed
+func (s *subscriptionService) invalidateEntitlements(ctx context.Context, userID string) {
+	if s.entitlements == nil {
+		return
+	}
+	if err := s.entitlements.Invalidate(ctx, userID); err != nil {
+		log.Printf("ユーザー %s の権利情報キャッシュの削除に失敗: %v", userID, err)
+	}
+}
+
+// releaseCoupon gives back a coupon redeemed for a subscription that was never created.
+// Failures are only logged; the slot stays used, which never lets a coupon exceed its limits.
+func (s *subscriptionService) releaseCoupon(ctx context.Context, redemption *models.CouponRedemption) {
+	if redemption == nil {
+		return
+	}
+	if err := s.couponService.Release(ctx, redemption.ID); err != nil {
+		log.Printf("クーポン利用 %s の解放に失敗: %v", redemption.ID, err)
+	}
+}
+
+// applyStripeSubscription copies the billing state of a Stripe subscription onto the local record.
+// Stripe reports the plan price, to which the tax rule is applied.
+func applyStripeSubscription(subscription *models.Subscription, stripeSub *stripe.Subscription, tax models.TaxRule) {
+	subscription.StripeSubID = stripeSub.ID
+	status := subscriptionStatusFromStripe(stripeSub.Status)
+	// 期限切れにした契約を、後から届くStripeの解約で「解約」に戻さない
+	if subscription.Status != models.SubscriptionStatusExpired || status != models.SubscriptionStatusCanceled {
+		subscription.Status = status
+	}
+	subscription.AutoRenew = !stripeSub.CancelAtPeriodEnd
+	if stripeSub.TrialEnd > 0 {
+		trialEnd := time.Unix(stripeSub.TrialEnd, 0)
+		subscription.TrialEnd = &trialEnd
+	}
+	if stripeSub.StartDate > 0 {
+		subscription.StartDate = time.Unix(stripeSub.StartDate, 0)
+	}
+	if stripeSub.CurrentPeriodEnd > 0 {
+		subscription.EndDate = time.Unix(stripeSub.CurrentPeriodEnd, 0)
+	}
+	if stripeSub.Plan != nil {
+		if price, err := models.NewMoney(stripeSub.Plan.Amount, string(stripeSub.Plan.Currency)); err == nil {
+			subscription.SetPrice(price, stripeDiscount(price, stripeSub.Discount), tax)
+		}
+	}
+	subscription.UpdatedAt = time.Now()
+}
 
-	// Set default values
-	subscription.CreatedAt = time.Now()
-	subscription.Status = models.SubscriptionStatusActive
+// stripeDiscount returns how much the subscription's current Stripe discount takes off the price.
+// Stripe drops the discount once the coupon's duration is over, so the next sync bills the list price again.
+func stripeDiscount(price models.Money, discount *stripe.Discount) models.Money {
+	off := models.Money{Currency: price.Currency}
+	if discount == nil || discount.Deleted || discount.Coupon == nil {
+		return off
+	}
+	coupon := discount.Coupon
+	switch {
+	case coupon.PercentOff > 0:
+		// Stripeは割引額を最小通貨単位に四捨五入する
+		off.Minor = int64(math.Round(float64(price.Minor) * coupon.PercentOff / 100))
+	case coupon.AmountOff > 0 && strings.EqualFold(string(coupon.Currency), price.Currency):
+		off.Minor = coupon.AmountOff
+	}
+	if off.Minor > price.Minor {
+		off.Minor = price.Minor
+	}
+	return off
+}
 
-	// Store in database
-	return s.repo.Create(ctx, subscription)
+// subscriptionStatusFromStripe maps Stripe subscription statuses onto local ones
+func subscriptionStatusFromStripe(status stripe.SubscriptionStatus) string {
+	switch status {
+	case stripe.SubscriptionStatusActive:
+		return models.SubscriptionStatusActive
+	case stripe.SubscriptionStatusTrialing:
+		return models.SubscriptionStatusTrialing
+	case stripe.SubscriptionStatusIncomplete:
+		return models.SubscriptionStatusIncomplete
+	case stripe.SubscriptionStatusIncompleteExpired:
+		return models.SubscriptionStatusExpired
+	case stripe.SubscriptionStatusCanceled:
+		return models.SubscriptionStatusCanceled
+	case stripe.SubscriptionStatusPastDue:
+		return models.SubscriptionStatusPastDue
+	default: // unpaid
+		return models.SubscriptionStatusInactive
+	}
 }
 
 func (s *subscriptionService) GetSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
@@ -50,6 +537,133 @@ func (s *subscriptionService) GetSubscription(ctx context.Context, subscriptionI
 	return s.repo.GetByID(ctx, subscriptionID)
 }
 
+// ListUserSubscriptions returns the user's Stripe subscriptions, newest first
+func (s *subscriptionService) ListUserSubscriptions(ctx context.Context, userID string, filter models.SubscriptionFilter) ([]*models.Subscription, error) {
+	return s.repo.ListByUserID(ctx, userID, filter)
+}
+
+// CurrentSubscription is the subscription that currently gives the user access,
+// whether it is billed through Stripe or bought in an app store
+type CurrentSubscription struct {
+	Source       string     `json:"source"` // EntitlementSourceSubscription or EntitlementSourceStore
+	ID           string     `json:"id"`     // サブスクリプションIDまたはストアの購入ID
+	PlanID       string     `json:"plan_id"`
+	Status       string     `json:"status"`
+	BillingCycle string     `json:"billing_cycle,omitempty"`
+	Platform     string     `json:"platform,omitempty"` // ストア購入のみ
+	StartDate    time.Time  `json:"start_date"`
+	EndDate      *time.Time `json:"end_date"`             // nilは無期限
+	AutoRenew    *bool      `json:"auto_renew,omitempty"` // ストア購入では不明
+	Features     []string   `json:"features"`
+
+	PendingPlanID       string     `json:"pending_plan_id,omitempty"`
+	PendingBillingCycle string     `json:"pending_billing_cycle,omitempty"`
+	PendingChangeAt     *time.Time `json:"pending_change_at,omitempty"`
+	GraceUntil          *time.Time `json:"grace_until,omitempty"`
+}
+
+// GetCurrentSubscription returns the effective subscription, merged from the same sources as the
+// user's entitlements. A Stripe subscription wins over a store purchase, a healthy one over a past-due one,
+// and otherwise the one lasting longest.
+func (s *subscriptionService) GetCurrentSubscription(ctx context.Context, userID string) (*CurrentSubscription, error) {
+	entitlements, err := s.entitlements.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var best *models.Subscription
+	for _, grant := range entitlements.Grants {
+		if grant.Source != EntitlementSourceSubscription {
+			continue
+		}
+		subscription, err := s.repo.GetByID(ctx, grant.SourceID)
+		if err != nil {
+			return nil, err
+		}
+		if best == nil || preferSubscription(subscription, best) {
+			best = subscription
+		}
+	}
+	if best != nil {
+		autoRenew := best.AutoRenew
+		current := &CurrentSubscription{
+			Source:              EntitlementSourceSubscription,
+			ID:                  best.ID,
+			PlanID:              best.PlanID,
+			Status:              best.Status,
+			BillingCycle:        best.BillingCycle,
+			StartDate:           best.StartDate,
+			AutoRenew:           &autoRenew,
+			Features:            grantFeatures(entitlements, best.ID),
+			PendingPlanID:       best.PendingPlanID,
+			PendingBillingCycle: best.PendingBillingCycle,
+			PendingChangeAt:     best.PendingChangeAt,
+			GraceUntil:          best.GraceUntil,
+		}
+		if !best.EndDate.IsZero() {
+			endDate := best.EndDate
+			current.EndDate = &endDate
+		}
+		return current, nil
+	}
+
+	var storeGrant *EntitlementGrant
+	for i, grant := range entitlements.Grants {
+		if grant.Source != EntitlementSourceStore {
+			continue
+		}
+		if storeGrant == nil || laterExpiry(grant.ExpiresAt, storeGrant.ExpiresAt) {
+			storeGrant = &entitlements.Grants[i]
+		}
+	}
+	if storeGrant == nil {
+		return nil, ErrNoActiveSubscription
+	}
+
+	purchase, err := s.purchaseRepo.GetByPurchaseID(ctx, storeGrant.SourceID)
+	if err != nil {
+		return nil, err
+	}
+	return &CurrentSubscription{
+		Source:    EntitlementSourceStore,
+		ID:        purchase.PurchaseID,
+		PlanID:    storeGrant.PlanID,
+		Status:    models.SubscriptionStatusActive,
+		Platform:  purchase.Platform,
+		StartDate: purchase.PurchasedAt,
+		EndDate:   storeGrant.ExpiresAt,
+		Features:  storeGrant.Features,
+	}, nil
+}
+
+// preferSubscription reports whether a should be shown instead of b as the current subscription
+func preferSubscription(a *models.Subscription, b *models.Subscription) bool {
+	aHealthy := a.IsCurrent()
+	bHealthy := b.IsCurrent()
+	if aHealthy != bHealthy {
+		return aHealthy
+	}
+	return a.EndDate.After(b.EndDate)
+}
+
+// laterExpiry reports whether expiry a is later than b; nil means it never expires
+func laterExpiry(a *time.Time, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == nil && b != nil
+	}
+	return a.After(*b)
+}
+
+// grantFeatures returns the features of the grant backed by the given source
+func grantFeatures(entitlements *Entitlements, sourceID string) []string {
+	for _, grant := range entitlements.Grants {
+		if grant.SourceID == sourceID {
+			return grant.Features
+		}
+	}
+	return []string{}
+}
+
 func (s *subscriptionService) UpdateSubscription(ctx context.Context, subscription *models.Subscription) error {
 	if subscription.ID == "" {
 		return errors.New("subscription ID is required")
@@ -61,9 +675,15 @@ func (s *subscriptionService) UpdateSubscription(ctx context.Context, subscripti
 	}
 
 	subscription.UpdatedAt = time.Now()
-	return s.repo.Update(ctx, subscription)
+	if err := s.repo.Update(ctx, subscription); err != nil {
+		return err
+	}
+	s.invalidateEntitlements(ctx, subscription.UserID)
+	return nil
 }
 
+// CancelSubscription stops renewal at the end of the current period.
+// The subscription stays active, and keeps its entitlements, until EndDate.
 func (s *subscriptionService) CancelSubscription(ctx context.Context, subscriptionID string) error {
 	if subscriptionID == "" {
 		return errors.New("subscription ID is required")
@@ -73,9 +693,145 @@ func (s *subscriptionService) CancelSubscription(ctx context.Context, subscripti
 	if err != nil {
 		return err
 	}
+	if !subscription.IsCurrent() || !subscription.AutoRenew {
+		return ErrSubscriptionNotCancelable
+	}
+
+	if subscription.StripeSubID != "" {
+		stripeSub, err := sub.Get(subscription.StripeSubID, nil)
+		if err != nil {
+			return err
+		}
+		// 予定していたプラン変更は解約で不要になる
+		if err := releaseSchedule(stripeSub); err != nil {
+			return err
+		}
+		updated, err := sub.Update(subscription.StripeSubID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+		if err != nil {
+			return err
+		}
+		applyStripeSubscription(subscription, updated, s.taxRules.Rule(models.TaxProductSubscription))
+	}
+
+	subscription.AutoRenew = false
+	subscription.ClearPendingChange()
+	return s.saveSubscription(ctx, subscription)
+}
+
+// ReactivateSubscription undoes CancelSubscription while the current period is still running
+func (s *subscriptionService) ReactivateSubscription(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	subscription, err := s.repo.GetByID(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if !subscription.IsCurrent() || subscription.AutoRenew || !subscription.EndDate.After(time.Now()) {
+		return nil, ErrSubscriptionNotReactivatable
+	}
+
+	if subscription.StripeSubID != "" {
+		updated, err := sub.Update(subscription.StripeSubID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(false),
+		})
+		if err != nil {
+			return nil, err
+		}
+		applyStripeSubscription(subscription, updated, s.taxRules.Rule(models.TaxProductSubscription))
+	}
+
+	subscription.AutoRenew = true
+	return subscription, s.saveSubscription(ctx, subscription)
+}
+
+// TerminateSubscription ends a subscription immediately, for staff handling support cases.
+// Depending on refundMode the latest invoice is refunded in full, for the unused part of the
+// period, or not at all. It returns the refunded amount.
+func (s *subscriptionService) TerminateSubscription(ctx context.Context, subscriptionID string, refundMode string) (*models.Subscription, models.Money, error) {
+	switch refundMode {
+	case CancelRefundNone, CancelRefundProrated, CancelRefundFull:
+	default:
+		return nil, models.Money{}, ErrInvalidRefundMode
+	}
+
+	subscription, err := s.repo.GetByID(ctx, subscriptionID)
+	if err != nil {
+		return nil, models.Money{}, err
+	}
+	if subscription.Status == models.SubscriptionStatusCanceled || subscription.Status == models.SubscriptionStatusExpired {
+		return nil, models.Money{}, ErrSubscriptionNotCancelable
+	}
+
+	var refunded models.Money
+	if subscription.StripeSubID != "" {
+		params := &stripe.SubscriptionParams{}
+		params.AddExpand("latest_invoice.payment_intent")
+		stripeSub, err := sub.Get(subscription.StripeSubID, params)
+		if err != nil {
+			return nil, models.Money{}, err
+		}
+
+		if refundMode != CancelRefundNone {
+			if refunded, err = refundLatestInvoice(subscription, stripeSub, refundMode, time.Now()); err != nil {
+				return nil, models.Money{}, err
+			}
+		}
+
+		canceled, err := sub.Cancel(subscription.StripeSubID, nil)
+		if err != nil {
+			// 返金済みの場合もStripeの再試行で二重返金にはならない（冪等キー）
+			return nil, refunded, err
+		}
+		applyStripeSubscription(subscription, canceled, s.taxRules.Rule(models.TaxProductSubscription))
+	}
 
 	subscription.Status = models.SubscriptionStatusCanceled
-	subscription.UpdatedAt = time.Now()
+	subscription.AutoRenew = false
+	subscription.EndDate = time.Now()
+	subscription.ClearPendingChange()
+	return subscription, refunded, s.saveSubscription(ctx, subscription)
+}
 
-	return s.repo.Update(ctx, subscription)
+// refundLatestInvoice refunds the payment of the subscription's latest invoice
+func refundLatestInvoice(subscription *models.Subscription, stripeSub *stripe.Subscription, refundMode string, now time.Time) (models.Money, error) {
+	invoice := stripeSub.LatestInvoice
+	if invoice == nil || invoice.PaymentIntent == nil || invoice.AmountPaid <= 0 {
+		return models.Money{}, nil // 無料期間など、返金する支払いがない
+	}
+
+	amount := invoice.AmountPaid
+	if refundMode == CancelRefundProrated {
+		amount = proratedRefundAmount(invoice.AmountPaid, stripeSub.CurrentPeriodStart, stripeSub.CurrentPeriodEnd, now)
+	}
+	refunded, err := models.NewMoney(amount, string(invoice.Currency))
+	if err != nil || amount <= 0 {
+		return models.Money{}, err
+	}
+
+	params := &stripe.RefundParams{
+		PaymentIntent: stripe.String(invoice.PaymentIntent.ID),
+		Amount:        stripe.Int64(amount),
+		Reason:        stripe.String(models.RefundReasonRequestedByCustomer),
+	}
+	params.SetIdempotencyKey("subscription-refund-" + subscription.ID + "-" + invoice.ID)
+	params.AddMetadata("subscription_id", subscription.ID)
+	if _, err := refund.New(params); err != nil {
+		return models.Money{}, err
+	}
+	return refunded, nil
+}
+
+// proratedRefundAmount returns the part of paid that covers the rest of the period, rounded down
+func proratedRefundAmount(paid int64, periodStart int64, periodEnd int64, now time.Time) int64 {
+	if periodEnd <= periodStart {
+		return 0
+	}
+	remaining := periodEnd - now.Unix()
+	if remaining <= 0 {
+		return 0
+	}
+	if remaining > periodEnd-periodStart {
+		return paid
+	}
+	return paid * remaining / (periodEnd - periodStart)
 }
@@ -0,0 +1,376 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go"
+	"gorm.io/gorm"
+)
+
+// memorySubscriptionRepository keeps subscriptions by ID
+type memorySubscriptionRepository struct {
+	repository.SubscriptionRepository
+	mu            sync.Mutex
+	subscriptions map[string]*models.Subscription
+}
+
+func newMemorySubscriptionRepository(subscriptions ...*models.Subscription) *memorySubscriptionRepository {
+	repo := &memorySubscriptionRepository{subscriptions: map[string]*models.Subscription{}}
+	for _, subscription := range subscriptions {
+		repo.subscriptions[subscription.ID] = subscription
+	}
+	return repo
+}
+
+func (r *memorySubscriptionRepository) GetByID(ctx context.Context, subscriptionID string) (*models.Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if subscription, ok := r.subscriptions[subscriptionID]; ok {
+		copied := *subscription
+		return &copied, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *memorySubscriptionRepository) Create(ctx context.Context, subscription *models.Subscription) error {
+	return r.Update(ctx, subscription)
+}
+
+func (r *memorySubscriptionRepository) Update(ctx context.Context, subscription *models.Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	copied := *subscription
+	r.subscriptions[subscription.ID] = &copied
+	return nil
+}
+
+func (r *memorySubscriptionRepository) ListDuePastDue(ctx context.Context, now time.Time, remindBefore time.Time, afterID string, limit int) ([]*models.Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var due []*models.Subscription
+	for _, subscription := range r.subscriptions {
+		if subscription.Status != models.SubscriptionStatusPastDue || subscription.ID <= afterID {
+			continue
+		}
+		if subscription.GraceUntil == nil || !subscription.GraceUntil.After(remindBefore) ||
+			(subscription.NextRetryAt != nil && !subscription.NextRetryAt.After(now)) {
+			copied := *subscription
+			due = append(due, &copied)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (r *memorySubscriptionRepository) ListExpiring(ctx context.Context, endBefore time.Time, afterID string, limit int) ([]*models.Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expiring []*models.Subscription
+	for _, subscription := range r.subscriptions {
+		if !subscription.IsCurrent() || subscription.ID <= afterID || !subscription.EndDate.Before(endBefore) {
+			continue
+		}
+		if !subscription.AutoRenew || subscription.StripeSubID == "" {
+			copied := *subscription
+			expiring = append(expiring, &copied)
+		}
+	}
+	sort.Slice(expiring, func(i, j int) bool { return expiring[i].ID < expiring[j].ID })
+	if len(expiring) > limit {
+		expiring = expiring[:limit]
+	}
+	return expiring, nil
+}
+
+type stubCustomerService struct{ CustomerService }
+
+func (stubCustomerService) EnsureCustomer(ctx context.Context, principal *Principal) (*stripe.Customer, error) {
+	return &stripe.Customer{ID: "cus_" + principal.UID}, nil
+}
+
+// fixedPriceResolver prices plans from a map keyed by plan ID and billing cycle
+type fixedPriceResolver struct {
+	PlanPriceResolver
+	prices map[string]*PlanPrice
+}
+
+func (r fixedPriceResolver) ResolvePrice(ctx context.Context, planID string, billingCycle string) (*PlanPrice, error) {
+	if price, ok := r.prices[planID+"/"+billingCycle]; ok {
+		return price, nil
+	}
+	return nil, ErrUnknownPlan
+}
+
+func newTestSubscriptionService(repo repository.SubscriptionRepository, couponService CouponService, taxRules models.TaxRules) SubscriptionService {
+	resolver := fixedPriceResolver{prices: map[string]*PlanPrice{
+		"basic/monthly":   {StripePriceID: "price_basic_monthly", Amount: models.Money{Minor: 500, Currency: "JPY"}},
+		"premium/monthly": {StripePriceID: "price_premium_monthly", Amount: models.Money{Minor: 1000, Currency: "JPY"}},
+		"basic/yearly":    {StripePriceID: "price_basic_yearly", Amount: models.Money{Minor: 5000, Currency: "JPY"}},
+	}}
+	return NewSubscriptionService(repo, stubCustomerService{}, resolver, nil, nil, nil, nil, couponService, &DunningConfig{}, taxRules)
+}
+
+func TestApplyStripeSubscriptionStoresTax(t *testing.T) {
+	stripeSub := &stripe.Subscription{
+		ID:     "sub_123",
+		Status: stripe.SubscriptionStatusActive,
+		Plan:   &stripe.Plan{Amount: 980, Currency: "jpy"},
+	}
+
+	inclusive := &models.Subscription{}
+	applyStripeSubscription(inclusive, stripeSub, models.DefaultTaxRule)
+	assert.Equal(t, int64(980), inclusive.Amount.Minor)
+	assert.Equal(t, int64(89), inclusive.Tax.Minor)
+	assert.Equal(t, models.TaxRateStandard, inclusive.TaxRate)
+
+	// 税抜価格ではStripeが税率を上乗せして請求する
+	exclusive := &models.Subscription{}
+	applyStripeSubscription(exclusive, stripeSub, models.TaxRule{RatePercent: models.TaxRateStandard, StripeTaxRateID: "txr_123"})
+	assert.Equal(t, int64(1078), exclusive.Amount.Minor)
+	assert.Equal(t, int64(98), exclusive.Tax.Minor)
+	assert.Equal(t, "JPY", exclusive.Tax.Currency)
+}
+
+func TestApplyStripeSubscriptionTaxesDiscountedPrice(t *testing.T) {
+	stripeSub := &stripe.Subscription{
+		ID:       "sub_123",
+		Status:   stripe.SubscriptionStatusActive,
+		Plan:     &stripe.Plan{Amount: 1000, Currency: "jpy"},
+		Discount: &stripe.Discount{Coupon: &stripe.Coupon{PercentOff: 25}},
+	}
+
+	// 税抜1000円の25%引き: 750円に消費税75円
+	subscription := &models.Subscription{}
+	applyStripeSubscription(subscription, stripeSub, models.TaxRule{RatePercent: models.TaxRateStandard, StripeTaxRateID: "txr_123"})
+	assert.Equal(t, int64(825), subscription.Amount.Minor)
+	assert.Equal(t, int64(75), subscription.Tax.Minor)
+	assert.Equal(t, int64(275), subscription.Discount.Minor)
+	assert.Equal(t, int64(1100), subscription.ListAmount().Minor)
+
+	// 税込980円から300円引き: 680円に含まれる消費税61円
+	stripeSub.Plan.Amount = 980
+	stripeSub.Discount = &stripe.Discount{Coupon: &stripe.Coupon{AmountOff: 300, Currency: "jpy"}}
+	applyStripeSubscription(subscription, stripeSub, models.DefaultTaxRule)
+	assert.Equal(t, int64(680), subscription.Amount.Minor)
+	assert.Equal(t, int64(61), subscription.Tax.Minor)
+	assert.Equal(t, int64(300), subscription.Discount.Minor)
+
+	// 割引期間が終わるとStripeはdiscountを外す
+	stripeSub.Discount = nil
+	applyStripeSubscription(subscription, stripeSub, models.DefaultTaxRule)
+	assert.Equal(t, int64(980), subscription.Amount.Minor)
+	assert.Zero(t, subscription.Discount.Minor)
+}
+
+func TestCreateSubscriptionUsesConfiguredTaxRule(t *testing.T) {
+	backend := useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+		return `{"id": "sub_123", "status": "active", "plan": {"id": "price_premium_monthly", "amount": 1000, "currency": "jpy"}}`, nil
+	})
+	repo := newMemorySubscriptionRepository()
+	service := newTestSubscriptionService(repo, nil, models.TaxRules{
+		models.TaxProductSubscription: {RatePercent: models.TaxRateReduced, StripeTaxRateID: "txr_reduced"},
+	})
+
+	subscription := &models.Subscription{PlanID: "premium", BillingCycle: models.BillingCycleMonthly}
+	_, err := service.CreateSubscription(context.Background(), &Principal{UID: "user-1"}, subscription)
+	require.NoError(t, err)
+
+	calls := backend.callsTo("POST", "/v1/subscriptions")
+	require.Len(t, calls, 1)
+	params := calls[0].Params.(*stripe.SubscriptionParams)
+	require.Len(t, params.DefaultTaxRates, 1)
+	assert.Equal(t, "txr_reduced", *params.DefaultTaxRates[0])
+
+	stored, err := repo.GetByID(context.Background(), subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1080), stored.Amount.Minor)
+	assert.Equal(t, int64(80), stored.Tax.Minor)
+	assert.Equal(t, models.TaxRateReduced, stored.TaxRate)
+}
+
+func TestSweepPastDueReachesEverySubscription(t *testing.T) {
+	now := time.Now()
+	repo := newMemorySubscriptionRepository()
+	// 猶予期間の終了が近く、毎回対象になるが状態の変わらない契約でバッチを埋める
+	graceEnding := now.Add(time.Hour)
+	for i := 0; i < subscriptionSweepBatchSize; i++ {
+		repo.subscriptions[fmt.Sprintf("sub-%04d", i)] = &models.Subscription{
+			ID: fmt.Sprintf("sub-%04d", i), UserID: "user-1", Status: models.SubscriptionStatusPastDue, GraceUntil: &graceEnding,
+		}
+	}
+	graceOver := now.Add(-time.Hour)
+	repo.subscriptions["sub-9999"] = &models.Subscription{
+		ID: "sub-9999", UserID: "user-2", Status: models.SubscriptionStatusPastDue, GraceUntil: &graceOver, EndDate: now.Add(24 * time.Hour),
+	}
+
+	service := NewSubscriptionService(repo, nil, nil, nil, nil, nil, nil, nil, &DunningConfig{ReminderBefore: 24 * time.Hour}, nil).(*subscriptionService)
+	require.NoError(t, service.sweepPastDue(context.Background(), now))
+
+	expired, err := repo.GetByID(context.Background(), "sub-9999")
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusExpired, expired.Status)
+}
+
+func TestSweepExpiringReachesEverySubscription(t *testing.T) {
+	now := time.Now()
+	repo := newMemorySubscriptionRepository()
+	// 終了間近で通知だけを受け、毎回対象になる契約でバッチを埋める
+	for i := 0; i < subscriptionSweepBatchSize; i++ {
+		repo.subscriptions[fmt.Sprintf("sub-%04d", i)] = &models.Subscription{
+			ID: fmt.Sprintf("sub-%04d", i), UserID: "user-1", Status: models.SubscriptionStatusActive, EndDate: now.Add(time.Hour),
+		}
+	}
+	repo.subscriptions["sub-9999"] = &models.Subscription{
+		ID: "sub-9999", UserID: "user-2", Status: models.SubscriptionStatusActive, EndDate: now.Add(-time.Hour),
+	}
+
+	service := NewSubscriptionService(repo, nil, nil, nil, nil, nil, nil, nil, &DunningConfig{ReminderBefore: 24 * time.Hour}, nil).(*subscriptionService)
+	require.NoError(t, service.sweepExpiring(context.Background(), now))
+
+	expired, err := repo.GetByID(context.Background(), "sub-9999")
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusExpired, expired.Status)
+	reminded, err := repo.GetByID(context.Background(), "sub-0000")
+	require.NoError(t, err)
+	assert.Equal(t, models.SubscriptionStatusActive, reminded.Status)
+}
+
+func TestCreateSubscriptionStoresCouponDiscount(t *testing.T) {
+	useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+		return `{"id": "sub_123", "status": "active", "plan": {"id": "price_premium_monthly", "amount": 1000, "currency": "jpy"},
+			"discount": {"coupon": {"id": "co_half", "percent_off": 50}}}`, nil
+	})
+	repo := newMemorySubscriptionRepository()
+	coupons := newMemoryCouponRepository(&models.Coupon{
+		ID: "coupon-1", Code: "HALF", DiscountType: models.CouponDiscountPercent, PercentOff: 50,
+		Duration: models.CouponDurationOnce, StripeCouponID: "co_half", Active: true,
+	})
+	service := newTestSubscriptionService(repo, NewCouponService(coupons), models.TaxRules{
+		models.TaxProductSubscription: {RatePercent: models.TaxRateStandard, StripeTaxRateID: "txr_standard"},
+	})
+
+	subscription := &models.Subscription{PlanID: "premium", BillingCycle: models.BillingCycleMonthly, CouponCode: "half"}
+	_, err := service.CreateSubscription(context.Background(), &Principal{UID: "user-1"}, subscription)
+	require.NoError(t, err)
+
+	// 消費税は割引後の500円にかかる
+	stored, err := repo.GetByID(context.Background(), subscription.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "HALF", stored.CouponCode)
+	assert.Equal(t, int64(550), stored.Amount.Minor)
+	assert.Equal(t, int64(50), stored.Tax.Minor)
+	assert.Equal(t, int64(550), stored.Discount.Minor)
+}
+
+func TestIsUpgrade(t *testing.T) {
+	basicMonthly := &models.Subscription{BillingCycle: models.BillingCycleMonthly, Amount: models.Money{Minor: 500, Currency: "JPY"}}
+	// 半額クーポンで250円になっていても、割引前の500円と比べる
+	discounted := &models.Subscription{BillingCycle: models.BillingCycleMonthly, Amount: models.Money{Minor: 250, Currency: "JPY"}, Discount: models.Money{Minor: 250, Currency: "JPY"}}
+	premiumYearly := &models.Subscription{BillingCycle: models.BillingCycleYearly, Amount: models.Money{Minor: 10000, Currency: "JPY"}}
+
+	tests := []struct {
+		name         string
+		current      *models.Subscription
+		billingCycle string
+		amount       int64
+		want         bool
+	}{
+		{"高いプランへの変更", basicMonthly, models.BillingCycleMonthly, 1000, true},
+		{"安いプランへの変更", basicMonthly, models.BillingCycleMonthly, 300, false},
+		{"同額のプランへの変更", basicMonthly, models.BillingCycleMonthly, 500, false},
+		{"割引中の契約からの変更", discounted, models.BillingCycleMonthly, 400, false},
+		{"月払いから年払い", basicMonthly, models.BillingCycleYearly, 5000, true},
+		{"年払いから月払い", premiumYearly, models.BillingCycleMonthly, 1000, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, isUpgrade(tt.current, tt.billingCycle, models.Money{Minor: tt.amount, Currency: "JPY"}), tt.name)
+	}
+}
+
+// planChangeStripe fakes the Stripe endpoints used to change the plan of sub_123, which bills priceID
+func planChangeStripe(t *testing.T, priceID string) *fakeStripeBackend {
+	return useFakeStripe(t, func(method, path string, params stripe.ParamsContainer) (string, error) {
+		switch {
+		case path == "/v1/subscriptions/sub_123" && method == "GET":
+			return fmt.Sprintf(`{"id": "sub_123", "status": "active", "current_period_start": 1790000000, "current_period_end": 1792592000,
+				"items": {"data": [{"id": "si_123", "plan": {"id": %q}}]}}`, priceID), nil
+		case path == "/v1/subscriptions/sub_123":
+			item := params.(*stripe.SubscriptionParams).Items[0]
+			return fmt.Sprintf(`{"id": "sub_123", "status": "active", "current_period_start": 1790000000, "current_period_end": 1792592000,
+				"items": {"data": [{"id": "si_123", "plan": {"id": %q, "amount": 1000, "currency": "jpy"}}]}}`, *item.Plan), nil
+		case path == "/v1/subscription_schedules":
+			return `{"id": "sub_sched_123"}`, nil
+		case path == "/v1/subscription_schedules/sub_sched_123":
+			return `{"id": "sub_sched_123"}`, nil
+		}
+		return "", fmt.Errorf("unexpected Stripe call %s %s", method, path)
+	})
+}
+
+func TestChangePlanUpgradesImmediately(t *testing.T) {
+	backend := planChangeStripe(t, "price_basic_monthly")
+	repo := newMemorySubscriptionRepository(&models.Subscription{
+		ID: "sub-1", UserID: "user-1", PlanID: "basic", BillingCycle: models.BillingCycleMonthly, Status: models.SubscriptionStatusActive,
+		AutoRenew: true, StripeSubID: "sub_123", Amount: models.Money{Minor: 500, Currency: "JPY"},
+	})
+	service := newTestSubscriptionService(repo, nil, nil)
+
+	_, _, err := service.ChangePlan(context.Background(), "sub-1", "premium", models.BillingCycleMonthly)
+	require.NoError(t, err)
+
+	calls := backend.callsTo("POST", "/v1/subscriptions/sub_123")
+	require.Len(t, calls, 1)
+	params := calls[0].Params.(*stripe.SubscriptionParams)
+	assert.Equal(t, "price_premium_monthly", *params.Items[0].Plan)
+	assert.Equal(t, string(stripe.SubscriptionProrationBehaviorAlwaysInvoice), *params.ProrationBehavior)
+	assert.Empty(t, backend.callsTo("POST", "/v1/subscription_schedules"))
+
+	stored, err := repo.GetByID(context.Background(), "sub-1")
+	require.NoError(t, err)
+	assert.Equal(t, "premium", stored.PlanID)
+	assert.Equal(t, int64(1000), stored.Amount.Minor)
+	assert.False(t, stored.HasPendingChange())
+}
+
+func TestChangePlanSchedulesDowngradeAtPeriodEnd(t *testing.T) {
+	backend := planChangeStripe(t, "price_premium_monthly")
+	repo := newMemorySubscriptionRepository(&models.Subscription{
+		ID: "sub-1", UserID: "user-1", PlanID: "premium", BillingCycle: models.BillingCycleMonthly, Status: models.SubscriptionStatusActive,
+		AutoRenew: true, StripeSubID: "sub_123", Amount: models.Money{Minor: 1000, Currency: "JPY"},
+	})
+	service := newTestSubscriptionService(repo, nil, nil)
+
+	_, _, err := service.ChangePlan(context.Background(), "sub-1", "basic", models.BillingCycleMonthly)
+	require.NoError(t, err)
+
+	// 期間終了まで現在の価格のまま、次の期間から安いプランに切り替える
+	assert.Empty(t, backend.callsTo("POST", "/v1/subscriptions/sub_123"))
+	calls := backend.callsTo("POST", "/v1/subscription_schedules/sub_sched_123")
+	require.Len(t, calls, 1)
+	phases := calls[0].Params.(*stripe.SubscriptionScheduleParams).Phases
+	require.Len(t, phases, 2)
+	assert.Equal(t, "price_premium_monthly", *phases[0].Plans[0].Plan)
+	assert.Equal(t, int64(1792592000), *phases[0].EndDate)
+	assert.Equal(t, "price_basic_monthly", *phases[1].Plans[0].Plan)
+
+	stored, err := repo.GetByID(context.Background(), "sub-1")
+	require.NoError(t, err)
+	assert.Equal(t, "premium", stored.PlanID)
+	assert.Equal(t, int64(1000), stored.Amount.Minor)
+	assert.Equal(t, "basic", stored.PendingPlanID)
+	require.NotNil(t, stored.PendingChangeAt)
+	assert.Equal(t, int64(1792592000), stored.PendingChangeAt.Unix())
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"kimiyomi/models"
+	"kimiyomi/repository"
+
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/webhook"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidWebhookSignature is returned when the Stripe-Signature header cannot be verified
+var ErrInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// StripeWebhookService verifies Stripe webhook events and applies them to local records
+type StripeWebhookService interface {
+	HandleEvent(ctx context.Context, payload []byte, signature string) error
+}
+
+type stripeWebhookService struct {
+	secret              string
+	eventRepo           repository.WebhookEventRepository
+	paymentService      PaymentService
+	subscriptionService SubscriptionService
+	ledger              LedgerService
+}
+
+// NewStripeWebhookService creates a new instance of StripeWebhookService
+func NewStripeWebhookService(secret string, eventRepo repository.WebhookEventRepository, paymentService PaymentService, subscriptionService SubscriptionService, ledger LedgerService) StripeWebhookService {
+	return &stripeWebhookService{
+		secret:              secret,
+		eventRepo:           eventRepo,
+		paymentService:      paymentService,
+		subscriptionService: subscriptionService,
+		ledger:              ledger,
+	}
+}
+
+// HandleEvent verifies the signature, skips already processed events and dispatches the rest
+func (s *stripeWebhookService) HandleEvent(ctx context.Context, payload []byte, signature string) error {
+	event, err := webhook.ConstructEvent(payload, signature, s.secret)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidWebhookSignature, err)
+	}
+
+	return processWebhookEvent(ctx, s.eventRepo, models.WebhookSourceStripe, event.ID, event.Type, func() error {
+		return s.dispatch(ctx, event)
+	})
+}
+
+// processWebhookEvent runs apply at most once per event. The claim holds a lease until apply has finished,
+// so a delivery abandoned by a crash is processed again on a redelivery after the lease expires.
+// While another delivery holds the claim an error is returned and the sender retries later.
+func processWebhookEvent(ctx context.Context, eventRepo repository.WebhookEventRepository, source, eventID, eventType string, apply func() error) error {
+	claimed, err := eventRepo.Claim(ctx, source, eventID, eventType)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return nil // 処理済みのイベント
+	}
+
+	if err := apply(); err != nil {
+		// 再送で再処理できるように記録を取り消す
+		if releaseErr := eventRepo.Release(ctx, source, eventID); releaseErr != nil {
+			log.Printf("Webhookイベントの解放に失敗 (%s): %v", eventID, releaseErr)
+		}
+		return err
+	}
+	// 記録に失敗しても次の再送で再処理されるだけなので、エラーを返して再送させる
+	return eventRepo.Complete(ctx, source, eventID)
+}
+
+func (s *stripeWebhookService) dispatch(ctx context.Context, event stripe.Event) error {
+	switch event.Type {
+	case "payment_intent.succeeded", "payment_intent.payment_failed", "payment_intent.canceled":
+		var pi stripe.PaymentIntent
+		if err := json.Unmarshal(event.Data.Raw, &pi); err != nil {
+			return err
+		}
+		status := models.PaymentStatusSucceeded
+		switch event.Type {
+		case "payment_intent.payment_failed":
+			status = models.PaymentStatusFailed
+		case "payment_intent.canceled":
+			status = models.PaymentStatusCanceled
+		}
+		return s.applyPaymentStatus(ctx, pi.ID, status)
+
+	case "charge.succeeded":
+		// 単品購入とサブスクリプションの請求の両方を台帳に記録する
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return err
+		}
+		return s.ledger.RecordStripeCharge(ctx, &charge)
+
+	case "charge.refunded":
+		var charge stripe.Charge
+		if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+			return err
+		}
+		if charge.Refunds == nil {
+			return nil
+		}
+		for _, rf := range charge.Refunds.Data {
+			if err := s.syncRefund(ctx, charge.PaymentIntent, rf); err != nil {
+				return err
+			}
+			if rf.Charge == nil {
+				rf.Charge = &stripe.Charge{ID: charge.ID}
+			}
+			if err := s.ledger.RecordStripeRefund(ctx, rf); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "charge.refund.updated":
+		var rf stripe.Refund
+		if err := json.Unmarshal(event.Data.Raw, &rf); err != nil {
+			return err
+		}
+		if err := s.ledger.RecordStripeRefund(ctx, &rf); err != nil {
+			return err
+		}
+		if rf.PaymentIntent == nil {
+			return nil
+		}
+		return s.syncRefund(ctx, rf.PaymentIntent.ID, &rf)
+
+	case "charge.dispute.created":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return err
+		}
+		if err := s.ledger.RecordStripeDispute(ctx, &dispute); err != nil {
+			return err
+		}
+		if dispute.PaymentIntent == nil {
+			return nil
+		}
+		return s.applyPaymentStatus(ctx, dispute.PaymentIntent.ID, models.PaymentStatusDisputed)
+
+	case "charge.dispute.closed":
+		var dispute stripe.Dispute
+		if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+			return err
+		}
+		return s.ledger.RecordStripeDispute(ctx, &dispute)
+
+	case "customer.subscription.created", "customer.subscription.updated", "customer.subscription.deleted":
+		var stripeSub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &stripeSub); err != nil {
+			return err
+		}
+		err := s.subscriptionService.SyncFromStripe(ctx, stripeSub.ID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Stripeサブスクリプション %s に対応する記録が見つかりません", stripeSub.ID)
+			return nil
+		}
+		return err
+
+	case "customer.subscription.trial_will_end":
+		var stripeSub stripe.Subscription
+		if err := json.Unmarshal(event.Data.Raw, &stripeSub); err != nil {
+			return err
+		}
+		err := s.subscriptionService.NotifyTrialEnding(ctx, stripeSub.ID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Stripeサブスクリプション %s に対応する記録が見つかりません", stripeSub.ID)
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// syncRefund records a refund, ignoring intents that were not created through this API
+func (s *stripeWebhookService) syncRefund(ctx context.Context, paymentIntentID string, rf *stripe.Refund) error {
+	if paymentIntentID == "" {
+		return nil
+	}
+	err := s.paymentService.SyncStripeRefund(ctx, paymentIntentID, rf)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("PaymentIntent %s に対応する決済が見つかりません", paymentIntentID)
+		return nil
+	}
+	return err
+}
+
+// applyPaymentStatus updates the local payment, ignoring intents that were not created through this API
+func (s *stripeWebhookService) applyPaymentStatus(ctx context.Context, paymentIntentID string, status string) error {
+	if paymentIntentID == "" {
+		return nil
+	}
+	err := s.paymentService.ApplyStripeStatus(ctx, paymentIntentID, status)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Printf("PaymentIntent %s に対応する決済が見つかりません", paymentIntentID)
+		return nil
+	}
+	return err
+}